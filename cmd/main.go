@@ -10,23 +10,98 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 )
 
 var (
-	start            bool
-	err              error
-	localAddr        string
-	upstreamDns      string
-	filterDomainFile string
-	filterList       *filter.FilterList
+	start          bool
+	err            error
+	localAddr      string
+	upstreamDns    string
+	strategyName   string
+	strategy       server.Strategy
+	randomCase     bool
+	listSpecs      listFlag
+	lists          []filter.List
+	formatName     string
+	format         filter.Format
+	allowFile      string
+	allowDomains   string
+	maxUDPSize     uint
+	maxNegativeTTL uint
+	maxStale       time.Duration
+	staleAfter     time.Duration
+	staleRecheck   time.Duration
+	serveDoT       bool
+	serveDoH       bool
+	serveDoQ       bool
+	certFile       string
+	keyFile        string
+	forwards       forwardFlag
+	listDir        string
+	listRefresh    time.Duration
+	watchLists     bool
+	blocklists     *filter.Blocklists
 )
 
+// forwardFlag collects every -forward given on the command line
+type forwardFlag []server.ForwardRule
+
+func (f *forwardFlag) String() string {
+	return fmt.Sprint(len(*f), " rules")
+}
+
+func (f *forwardFlag) Set(value string) error {
+	var (
+		rule server.ForwardRule
+		err  error
+	)
+	if rule, err = server.ParseForwardRule(value); err != nil {
+		return err
+	}
+	*f = append(*f, rule)
+	return nil
+}
+
+// listFlag collects every -f given on the command line, they are parsed
+// once -format is known
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return fmt.Sprint(len(*l), " lists")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func init() {
 	flag.BoolVar(&start, "s", false, "Start the Server")
 	flag.StringVar(&localAddr, "a", "0.0.0.0", "Address that the DNS server will listen")
-	flag.StringVar(&upstreamDns, "d", "1.1.1.1,8.8.8.8", "Upstream DNS to consult ips")
-	flag.StringVar(&filterDomainFile, "f", "", "Path to file with domains to be filtered")
+	flag.StringVar(&upstreamDns, "d", "1.1.1.1,8.8.8.8", "Upstream DNS to consult, comma separated IPs, tls://host:port#name, quic://host:port#name or https://host/dns-query")
+	flag.StringVar(&strategyName, "strategy", "parallel", "How upstreams are asked: parallel, strict, round-robin, random or fastest")
+	flag.BoolVar(&randomCase, "0x20", false, "Send questions to plain upstreams in random letter case and reject answers that do not echo it")
+	flag.Var(&forwards, "forward", "Send domains to their own upstreams, repeatable: \"lan,192.168.0.0/16=192.168.1.1 strategy=strict timeout=2s\"")
+	flag.Var(&listSpecs, "f", "Blocklist file, directory or glob, repeatable: \"ads=/etc/flash-dns/ads.txt format=adblock enabled=false\"")
+	flag.StringVar(&formatName, "format", "auto", "Format of the -f lists that do not set one: auto, adblock, hosts, domains or dnsmasq")
+	flag.StringVar(&listDir, "list-dir", filter.DEFAULT_LIST_DIR, "Where the last downloaded copy of each remote -f list is kept for offline starts")
+	flag.DurationVar(&listRefresh, "list-refresh", filter.DEFAULT_LIST_REFRESH, "How often remote -f lists are downloaded again, 0 disables it")
+	flag.BoolVar(&watchLists, "watch", false, "Reload the filter when a local -f list or the -allow-file changes (inotify), SIGHUP always does")
+	flag.StringVar(&allowFile, "allow-file", "", "Path to file with domains that are never filtered")
+	flag.StringVar(&allowDomains, "allow", "", "Comma separated domains that are never filtered, subdomains included")
+	flag.UintVar(&maxUDPSize, "u", uint(server.DEFAULT_MAX_UDP), "Largest EDNS0 UDP payload answered, in bytes")
+	flag.UintVar(&maxNegativeTTL, "n", uint(server.DEFAULT_MAX_NEGATIVE_TTL), "Longest time in seconds a NXDOMAIN or NODATA answer is cached")
+	flag.DurationVar(&maxStale, "stale", server.DEFAULT_MAX_STALE, "Serve expired answers up to this age (e.g. 72h) when upstreams are slow or down, 0 disables it")
+	flag.DurationVar(&staleAfter, "stale-after", server.DEFAULT_STALE_TIMEOUT, "How long upstream gets before a stale answer is sent")
+	flag.DurationVar(&staleRecheck, "stale-recheck", server.DEFAULT_FAILURE_RECHECK, "How long a name is served stale without asking upstream after a failure")
+	flag.BoolVar(&serveDoT, "dot", false, "Serve DNS-over-TLS on port 853, needs -cert and -key")
+	flag.BoolVar(&serveDoH, "doh", false, "Serve DNS-over-HTTPS on port 443 (/dns-query and /resolve), needs -cert and -key")
+	flag.BoolVar(&serveDoQ, "doq", false, "Serve DNS-over-QUIC on udp port 853, needs -cert and -key")
+	flag.StringVar(&certFile, "cert", "", "Certificate file (PEM) for the encrypted listeners, reloaded when it changes")
+	flag.StringVar(&keyFile, "key", "", "Private key file (PEM) matching -cert")
 }
 
 func main() {
@@ -46,23 +121,97 @@ func verifications() {
 		fmt.Fprintln(os.Stderr, "Failed to initialize logger: "+err.Error())
 		os.Exit(1)
 	}
+
+	if strategy, err = server.ParseStrategy(strategyName); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	if format, err = filter.ParseFormat(formatName); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	for _, spec := range listSpecs {
+		var list filter.List
+		if list, err = filter.ParseList(spec, format); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		lists = append(lists, list)
+	}
+
+	if (serveDoT || serveDoH || serveDoQ) && (certFile == "" || keyFile == "") {
+		fmt.Fprintln(os.Stderr, "Encrypted listeners need both -cert and -key")
+		os.Exit(1)
+	}
 }
 
 func getFilterList() {
-	if filterDomainFile == "" {
+	if len(lists) == 0 && allowFile == "" && allowDomains == "" {
 		return
 	}
 
 	var (
-		absolutePath string
-		err          error
+		err    error
+		config filter.BlocklistsConfig = filter.BlocklistsConfig{AllowFile: allowFile, AllowDomains: strings.Split(allowDomains, ","), CacheDir: listDir}
 	)
-	absolutePath, err = filepath.Abs(filterDomainFile)
-	if err != nil {
-		logger.Error("File path to the filter list returned an error.")
+	for _, list := range lists {
+		if !list.Remote() {
+			if list.Path, err = filepath.Abs(list.Path); err != nil {
+				logger.Error("File path to the filter list returned an error.")
+				continue
+			}
+		}
+		config.Lists = append(config.Lists, list)
+	}
+
+	blocklists = filter.NewBlocklists(config)
+	if err = blocklists.Load(context.Background()); err != nil {
+		logger.Error("Failed to load the filter lists: " + err.Error())
+	}
+}
+
+// hasRemoteLists reports whether there is anything to refresh
+func hasRemoteLists() bool {
+	for _, list := range lists {
+		if list.Remote() && list.Enabled {
+			return true
+		}
+	}
+
+	return false
+}
+
+// staleLimit maps -stale onto the server config, where zero means the
+// default and serving stale is turned off with a negative duration
+func staleLimit(maxStale time.Duration) time.Duration {
+	if maxStale == 0 {
+		return -1
+	}
+
+	return maxStale
+}
+
+// reloadOnHangup rebuilds the filter from disk on every SIGHUP, the
+// running filter answers until the new one is ready
+func reloadOnHangup(ctx context.Context, hupChan chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hupChan:
+			if blocklists == nil {
+				logger.Warn("Received SIGHUP, but no filter list was given")
+				continue
+			}
+
+			logger.Info("Reloading blocklists, received signal: hangup")
+			if err := blocklists.Reload(); err != nil {
+				logger.Error("Failed to reload blocklists: " + err.Error())
+			}
+		}
 	}
-	filterList = filter.NewFilterList()
-	filterList.LoadFromFile(absolutePath)
 }
 
 func startServer() {
@@ -70,9 +219,11 @@ func startServer() {
 		ctx     context.Context
 		cancel  context.CancelFunc
 		sigChan chan os.Signal = make(chan os.Signal, 1)
+		hupChan chan os.Signal = make(chan os.Signal, 1)
 	)
 
 	signal.Notify(sigChan, os.Interrupt, os.Kill, syscall.SIGTERM)
+	signal.Notify(hupChan, syscall.SIGHUP)
 
 	ctx, cancel = context.WithCancel(context.Background())
 	defer cancel()
@@ -82,16 +233,53 @@ func startServer() {
 		logger.Info("Closing DNS Server, received signal: " + sig.String())
 		cancel()
 	}()
+	go reloadOnHangup(ctx, hupChan)
 
 	if start {
 
 		var (
-			dnsPort  string                   = ":53"
-			config   server.Config            = server.Config{LocalAddr: localAddr + dnsPort, UpstreamDns: upstreamDns, FilterMode: "nxdomain"}
-			resolver *server.UpstreamResolver = server.NewUpstreamResolver(config.UpstreamDns)
-			server   *server.DNSServer        = server.NewDNSServer(config, resolver, filterList)
+			dnsPort   string        = ":53"
+			dotPort   string        = ":853"
+			dohPort   string        = ":443"
+			config    server.Config = server.Config{LocalAddr: localAddr + dnsPort, UpstreamDns: upstreamDns, FilterMode: "nxdomain", MaxUDPSize: uint16(min(maxUDPSize, 65535)), MaxNegative: uint32(min(maxNegativeTTL, 1<<31-1)), MaxStale: staleLimit(maxStale), StaleAfter: staleAfter, Recheck: staleRecheck, CertFile: certFile, KeyFile: keyFile}
+			upstream  *server.UpstreamResolver
+			router    *server.Router
+			resolver  server.Resolver
+			blocklist server.Filter
+			dnsServer *server.DNSServer
 		)
-		if err = server.Start(ctx); err != nil {
+		if serveDoT {
+			config.DoTAddr = localAddr + dotPort
+		}
+		if serveDoH {
+			config.DoHAddr = localAddr + dohPort
+		}
+		if serveDoQ {
+			config.DoQAddr = localAddr + dotPort // DoQ uses 853 too, but over udp
+		}
+		upstream = server.NewUpstreamResolver(config.UpstreamDns, strategy)
+		upstream.SetRandomCase(randomCase)
+		resolver = upstream
+		if len(forwards) > 0 {
+			router = server.NewRouter(upstream, forwards)
+			router.SetRandomCase(randomCase)
+			resolver = router
+		}
+		if blocklists != nil {
+			blocklist = blocklists
+			if listRefresh > 0 && hasRemoteLists() {
+				go blocklists.Run(ctx, listRefresh)
+			}
+			if watchLists {
+				go func() {
+					if err := blocklists.Watch(ctx); err != nil {
+						logger.Error("Failed to watch the filter lists: " + err.Error())
+					}
+				}()
+			}
+		}
+		dnsServer = server.NewDNSServer(config, resolver, blocklist)
+		if err = dnsServer.Start(ctx); err != nil {
 			logger.Error("Server gave an error: " + err.Error())
 			fmt.Fprintln(os.Stderr, "Server had an error while starting, is port 53 free?")
 			os.Exit(1)
@@ -1,25 +1,29 @@
 package cache
 
 import (
+	"bytes"
+	"flash-dns/internal/dns"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 var (
-	CACHE_MAX_SIZE       int           = 1024
-	GRACE_PERIOD         time.Duration = 5 * time.Minute // How long to accept expired entries
-	POPULARITY_THRESHOLD int64         = 5               // lower than that triggers eviction
-	PREFETCH_THRESHOLD   float64       = 0.8             // 80%
+	CACHE_MAX_SIZE       int     = 1024
+	POPULARITY_THRESHOLD int64   = 5   // lower than that triggers eviction
+	PREFETCH_THRESHOLD   float64 = 0.8 // 80%
+	STALE_TTL            uint32  = 30  // ttl of stale answers, RFC 8767 suggests 30 seconds
 )
 
 // CACHE ENTRY
 type CacheEntry struct {
 	CreatedAt   time.Time
 	ExpiresAt   time.Time
+	StaleUntil  time.Time // expired entries are served stale until then
 	Response    []byte
 	LastAccess  atomic.Int64
 	popularity  atomic.Int64 // internal metric
+	failedAt    atomic.Int64 // last failed refresh in unix nanoseconds, zero if none
 	originalTTL uint32
 }
 
@@ -27,13 +31,14 @@ func (ce *CacheEntry) IsPopular() bool {
 	return ce.popularity.Load() >= POPULARITY_THRESHOLD
 }
 
+// IsStale reports an expired entry that may still be served stale
 func (ce *CacheEntry) IsStale(now time.Time) bool {
-	return now.After(ce.ExpiresAt) && now.Before(ce.ExpiresAt.Add(GRACE_PERIOD))
+	return now.After(ce.ExpiresAt) && now.Before(ce.StaleUntil)
 }
 
 func (ce *CacheEntry) IsCompletelyExpired() bool {
 	var now time.Time = time.Now()
-	return now.After(ce.ExpiresAt.Add(GRACE_PERIOD))
+	return now.After(ce.ExpiresAt) && !now.Before(ce.StaleUntil)
 }
 
 func (ce *CacheEntry) ShouldPrefetch() bool {
@@ -50,6 +55,12 @@ func (ce *CacheEntry) ShouldPrefetch() bool {
 	return age >= time.Duration(float64(ttl)*PREFETCH_THRESHOLD)
 }
 
+// failedWithin reports whether a refresh failed less than window ago
+func (ce *CacheEntry) failedWithin(now time.Time, window time.Duration) bool {
+	var failedAt int64 = ce.failedAt.Load()
+	return failedAt != 0 && now.Sub(time.Unix(0, failedAt)) < window
+}
+
 func (ce *CacheEntry) increasePopularity() {
 	_ = ce.popularity.Add(1)
 }
@@ -65,9 +76,11 @@ func (ce *CacheEntry) TimeSinceLastAccess() time.Duration {
 
 // DNS CACHE
 type DNSCache struct {
-	mu      sync.RWMutex
-	entries map[string]*CacheEntry
-	maxSize int
+	mu             sync.RWMutex
+	entries        map[string]*CacheEntry
+	maxSize        int
+	maxStale       time.Duration // how long past expiry entries are served stale, zero disables it
+	failureRecheck time.Duration // how long a failed refresh keeps answers stale without retrying
 }
 
 func NewDNSCache() *DNSCache {
@@ -77,12 +90,25 @@ func NewDNSCache() *DNSCache {
 	}
 }
 
+// SetServeStale enables RFC 8767, entries stored from now on are kept for
+// maxStale past their expiry and answered through GetStale. after a failed
+// refresh GetStale asks for no new attempt during recheck
+func (c *DNSCache) SetServeStale(maxStale, recheck time.Duration) {
+	c.mu.Lock()
+	c.maxStale = maxStale
+	c.failureRecheck = recheck
+	c.mu.Unlock()
+}
+
+// Get returns a copy of a fresh cached response with every ttl lowered to
+// the lifetime left, expired entries are a miss and are left for GetStale
 func (c *DNSCache) Get(key string) ([]byte, bool, bool) {
 	var (
 		entry        *CacheEntry = nil
 		found        bool        = false
 		needsRefresh bool        = false
 		now          time.Time   = time.Now()
+		response     []byte
 	)
 	c.mu.RLock()
 	entry, found = c.entries[key]
@@ -106,14 +132,59 @@ func (c *DNSCache) Get(key string) ([]byte, bool, bool) {
 	}
 
 	if entry.IsStale(now) {
-		needsRefresh = true
+		return nil, false, needsRefresh
 	}
 
+	response = bytes.Clone(entry.Response)
+	_ = dns.DecrementTTLs(response, uint32(now.Sub(entry.CreatedAt)/time.Second))
+
 	if entry.ShouldPrefetch() {
 		needsRefresh = true
 	}
 
-	return entry.Response, found, needsRefresh
+	return response, found, needsRefresh
+}
+
+// GetStale returns an expired entry with STALE_TTL, the last bool is false
+// while a failed refresh is younger than the failure recheck time, upstream
+// should not be asked again until then
+func (c *DNSCache) GetStale(key string) ([]byte, bool, bool) {
+	var (
+		entry    *CacheEntry
+		found    bool
+		recheck  time.Duration
+		now      time.Time = time.Now()
+		response []byte
+	)
+	c.mu.RLock()
+	entry, found = c.entries[key]
+	recheck = c.failureRecheck
+	c.mu.RUnlock()
+
+	if !found || !entry.IsStale(now) {
+		return nil, false, false
+	}
+
+	response = bytes.Clone(entry.Response)
+	_ = dns.SetTTLs(response, STALE_TTL)
+
+	return response, true, !entry.failedWithin(now, recheck)
+}
+
+// MarkFailed records that refreshing key failed, starting the failure
+// recheck time
+func (c *DNSCache) MarkFailed(key string) {
+	var (
+		entry *CacheEntry
+		found bool
+	)
+	c.mu.RLock()
+	entry, found = c.entries[key]
+	c.mu.RUnlock()
+
+	if found {
+		entry.failedAt.Store(time.Now().UnixNano())
+	}
 }
 
 func (c *DNSCache) Set(key string, response []byte, ttl uint32) {
@@ -128,12 +199,14 @@ func (c *DNSCache) Set(key string, response []byte, ttl uint32) {
 	}
 
 	var (
-		now time.Time = time.Now()
+		now       time.Time = time.Now()
+		expiresAt time.Time = now.Add(time.Duration(ttl) * time.Second)
 	)
 	c.entries[key] = &CacheEntry{
 		Response:    response,
 		CreatedAt:   now,
-		ExpiresAt:   now.Add(time.Duration(ttl) * time.Second),
+		ExpiresAt:   expiresAt,
+		StaleUntil:  expiresAt.Add(c.maxStale),
 		originalTTL: ttl,
 	}
 
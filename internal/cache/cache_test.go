@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"flash-dns/internal/dns"
 	"testing"
 	"time"
 )
@@ -91,16 +92,16 @@ func TestCacheEntry_PopularityTracking(t *testing.T) {
 	}
 }
 
-// TEST 4: Stale detection within grace period
-// Tests that expired entries within grace period are marked as stale
+// TEST 4: Stale detection within the stale window
+// Tests that expired entries before StaleUntil are marked as stale
 func TestCacheEntry_StaleDetection(t *testing.T) {
 	var (
 		now   time.Time   = time.Now()
 		entry *CacheEntry = &CacheEntry{
-			CreatedAt: now.Add(-10 * time.Minute),
-			ExpiresAt: now.Add(-2 * time.Minute), // Expired 2 min ago
+			CreatedAt:  now.Add(-10 * time.Minute),
+			ExpiresAt:  now.Add(-2 * time.Minute), // Expired 2 min ago
+			StaleUntil: now.Add(3 * time.Minute),
 		}
-		// Grace period is 5 minutes, so this is stale but not completely expired
 	)
 
 	if !entry.IsStale(now) {
@@ -112,25 +113,19 @@ func TestCacheEntry_StaleDetection(t *testing.T) {
 }
 
 // TEST 5: Complete expiration removes entry
-// Tests that entries beyond grace period are deleted
+// Tests that entries beyond the stale window are deleted
 func TestDNSCache_CompleteExpiration(t *testing.T) {
 	var (
-		cache          *DNSCache     = NewDNSCache()
-		key            string        = "expired.com"
-		response       []byte        = []byte("5.6.7.8")
-		ttl            uint32        = 1 // 1 second TTL
-		oldGracePeriod time.Duration = GRACE_PERIOD
+		cache    *DNSCache = NewDNSCache()
+		key      string    = "expired.com"
+		response []byte    = []byte("5.6.7.8")
+		ttl      uint32    = 1 // 1 second TTL
 	)
 
 	cache.Set(key, response, ttl)
 
-	defer func() {
-		GRACE_PERIOD = oldGracePeriod
-	}()
-
-	GRACE_PERIOD = 1 * time.Millisecond
-	// Wait for complete expiration (TTL + grace period)
-	time.Sleep(time.Duration(ttl)*time.Second + GRACE_PERIOD + 10*time.Millisecond)
+	// Without serve-stale entries are gone as soon as they expire
+	time.Sleep(time.Duration(ttl)*time.Second + 10*time.Millisecond)
 
 	var (
 		result []byte
@@ -229,25 +224,19 @@ func TestDNSCache_Eviction(t *testing.T) {
 }
 
 // TEST 8: Clean removes all expired entries
-// Tests the Clean method removes entries beyond grace period
+// Tests the Clean method removes entries beyond the stale window
 func TestDNSCache_Clean(t *testing.T) {
 	var (
-		c              *DNSCache     = NewDNSCache()
-		ttl            uint32        = 1
-		oldGracePeriod time.Duration = GRACE_PERIOD
+		c   *DNSCache = NewDNSCache()
+		ttl uint32    = 1
 	)
 
 	// Add entries
 	c.Set("keep.com", []byte("1.1.1.1"), 3600)  // Long TTL, keep
 	c.Set("expire.com", []byte("2.2.2.2"), ttl) // Short TTL, expire
 
-	defer func() {
-		GRACE_PERIOD = oldGracePeriod
-	}()
-
-	GRACE_PERIOD = 1 * time.Millisecond
 	// Wait for expiration
-	time.Sleep(time.Duration(ttl)*time.Second + GRACE_PERIOD + 50*time.Millisecond)
+	time.Sleep(time.Duration(ttl)*time.Second + 50*time.Millisecond)
 
 	// Run cleanup
 	c.Clean()
@@ -271,9 +260,9 @@ func TestDNSCache_Clean(t *testing.T) {
 	}
 }
 
-// TEST 9: Stale entries trigger refresh flag
-// Tests that Get returns needsRefresh=true for stale entries
-func TestDNSCache_StaleRefreshFlag(t *testing.T) {
+// TEST 9: Stale entries are served through GetStale
+// Tests that Get misses on an expired entry while GetStale still returns it
+func TestDNSCache_StaleServedByGetStale(t *testing.T) {
 	var (
 		cache    *DNSCache = NewDNSCache()
 		key      string    = "stale.com"
@@ -281,23 +270,28 @@ func TestDNSCache_StaleRefreshFlag(t *testing.T) {
 		ttl      uint32    = 1
 	)
 
+	cache.SetServeStale(time.Hour, 30*time.Second)
 	cache.Set(key, response, ttl)
 
-	// Wait for entry to become stale (expired but within grace period)
+	// Wait for entry to become stale (expired but within the stale window)
 	time.Sleep(time.Duration(ttl)*time.Second + 10*time.Millisecond)
 
 	var (
-		result       []byte
-		found        bool
-		needsRefresh bool
+		result  []byte
+		found   bool
+		recheck bool
 	)
-	result, found, needsRefresh = cache.Get(key)
+	if _, found, _ = cache.Get(key); found {
+		t.Error("Get should miss on a stale entry")
+	}
+
+	result, found, recheck = cache.GetStale(key)
 
 	if !found {
 		t.Error("Stale entry should still be found")
 	}
-	if !needsRefresh {
-		t.Error("Stale entry should trigger refresh flag")
+	if !recheck {
+		t.Error("Upstream should be tried when no refresh failed")
 	}
 	if string(result) != string(response) {
 		t.Error("Should return stale data while waiting for refresh")
@@ -344,3 +338,129 @@ func TestDNSCache_UpdateExistingKey(t *testing.T) {
 		t.Error("Should retrieve updated value")
 	}
 }
+
+// buildAnswer packs a response for example.com with one A record per ttl
+func buildAnswer(t *testing.T, ttls ...uint32) []byte {
+	var (
+		message  *dns.Message = &dns.Message{ID: 0x1234, Flags: dns.FLAG_QR | dns.FLAG_RD | dns.FLAG_RA}
+		response []byte
+		err      error
+		ttl      uint32
+	)
+	message.Questions = []dns.Question{{Name: "example.com", Type: dns.TYPE_A, Class: dns.CLASS_IN}}
+	for _, ttl = range ttls {
+		message.Answers = append(message.Answers, dns.Resource{
+			Name: "example.com", Type: dns.TYPE_A, Class: dns.CLASS_IN, TTL: ttl, Data: []byte{1, 2, 3, 4},
+		})
+	}
+
+	if response, err = message.Pack(); err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+
+	return response
+}
+
+// answerTTLs reads back the ttl of every answer
+func answerTTLs(t *testing.T, response []byte) []uint32 {
+	var (
+		message *dns.Message
+		result  []uint32
+		err     error
+	)
+	if message, err = dns.Parse(response); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	for _, answer := range message.Answers {
+		result = append(result, answer.TTL)
+	}
+
+	return result
+}
+
+// TEST 11: Cache hits carry the remaining ttl
+// Tests that every record is lowered by the time spent in the cache
+func TestDNSCache_DecrementsTTL(t *testing.T) {
+	var (
+		cache    *DNSCache = NewDNSCache()
+		key      string    = "example.com:1"
+		response []byte    = buildAnswer(t, 300, 600)
+		result   []byte
+		ttls     []uint32
+	)
+	cache.Set(key, response, 300)
+
+	// pretend the entry was stored 100 seconds ago
+	cache.entries[key].CreatedAt = cache.entries[key].CreatedAt.Add(-100 * time.Second)
+	cache.entries[key].ExpiresAt = cache.entries[key].ExpiresAt.Add(-100 * time.Second)
+
+	result, _, _ = cache.Get(key)
+
+	ttls = answerTTLs(t, result)
+	if len(ttls) != 2 || ttls[0] != 200 || ttls[1] != 500 {
+		t.Errorf("Expected ttls [200 500], got %v", ttls)
+	}
+	if ttls = answerTTLs(t, cache.entries[key].Response); ttls[0] != 300 {
+		t.Errorf("Stored response should keep its ttl, got %d", ttls[0])
+	}
+}
+
+// TEST 12: Stale answers carry STALE_TTL
+// Tests that expired entries inside the stale window get the fixed ttl
+func TestDNSCache_StaleTTL(t *testing.T) {
+	var (
+		cache    *DNSCache = NewDNSCache()
+		key      string    = "example.com:1"
+		response []byte    = buildAnswer(t, 60)
+		result   []byte
+		ttls     []uint32
+	)
+	cache.SetServeStale(time.Hour, 30*time.Second)
+	cache.Set(key, response, 60)
+
+	cache.entries[key].CreatedAt = cache.entries[key].CreatedAt.Add(-2 * time.Minute)
+	cache.entries[key].ExpiresAt = cache.entries[key].ExpiresAt.Add(-2 * time.Minute)
+
+	result, _, _ = cache.GetStale(key)
+
+	if ttls = answerTTLs(t, result); len(ttls) != 1 || ttls[0] != STALE_TTL {
+		t.Errorf("Expected ttl %d, got %v", STALE_TTL, ttls)
+	}
+}
+
+// TEST 13: Failure recheck and maximum stale age
+// Tests that a failed refresh pauses upstream attempts and that entries
+// past the stale window are dropped
+func TestDNSCache_FailureRecheck(t *testing.T) {
+	var (
+		cache   *DNSCache = NewDNSCache()
+		key     string    = "example.com:1"
+		found   bool
+		recheck bool
+	)
+	cache.SetServeStale(24*time.Hour, 30*time.Second)
+	cache.Set(key, buildAnswer(t, 60), 60)
+
+	if _, found, _ = cache.GetStale(key); found {
+		t.Error("Fresh entries should not be returned as stale")
+	}
+
+	// expired an hour ago
+	cache.entries[key].ExpiresAt = cache.entries[key].ExpiresAt.Add(-time.Hour)
+	cache.MarkFailed(key)
+
+	if _, found, recheck = cache.GetStale(key); !found || recheck {
+		t.Errorf("Expected a stale answer without recheck, got found=%v recheck=%v", found, recheck)
+	}
+
+	cache.entries[key].failedAt.Store(time.Now().Add(-time.Minute).UnixNano())
+	if _, _, recheck = cache.GetStale(key); !recheck {
+		t.Error("Upstream should be retried once the recheck time passed")
+	}
+
+	cache.entries[key].StaleUntil = time.Now().Add(-time.Second)
+	cache.Clean()
+	if _, found, _ = cache.GetStale(key); found {
+		t.Error("Entries past the maximum stale age should be gone")
+	}
+}
@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"encoding/binary"
+)
+
+// Extended DNS Errors (RFC 8914), carried as an EDNS0 option so only
+// clients that sent OPT can receive them
+const (
+	OPTION_EDE                 uint16 = 15
+	EDE_OTHER                  uint16 = 0
+	EDE_STALE_ANSWER           uint16 = 3
+	EDE_STALE_NXDOMAIN         uint16 = 19
+	EDE_NO_REACHABLE_AUTHORITY uint16 = 22
+	EDE_NETWORK_ERROR          uint16 = 23
+)
+
+// ExtendedError builds the EDE option, text is optional and meant for humans
+func ExtendedError(code uint16, text string) Option {
+	var data []byte = make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+
+	return Option{Code: OPTION_EDE, Data: append(data, text...)}
+}
+
+// ServerFailure answers query with SERVFAIL and the extended error, when
+// the query can not be parsed the answer is only a header
+func ServerFailure(query []byte, code uint16, text string) []byte {
+	var (
+		message  *Message
+		reply    *Message
+		response []byte
+		err      error
+	)
+	if message, err = Parse(query); err != nil {
+		if len(query) < HEADER_SIZE {
+			return nil
+		}
+
+		response = make([]byte, HEADER_SIZE)
+		copy(response[0:2], query[0:2])
+		binary.BigEndian.PutUint16(response[2:4], FLAG_QR|FLAG_RA|binary.BigEndian.Uint16(query[2:4])&(OPCODE_MASK|FLAG_RD)|RCODE_SERVFAIL)
+		return response
+	}
+
+	reply = message.Reply(RCODE_SERVFAIL)
+	if reply.EDNS != nil {
+		reply.EDNS.Options = append(reply.EDNS.Options, ExtendedError(code, text))
+	}
+
+	if response, err = reply.Pack(); err != nil {
+		return nil
+	}
+
+	return response
+}
+
+// AddExtendedError returns a copy of response with the extended error added
+// to its OPT record, responses without OPT are returned unchanged
+func AddExtendedError(response []byte, code uint16, text string) []byte {
+	var (
+		message *Message
+		result  []byte
+		err     error
+	)
+	if message, err = Parse(response); err != nil || message.EDNS == nil {
+		return response
+	}
+
+	message.EDNS.Options = append(message.EDNS.Options, ExtendedError(code, text))
+	if result, err = message.Pack(); err != nil {
+		return response
+	}
+
+	return result
+}
@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// TEST 1: ServerFailure carries the extended error
+// Tests rcode, question and the EDE option for an EDNS0 query
+func TestServerFailure(t *testing.T) {
+	var (
+		query    []byte = SetEDNS0(buildDNSQuery("example.com", 1, 1), 1232)
+		response []byte = ServerFailure(query, EDE_NO_REACHABLE_AUTHORITY, "upstream timed out")
+		message  *Message
+		err      error
+	)
+
+	if message, err = Parse(response); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if message.Rcode() != RCODE_SERVFAIL || message.Flags&FLAG_QR == 0 {
+		t.Errorf("Expected a SERVFAIL response, got flags 0x%04X", message.Flags)
+	}
+	if message.ID != binary.BigEndian.Uint16(query[0:2]) {
+		t.Error("ID should match the query")
+	}
+	if len(message.Questions) != 1 || message.Questions[0].Name != "example.com" {
+		t.Errorf("Expected the question to be echoed, got %+v", message.Questions)
+	}
+	if message.EDNS == nil || len(message.EDNS.Options) != 1 {
+		t.Fatal("Expected one EDNS0 option")
+	}
+	if option := message.EDNS.Options[0]; option.Code != OPTION_EDE ||
+		binary.BigEndian.Uint16(option.Data[0:2]) != EDE_NO_REACHABLE_AUTHORITY ||
+		string(option.Data[2:]) != "upstream timed out" {
+		t.Errorf("Unexpected EDE option %+v", option)
+	}
+}
+
+// TEST 2: ServerFailure without EDNS0
+// Tests that clients without OPT get a plain SERVFAIL and garbage gets a header
+func TestServerFailure_NoEDNS(t *testing.T) {
+	var (
+		response []byte = ServerFailure(buildDNSQuery("example.com", 1, 1), EDE_NETWORK_ERROR, "")
+		header   Header
+	)
+
+	if _, _, found := FindOPT(response); found {
+		t.Error("OPT should not be added for a client without EDNS0")
+	}
+
+	response = ServerFailure(append(buildDNSQuery("example.com", 1, 1)[:HEADER_SIZE], 0xC0), EDE_NETWORK_ERROR, "")
+	if header, _ = ParseHeader(response); len(response) != HEADER_SIZE || header.Rcode() != RCODE_SERVFAIL {
+		t.Errorf("Expected a header only SERVFAIL, got %d bytes rcode %d", len(response), header.Rcode())
+	}
+}
+
+// TEST 3: AddExtendedError keeps the answers
+// Tests that the option is added to an existing response
+func TestAddExtendedError(t *testing.T) {
+	var (
+		response []byte = SetEDNS0(buildDNSResponse("example.com", 1, 1, 30, []byte{1, 2, 3, 4}), 1232)
+		message  *Message
+		err      error
+	)
+
+	if message, err = Parse(AddExtendedError(response, EDE_STALE_ANSWER, "")); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(message.Answers) != 1 || message.Answers[0].TTL != 30 {
+		t.Errorf("Expected the answer to be kept, got %+v", message.Answers)
+	}
+	if len(message.EDNS.Options) != 1 || binary.BigEndian.Uint16(message.EDNS.Options[0].Data) != EDE_STALE_ANSWER {
+		t.Errorf("Expected a Stale Answer option, got %+v", message.EDNS.Options)
+	}
+}
@@ -0,0 +1,162 @@
+package dns
+
+import (
+	"encoding/binary"
+)
+
+// FindOPT locates the OPT record in the additional section, returning its
+// start offset and total length
+func FindOPT(message []byte) (int, int, bool) {
+	var (
+		record RecordHeader
+		found  bool
+	)
+	if record, found = findOPT(message); !found {
+		return 0, 0, false
+	}
+	return record.Offset, record.DataOffset + record.DataLength - record.Offset, true
+}
+
+func findOPT(message []byte) (RecordHeader, bool) {
+	var (
+		scanner RecordScanner
+		record  RecordHeader
+	)
+	scanner.Reset(message)
+	for scanner.Next() {
+		if record = scanner.Record(); record.Section == SECTION_ADDITIONAL && record.Type == TYPE_OPT {
+			return record, true
+		}
+	}
+
+	return RecordHeader{}, false
+}
+
+// classOffset is where the class field sits, for OPT it carries the payload size
+func (r RecordHeader) classOffset() int {
+	return r.DataOffset - 8
+}
+
+// ParseEDNS0 reports whether the message carries an OPT record and the UDP
+// payload size it advertises, sizes below 512 are raised to 512 as RFC 6891 asks
+func ParseEDNS0(message []byte) (uint16, bool) {
+	var (
+		record RecordHeader
+		found  bool
+		size   uint16
+	)
+	if record, found = findOPT(message); !found {
+		return DEFAULT_UDP_SIZE, false
+	}
+
+	size = record.Class
+	if size < DEFAULT_UDP_SIZE {
+		size = DEFAULT_UDP_SIZE
+	}
+
+	return size, true
+}
+
+// SetEDNS0 returns a copy of the query advertising udpSize, the client OPT
+// record is kept (flags and options included) and only its size rewritten,
+// when the query has none a bare OPT record is appended
+func SetEDNS0(query []byte, udpSize uint16) []byte {
+	if len(query) < HEADER_SIZE {
+		return query
+	}
+
+	var (
+		record RecordHeader
+		found  bool
+		result []byte
+	)
+	if record, found = findOPT(query); found {
+		result = make([]byte, len(query))
+		copy(result, query)
+		binary.BigEndian.PutUint16(result[record.classOffset():record.classOffset()+2], udpSize)
+		return result
+	}
+
+	result = make([]byte, len(query), len(query)+optFixedRRLength)
+	copy(result, query)
+	result = append(result, 0)                               // root name
+	result = binary.BigEndian.AppendUint16(result, TYPE_OPT) // type
+	result = binary.BigEndian.AppendUint16(result, udpSize)  // class carries the payload size
+	result = binary.BigEndian.AppendUint32(result, 0)        // extended rcode, version and flags
+	result = binary.BigEndian.AppendUint16(result, 0)        // no options
+	binary.BigEndian.PutUint16(result[10:12], binary.BigEndian.Uint16(result[10:12])+1)
+
+	return result
+}
+
+// StripEDNS0 returns the message without its OPT record, answers to clients
+// that did not send one must not carry it either
+func StripEDNS0(message []byte) []byte {
+	var (
+		start  int
+		length int
+		found  bool
+		result []byte
+	)
+	if start, length, found = FindOPT(message); !found {
+		return message
+	}
+
+	result = make([]byte, 0, len(message)-length)
+	result = append(result, message[:start]...)
+	result = append(result, message[start+length:]...)
+	binary.BigEndian.PutUint16(result[10:12], binary.BigEndian.Uint16(result[10:12])-1)
+
+	return result
+}
+
+// TruncateResponse makes the response fit in size bytes, when it does not
+// the records are dropped and the TC bit set so the client retries over TCP,
+// the question and the OPT record are kept
+func TruncateResponse(response []byte, size int) []byte {
+	if len(response) <= size {
+		return response
+	}
+
+	var (
+		end       int
+		err       error
+		start     int
+		length    int
+		found     bool
+		truncated []byte
+	)
+	// without a readable question only the header is kept, with TC set
+	// and no section left so the client does not trust an empty answer
+	if end, err = QuestionEnd(response); err != nil {
+		truncated = make([]byte, HEADER_SIZE)
+		copy(truncated, response[:HEADER_SIZE])
+		binary.BigEndian.PutUint16(truncated[2:4], binary.BigEndian.Uint16(truncated[2:4])|FLAG_TC)
+		clear(truncated[4:HEADER_SIZE])
+		return truncated
+	}
+
+	start, length, found = FindOPT(response)
+	if found && end+length > size {
+		found = false
+	}
+
+	truncated = make([]byte, end, end+length)
+	copy(truncated, response[:end])
+	binary.BigEndian.PutUint16(truncated[2:4], binary.BigEndian.Uint16(truncated[2:4])|FLAG_TC)
+	binary.BigEndian.PutUint16(truncated[6:8], 0)
+	binary.BigEndian.PutUint16(truncated[8:10], 0)
+	binary.BigEndian.PutUint16(truncated[10:12], 0)
+
+	if found {
+		truncated = append(truncated, response[start:start+length]...)
+		binary.BigEndian.PutUint16(truncated[10:12], 1)
+	}
+
+	return truncated
+}
+
+// IsTruncated reports whether the TC bit is set
+func IsTruncated(message []byte) bool {
+	return len(message) >= HEADER_SIZE && binary.BigEndian.Uint16(message[2:4])&FLAG_TC != 0
+}
@@ -0,0 +1,216 @@
+package dns
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// TEST 1: Query without OPT record
+// Tests that a plain query reports no EDNS0 and the 512 byte default
+func TestParseEDNS0_Absent(t *testing.T) {
+	var (
+		query   []byte = buildDNSQuery("example.com", 1, 1)
+		size    uint16
+		present bool
+	)
+
+	size, present = ParseEDNS0(query)
+
+	if present {
+		t.Error("Query without OPT should not report EDNS0")
+	}
+	if size != DEFAULT_UDP_SIZE {
+		t.Errorf("Expected default size %d, got %d", DEFAULT_UDP_SIZE, size)
+	}
+}
+
+// TEST 2: SetEDNS0 appends an OPT record
+// Tests that the appended record is found and advertises the requested size
+func TestSetEDNS0_Appends(t *testing.T) {
+	var (
+		query   []byte = buildDNSQuery("example.com", 1, 1)
+		result  []byte
+		size    uint16
+		present bool
+	)
+
+	result = SetEDNS0(query, 4096)
+
+	if len(result) != len(query)+optFixedRRLength {
+		t.Errorf("Expected length %d, got %d", len(query)+optFixedRRLength, len(result))
+	}
+	if binary.BigEndian.Uint16(result[10:12]) != 1 {
+		t.Errorf("Expected ARCOUNT 1, got %d", binary.BigEndian.Uint16(result[10:12]))
+	}
+	if binary.BigEndian.Uint16(query[10:12]) != 0 {
+		t.Error("Original query should not be modified")
+	}
+
+	size, present = ParseEDNS0(result)
+	if !present || size != 4096 {
+		t.Errorf("Expected EDNS0 with size 4096, got present=%v size=%d", present, size)
+	}
+}
+
+// TEST 3: SetEDNS0 rewrites an existing OPT record
+// Tests that the client record is reused instead of adding a second one
+func TestSetEDNS0_Rewrites(t *testing.T) {
+	var (
+		query  []byte = SetEDNS0(buildDNSQuery("example.com", 1, 1), 1232)
+		result []byte
+		size   uint16
+	)
+
+	result = SetEDNS0(query, 4096)
+
+	if len(result) != len(query) {
+		t.Errorf("Expected length %d, got %d", len(query), len(result))
+	}
+	if binary.BigEndian.Uint16(result[10:12]) != 1 {
+		t.Errorf("Expected ARCOUNT 1, got %d", binary.BigEndian.Uint16(result[10:12]))
+	}
+
+	size, _ = ParseEDNS0(result)
+	if size != 4096 {
+		t.Errorf("Expected size 4096, got %d", size)
+	}
+}
+
+// TEST 4: Sizes below 512 are raised
+// Tests that RFC 6891 minimum is honored
+func TestParseEDNS0_MinimumSize(t *testing.T) {
+	var (
+		query []byte = SetEDNS0(buildDNSQuery("example.com", 1, 1), 100)
+		size  uint16
+	)
+
+	size, _ = ParseEDNS0(query)
+
+	if size != DEFAULT_UDP_SIZE {
+		t.Errorf("Expected size %d, got %d", DEFAULT_UDP_SIZE, size)
+	}
+}
+
+// TEST 5: StripEDNS0 removes the OPT record
+// Tests that the message goes back to its original form
+func TestStripEDNS0(t *testing.T) {
+	var (
+		response []byte = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		withOPT  []byte = SetEDNS0(response, 1232)
+		stripped []byte
+	)
+
+	stripped = StripEDNS0(withOPT)
+
+	if string(stripped) != string(response) {
+		t.Error("Stripped message should equal the original")
+	}
+}
+
+// TEST 6: TruncateResponse sets TC and keeps the question
+// Tests that oversized answers are cut at record boundaries
+func TestTruncateResponse(t *testing.T) {
+	var (
+		ttls      []uint32 = make([]uint32, 60)
+		response  []byte
+		truncated []byte
+		end       int
+		err       error
+		present   bool
+		i         int
+	)
+	for i = range ttls {
+		ttls[i] = 300
+	}
+	response = SetEDNS0(buildDNSResponseMultiple("example.com", ttls), 1232)
+
+	truncated = TruncateResponse(response, 512)
+
+	if len(truncated) > 512 {
+		t.Fatalf("Truncated response should fit in 512 bytes, got %d", len(truncated))
+	}
+	if binary.BigEndian.Uint16(truncated[2:4])&FLAG_TC == 0 {
+		t.Error("TC bit should be set")
+	}
+	if binary.BigEndian.Uint16(truncated[6:8]) != 0 {
+		t.Error("Truncated response should not carry answers")
+	}
+
+	end, err = QuestionEnd(truncated)
+	if err != nil {
+		t.Fatalf("Truncated response should keep a valid question: %v", err)
+	}
+	if _, present = ParseEDNS0(truncated); !present {
+		t.Error("OPT record should be kept")
+	}
+	if end+optFixedRRLength != len(truncated) {
+		t.Errorf("Expected question plus OPT, got %d trailing bytes", len(truncated)-end)
+	}
+}
+
+// TEST 7: TruncateResponse leaves small answers alone
+// Tests that responses within the limit are returned unchanged
+func TestTruncateResponse_Fits(t *testing.T) {
+	var (
+		response []byte = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		result   []byte
+	)
+
+	result = TruncateResponse(response, 512)
+
+	if string(result) != string(response) {
+		t.Error("Response that fits should be returned unchanged")
+	}
+}
+
+// TEST 8: FindOPT skips answer records
+// Tests that only the additional section is searched
+func TestFindOPT(t *testing.T) {
+	var (
+		response []byte = SetEDNS0(buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), 1232)
+		start    int
+		length   int
+		found    bool
+	)
+
+	start, length, found = FindOPT(response)
+
+	if !found {
+		t.Fatal("OPT record should be found")
+	}
+	if start+length != len(response) || length != optFixedRRLength {
+		t.Errorf("Expected OPT at %d with length %d, got %d and %d", len(response)-optFixedRRLength, optFixedRRLength, start, length)
+	}
+	if _, _, found = FindOPT(buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})); found {
+		t.Error("Response without OPT should report none")
+	}
+}
+
+// TEST 9: TruncateResponse without a readable question
+// Tests that the header alone still carries TC and no section counts
+func TestTruncateResponse_BadQuestion(t *testing.T) {
+	var (
+		response  []byte = make([]byte, 600)
+		truncated []byte
+	)
+	binary.BigEndian.PutUint16(response[4:6], 1)
+	binary.BigEndian.PutUint16(response[6:8], 3)
+	binary.BigEndian.PutUint16(response[10:12], 1)
+	for i := HEADER_SIZE; i < len(response); i++ {
+		response[i] = 0x3f // labels running past the end of the message
+	}
+
+	truncated = TruncateResponse(response, 512)
+
+	if len(truncated) != HEADER_SIZE {
+		t.Fatalf("Expected only the header, got %d bytes", len(truncated))
+	}
+	if binary.BigEndian.Uint16(truncated[2:4])&FLAG_TC == 0 {
+		t.Error("TC bit should be set")
+	}
+	for offset := 4; offset < HEADER_SIZE; offset += 2 {
+		if count := binary.BigEndian.Uint16(truncated[offset : offset+2]); count != 0 {
+			t.Errorf("Expected every section count zeroed, got %d at offset %d", count, offset)
+		}
+	}
+}
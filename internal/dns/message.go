@@ -0,0 +1,391 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	HEADER_SIZE       int    = 12
+	MAX_MESSAGE_SIZE  int    = 65535
+	DEFAULT_UDP_SIZE  uint16 = 512 // what a client without EDNS0 can receive
+	MAX_NAME_LENGTH   int    = 255 // wire length of a name, root label included
+	MAX_LABEL_LENGTH  int    = 63
+	rrFixedFieldsSize int    = 10 // type + class + ttl + rdlength
+	optFixedRRLength  int    = 11 // root name + the fixed fields
+)
+
+// record types
+const (
+	TYPE_A     uint16 = 1
+	TYPE_NS    uint16 = 2
+	TYPE_CNAME uint16 = 5
+	TYPE_SOA   uint16 = 6
+	TYPE_PTR   uint16 = 12
+	TYPE_MX    uint16 = 15
+	TYPE_TXT   uint16 = 16
+	TYPE_AAAA  uint16 = 28
+	TYPE_SRV   uint16 = 33
+	TYPE_DNAME uint16 = 39
+	TYPE_OPT   uint16 = 41 // EDNS0 pseudo record (RFC 6891)
+	TYPE_DS    uint16 = 43
+	TYPE_SVCB  uint16 = 64
+	TYPE_HTTPS uint16 = 65
+	TYPE_ANY   uint16 = 255
+	TYPE_CAA   uint16 = 257
+	CLASS_IN   uint16 = 1
+)
+
+// header flags
+const (
+	FLAG_QR      uint16 = 0x8000
+	FLAG_AA      uint16 = 0x0400
+	FLAG_TC      uint16 = 0x0200
+	FLAG_RD      uint16 = 0x0100
+	FLAG_RA      uint16 = 0x0080
+	FLAG_AD      uint16 = 0x0020
+	FLAG_CD      uint16 = 0x0010
+	OPCODE_MASK  uint16 = 0x7800
+	RCODE_MASK   uint16 = 0x000F
+	EDNS_FLAG_DO uint16 = 0x8000 // DNSSEC OK, lives in the OPT ttl
+)
+
+// response codes
+const (
+	RCODE_NOERROR  uint16 = 0
+	RCODE_FORMERR  uint16 = 1
+	RCODE_SERVFAIL uint16 = 2
+	RCODE_NXDOMAIN uint16 = 3
+	RCODE_NOTIMP   uint16 = 4
+	RCODE_REFUSED  uint16 = 5
+)
+
+var (
+	errShortMessage   error = errors.New("message too short")
+	errRecordBounds   error = errors.New("record out of bounds")
+	errMultipleOPT    error = errors.New("more than one OPT record")
+	errMessageTooLong error = errors.New("message larger than 65535 bytes")
+)
+
+type Header struct {
+	ID      uint16
+	Flags   uint16
+	QDCount uint16
+	ANCount uint16
+	NSCount uint16
+	ARCount uint16
+}
+
+func (h Header) Opcode() uint16 {
+	return (h.Flags & OPCODE_MASK) >> 11
+}
+
+func (h Header) Rcode() uint16 {
+	return h.Flags & RCODE_MASK
+}
+
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// Resource is a decoded record, names inside Data are stored expanded so the
+// record stays valid once taken out of the message it came from
+type Resource struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+type Option struct {
+	Code uint16
+	Data []byte
+}
+
+// OPT is the EDNS0 pseudo record, it travels in the additional section but
+// is kept apart since its fields mean something else
+type OPT struct {
+	UDPSize       uint16
+	ExtendedRcode uint8
+	Version       uint8
+	Flags         uint16
+	Options       []Option
+}
+
+// Message is a fully decoded DNS message, the section counts are derived
+// from the slices when packing
+type Message struct {
+	ID          uint16
+	Flags       uint16
+	Questions   []Question
+	Answers     []Resource
+	Authorities []Resource
+	Additionals []Resource
+	EDNS        *OPT
+}
+
+// Parse decodes every section of message, compressed names are expanded
+func Parse(message []byte) (*Message, error) {
+	var (
+		result *Message = &Message{}
+		err    error
+	)
+	if err = result.Unpack(message); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (m *Message) Unpack(message []byte) error {
+	var (
+		header   Header
+		position int = HEADER_SIZE
+		question Question
+		resource Resource
+		err      error
+		i        int
+	)
+	if header, err = ParseHeader(message); err != nil {
+		return err
+	}
+
+	*m = Message{ID: header.ID, Flags: header.Flags}
+
+	m.Questions = make([]Question, 0, header.QDCount)
+	for i = 0; i < int(header.QDCount); i++ {
+		if question.Name, position, err = ReadName(message, position); err != nil {
+			return err
+		}
+		if position+4 > len(message) {
+			return fmt.Errorf("question out of bounds")
+		}
+		question.Type = binary.BigEndian.Uint16(message[position : position+2])
+		question.Class = binary.BigEndian.Uint16(message[position+2 : position+4])
+		position += 4
+		m.Questions = append(m.Questions, question)
+	}
+
+	if m.Answers, position, err = unpackSection(message, position, int(header.ANCount)); err != nil {
+		return err
+	}
+	if m.Authorities, position, err = unpackSection(message, position, int(header.NSCount)); err != nil {
+		return err
+	}
+
+	for i = 0; i < int(header.ARCount); i++ {
+		if resource, position, err = unpackResource(message, position); err != nil {
+			return err
+		}
+		if resource.Type != TYPE_OPT {
+			m.Additionals = append(m.Additionals, resource)
+			continue
+		}
+		if m.EDNS != nil {
+			return errMultipleOPT
+		}
+		m.EDNS = unpackOPT(resource)
+	}
+
+	return nil
+}
+
+func unpackSection(message []byte, position, count int) ([]Resource, int, error) {
+	if count == 0 {
+		return nil, position, nil
+	}
+
+	var (
+		records  []Resource = make([]Resource, 0, min(count, len(message)/optFixedRRLength))
+		resource Resource
+		err      error
+		i        int
+	)
+	for i = 0; i < count; i++ {
+		if resource, position, err = unpackResource(message, position); err != nil {
+			return nil, 0, err
+		}
+		records = append(records, resource)
+	}
+
+	return records, position, nil
+}
+
+func unpackResource(message []byte, position int) (Resource, int, error) {
+	var (
+		resource Resource
+		rdlength int
+		err      error
+	)
+	if resource.Name, position, err = ReadName(message, position); err != nil {
+		return Resource{}, 0, err
+	}
+	if position+rrFixedFieldsSize > len(message) {
+		return Resource{}, 0, errRecordBounds
+	}
+
+	resource.Type = binary.BigEndian.Uint16(message[position : position+2])
+	resource.Class = binary.BigEndian.Uint16(message[position+2 : position+4])
+	resource.TTL = binary.BigEndian.Uint32(message[position+4 : position+8])
+	rdlength = int(binary.BigEndian.Uint16(message[position+8 : position+10]))
+	position += rrFixedFieldsSize
+
+	if position+rdlength > len(message) {
+		return Resource{}, 0, errRecordBounds
+	}
+	if resource.Data, err = expandRData(message, resource.Type, position, rdlength); err != nil {
+		return Resource{}, 0, err
+	}
+
+	return resource, position + rdlength, nil
+}
+
+func unpackOPT(resource Resource) *OPT {
+	var (
+		opt    *OPT = &OPT{UDPSize: resource.Class}
+		data   []byte
+		length int
+	)
+	opt.ExtendedRcode = uint8(resource.TTL >> 24)
+	opt.Version = uint8(resource.TTL >> 16)
+	opt.Flags = uint16(resource.TTL)
+
+	// a truncated option ends the list, the rest is ignored
+	for data = resource.Data; len(data) >= 4; data = data[4+length:] {
+		length = int(binary.BigEndian.Uint16(data[2:4]))
+		if 4+length > len(data) {
+			break
+		}
+		opt.Options = append(opt.Options, Option{Code: binary.BigEndian.Uint16(data[0:2]), Data: data[4 : 4+length]})
+	}
+
+	return opt
+}
+
+// Rcode joins the header rcode with the upper bits carried by EDNS0
+func (m *Message) Rcode() uint16 {
+	var rcode uint16 = m.Flags & RCODE_MASK
+	if m.EDNS != nil {
+		rcode |= uint16(m.EDNS.ExtendedRcode) << 4
+	}
+	return rcode
+}
+
+// Reply starts a response to m with the same ID, opcode, RD and CD bits and
+// question, an OPT record is included when the query had one
+func (m *Message) Reply(rcode uint16) *Message {
+	var reply *Message = &Message{
+		ID:        m.ID,
+		Flags:     FLAG_QR | FLAG_RA | m.Flags&(OPCODE_MASK|FLAG_RD|FLAG_CD) | rcode&RCODE_MASK,
+		Questions: append([]Question(nil), m.Questions...),
+	}
+	if m.EDNS != nil {
+		reply.EDNS = &OPT{UDPSize: m.EDNS.UDPSize, Flags: m.EDNS.Flags & EDNS_FLAG_DO}
+	}
+
+	return reply
+}
+
+func (m *Message) Pack() ([]byte, error) {
+	return m.AppendPack(make([]byte, 0, 512))
+}
+
+// AppendPack encodes the message at the end of buffer, names are compressed
+// where RFC 3597 allows it
+func (m *Message) AppendPack(buffer []byte) ([]byte, error) {
+	var (
+		start       int        = len(buffer)
+		compression compressor = compressor{start: start}
+		additionals int        = len(m.Additionals)
+		err         error
+	)
+	if m.EDNS != nil {
+		additionals++
+	}
+	if len(m.Questions) > 0xFFFF || len(m.Answers) > 0xFFFF || len(m.Authorities) > 0xFFFF || additionals > 0xFFFF {
+		return nil, fmt.Errorf("too many records")
+	}
+
+	buffer = binary.BigEndian.AppendUint16(buffer, m.ID)
+	buffer = binary.BigEndian.AppendUint16(buffer, m.Flags)
+	buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(m.Questions)))
+	buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(m.Answers)))
+	buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(m.Authorities)))
+	buffer = binary.BigEndian.AppendUint16(buffer, uint16(additionals))
+
+	for _, question := range m.Questions {
+		if buffer, err = compression.appendName(buffer, question.Name); err != nil {
+			return nil, err
+		}
+		buffer = binary.BigEndian.AppendUint16(buffer, question.Type)
+		buffer = binary.BigEndian.AppendUint16(buffer, question.Class)
+	}
+
+	for _, section := range [][]Resource{m.Answers, m.Authorities, m.Additionals} {
+		for _, resource := range section {
+			if buffer, err = compression.appendResource(buffer, resource); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if m.EDNS != nil {
+		buffer = m.EDNS.appendTo(buffer)
+	}
+
+	if len(buffer)-start > MAX_MESSAGE_SIZE {
+		return nil, errMessageTooLong
+	}
+	return buffer, nil
+}
+
+func (c *compressor) appendResource(buffer []byte, resource Resource) ([]byte, error) {
+	var (
+		lengthAt int
+		err      error
+	)
+	if buffer, err = c.appendName(buffer, resource.Name); err != nil {
+		return nil, err
+	}
+	buffer = binary.BigEndian.AppendUint16(buffer, resource.Type)
+	buffer = binary.BigEndian.AppendUint16(buffer, resource.Class)
+	buffer = binary.BigEndian.AppendUint32(buffer, resource.TTL)
+	lengthAt = len(buffer)
+	buffer = append(buffer, 0, 0)
+
+	if buffer, err = c.appendRData(buffer, resource.Type, resource.Data); err != nil {
+		return nil, err
+	}
+	if len(buffer)-lengthAt-2 > 0xFFFF {
+		return nil, fmt.Errorf("rdata of %s too long", resource.Name)
+	}
+	binary.BigEndian.PutUint16(buffer[lengthAt:lengthAt+2], uint16(len(buffer)-lengthAt-2))
+
+	return buffer, nil
+}
+
+func (o *OPT) appendTo(buffer []byte) []byte {
+	var (
+		lengthAt int
+		option   Option
+	)
+	buffer = append(buffer, 0) // root name
+	buffer = binary.BigEndian.AppendUint16(buffer, TYPE_OPT)
+	buffer = binary.BigEndian.AppendUint16(buffer, o.UDPSize)
+	buffer = append(buffer, o.ExtendedRcode, o.Version)
+	buffer = binary.BigEndian.AppendUint16(buffer, o.Flags)
+	lengthAt = len(buffer)
+	buffer = append(buffer, 0, 0)
+
+	for _, option = range o.Options {
+		buffer = binary.BigEndian.AppendUint16(buffer, option.Code)
+		buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(option.Data)))
+		buffer = append(buffer, option.Data...)
+	}
+	binary.BigEndian.PutUint16(buffer[lengthAt:lengthAt+2], uint16(len(buffer)-lengthAt-2))
+
+	return buffer
+}
@@ -0,0 +1,379 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// TEST 1: Parse decodes every section
+// Tests header fields, question and answers of a plain response
+func TestParse_Response(t *testing.T) {
+	var (
+		response []byte = buildDNSResponseMultiple("example.com", []uint32{300, 60})
+		message  *Message
+		err      error
+	)
+
+	message, err = Parse(response)
+
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if message.ID != 0x1234 || message.Flags != 0x8180 {
+		t.Errorf("Expected ID 0x1234 and flags 0x8180, got 0x%04X and 0x%04X", message.ID, message.Flags)
+	}
+	if len(message.Questions) != 1 || message.Questions[0] != (Question{Name: "example.com", Type: TYPE_A, Class: CLASS_IN}) {
+		t.Errorf("Unexpected question %+v", message.Questions)
+	}
+	if len(message.Answers) != 2 {
+		t.Fatalf("Expected 2 answers, got %d", len(message.Answers))
+	}
+	if message.Answers[0].Name != "example.com" || message.Answers[1].TTL != 60 {
+		t.Errorf("Unexpected answers %+v", message.Answers)
+	}
+	if message.Answers[0].DataString() != "192.168.1.1" {
+		t.Errorf("Expected 192.168.1.1, got %s", message.Answers[0].DataString())
+	}
+	if message.EDNS != nil {
+		t.Error("Response without OPT should have no EDNS")
+	}
+}
+
+// TEST 2: Names inside rdata are expanded
+// Tests that a CNAME pointing into the question survives leaving the message
+func TestParse_ExpandsRData(t *testing.T) {
+	var (
+		response []byte = buildDNSResponse("www.example.com", TYPE_CNAME, CLASS_IN, 300, []byte{3, 'c', 'd', 'n', 0xC0, 0x10})
+		message  *Message
+		err      error
+	)
+
+	message, err = Parse(response)
+
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if message.Answers[0].DataString() != "cdn.example.com." {
+		t.Errorf("Expected cdn.example.com., got %s", message.Answers[0].DataString())
+	}
+	if len(message.Answers[0].Data) != 17 {
+		t.Errorf("Expected 17 bytes of expanded rdata, got %d", len(message.Answers[0].Data))
+	}
+}
+
+// TEST 3: Malformed messages are rejected
+// Tests short headers, counts past the end and duplicate OPT records
+func TestParse_Malformed(t *testing.T) {
+	var (
+		response []byte = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		twoOPT   []byte
+		err      error
+	)
+
+	if _, err = Parse(response[:10]); err == nil {
+		t.Error("Expected error for a short header")
+	}
+	if _, err = Parse(response[:len(response)-2]); err == nil {
+		t.Error("Expected error for rdata past the end")
+	}
+
+	twoOPT = SetEDNS0(response, 1232)
+	twoOPT = append(twoOPT, twoOPT[len(twoOPT)-optFixedRRLength:]...)
+	binary.BigEndian.PutUint16(twoOPT[10:12], 2)
+	if _, err = Parse(twoOPT); !errors.Is(err, errMultipleOPT) {
+		t.Errorf("Expected errMultipleOPT, got %v", err)
+	}
+}
+
+// TEST 4: Pack and Parse round trip
+// Tests that every section and the OPT record come back unchanged
+func TestMessage_PackRoundTrip(t *testing.T) {
+	var (
+		message *Message = &Message{
+			ID:        0xBEEF,
+			Flags:     FLAG_QR | FLAG_RD | FLAG_RA,
+			Questions: []Question{{Name: "www.example.com", Type: TYPE_A, Class: CLASS_IN}},
+			Answers: []Resource{
+				{Name: "www.example.com", Type: TYPE_CNAME, Class: CLASS_IN, TTL: 300, Data: []byte{3, 'c', 'd', 'n', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}},
+				{Name: "cdn.example.com", Type: TYPE_A, Class: CLASS_IN, TTL: 60, Data: []byte{10, 0, 0, 1}},
+			},
+			Authorities: []Resource{
+				{Name: "example.com", Type: TYPE_NS, Class: CLASS_IN, TTL: 3600, Data: []byte{2, 'n', 's', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}},
+			},
+			EDNS: &OPT{UDPSize: 1232, Flags: EDNS_FLAG_DO, Options: []Option{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}}},
+		}
+		packed []byte
+		parsed *Message
+		err    error
+	)
+
+	packed, err = message.Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+
+	parsed, err = Parse(packed)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if parsed.ID != message.ID || parsed.Flags != message.Flags {
+		t.Errorf("Header changed: %04X/%04X", parsed.ID, parsed.Flags)
+	}
+	if len(parsed.Answers) != 2 || len(parsed.Authorities) != 1 || len(parsed.Additionals) != 0 {
+		t.Fatalf("Unexpected section sizes %d/%d/%d", len(parsed.Answers), len(parsed.Authorities), len(parsed.Additionals))
+	}
+	for i, answer := range message.Answers {
+		if parsed.Answers[i].Name != answer.Name || !bytes.Equal(parsed.Answers[i].Data, answer.Data) || parsed.Answers[i].TTL != answer.TTL {
+			t.Errorf("Answer %d changed: %+v", i, parsed.Answers[i])
+		}
+	}
+	if !bytes.Equal(parsed.Authorities[0].Data, message.Authorities[0].Data) {
+		t.Errorf("Authority changed: %+v", parsed.Authorities[0])
+	}
+	if parsed.EDNS == nil || parsed.EDNS.UDPSize != 1232 || parsed.EDNS.Flags != EDNS_FLAG_DO {
+		t.Fatalf("EDNS changed: %+v", parsed.EDNS)
+	}
+	if len(parsed.EDNS.Options) != 1 || parsed.EDNS.Options[0].Code != 10 || len(parsed.EDNS.Options[0].Data) != 8 {
+		t.Errorf("Options changed: %+v", parsed.EDNS.Options)
+	}
+}
+
+// TEST 5: Pack compresses repeated names
+// Tests that the answer owner becomes a pointer to the question
+func TestMessage_PackCompresses(t *testing.T) {
+	var (
+		message *Message = &Message{
+			ID:        0x1234,
+			Flags:     0x8180,
+			Questions: []Question{{Name: "example.com", Type: TYPE_A, Class: CLASS_IN}},
+			Answers:   []Resource{{Name: "example.com", Type: TYPE_A, Class: CLASS_IN, TTL: 300, Data: []byte{1, 2, 3, 4}}},
+		}
+		packed []byte
+		err    error
+	)
+
+	packed, err = message.Pack()
+
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+	if !bytes.Equal(packed, buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})) {
+		t.Error("Expected the same bytes as a hand built response")
+	}
+	if packed[29] != 0xC0 || packed[30] != 0x0C {
+		t.Errorf("Expected pointer 0xC00C for the answer name, got 0x%02X%02X", packed[29], packed[30])
+	}
+}
+
+// TEST 6: Pack rejects invalid names
+// Tests empty labels and names over 255 bytes
+func TestMessage_PackInvalidName(t *testing.T) {
+	var (
+		long []byte = bytes.Repeat([]byte("abcdefghi."), 26)
+		err  error
+	)
+
+	if _, err = (&Message{Questions: []Question{{Name: "bad..name"}}}).Pack(); err == nil {
+		t.Error("Expected error for an empty label")
+	}
+	if _, err = (&Message{Questions: []Question{{Name: string(long)}}}).Pack(); err == nil {
+		t.Error("Expected error for a name over 255 bytes")
+	}
+}
+
+// TEST 7: Reply copies what a response needs
+// Tests ID, question, RD bit and the OPT record
+func TestMessage_Reply(t *testing.T) {
+	var (
+		query *Message = &Message{
+			ID:        0x4321,
+			Flags:     FLAG_RD,
+			Questions: []Question{{Name: "example.com", Type: TYPE_AAAA, Class: CLASS_IN}},
+			EDNS:      &OPT{UDPSize: 4096, Flags: EDNS_FLAG_DO, Options: []Option{{Code: 8}}},
+		}
+		reply *Message
+	)
+
+	reply = query.Reply(RCODE_SERVFAIL)
+
+	if reply.ID != 0x4321 {
+		t.Errorf("Expected ID 0x4321, got 0x%04X", reply.ID)
+	}
+	if reply.Flags != FLAG_QR|FLAG_RD|FLAG_RA|RCODE_SERVFAIL {
+		t.Errorf("Unexpected flags 0x%04X", reply.Flags)
+	}
+	if len(reply.Questions) != 1 || reply.Questions[0].Name != "example.com" {
+		t.Errorf("Question should be copied, got %+v", reply.Questions)
+	}
+	if reply.EDNS == nil || reply.EDNS.UDPSize != 4096 || reply.EDNS.Flags != EDNS_FLAG_DO || len(reply.EDNS.Options) != 0 {
+		t.Errorf("Expected a fresh OPT record, got %+v", reply.EDNS)
+	}
+}
+
+// ============================================================================
+// HELPER FUNCTIONS FOR BUILDING DNS PACKETS
+// ============================================================================
+
+// buildDNSQuery creates a minimal DNS query packet
+func buildDNSQuery(domain string, qtype uint16, qclass uint16) []byte {
+	var (
+		query    []byte = make([]byte, 12)
+		labels   []string
+		i        int
+		label    string
+		labelLen int
+	)
+
+	// DNS Header (12 bytes) - already zero-initialized
+	binary.BigEndian.PutUint16(query[0:2], 0x1234) // Transaction ID
+	binary.BigEndian.PutUint16(query[4:6], 1)      // QDCOUNT = 1
+
+	// Question section - domain name
+	labels = splitDomain(domain)
+	for i, label = range labels {
+		_ = i
+		labelLen = len(label)
+		query = append(query, byte(labelLen))
+		query = append(query, []byte(label)...)
+	}
+	query = append(query, 0) // End of domain name
+
+	// QTYPE and QCLASS
+	var typeClass []byte = make([]byte, 4)
+	binary.BigEndian.PutUint16(typeClass[0:2], qtype)
+	binary.BigEndian.PutUint16(typeClass[2:4], qclass)
+	query = append(query, typeClass...)
+
+	return query
+}
+
+// buildDNSResponse creates a minimal DNS response packet
+func buildDNSResponse(domain string, qtype uint16, qclass uint16, ttl uint32, rdata []byte) []byte {
+	var (
+		response []byte = make([]byte, 12)
+		labels   []string
+		i        int
+		label    string
+		labelLen int
+	)
+
+	// DNS Header
+	binary.BigEndian.PutUint16(response[0:2], 0x1234) // Transaction ID
+	binary.BigEndian.PutUint16(response[2:4], 0x8180) // Flags (response)
+	binary.BigEndian.PutUint16(response[4:6], 1)      // QDCOUNT = 1
+	binary.BigEndian.PutUint16(response[6:8], 1)      // ANCOUNT = 1
+
+	// Question section
+	labels = splitDomain(domain)
+	for i, label = range labels {
+		_ = i
+		labelLen = len(label)
+		response = append(response, byte(labelLen))
+		response = append(response, []byte(label)...)
+	}
+	response = append(response, 0) // End of domain
+
+	var typeClass []byte = make([]byte, 4)
+	binary.BigEndian.PutUint16(typeClass[0:2], qtype)
+	binary.BigEndian.PutUint16(typeClass[2:4], qclass)
+	response = append(response, typeClass...)
+
+	// Answer section
+	response = append(response, 0xC0, 0x0C) // Name pointer to question
+
+	// TYPE, CLASS, TTL, RDLENGTH, RDATA
+	var answerData []byte = make([]byte, 10)
+	binary.BigEndian.PutUint16(answerData[0:2], qtype)
+	binary.BigEndian.PutUint16(answerData[2:4], qclass)
+	binary.BigEndian.PutUint32(answerData[4:8], ttl)
+	binary.BigEndian.PutUint16(answerData[8:10], uint16(len(rdata)))
+	response = append(response, answerData...)
+	response = append(response, rdata...)
+
+	return response
+}
+
+// buildDNSResponseMultiple creates a response with multiple answers
+func buildDNSResponseMultiple(domain string, ttls []uint32) []byte {
+	var (
+		response []byte = make([]byte, 12)
+		labels   []string
+		i        int
+		label    string
+		labelLen int
+		ttl      uint32
+	)
+
+	// DNS Header
+	binary.BigEndian.PutUint16(response[0:2], 0x1234)
+	binary.BigEndian.PutUint16(response[2:4], 0x8180)
+	binary.BigEndian.PutUint16(response[4:6], 1)
+	binary.BigEndian.PutUint16(response[6:8], uint16(len(ttls))) // ANCOUNT
+
+	// Question section
+	labels = splitDomain(domain)
+	for i, label = range labels {
+		_ = i
+		labelLen = len(label)
+		response = append(response, byte(labelLen))
+		response = append(response, []byte(label)...)
+	}
+	response = append(response, 0)
+
+	var typeClass []byte = make([]byte, 4)
+	binary.BigEndian.PutUint16(typeClass[0:2], 1) // Type A
+	binary.BigEndian.PutUint16(typeClass[2:4], 1) // Class IN
+	response = append(response, typeClass...)
+
+	// Answer sections
+	for i, ttl = range ttls {
+		_ = i
+		response = append(response, 0xC0, 0x0C) // Name pointer
+
+		var answerData []byte = make([]byte, 10)
+		binary.BigEndian.PutUint16(answerData[0:2], 1) // Type A
+		binary.BigEndian.PutUint16(answerData[2:4], 1) // Class IN
+		binary.BigEndian.PutUint32(answerData[4:8], ttl)
+		binary.BigEndian.PutUint16(answerData[8:10], 4) // RDLENGTH = 4
+		response = append(response, answerData...)
+		response = append(response, 192, 168, 1, byte(i+1)) // IP address
+	}
+
+	return response
+}
+
+// buildDNSResponseWithCompression creates response with compression pointer
+func buildDNSResponseWithCompression(domain string, qtype uint16, qclass uint16, ttl uint32, rdata []byte) []byte {
+	// This is identical to buildDNSResponse since it already uses compression (0xC00C)
+	return buildDNSResponse(domain, qtype, qclass, ttl, rdata)
+}
+
+// splitDomain splits a domain into labels
+func splitDomain(domain string) []string {
+	var (
+		labels []string
+		start  int = 0
+		end    int = 0
+		i      int
+		ch     rune
+	)
+
+	for i, ch = range domain {
+		if ch == '.' {
+			if i > start {
+				labels = append(labels, domain[start:i])
+			}
+			start = i + 1
+		}
+		end = i
+	}
+
+	if end >= start {
+		labels = append(labels, domain[start:end+1])
+	}
+
+	return labels
+}
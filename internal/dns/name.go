@@ -0,0 +1,257 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// ReadName decodes the name at position following compression pointers,
+// it returns the name without the trailing dot and the position right
+// after it in the message
+func ReadName(message []byte, position int) (string, int, error) {
+	var (
+		buffer [MAX_NAME_LENGTH]byte
+		name   []byte
+		next   int
+		err    error
+	)
+	if name, next, err = decodeName(buffer[:0], message, position, false); err != nil {
+		return "", 0, err
+	}
+	return string(name), next, nil
+}
+
+// AppendName is ReadName writing into dst, with enough capacity it does
+// not allocate
+func AppendName(dst []byte, message []byte, position int) ([]byte, int, error) {
+	return decodeName(dst, message, position, false)
+}
+
+// EncodeName writes name as uncompressed labels, the form the rdata of a
+// CNAME or PTR built outside of a message takes. a single name never
+// repeats one of its suffixes so the compressor emits no pointer
+func EncodeName(name string) ([]byte, error) {
+	var c compressor
+	return c.appendName(nil, name)
+}
+
+// SkipName returns the position right after the name starting at position,
+// a compression pointer ends the name so it is not followed
+func SkipName(message []byte, position int) (int, error) {
+	var length int
+	for {
+		if position >= len(message) {
+			return 0, fmt.Errorf("name out of bounds")
+		}
+
+		length = int(message[position])
+		switch {
+		case length == 0:
+			return position + 1, nil
+		case length&0xC0 == 0xC0:
+			if position+2 > len(message) {
+				return 0, fmt.Errorf("compression pointer out of bounds")
+			}
+			return position + 2, nil
+		case length > MAX_LABEL_LENGTH:
+			return 0, fmt.Errorf("invalid label length: %d", length)
+		}
+
+		position += length + 1
+	}
+}
+
+// decodeName walks the name at position, appending it to dst in dotted form
+// or, when wire is set, as uncompressed labels. Pointers must go strictly
+// backwards from where the current run of labels started, which is what a
+// real encoder produces and rules out loops without counting jumps
+func decodeName(dst []byte, message []byte, position int, wire bool) ([]byte, int, error) {
+	var (
+		end        int = -1
+		runStart   int = position
+		nameLength int = 1 // root label
+		length     int
+		target     int
+		labels     int
+	)
+
+	for {
+		if position >= len(message) {
+			return nil, 0, fmt.Errorf("name out of bounds")
+		}
+
+		length = int(message[position])
+		switch {
+		case length == 0:
+			if end == -1 {
+				end = position + 1
+			}
+			if wire {
+				dst = append(dst, 0)
+			}
+			return dst, end, nil
+
+		case length&0xC0 == 0xC0:
+			if position+2 > len(message) {
+				return nil, 0, fmt.Errorf("compression pointer out of bounds")
+			}
+			if end == -1 {
+				end = position + 2
+			}
+			target = int(binary.BigEndian.Uint16(message[position:position+2]) & 0x3FFF)
+			if target >= runStart {
+				return nil, 0, fmt.Errorf("compression pointer to %d does not point backwards", target)
+			}
+			runStart, position = target, target
+
+		case length > MAX_LABEL_LENGTH:
+			return nil, 0, fmt.Errorf("invalid label length: %d", length)
+
+		default:
+			if position+1+length > len(message) {
+				return nil, 0, fmt.Errorf("label out of bounds")
+			}
+			if nameLength += length + 1; nameLength > MAX_NAME_LENGTH {
+				return nil, 0, fmt.Errorf("name longer than %d bytes", MAX_NAME_LENGTH)
+			}
+
+			if wire {
+				dst = append(dst, byte(length))
+			} else if labels > 0 {
+				dst = append(dst, '.')
+			}
+			dst = append(dst, message[position+1:position+1+length]...)
+			labels++
+			position += length + 1
+		}
+	}
+}
+
+// expandRData copies the rdata at position, names inside the types that may
+// carry compressed ones are expanded so the copy does not need the message
+func expandRData(message []byte, rtype uint16, position, length int) ([]byte, error) {
+	var (
+		prefix int // fixed fields before the first name
+		names  int
+		end    int = position + length
+		data   []byte
+		err    error
+		i      int
+	)
+	switch rtype {
+	case TYPE_NS, TYPE_CNAME, TYPE_PTR, TYPE_DNAME:
+		names = 1
+	case TYPE_MX:
+		prefix, names = 2, 1
+	case TYPE_SRV:
+		prefix, names = 6, 1
+	case TYPE_SOA:
+		names = 2
+	default:
+		return append([]byte(nil), message[position:end]...), nil
+	}
+
+	if length < prefix {
+		return nil, fmt.Errorf("rdata too short for type %d", rtype)
+	}
+
+	data = make([]byte, 0, length+MAX_NAME_LENGTH)
+	data = append(data, message[position:position+prefix]...)
+	position += prefix
+
+	for i = 0; i < names; i++ {
+		if data, position, err = decodeName(data, message[:end], position, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return append(data, message[position:end]...), nil
+}
+
+// compressor remembers where every name suffix was written so later
+// occurrences become pointers
+type compressor struct {
+	start   int // where the message begins in the buffer
+	offsets map[string]int
+}
+
+func (c *compressor) appendName(buffer []byte, name string) ([]byte, error) {
+	var (
+		rest   string = strings.TrimSuffix(name, ".")
+		label  string
+		after  string
+		dotted bool
+		offset int
+		found  bool
+	)
+	if rest != "" && len(rest)+2 > MAX_NAME_LENGTH {
+		return nil, fmt.Errorf("name longer than %d bytes: %s", MAX_NAME_LENGTH, name)
+	}
+
+	for rest != "" {
+		if offset, found = c.offsets[rest]; found {
+			return append(buffer, byte(0xC0|offset>>8), byte(offset)), nil
+		}
+
+		label, after, dotted = strings.Cut(rest, ".")
+		if len(label) == 0 || len(label) > MAX_LABEL_LENGTH || (dotted && after == "") {
+			return nil, fmt.Errorf("invalid label in %q", name)
+		}
+
+		if offset = len(buffer) - c.start; offset < 0x4000 {
+			if c.offsets == nil {
+				c.offsets = make(map[string]int)
+			}
+			c.offsets[rest] = offset
+		}
+		buffer = append(buffer, byte(len(label)))
+		buffer = append(buffer, label...)
+		rest = after
+	}
+
+	return append(buffer, 0), nil
+}
+
+// appendRData writes rdata, the names in the types RFC 3597 lets us compress
+// are compressed against the rest of the message
+func (c *compressor) appendRData(buffer []byte, rtype uint16, data []byte) ([]byte, error) {
+	var (
+		prefix   int
+		count    int
+		names    [2]string
+		position int
+		err      error
+		i        int
+	)
+	switch rtype {
+	case TYPE_NS, TYPE_CNAME, TYPE_PTR:
+		count = 1
+	case TYPE_MX:
+		prefix, count = 2, 1
+	case TYPE_SOA:
+		count = 2
+	default:
+		return append(buffer, data...), nil
+	}
+
+	// data that does not hold valid names is written as it is
+	position = prefix
+	for i = 0; i < count; i++ {
+		if position > len(data) {
+			return append(buffer, data...), nil
+		}
+		if names[i], position, err = ReadName(data, position); err != nil {
+			return append(buffer, data...), nil
+		}
+	}
+
+	buffer = append(buffer, data[:prefix]...)
+	for i = 0; i < count; i++ {
+		if buffer, err = c.appendName(buffer, names[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return append(buffer, data[position:]...), nil
+}
@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TEST 1: ReadName follows compression pointers
+// Tests that the answer name pointing at the question is expanded
+func TestReadName_Compression(t *testing.T) {
+	var (
+		response []byte = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		end      int
+		name     string
+		next     int
+		err      error
+	)
+	end, _ = QuestionEnd(response)
+
+	name, next, err = ReadName(response, end)
+
+	if err != nil {
+		t.Fatalf("ReadName failed: %v", err)
+	}
+	if name != "example.com" {
+		t.Errorf("Expected example.com, got %s", name)
+	}
+	if next != end+2 {
+		t.Errorf("Expected position %d after pointer, got %d", end+2, next)
+	}
+}
+
+// TEST 2: ReadName stops pointer loops
+// Tests that pointers to themselves or forward are rejected
+func TestReadName_PointerLoop(t *testing.T) {
+	var (
+		self    []byte = append(make([]byte, 12), 0xC0, 0x0C)
+		forward []byte = append(make([]byte, 12), 0xC0, 0x0E, 1, 'a', 0xC0, 0x0C)
+		err     error
+	)
+
+	if _, _, err = ReadName(self, 12); err == nil {
+		t.Error("Expected error for a pointer to itself")
+	}
+	if _, _, err = ReadName(forward, 12); err == nil {
+		t.Error("Expected error for a forward pointer")
+	}
+}
+
+// TEST 3: ReadName bounds checks
+// Tests truncated labels, truncated pointers and oversized names
+func TestReadName_Bounds(t *testing.T) {
+	var (
+		long []byte = make([]byte, 0, 300)
+		err  error
+		i    int
+	)
+	for i = 0; i < 5; i++ {
+		long = append(long, 63)
+		long = append(long, make([]byte, 63)...)
+	}
+	long = append(long, 0)
+
+	if _, _, err = ReadName([]byte{5, 'a', 'b'}, 0); err == nil {
+		t.Error("Expected error for a label past the end")
+	}
+	if _, _, err = ReadName([]byte{0xC0}, 0); err == nil {
+		t.Error("Expected error for a truncated pointer")
+	}
+	if _, _, err = ReadName([]byte{0x40, 0}, 0); err == nil {
+		t.Error("Expected error for an extended label type")
+	}
+	if _, _, err = ReadName(long, 0); err == nil {
+		t.Error("Expected error for a name over 255 bytes")
+	}
+}
+
+// TEST 4: AppendName reuses the caller buffer
+// Tests that decoding into a buffer with room does not allocate
+func TestAppendName_NoAllocation(t *testing.T) {
+	var (
+		response []byte = buildDNSResponse("www.example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		buffer   []byte = make([]byte, 0, MAX_NAME_LENGTH)
+		end      int
+		allocs   float64
+	)
+	end, _ = QuestionEnd(response)
+
+	allocs = testing.AllocsPerRun(100, func() {
+		buffer, _, _ = AppendName(buffer[:0], response, end)
+	})
+
+	if allocs != 0 {
+		t.Errorf("Expected no allocations, got %.1f", allocs)
+	}
+	if string(buffer) != "www.example.com" {
+		t.Errorf("Expected www.example.com, got %s", buffer)
+	}
+}
+
+// TEST 5: Names are compressed on encode
+// Tests that repeated suffixes become pointers to earlier copies
+func TestCompressor_AppendName(t *testing.T) {
+	var (
+		compression compressor
+		buffer      []byte = make([]byte, HEADER_SIZE)
+		err         error
+		name        string
+	)
+
+	buffer, err = compression.appendName(buffer, "www.example.com")
+	if err != nil {
+		t.Fatalf("appendName failed: %v", err)
+	}
+	if len(buffer) != HEADER_SIZE+17 {
+		t.Fatalf("Expected 17 bytes for the first name, got %d", len(buffer)-HEADER_SIZE)
+	}
+
+	buffer, err = compression.appendName(buffer, "mail.example.com.")
+	if err != nil {
+		t.Fatalf("appendName failed: %v", err)
+	}
+
+	// "mail" plus a pointer to the "example.com" written at offset 16
+	if len(buffer) != HEADER_SIZE+17+7 {
+		t.Errorf("Expected 7 bytes for the second name, got %d", len(buffer)-HEADER_SIZE-17)
+	}
+	if name, _, err = ReadName(buffer, HEADER_SIZE+17); err != nil || name != "mail.example.com" {
+		t.Errorf("Expected mail.example.com, got %q (%v)", name, err)
+	}
+}
+
+// TEST 6: EncodeName writes plain labels
+// Tests the wire form of a name and the root, and a label that is too long
+func TestEncodeName(t *testing.T) {
+	var (
+		encoded []byte
+		name    string
+		err     error
+	)
+	if encoded, err = EncodeName("a.a.example.com."); err != nil {
+		t.Fatalf("EncodeName failed: %v", err)
+	}
+	if !bytes.Equal(encoded, []byte("\x01a\x01a\x07example\x03com\x00")) {
+		t.Errorf("Unexpected encoding %q", encoded)
+	}
+	if name, _, err = ReadName(encoded, 0); err != nil || name != "a.a.example.com" {
+		t.Errorf("Expected a.a.example.com back, got %q (%v)", name, err)
+	}
+
+	if encoded, err = EncodeName("."); err != nil || !bytes.Equal(encoded, []byte{0}) {
+		t.Errorf("Expected the root label, got %v (%v)", encoded, err)
+	}
+	if _, err = EncodeName(strings.Repeat("a", 64) + ".com"); err == nil {
+		t.Error("Expected an error for a label over 63 bytes")
+	}
+}
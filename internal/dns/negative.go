@@ -0,0 +1,74 @@
+package dns
+
+import (
+	"encoding/binary"
+)
+
+// soaMinimumSize is the smallest SOA rdata, two root names and five counters
+const soaMinimumSize int = 22
+
+// IsNegative reports a NXDOMAIN or a NODATA answer (NOERROR without any
+// answer records), the two negative responses of RFC 2308
+func IsNegative(response []byte) bool {
+	var (
+		header Header
+		err    error
+	)
+	if header, err = ParseHeader(response); err != nil {
+		return false
+	}
+
+	switch header.Rcode() {
+	case RCODE_NXDOMAIN:
+		return true
+	case RCODE_NOERROR:
+		return header.ANCount == 0
+	}
+
+	return false
+}
+
+// IsFailure reports a response with an rcode other than NOERROR and
+// NXDOMAIN, SERVFAIL, REFUSED, FORMERR, NOTIMP and the like say nothing
+// about the name and must not be cached for long
+func IsFailure(response []byte) bool {
+	var (
+		header Header
+		err    error
+	)
+	if header, err = ParseHeader(response); err != nil {
+		return false
+	}
+
+	return header.Rcode() != RCODE_NOERROR && header.Rcode() != RCODE_NXDOMAIN
+}
+
+// NegativeTTL returns how long a negative response may be cached, the
+// smaller of the SOA ttl and its MINIMUM field (RFC 2308 section 5).
+// without a SOA in the authority section the answer must not be cached
+// and the ttl is zero, the bool is false for positive responses
+func NegativeTTL(response []byte) (uint32, bool) {
+	if !IsNegative(response) {
+		return 0, false
+	}
+
+	var (
+		scanner RecordScanner
+		record  RecordHeader
+		minimum uint32
+	)
+	scanner.Reset(response)
+	for scanner.Next() {
+		if record = scanner.Record(); record.Section != SECTION_AUTHORITY || record.Type != TYPE_SOA {
+			continue
+		}
+		if record.DataLength < soaMinimumSize {
+			return 0, true
+		}
+
+		minimum = binary.BigEndian.Uint32(response[record.DataOffset+record.DataLength-4 : record.DataOffset+record.DataLength])
+		return min(record.TTL, minimum), true
+	}
+
+	return 0, true
+}
@@ -0,0 +1,102 @@
+package dns
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// buildNegative packs a response with rcode and, when soaTTL is not zero,
+// a SOA for example.com in the authority section
+func buildNegative(t *testing.T, rcode uint16, soaTTL uint32, minimum uint32) []byte {
+	var (
+		message  *Message = &Message{ID: 1, Flags: FLAG_QR | FLAG_RD | FLAG_RA | rcode}
+		rdata    []byte   = []byte{2, 'n', 's', 0, 4, 'h', 'o', 's', 't', 0}
+		response []byte
+		err      error
+	)
+	message.Questions = []Question{{Name: "missing.example.com", Type: TYPE_A, Class: CLASS_IN}}
+	if soaTTL != 0 {
+		rdata = binary.BigEndian.AppendUint32(rdata, 2024010101) // serial
+		rdata = binary.BigEndian.AppendUint32(rdata, 7200)       // refresh
+		rdata = binary.BigEndian.AppendUint32(rdata, 3600)       // retry
+		rdata = binary.BigEndian.AppendUint32(rdata, 1209600)    // expire
+		rdata = binary.BigEndian.AppendUint32(rdata, minimum)
+		message.Authorities = []Resource{{Name: "example.com", Type: TYPE_SOA, Class: CLASS_IN, TTL: soaTTL, Data: rdata}}
+	}
+
+	if response, err = message.Pack(); err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+
+	return response
+}
+
+// TEST 1: IsNegative recognizes NXDOMAIN and NODATA
+// Tests both negative kinds and that answers or other rcodes are not negative
+func TestIsNegative(t *testing.T) {
+	if !IsNegative(buildNegative(t, RCODE_NXDOMAIN, 0, 0)) {
+		t.Error("NXDOMAIN should be negative")
+	}
+	if !IsNegative(buildNegative(t, RCODE_NOERROR, 0, 0)) {
+		t.Error("NOERROR without answers should be negative")
+	}
+	if IsNegative(buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})) {
+		t.Error("An answer should not be negative")
+	}
+	if IsNegative(buildNegative(t, RCODE_SERVFAIL, 0, 0)) {
+		t.Error("SERVFAIL should not be negative")
+	}
+	if IsNegative([]byte{0, 1}) {
+		t.Error("A short message should not be negative")
+	}
+}
+
+// TEST 2: NegativeTTL uses the smaller of SOA ttl and MINIMUM
+// Tests both orders
+func TestNegativeTTL(t *testing.T) {
+	var (
+		ttl      uint32
+		negative bool
+	)
+
+	if ttl, negative = NegativeTTL(buildNegative(t, RCODE_NXDOMAIN, 3600, 300)); !negative || ttl != 300 {
+		t.Errorf("Expected MINIMUM 300, got %d (%v)", ttl, negative)
+	}
+	if ttl, negative = NegativeTTL(buildNegative(t, RCODE_NOERROR, 120, 900)); !negative || ttl != 120 {
+		t.Errorf("Expected SOA ttl 120, got %d (%v)", ttl, negative)
+	}
+}
+
+// TEST 3: NegativeTTL without SOA
+// Tests that a negative answer without SOA gets no ttl and positives are not negative
+func TestNegativeTTL_NoSOA(t *testing.T) {
+	var (
+		ttl      uint32
+		negative bool
+	)
+
+	if ttl, negative = NegativeTTL(buildNegative(t, RCODE_NXDOMAIN, 0, 0)); !negative || ttl != 0 {
+		t.Errorf("Expected negative with ttl 0, got %d (%v)", ttl, negative)
+	}
+	if _, negative = NegativeTTL(buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})); negative {
+		t.Error("A positive answer should not be negative")
+	}
+}
+
+// TEST 4: IsFailure recognizes error rcodes
+// Tests that only rcodes other than NOERROR and NXDOMAIN are failures
+func TestIsFailure(t *testing.T) {
+	for _, rcode := range []uint16{RCODE_FORMERR, RCODE_SERVFAIL, RCODE_NOTIMP, RCODE_REFUSED} {
+		if !IsFailure(buildNegative(t, rcode, 0, 0)) {
+			t.Errorf("Rcode %d should be a failure", rcode)
+		}
+	}
+	for _, rcode := range []uint16{RCODE_NOERROR, RCODE_NXDOMAIN} {
+		if IsFailure(buildNegative(t, rcode, 60, 60)) {
+			t.Errorf("Rcode %d should not be a failure", rcode)
+		}
+	}
+	if IsFailure([]byte{0, 1}) {
+		t.Error("A short message should not be a failure")
+	}
+}
@@ -0,0 +1,120 @@
+package dns
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var typeNames = map[string]uint16{
+	"A":     TYPE_A,
+	"NS":    TYPE_NS,
+	"CNAME": TYPE_CNAME,
+	"SOA":   TYPE_SOA,
+	"PTR":   TYPE_PTR,
+	"MX":    TYPE_MX,
+	"TXT":   TYPE_TXT,
+	"AAAA":  TYPE_AAAA,
+	"SRV":   TYPE_SRV,
+	"DNAME": TYPE_DNAME,
+	"OPT":   TYPE_OPT,
+	"DS":    TYPE_DS,
+	"HTTPS": TYPE_HTTPS,
+	"SVCB":  TYPE_SVCB,
+	"CAA":   TYPE_CAA,
+	"ANY":   TYPE_ANY,
+}
+
+// ParseType accepts a record type by name (AAAA) or number (28)
+func ParseType(value string) (uint16, bool) {
+	var (
+		qtype  uint16
+		found  bool
+		number uint64
+		err    error
+	)
+	if qtype, found = typeNames[strings.ToUpper(strings.TrimSpace(value))]; found {
+		return qtype, true
+	}
+
+	if number, err = strconv.ParseUint(value, 10, 16); err == nil {
+		return uint16(number), true
+	}
+
+	return 0, false
+}
+
+// BuildQuery creates a recursive query for domain
+func BuildQuery(id uint16, domain string, qtype uint16) ([]byte, error) {
+	var query *Message = &Message{
+		ID:        id,
+		Flags:     FLAG_RD,
+		Questions: []Question{{Name: strings.TrimSpace(domain), Type: qtype, Class: CLASS_IN}},
+	}
+
+	return query.Pack()
+}
+
+// DataString renders the rdata of the common types in presentation format,
+// anything else is shown as hex
+func (r Resource) DataString() string {
+	var (
+		name   string
+		second string
+		next   int
+		err    error
+		addr   netip.Addr
+		ok     bool
+	)
+	switch r.Type {
+	case TYPE_A, TYPE_AAAA:
+		if addr, ok = netip.AddrFromSlice(r.Data); ok && (len(r.Data) == 4 || len(r.Data) == 16) {
+			return addr.Unmap().String()
+		}
+
+	case TYPE_NS, TYPE_CNAME, TYPE_PTR, TYPE_DNAME:
+		if name, _, err = ReadName(r.Data, 0); err == nil {
+			return name + "."
+		}
+
+	case TYPE_MX:
+		if len(r.Data) >= 3 {
+			if name, _, err = ReadName(r.Data, 2); err == nil {
+				return fmt.Sprintf("%d %s.", binary.BigEndian.Uint16(r.Data[0:2]), name)
+			}
+		}
+
+	case TYPE_SOA:
+		if name, next, err = ReadName(r.Data, 0); err == nil {
+			if second, next, err = ReadName(r.Data, next); err == nil && next+20 == len(r.Data) {
+				return fmt.Sprintf("%s. %s. %d %d %d %d %d", name, second,
+					binary.BigEndian.Uint32(r.Data[next:next+4]),
+					binary.BigEndian.Uint32(r.Data[next+4:next+8]),
+					binary.BigEndian.Uint32(r.Data[next+8:next+12]),
+					binary.BigEndian.Uint32(r.Data[next+12:next+16]),
+					binary.BigEndian.Uint32(r.Data[next+16:next+20]))
+			}
+		}
+
+	case TYPE_TXT:
+		var (
+			parts  []string
+			offset int
+			size   int
+		)
+		for offset < len(r.Data) {
+			size = int(r.Data[offset])
+			if offset+1+size > len(r.Data) {
+				break
+			}
+			parts = append(parts, strconv.Quote(string(r.Data[offset+1:offset+1+size])))
+			offset += 1 + size
+		}
+		return strings.Join(parts, " ")
+	}
+
+	return hex.EncodeToString(r.Data)
+}
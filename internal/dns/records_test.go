@@ -0,0 +1,88 @@
+package dns
+
+import (
+	"testing"
+)
+
+// TEST 1: BuildQuery produces a parseable query
+// Tests that Parse reads back what BuildQuery wrote
+func TestBuildQuery(t *testing.T) {
+	var (
+		query   []byte
+		message *Message
+		err     error
+	)
+
+	query, err = BuildQuery(0x1111, "www.example.com.", 28)
+	if err != nil {
+		t.Fatalf("BuildQuery failed: %v", err)
+	}
+
+	message, err = Parse(query)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(message.Questions) != 1 || message.Questions[0].Name != "www.example.com" || message.Questions[0].Type != 28 {
+		t.Errorf("Expected www.example.com type 28, got %+v", message.Questions)
+	}
+	if message.ID != 0x1111 {
+		t.Errorf("Expected ID 0x1111, got 0x%04X", message.ID)
+	}
+	if message.Flags&FLAG_RD == 0 {
+		t.Error("RD bit should be set")
+	}
+}
+
+// TEST 2: BuildQuery rejects bad labels
+// Tests empty and oversized labels
+func TestBuildQuery_InvalidLabel(t *testing.T) {
+	var err error
+
+	if _, err = BuildQuery(0, "bad..example.com", 1); err == nil {
+		t.Error("Expected error for empty label")
+	}
+	if _, err = BuildQuery(0, string(make([]byte, 64))+".com", 1); err == nil {
+		t.Error("Expected error for label longer than 63 bytes")
+	}
+}
+
+// TEST 3: DataString renders the common types
+// Tests addresses, names and the hex fallback
+func TestResource_DataString(t *testing.T) {
+	var tests = []struct {
+		resource Resource
+		expected string
+	}{
+		{Resource{Type: TYPE_A, Data: []byte{192, 168, 1, 1}}, "192.168.1.1"},
+		{Resource{Type: TYPE_AAAA, Data: []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}}, "2001:db8::1"},
+		{Resource{Type: TYPE_CNAME, Data: []byte{3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}}, "www.example.com."},
+		{Resource{Type: TYPE_MX, Data: []byte{0, 10, 4, 'm', 'a', 'i', 'l', 0}}, "10 mail."},
+		{Resource{Type: TYPE_TXT, Data: []byte{5, 'h', 'e', 'l', 'l', 'o'}}, `"hello"`},
+		{Resource{Type: TYPE_CAA, Data: []byte{0xAB, 0xCD}}, "abcd"},
+	}
+
+	for _, test := range tests {
+		if result := test.resource.DataString(); result != test.expected {
+			t.Errorf("Type %d: expected %q, got %q", test.resource.Type, test.expected, result)
+		}
+	}
+}
+
+// TEST 4: ParseType accepts names and numbers
+// Tests the lookup used by the json api
+func TestParseType(t *testing.T) {
+	var (
+		qtype uint16
+		found bool
+	)
+
+	if qtype, found = ParseType("aaaa"); !found || qtype != 28 {
+		t.Errorf("Expected AAAA=28, got %d", qtype)
+	}
+	if qtype, found = ParseType("65"); !found || qtype != 65 {
+		t.Errorf("Expected 65, got %d", qtype)
+	}
+	if _, found = ParseType("bogus"); found {
+		t.Error("Unknown names should not be found")
+	}
+}
@@ -0,0 +1,156 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// sections as reported by RecordScanner
+const (
+	SECTION_ANSWER     int = 0
+	SECTION_AUTHORITY  int = 1
+	SECTION_ADDITIONAL int = 2
+)
+
+// ParseHeader reads the fixed header, it does not allocate
+func ParseHeader(message []byte) (Header, error) {
+	if len(message) < HEADER_SIZE {
+		return Header{}, fmt.Errorf("%w: %d bytes", errShortMessage, len(message))
+	}
+
+	return Header{
+		ID:      binary.BigEndian.Uint16(message[0:2]),
+		Flags:   binary.BigEndian.Uint16(message[2:4]),
+		QDCount: binary.BigEndian.Uint16(message[4:6]),
+		ANCount: binary.BigEndian.Uint16(message[6:8]),
+		NSCount: binary.BigEndian.Uint16(message[8:10]),
+		ARCount: binary.BigEndian.Uint16(message[10:12]),
+	}, nil
+}
+
+// QuestionEnd returns the offset where the question section ends
+func QuestionEnd(message []byte) (int, error) {
+	var (
+		header   Header
+		position int = HEADER_SIZE
+		err      error
+		i        int
+	)
+	if header, err = ParseHeader(message); err != nil {
+		return 0, err
+	}
+
+	for i = 0; i < int(header.QDCount); i++ {
+		if position, err = SkipName(message, position); err != nil {
+			return 0, err
+		}
+		position += 4 // QTYPE and QCLASS
+		if position > len(message) {
+			return 0, fmt.Errorf("question out of bounds")
+		}
+	}
+
+	return position, nil
+}
+
+// RecordHeader locates one record inside the message it was scanned from
+type RecordHeader struct {
+	Section    int
+	Offset     int // where the owner name starts
+	Type       uint16
+	Class      uint16
+	TTL        uint32
+	DataOffset int
+	DataLength int
+}
+
+// TTLOffset is where the ttl sits, for rewriting it in place
+func (r RecordHeader) TTLOffset() int {
+	return r.DataOffset - 6
+}
+
+// RecordScanner walks the records of a message in place without decoding
+// names or copying anything, for the hot paths that only need the fixed
+// fields:
+//
+//	var scanner dns.RecordScanner
+//	scanner.Reset(message)
+//	for scanner.Next() {
+//		record := scanner.Record()
+//	}
+//	err := scanner.Err()
+type RecordScanner struct {
+	message   []byte
+	position  int
+	section   int
+	remaining [3]int
+	record    RecordHeader
+	err       error
+}
+
+// Reset starts scanning message right after its question section
+func (s *RecordScanner) Reset(message []byte) {
+	*s = RecordScanner{message: message}
+	if s.position, s.err = QuestionEnd(message); s.err != nil {
+		return
+	}
+
+	s.remaining[SECTION_ANSWER] = int(binary.BigEndian.Uint16(message[6:8]))
+	s.remaining[SECTION_AUTHORITY] = int(binary.BigEndian.Uint16(message[8:10]))
+	s.remaining[SECTION_ADDITIONAL] = int(binary.BigEndian.Uint16(message[10:12]))
+}
+
+// Next moves to the following record, false at the end or on a malformed one
+func (s *RecordScanner) Next() bool {
+	if s.err != nil {
+		return false
+	}
+
+	for s.section < len(s.remaining) && s.remaining[s.section] == 0 {
+		s.section++
+	}
+	if s.section == len(s.remaining) {
+		return false
+	}
+	s.remaining[s.section]--
+
+	var (
+		start    int = s.position
+		position int
+		rdlength int
+	)
+	if position, s.err = SkipName(s.message, start); s.err != nil {
+		return false
+	}
+	if position+rrFixedFieldsSize > len(s.message) {
+		s.err = errRecordBounds
+		return false
+	}
+
+	rdlength = int(binary.BigEndian.Uint16(s.message[position+8 : position+10]))
+	if position+rrFixedFieldsSize+rdlength > len(s.message) {
+		s.err = errRecordBounds
+		return false
+	}
+
+	s.record = RecordHeader{
+		Section:    s.section,
+		Offset:     start,
+		Type:       binary.BigEndian.Uint16(s.message[position : position+2]),
+		Class:      binary.BigEndian.Uint16(s.message[position+2 : position+4]),
+		TTL:        binary.BigEndian.Uint32(s.message[position+4 : position+8]),
+		DataOffset: position + rrFixedFieldsSize,
+		DataLength: rdlength,
+	}
+	s.position = position + rrFixedFieldsSize + rdlength
+
+	return true
+}
+
+func (s *RecordScanner) Record() RecordHeader {
+	return s.record
+}
+
+func (s *RecordScanner) Err() error {
+	return s.err
+}
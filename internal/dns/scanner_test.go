@@ -0,0 +1,110 @@
+package dns
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// TEST 1: ParseHeader reads the counts
+// Tests the fixed header and the short message error
+func TestParseHeader(t *testing.T) {
+	var (
+		header Header
+		err    error
+	)
+
+	header, err = ParseHeader(buildDNSResponseMultiple("example.com", []uint32{1, 2, 3}))
+
+	if err != nil {
+		t.Fatalf("ParseHeader failed: %v", err)
+	}
+	if header.ID != 0x1234 || header.QDCount != 1 || header.ANCount != 3 || header.Rcode() != RCODE_NOERROR {
+		t.Errorf("Unexpected header %+v", header)
+	}
+	if _, err = ParseHeader(make([]byte, 11)); err == nil {
+		t.Error("Expected error for a short header")
+	}
+}
+
+// TEST 2: RecordScanner visits every record in order
+// Tests sections, ttls and rdata offsets
+func TestRecordScanner(t *testing.T) {
+	var (
+		response []byte = SetEDNS0(buildDNSResponseMultiple("example.com", []uint32{300, 60}), 1232)
+		scanner  RecordScanner
+		records  []RecordHeader
+	)
+
+	scanner.Reset(response)
+	for scanner.Next() {
+		records = append(records, scanner.Record())
+	}
+
+	if scanner.Err() != nil {
+		t.Fatalf("Scanner failed: %v", scanner.Err())
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(records))
+	}
+	if records[0].Section != SECTION_ANSWER || records[0].TTL != 300 || records[1].TTL != 60 {
+		t.Errorf("Unexpected answers %+v %+v", records[0], records[1])
+	}
+	if records[2].Section != SECTION_ADDITIONAL || records[2].Type != TYPE_OPT {
+		t.Errorf("Expected the OPT record last, got %+v", records[2])
+	}
+	if response[records[1].DataOffset+3] != 2 || records[1].DataLength != 4 {
+		t.Errorf("Rdata offset points at the wrong bytes")
+	}
+	if binary.BigEndian.Uint32(response[records[1].TTLOffset():]) != 60 {
+		t.Error("TTLOffset should point at the ttl")
+	}
+}
+
+// TEST 3: RecordScanner stops on malformed records
+// Tests that a count past the end of the message is reported
+func TestRecordScanner_Malformed(t *testing.T) {
+	var (
+		response []byte = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		scanner  RecordScanner
+		count    int
+	)
+	binary.BigEndian.PutUint16(response[6:8], 2)
+
+	scanner.Reset(response)
+	for scanner.Next() {
+		count++
+	}
+
+	if count != 1 {
+		t.Errorf("Expected 1 record before the error, got %d", count)
+	}
+	if scanner.Err() == nil {
+		t.Error("Expected an error for the missing record")
+	}
+}
+
+// TEST 4: Scanning does not allocate
+// Tests the hot path used for ttl extraction
+func TestRecordScanner_NoAllocation(t *testing.T) {
+	var (
+		response []byte = buildDNSResponseMultiple("example.com", []uint32{300, 60, 30})
+		scanner  RecordScanner
+		minTTL   uint32
+		allocs   float64
+	)
+
+	allocs = testing.AllocsPerRun(100, func() {
+		minTTL = 3600
+		scanner.Reset(response)
+		for scanner.Next() {
+			minTTL = min(minTTL, scanner.Record().TTL)
+		}
+	})
+
+	if allocs != 0 {
+		t.Errorf("Expected no allocations, got %.1f", allocs)
+	}
+	if minTTL != 30 {
+		t.Errorf("Expected minimum TTL 30, got %d", minTTL)
+	}
+}
@@ -0,0 +1,52 @@
+package dns
+
+import (
+	"encoding/binary"
+)
+
+// DecrementTTLs lowers the ttl of every record by elapsed seconds in place,
+// stopping at zero. used on cached answers so clients only keep them for
+// the lifetime that is left
+func DecrementTTLs(message []byte, elapsed uint32) error {
+	return rewriteTTLs(message, func(ttl uint32) uint32 {
+		if ttl <= elapsed {
+			return 0
+		}
+		return ttl - elapsed
+	})
+}
+
+// SetTTLs overwrites the ttl of every record in place
+func SetTTLs(message []byte, ttl uint32) error {
+	return rewriteTTLs(message, func(uint32) uint32 {
+		return ttl
+	})
+}
+
+// CapTTLs lowers every ttl above limit to limit in place
+func CapTTLs(message []byte, limit uint32) error {
+	return rewriteTTLs(message, func(ttl uint32) uint32 {
+		return min(ttl, limit)
+	})
+}
+
+// rewriteTTLs skips the OPT pseudo record, its ttl field carries the
+// extended rcode, version and flags
+func rewriteTTLs(message []byte, rewrite func(uint32) uint32) error {
+	var (
+		scanner RecordScanner
+		record  RecordHeader
+		offset  int
+	)
+	scanner.Reset(message)
+	for scanner.Next() {
+		if record = scanner.Record(); record.Type == TYPE_OPT {
+			continue
+		}
+
+		offset = record.TTLOffset()
+		binary.BigEndian.PutUint32(message[offset:offset+4], rewrite(record.TTL))
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,94 @@
+package dns
+
+import (
+	"testing"
+)
+
+// ttls collects the ttl of every record, OPT included
+func ttls(message []byte) []uint32 {
+	var (
+		scanner RecordScanner
+		result  []uint32
+	)
+	scanner.Reset(message)
+	for scanner.Next() {
+		result = append(result, scanner.Record().TTL)
+	}
+
+	return result
+}
+
+// TEST 1: DecrementTTLs subtracts the elapsed time
+// Tests every answer is lowered and none goes below zero
+func TestDecrementTTLs(t *testing.T) {
+	var (
+		response []byte = buildDNSResponseMultiple("example.com", []uint32{300, 60, 3600})
+		result   []uint32
+		err      error
+	)
+
+	if err = DecrementTTLs(response, 100); err != nil {
+		t.Fatalf("DecrementTTLs failed: %v", err)
+	}
+
+	result = ttls(response)
+	if len(result) != 3 || result[0] != 200 || result[1] != 0 || result[2] != 3500 {
+		t.Errorf("Expected [200 0 3500], got %v", result)
+	}
+}
+
+// TEST 2: SetTTLs leaves the OPT record alone
+// Tests that the extended rcode and flags of OPT are not overwritten
+func TestSetTTLs_SkipsOPT(t *testing.T) {
+	var (
+		response []byte = SetEDNS0(buildDNSResponseMultiple("example.com", []uint32{300, 60}), 1232)
+		opt      RecordHeader
+		found    bool
+		result   []uint32
+		err      error
+	)
+	opt, found = findOPT(response)
+	if !found {
+		t.Fatal("Expected an OPT record")
+	}
+
+	if err = SetTTLs(response, 30); err != nil {
+		t.Fatalf("SetTTLs failed: %v", err)
+	}
+
+	result = ttls(response)
+	if len(result) != 3 || result[0] != 30 || result[1] != 30 {
+		t.Errorf("Expected answers at 30, got %v", result)
+	}
+	if result[2] != opt.TTL {
+		t.Errorf("OPT ttl field changed from %d to %d", opt.TTL, result[2])
+	}
+}
+
+// TEST 3: Malformed messages are reported
+// Tests that a truncated record returns an error
+func TestDecrementTTLs_Malformed(t *testing.T) {
+	var response []byte = buildDNSResponseMultiple("example.com", []uint32{300})
+
+	if err := DecrementTTLs(response[:len(response)-2], 10); err == nil {
+		t.Error("Expected error for a truncated record")
+	}
+}
+
+// TEST 4: CapTTLs only lowers
+// Tests that ttls above the limit are capped and the others kept
+func TestCapTTLs(t *testing.T) {
+	var (
+		response []byte = buildDNSResponseMultiple("example.com", []uint32{300, 60, 3600})
+		result   []uint32
+	)
+
+	if err := CapTTLs(response, 100); err != nil {
+		t.Fatalf("CapTTLs failed: %v", err)
+	}
+
+	result = ttls(response)
+	if len(result) != 3 || result[0] != 100 || result[1] != 60 || result[2] != 100 {
+		t.Errorf("Expected [100 60 100], got %v", result)
+	}
+}
@@ -0,0 +1,113 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+)
+
+var (
+	ErrNotResponse      error = errors.New("message is not a response")
+	ErrIDMismatch       error = errors.New("transaction ID does not match the query")
+	ErrQuestionMismatch error = errors.New("question does not match the query")
+)
+
+// MatchResponse checks that response answers query, the QR bit must be set
+// and the ID and question section (name, type and class) must be the ones
+// sent. exactCase compares the names byte for byte, which is what makes
+// 0x20 case randomization worth anything, otherwise case is ignored
+func MatchResponse(query []byte, response []byte, exactCase bool) error {
+	var (
+		queryHeader    Header
+		responseHeader Header
+		end            int
+		err            error
+	)
+	if queryHeader, err = ParseHeader(query); err != nil {
+		return err
+	}
+	if responseHeader, err = ParseHeader(response); err != nil {
+		return err
+	}
+
+	if responseHeader.Flags&FLAG_QR == 0 {
+		return ErrNotResponse
+	}
+	if responseHeader.ID != queryHeader.ID {
+		return fmt.Errorf("%w: sent %d, got %d", ErrIDMismatch, queryHeader.ID, responseHeader.ID)
+	}
+
+	if end, err = QuestionEnd(query); err != nil {
+		return err
+	}
+	if responseHeader.QDCount != queryHeader.QDCount || len(response) < end {
+		return ErrQuestionMismatch
+	}
+	if !equalQuestion(query[HEADER_SIZE:end], response[HEADER_SIZE:end], exactCase) {
+		return ErrQuestionMismatch
+	}
+
+	return nil
+}
+
+// equalQuestion compares two question sections, label lengths never go
+// above 63 so folding only ever touches letters
+func equalQuestion(a []byte, b []byte, exactCase bool) bool {
+	if exactCase {
+		return bytes.Equal(a, b)
+	}
+
+	for i := range a {
+		if toLower(a[i]) != toLower(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+
+	return c
+}
+
+// RandomizeCase returns a copy of query with the letters of its question
+// names in random case (DNS 0x20), a spoofed answer has to guess them too.
+// a query that does not parse is copied unchanged
+func RandomizeCase(query []byte) []byte {
+	var (
+		result   []byte = bytes.Clone(query)
+		end      int
+		err      error
+		position int = HEADER_SIZE
+		length   int
+		i        int
+	)
+	if end, err = QuestionEnd(result); err != nil {
+		return result
+	}
+
+	for position < end {
+		if length = int(result[position]); length == 0 || length&0xC0 == 0xC0 {
+			// end of this name, skip the pointer and QTYPE/QCLASS
+			position += 5
+			if length != 0 {
+				position++
+			}
+			continue
+		}
+
+		for i = position + 1; i <= position+length; i++ {
+			if c := result[i] | 0x20; c >= 'a' && c <= 'z' && rand.IntN(2) == 1 {
+				result[i] ^= 0x20
+			}
+		}
+		position += length + 1
+	}
+
+	return result
+}
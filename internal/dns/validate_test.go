@@ -0,0 +1,117 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TEST 1: MatchResponse accepts the answer to the query
+// Tests a matching ID and question, with and without exact case
+func TestMatchResponse(t *testing.T) {
+	var (
+		query    []byte
+		response []byte
+		err      error
+	)
+	if query, err = BuildQuery(0x1234, "example.com", TYPE_A); err != nil {
+		t.Fatalf("BuildQuery failed: %v", err)
+	}
+	response = bytes.Clone(query)
+	binary.BigEndian.PutUint16(response[2:4], FLAG_QR|FLAG_RA)
+
+	if err = MatchResponse(query, response, true); err != nil {
+		t.Errorf("Expected a match, got %v", err)
+	}
+
+	copy(response[HEADER_SIZE+1:], "EXAMPLE")
+	if err = MatchResponse(query, response, false); err != nil {
+		t.Errorf("Expected case to be ignored, got %v", err)
+	}
+	if err = MatchResponse(query, response, true); !errors.Is(err, ErrQuestionMismatch) {
+		t.Errorf("Expected a question mismatch with exact case, got %v", err)
+	}
+}
+
+// TEST 2: MatchResponse rejects forged answers
+// Tests the QR bit, the ID, the name, the type and the class
+func TestMatchResponse_Rejects(t *testing.T) {
+	var (
+		query    []byte
+		response []byte
+		end      int
+		err      error
+		tests    = []struct {
+			name     string
+			change   func(response []byte)
+			expected error
+		}{
+			{"query echoed back", func(r []byte) { binary.BigEndian.PutUint16(r[2:4], 0) }, ErrNotResponse},
+			{"other ID", func(r []byte) { binary.BigEndian.PutUint16(r[0:2], 0x4321) }, ErrIDMismatch},
+			{"other name", func(r []byte) { r[HEADER_SIZE+1] = 'x' }, ErrQuestionMismatch},
+			{"other type", func(r []byte) { binary.BigEndian.PutUint16(r[end-4:end-2], TYPE_AAAA) }, ErrQuestionMismatch},
+			{"other class", func(r []byte) { binary.BigEndian.PutUint16(r[end-2:end], 3) }, ErrQuestionMismatch},
+			{"no question", func(r []byte) { binary.BigEndian.PutUint16(r[4:6], 0) }, ErrQuestionMismatch},
+		}
+	)
+	if query, err = BuildQuery(0x1234, "example.com", TYPE_A); err != nil {
+		t.Fatalf("BuildQuery failed: %v", err)
+	}
+	end, _ = QuestionEnd(query)
+
+	for _, test := range tests {
+		response = bytes.Clone(query)
+		binary.BigEndian.PutUint16(response[2:4], FLAG_QR)
+		test.change(response)
+
+		if err = MatchResponse(query, response, false); !errors.Is(err, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+
+	if err = MatchResponse(query, response[:HEADER_SIZE+3], false); err == nil {
+		t.Error("Expected an error for a short response")
+	}
+}
+
+// TEST 3: RandomizeCase only changes the case of the question name
+// Tests that the copy keeps its length, labels, type and class
+func TestRandomizeCase(t *testing.T) {
+	var (
+		query      []byte
+		randomized []byte
+		response   []byte
+		name       []byte
+		err        error
+		changed    bool
+		i          int
+	)
+	if query, err = BuildQuery(0x1234, "www.some-example.com", TYPE_AAAA); err != nil {
+		t.Fatalf("BuildQuery failed: %v", err)
+	}
+
+	for i = 0; i < 20 && !changed; i++ {
+		randomized = RandomizeCase(query)
+		if len(randomized) != len(query) {
+			t.Fatalf("Length changed from %d to %d", len(query), len(randomized))
+		}
+		response = bytes.Clone(randomized)
+		binary.BigEndian.PutUint16(response[2:4], FLAG_QR)
+		if err = MatchResponse(query, response, false); err != nil {
+			t.Fatalf("Randomized query should match ignoring case: %v", err)
+		}
+		changed = !bytes.Equal(query, randomized)
+	}
+	if !changed {
+		t.Error("Expected the case to change at least once in 20 tries")
+	}
+
+	if name, _, err = AppendName(nil, randomized, HEADER_SIZE); err != nil || strings.ToLower(string(name)) != "www.some-example.com" {
+		t.Errorf("Unexpected name %q (%v)", name, err)
+	}
+	if !bytes.Equal(RandomizeCase(query[:5]), query[:5]) {
+		t.Error("A malformed query should be copied unchanged")
+	}
+}
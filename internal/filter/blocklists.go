@@ -0,0 +1,304 @@
+package filter
+
+import (
+	"context"
+	"errors"
+	"flash-dns/internal/logger"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_LIST_DIR     string        = "/var/lib/flash-dns/lists" // where remote lists are kept between runs
+	DEFAULT_LIST_REFRESH time.Duration = 24 * time.Hour             // how often remote lists are downloaded again
+	DIFF_LOG_LIMIT       int           = 10                         // rules named in the log of a reload, the rest are counted
+)
+
+// BlocklistsConfig is what the filter is built from
+type BlocklistsConfig struct {
+	Lists        []List
+	AllowFile    string   // allowlist file, empty for none
+	AllowDomains []string // domains that are never blocked
+	CacheDir     string   // last-known-good copies of the remote lists, default to DEFAULT_LIST_DIR
+}
+
+// Blocklists answers from a FilterList built out of every list and the
+// allowlist. a rebuilt filter takes the place of the old one atomically,
+// queries keep being answered by the old one until the new one is ready
+type Blocklists struct {
+	config     BlocklistsConfig
+	client     *http.Client
+	current    atomic.Pointer[FilterList]
+	watchDelay time.Duration
+
+	mu sync.Mutex // one download or rebuild at a time
+}
+
+func NewBlocklists(config BlocklistsConfig) *Blocklists {
+	if config.CacheDir == "" {
+		config.CacheDir = DEFAULT_LIST_DIR
+	}
+
+	var blocklists *Blocklists = &Blocklists{
+		config:     config,
+		client:     &http.Client{Timeout: DOWNLOAD_TIMEOUT},
+		watchDelay: WATCH_DELAY,
+	}
+	blocklists.current.Store(NewFilterList())
+
+	return blocklists
+}
+
+func (b *Blocklists) Check(query Query) Verdict {
+	return b.current.Load().Check(query)
+}
+
+func (b *Blocklists) Count() int {
+	return b.current.Load().Count()
+}
+
+// Filter is the filter queries are answered from right now
+func (b *Blocklists) Filter() *FilterList {
+	return b.current.Load()
+}
+
+// Load downloads the remote lists and builds the first filter, a remote
+// list that can not be downloaded is read from its last-known-good copy.
+// lists that fail to load are reported and left out
+func (b *Blocklists) Load(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var (
+		filterList *FilterList
+		err        error
+	)
+	// local lists alone never need the directory
+	if b.hasRemote() {
+		if err = os.MkdirAll(b.config.CacheDir, 0o755); err != nil {
+			logger.Warn(fmt.Sprintf("Remote lists will not be kept on disk: %v", err))
+		}
+	}
+	b.downloadAll(ctx)
+
+	filterList, err = b.build()
+	b.current.Store(filterList)
+	logger.Info(fmt.Sprintf("Blocklists loaded: %d rules, %d allowed", filterList.Count(), filterList.AllowCount()))
+
+	return err
+}
+
+// Refresh downloads the remote lists again and swaps in a new filter when
+// one of them changed, a list failing to load keeps the current filter
+func (b *Blocklists) Refresh(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.downloadAll(ctx) {
+		return nil
+	}
+
+	return b.rebuild("refreshed")
+}
+
+// Reload builds the filter again from the files on disk, remote lists from
+// their last downloaded copy, and swaps it in. a list failing to load
+// keeps the current filter
+func (b *Blocklists) Reload() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.rebuild("reloaded")
+}
+
+// rebuild swaps in a new filter and logs the rules it adds and removes,
+// must be called with b.mu held
+func (b *Blocklists) rebuild(action string) error {
+	var (
+		previous   *FilterList = b.current.Load()
+		filterList *FilterList
+		added      []string
+		removed    []string
+		err        error
+	)
+	if filterList, err = b.build(); err != nil {
+		return fmt.Errorf("keeping the current filter: %w", err)
+	}
+	b.current.Store(filterList)
+
+	added, removed = diffRules(previous, filterList)
+	logger.Info(fmt.Sprintf("Blocklists %s: %d rules, %d allowed, %d rules added%s, %d removed%s", action, filterList.Count(), filterList.AllowCount(), len(added), sample(added), len(removed), sample(removed)))
+
+	return nil
+}
+
+// diffRules lists the rules only next has and only previous has, blocked
+// domains and patterns, rules with modifiers and exceptions alike
+func diffRules(previous *FilterList, next *FilterList) ([]string, []string) {
+	var (
+		before  map[string]bool = previous.ruleSet()
+		after   map[string]bool = next.ruleSet()
+		added   []string
+		removed []string
+	)
+	for text := range after {
+		if !before[text] {
+			added = append(added, text)
+		}
+	}
+	for text := range before {
+		if !after[text] {
+			removed = append(removed, text)
+		}
+	}
+	slices.Sort(added)
+	slices.Sort(removed)
+
+	return added, removed
+}
+
+// ruleSet names every rule of the filter the way the diff log shows it,
+// domains bare, patterns between slashes and exceptions after @@
+func (f *FilterList) ruleSet() map[string]bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var set map[string]bool = make(map[string]bool, len(f.domains)+len(f.allowed))
+	for domain := range f.domains {
+		set[domain] = true
+	}
+	for domain := range f.allowed {
+		set["@@"+domain] = true
+	}
+	for _, pattern := range f.patterns.rules {
+		set["/"+pattern.String()+"/"] = true
+	}
+	for _, pattern := range f.allowedPatterns.rules {
+		set["@@/"+pattern.String()+"/"] = true
+	}
+	for _, rules := range f.rules {
+		for _, r := range rules {
+			set[r.text] = true
+		}
+	}
+	for _, r := range f.patternRules {
+		set[r.text] = true
+	}
+
+	return set
+}
+
+// sample names the first DIFF_LOG_LIMIT rules for the log
+func sample(rules []string) string {
+	switch {
+	case len(rules) == 0:
+		return ""
+	case len(rules) > DIFF_LOG_LIMIT:
+		return fmt.Sprintf(" (%s, ...)", strings.Join(rules[:DIFF_LOG_LIMIT], ", "))
+	}
+
+	return fmt.Sprintf(" (%s)", strings.Join(rules, ", "))
+}
+
+// Run refreshes the remote lists every interval until ctx is done
+func (b *Blocklists) Run(ctx context.Context, interval time.Duration) {
+	var ticker *time.Ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := b.Refresh(ctx); err != nil {
+				logger.Error(fmt.Sprintf("Failed to refresh blocklists: %v", err))
+			}
+		}
+	}
+}
+
+// downloadAll fetches every enabled remote list and reports whether one
+// of them changed, failures leave the copy on disk alone
+func (b *Blocklists) downloadAll(ctx context.Context) bool {
+	var (
+		changed bool
+		updated bool
+		err     error
+	)
+	for _, list := range b.config.Lists {
+		if !list.Enabled || !list.Remote() {
+			continue
+		}
+
+		if updated, err = b.download(ctx, list); err != nil {
+			logger.Warn(fmt.Sprintf("Failed to download list %s, using the copy on disk: %v", list.Name, err))
+			continue
+		}
+		changed = changed || updated
+	}
+
+	return changed
+}
+
+// hasRemote reports whether an enabled list is downloaded
+func (b *Blocklists) hasRemote() bool {
+	for _, list := range b.config.Lists {
+		if list.Enabled && list.Remote() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// build reads every list into a new filter, remote lists from their copy.
+// the filter is complete when an error is returned, less the failed lists
+func (b *Blocklists) build() (*FilterList, error) {
+	var (
+		filterList *FilterList = NewFilterList()
+		stats      LoadStats
+		errs       []error
+		err        error
+	)
+	for _, list := range b.config.Lists {
+		if list.Remote() {
+			list.Path = b.copyPath(list)
+			// never downloaded yet, it must not hold back the other lists
+			if _, err = os.Stat(list.Path); list.Enabled && os.IsNotExist(err) {
+				logger.Warn(fmt.Sprintf("List %s has no copy on disk yet, skipping it", list.Name))
+				continue
+			}
+		}
+		// an empty list is most likely a file caught halfway through a write
+		if stats, err = filterList.LoadList(list); err != nil {
+			errs = append(errs, err)
+		} else if list.Enabled && stats.Parsed == 0 {
+			errs = append(errs, fmt.Errorf("list %s holds no rule", list.Name))
+		}
+	}
+
+	if b.config.AllowFile != "" {
+		if err = filterList.LoadAllowlistFromFile(b.config.AllowFile); err != nil {
+			errs = append(errs, fmt.Errorf("allowlist: %w", err))
+		}
+	}
+	for _, domain := range b.config.AllowDomains {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			filterList.Allow(domain)
+		}
+	}
+
+	return filterList, errors.Join(errs...)
+}
+
+// copyPath is where the last-known-good copy of a remote list is kept
+func (b *Blocklists) copyPath(list List) string {
+	return filepath.Join(b.config.CacheDir, list.Name+".txt")
+}
@@ -0,0 +1,386 @@
+package filter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listServer serves a blocklist the test can change, with an ETag and a
+// Last-Modified when asked for
+type listServer struct {
+	mu           sync.Mutex
+	content      string
+	etag         string
+	lastModified time.Time
+	status       int // answered instead of the list when set
+	requests     atomic.Int32
+	conditional  atomic.Int32 // requests answered with 304
+}
+
+func (l *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.requests.Add(1)
+
+	if l.status != 0 {
+		w.WriteHeader(l.status)
+		return
+	}
+	if l.etag != "" {
+		w.Header().Set("ETag", l.etag)
+		if r.Header.Get("If-None-Match") == l.etag {
+			l.conditional.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if !l.lastModified.IsZero() {
+		w.Header().Set("Last-Modified", l.lastModified.UTC().Format(http.TimeFormat))
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !l.lastModified.Truncate(time.Second).After(since) {
+			l.conditional.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.Write([]byte(l.content))
+}
+
+func (l *listServer) set(content string, etag string, lastModified time.Time, status int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.content, l.etag, l.lastModified, l.status = content, etag, lastModified, status
+}
+
+// startListServer serves a list and returns Blocklists reading it
+func startListServer(t *testing.T, content string, etag string) (*listServer, *httptest.Server, *Blocklists) {
+	var (
+		handler *listServer      = &listServer{content: content, etag: etag}
+		server  *httptest.Server = httptest.NewServer(handler)
+	)
+	t.Cleanup(server.Close)
+
+	return handler, server, NewBlocklists(BlocklistsConfig{
+		Lists:    []List{{Name: "remote", Path: server.URL + "/list.txt", Format: FORMAT_ADBLOCK, Enabled: true}},
+		CacheDir: t.TempDir(),
+	})
+}
+
+// TEST 1: Downloading a remote list
+// Tests that the list is blocked from, kept on disk and asked again with
+// its ETag, a 304 keeps the current filter
+func TestBlocklists_Load_Remote(t *testing.T) {
+	var (
+		ctx        context.Context = context.Background()
+		handler    *listServer
+		blocklists *Blocklists
+		current    *FilterList
+		err        error
+	)
+	handler, _, blocklists = startListServer(t, "||ads.com^\n||tracker.com^\n", `"v1"`)
+	blocklists.config.AllowDomains = []string{"tracker.com"}
+
+	if err = blocklists.Load(ctx); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if verdict := blocklists.Check(Query{Domain: "ads.com"}); !verdict.Blocked || verdict.List != "remote" {
+		t.Errorf("ads.com should be blocked by the remote list, got %+v", verdict)
+	}
+	if blocklists.Check(Query{Domain: "tracker.com"}).Blocked {
+		t.Error("The allowlist should apply to remote lists")
+	}
+	if _, err = os.Stat(blocklists.copyPath(blocklists.config.Lists[0])); err != nil {
+		t.Errorf("Expected a copy on disk: %v", err)
+	}
+
+	current = blocklists.Filter()
+	if err = blocklists.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if handler.conditional.Load() != 1 {
+		t.Errorf("Expected the refresh to be answered 304, got %d of %d requests", handler.conditional.Load(), handler.requests.Load())
+	}
+	if blocklists.Filter() != current {
+		t.Error("An unchanged list should not rebuild the filter")
+	}
+}
+
+// TEST 2: Refreshing a changed list
+// Tests If-Modified-Since and that the new rules are swapped in
+func TestBlocklists_Refresh_LastModified(t *testing.T) {
+	var (
+		ctx        context.Context = context.Background()
+		handler    *listServer
+		blocklists *Blocklists
+		modified   time.Time = time.Now().Add(-time.Hour)
+	)
+	handler, _, blocklists = startListServer(t, "", "")
+	handler.set("||ads.com^\n", "", modified, 0)
+
+	if err := blocklists.Load(ctx); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := blocklists.Refresh(ctx); err != nil || handler.conditional.Load() != 1 {
+		t.Fatalf("Expected a 304 for an unmodified list, err %v", err)
+	}
+
+	handler.set("||tracker.com^\n", "", time.Now(), 0)
+	if err := blocklists.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if !blocklists.Check(Query{Domain: "tracker.com"}).Blocked || blocklists.Check(Query{Domain: "ads.com"}).Blocked {
+		t.Error("The refreshed list should replace the old rules")
+	}
+}
+
+// TEST 3: Offline start
+// Tests that the copy on disk is used when the list can not be downloaded
+// and the list is skipped when there is none
+func TestBlocklists_Load_Offline(t *testing.T) {
+	var (
+		ctx        context.Context = context.Background()
+		server     *httptest.Server
+		blocklists *Blocklists
+	)
+	_, server, blocklists = startListServer(t, "||ads.com^\n", "")
+	if err := blocklists.Load(ctx); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	server.Close()
+
+	blocklists = NewBlocklists(blocklists.config)
+	if err := blocklists.Load(ctx); err != nil {
+		t.Fatalf("Load should fall back to the copy on disk: %v", err)
+	}
+	if !blocklists.Check(Query{Domain: "ads.com"}).Blocked {
+		t.Error("ads.com should be blocked from the copy on disk")
+	}
+
+	blocklists = NewBlocklists(BlocklistsConfig{Lists: blocklists.config.Lists, CacheDir: t.TempDir()})
+	if err := blocklists.Load(ctx); err != nil {
+		t.Errorf("A list without a download nor a copy should be skipped: %v", err)
+	}
+	if blocklists.Check(Query{Domain: "ads.com"}).Blocked {
+		t.Error("ads.com should not be blocked without a copy")
+	}
+}
+
+// TEST 4: Bad downloads keep the last-known-good copy
+// Tests that errors and lists without rules do not replace the copy
+func TestBlocklists_Refresh_BadDownload(t *testing.T) {
+	var (
+		ctx        context.Context = context.Background()
+		handler    *listServer
+		blocklists *Blocklists
+		current    *FilterList
+	)
+	handler, _, blocklists = startListServer(t, "||ads.com^\n", "")
+	if err := blocklists.Load(ctx); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	current = blocklists.Filter()
+
+	handler.set("", "", time.Time{}, http.StatusInternalServerError)
+	blocklists.Refresh(ctx)
+	handler.set("<html><body>Service Unavailable</body></html>\n", "", time.Time{}, 0)
+	blocklists.Refresh(ctx)
+
+	if blocklists.Filter() != current {
+		t.Error("Failed downloads should keep the current filter")
+	}
+
+	blocklists = NewBlocklists(blocklists.config)
+	handler.set("", "", time.Time{}, http.StatusNotFound)
+	blocklists.Load(ctx)
+	if !blocklists.Check(Query{Domain: "ads.com"}).Blocked {
+		t.Error("The copy on disk should still hold the good list")
+	}
+}
+
+// TEST 5: Swapping under load
+// Tests that queries keep being answered while the filter is replaced
+func TestBlocklists_Refresh_Concurrent(t *testing.T) {
+	var (
+		ctx        context.Context = context.Background()
+		handler    *listServer
+		blocklists *Blocklists
+		stop       chan struct{} = make(chan struct{})
+		wg         sync.WaitGroup
+		missed     atomic.Int32
+	)
+	handler, _, blocklists = startListServer(t, "||ads.com^\n", "")
+	if err := blocklists.Load(ctx); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if !blocklists.Check(Query{Domain: "ads.com"}).Blocked {
+					missed.Add(1)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		handler.set("||ads.com^\n||tracker"+string(rune('a'+i))+".com^\n", "", time.Time{}, 0)
+		if err := blocklists.Refresh(ctx); err != nil {
+			t.Errorf("Refresh failed: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if missed.Load() != 0 {
+		t.Errorf("ads.com was let through %d times during the swaps", missed.Load())
+	}
+	if !blocklists.Check(Query{Domain: "trackerj.com"}).Blocked {
+		t.Error("The last refresh should be in use")
+	}
+}
+
+// TEST 6: Reloading from disk
+// Tests that changed files are swapped in with their diff, patterns
+// included, and a list that can not be read or lost its rules keeps the
+// current filter
+func TestBlocklists_Reload(t *testing.T) {
+	var (
+		filename   string = writeList(t, "||ads.com^\n||tracker.com^\n")
+		blocklists *Blocklists
+		current    *FilterList
+		added      []string
+		removed    []string
+	)
+	blocklists = NewBlocklists(BlocklistsConfig{Lists: []List{{Name: "local", Path: filename, Format: FORMAT_ADBLOCK, Enabled: true}}, CacheDir: t.TempDir()})
+	if err := blocklists.Load(context.Background()); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	current = blocklists.Filter()
+
+	os.WriteFile(filename, []byte("||ads.com^\n||metrics.com^\n||pixel.com^\n"), 0o644)
+	if err := blocklists.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if !blocklists.Check(Query{Domain: "metrics.com"}).Blocked || blocklists.Check(Query{Domain: "tracker.com"}).Blocked {
+		t.Error("The reloaded rules should be in use")
+	}
+	if added, removed = diffRules(current, blocklists.Filter()); len(added) != 2 || added[0] != "metrics.com" || len(removed) != 1 || removed[0] != "tracker.com" {
+		t.Errorf("Expected metrics.com and pixel.com added, tracker.com removed, got %v and %v", added, removed)
+	}
+
+	current = blocklists.Filter()
+	os.WriteFile(filename, []byte("||ads.com^\n||metrics.com^\n||pixel.com^\n/^track[0-9]+\\.com$/\n"), 0o644)
+	if err := blocklists.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if added, removed = diffRules(current, blocklists.Filter()); len(added) != 1 || added[0] != `/^track[0-9]+\.com$/` || len(removed) != 0 {
+		t.Errorf("Expected only the regex added, got %v and %v", added, removed)
+	}
+
+	current = blocklists.Filter()
+	for _, content := range []string{"", "! nothing left\n"} {
+		os.WriteFile(filename, []byte(content), 0o644)
+		if err := blocklists.Reload(); err == nil {
+			t.Errorf("Expected an error for a list with %q", content)
+		}
+	}
+	os.Remove(filename)
+	if err := blocklists.Reload(); err == nil {
+		t.Error("Expected an error for a missing list")
+	}
+	if blocklists.Filter() != current || !blocklists.Check(Query{Domain: "pixel.com"}).Blocked {
+		t.Error("Failed reloads should keep the current filter")
+	}
+}
+
+// TEST 7: Logging a diff
+// Tests that only the first DIFF_LOG_LIMIT domains are named
+func TestSample(t *testing.T) {
+	var domains []string
+	for i := 0; i < DIFF_LOG_LIMIT+5; i++ {
+		domains = append(domains, string(rune('a'+i))+".com")
+	}
+
+	if sample(nil) != "" {
+		t.Error("An empty diff should name nothing")
+	}
+	if sample(domains[:2]) != " (a.com, b.com)" {
+		t.Errorf("Unexpected sample %q", sample(domains[:2]))
+	}
+	if got := sample(domains); got != " (a.com, b.com, c.com, d.com, e.com, f.com, g.com, h.com, i.com, j.com, ...)" {
+		t.Errorf("Unexpected sample %q", got)
+	}
+}
+
+// TEST 8: Local lists only
+// Tests that the directory of the remote copies is not created when every
+// list is local
+func TestBlocklists_Load_LocalOnly(t *testing.T) {
+	var (
+		cacheDir   string = filepath.Join(t.TempDir(), "lists")
+		blocklists *Blocklists
+	)
+	blocklists = NewBlocklists(BlocklistsConfig{
+		Lists:    []List{{Name: "local", Path: writeList(t, "||ads.com^\n"), Format: FORMAT_ADBLOCK, Enabled: true}},
+		CacheDir: cacheDir,
+	})
+	if err := blocklists.Load(context.Background()); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if !blocklists.Check(Query{Domain: "ads.com"}).Blocked {
+		t.Error("ads.com should be blocked by the local list")
+	}
+	if _, err := os.Stat(cacheDir); !os.IsNotExist(err) {
+		t.Errorf("Expected no list directory without remote lists, got %v", err)
+	}
+}
+
+// TEST 9: Remote list never downloaded
+// Tests that a remote list without a copy on disk does not keep the other
+// lists from being reloaded
+func TestBlocklists_Reload_RemoteWithoutCopy(t *testing.T) {
+	var (
+		filename   string = writeList(t, "||ads.com^\n")
+		handler    *listServer
+		server     *httptest.Server
+		blocklists *Blocklists
+		current    *FilterList
+	)
+	handler, server, _ = startListServer(t, "", "")
+	handler.set("", "", time.Time{}, http.StatusInternalServerError)
+	blocklists = NewBlocklists(BlocklistsConfig{
+		Lists: []List{
+			{Name: "remote", Path: server.URL + "/list.txt", Format: FORMAT_ADBLOCK, Enabled: true},
+			{Name: "local", Path: filename, Format: FORMAT_ADBLOCK, Enabled: true},
+		},
+		CacheDir: t.TempDir(),
+	})
+	if err := blocklists.Load(context.Background()); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	current = blocklists.Filter()
+
+	os.WriteFile(filename, []byte("||ads.com^\n||tracker.com^\n"), 0o644)
+	if err := blocklists.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if blocklists.Filter() == current || !blocklists.Check(Query{Domain: "tracker.com"}).Blocked {
+		t.Error("The changed local list should be swapped in")
+	}
+}
@@ -3,45 +3,96 @@ package filter
 import (
 	"bufio"
 	"encoding/binary"
+	"flash-dns/internal/dns"
 	"flash-dns/internal/logger"
 	"fmt"
 	"os"
-	"regexp"
 	"strings"
 	"sync"
 )
 
 type FilterList struct {
-	mu      sync.RWMutex
-	domains map[string]bool
+	mu              sync.RWMutex
+	domains         map[string]string // blocked domains and the list each came from
+	allowed         map[string]bool   // exceptions from @@ rules, they win over domains
+	patterns        patternIndex      // regex and glob rules, checked when domains has no match
+	allowedPatterns patternIndex
+	rules           map[string][]*rule // ||domain^ rules with modifiers, by domain
+	patternRules    []*rule            // regex and glob rules with modifiers
+	badfilters      map[string]bool    // rules cancelled by a $badfilter
 }
 
 func NewFilterList() *FilterList {
 	const defaultSize int = 8192 // 2^13 = 8192
-	return &FilterList{domains: make(map[string]bool, defaultSize)}
+	return &FilterList{
+		domains:    make(map[string]string, defaultSize),
+		allowed:    make(map[string]bool),
+		rules:      make(map[string][]*rule),
+		badfilters: make(map[string]bool),
+	}
 }
 
 func (f *FilterList) Add(domain string) {
+	f.add(domain, "")
+}
+
+// add blocks domain on behalf of list, a domain in several lists stays
+// attributed to the first one loaded
+func (f *FilterList) add(domain string, list string) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	domain = normalizeDomain(domain)
-	f.domains[domain] = true
+	if _, found := f.domains[domain]; !found {
+		f.domains[domain] = list
+	}
 }
 
-// match wildcard, if googleads.com is blocked, ads.googleads.com is also blocked
+// Allow exempts domain and its subdomains from blocking
+func (f *FilterList) Allow(domain string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	domain = normalizeDomain(domain)
+	f.allowed[domain] = true
+}
+
+// match wildcard, if googleads.com is blocked, ads.googleads.com is also blocked,
+// unless the allowlist covers it. patterns only run when the maps have no answer.
+// rules scoped by $dnstype or $client need Check
 func (f *FilterList) IsBlocked(domain string) bool {
+	return f.Check(Query{Domain: domain}).Blocked
+}
+
+// IsAllowed reports whether an exception covers domain
+func (f *FilterList) IsAllowed(domain string) bool {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
+
+	return f.isAllowed(normalizeDomain(domain))
+}
+
+// isAllowed must be called with f.mu held and a normalized domain
+func (f *FilterList) isAllowed(domain string) bool {
+	var found bool
+	if _, found = matchSuffix(f.allowed, domain); found {
+		return true
+	}
+
+	_, found = f.allowedPatterns.match(domain)
+	return found
+}
+
+// matchSuffix looks for domain or any of its parents in set and returns
+// the one found
+func matchSuffix[V any](set map[string]V, domain string) (string, bool) {
 	var (
 		found    bool
 		dotIndex int
 	)
-	domain = normalizeDomain(domain)
-
 	for {
-		if _, found = f.domains[domain]; found {
-			return true
+		if _, found = set[domain]; found {
+			return domain, true
 		}
 
 		dotIndex = strings.IndexRune(domain, '.')
@@ -49,21 +100,86 @@ func (f *FilterList) IsBlocked(domain string) bool {
 			break
 		}
 
-		domain = strings.Clone(domain[dotIndex+1:])
+		domain = domain[dotIndex+1:]
 	}
 
-	return false
+	return "", false
 }
 
+// LoadFromFile reads a list in whatever format it is written in, see
+// LoadFile
 func (f *FilterList) LoadFromFile(filename string) error {
+	_, err := f.LoadFile(filename, FORMAT_AUTO)
+	return err
+}
+
+// LoadFile reads a list in format, FORMAT_AUTO detects it from the first
+// rules. adblock exceptions (@@||domain^) go to the allowlist. the rules
+// are attributed to a list named after the file, without its extension
+func (f *FilterList) LoadFile(filename string, format Format) (LoadStats, error) {
+	return f.loadFile(filename, format, listName(filename))
+}
+
+func (f *FilterList) loadFile(filename string, format Format, list string) (LoadStats, error) {
 	var (
-		file    *os.File
+		content []byte
 		err     error
-		scanner *bufio.Scanner
-		count   int
-		line    string
-		domain  []string
-		regex   *regexp.Regexp
+		stats   LoadStats
+	)
+	if content, err = os.ReadFile(filename); err != nil {
+		return stats, err
+	}
+
+	stats = f.load(content, format, list)
+	logger.Info(fmt.Sprintf("Loaded %s list %s: %d parsed (%d exceptions), %d skipped, %d malformed", stats.Format, filename, stats.Parsed, stats.Exceptions, stats.Skipped, stats.Malformed))
+	return stats, nil
+}
+
+// load parses the content of a list into the filter
+func (f *FilterList) load(content []byte, format Format, list string) LoadStats {
+	var (
+		lines     []string = strings.Split(string(content), "\n")
+		line      string
+		result    lineResult
+		exception bool
+		stats     LoadStats
+	)
+
+	if format == FORMAT_AUTO {
+		format = DetectFormat(lines)
+	}
+	stats.Format = format
+
+	for _, line = range lines {
+		result, exception = f.parseLine(format, line, list)
+		switch result {
+		case lineParsed:
+			stats.Parsed++
+			if exception {
+				stats.Exceptions++
+			}
+		case lineSkipped:
+			stats.Skipped++
+		case lineMalformed:
+			stats.Malformed++
+		}
+	}
+
+	return stats
+}
+
+// LoadAllowlistFromFile reads a file of domains that must never be blocked,
+// one per line either bare or as an Adblock rule (||domain^, @@||domain^,
+// /regex/ or any of them with $modifiers). every line is an exception,
+// lines that are neither are counted as malformed
+func (f *FilterList) LoadAllowlistFromFile(filename string) error {
+	var (
+		file      *os.File
+		err       error
+		scanner   *bufio.Scanner
+		count     int
+		malformed int
+		line      string
 	)
 	file, err = os.Open(filename)
 	if err != nil {
@@ -72,39 +188,49 @@ func (f *FilterList) LoadFromFile(filename string) error {
 	defer file.Close()
 	scanner = bufio.NewScanner(file)
 
-	regex, err = regexp.Compile(`\|\|(.*)\^$`) // take string from ||<some string>^
-	if err != nil {
-		return err
-	}
-
 	for scanner.Scan() {
-		line = strings.TrimSpace(scanner.Text())
-
-		if line == "" ||
-			strings.HasPrefix(line, "!") ||
-			strings.HasPrefix(line, "[") ||
-			strings.HasPrefix(line, "@@") {
+		if line = strings.TrimSpace(scanner.Text()); isComment(line) {
 			continue
 		}
 
-		domain = regex.FindStringSubmatch(line)
-		if len(domain) == 0 { // if it is 0, no match was found :)
-			continue
+		line = strings.TrimPrefix(line, "@@")
+		if !strings.HasPrefix(line, "||") && !strings.HasPrefix(line, "/") {
+			if !isDomain(line) {
+				malformed++
+				continue
+			}
+			line = "||" + normalizeDomain(line) + "^"
 		}
 
-		f.Add(domain[1]) // the output is like [complete_line matched_group]
+		if result, _ := f.parseAdblock("@@"+line, ""); result != lineParsed {
+			malformed++
+			continue
+		}
 		count++
 	}
 
-	logger.Info(fmt.Sprintf("Loaded %d domains to Filter from %s", count, filename))
+	logger.Info(fmt.Sprintf("Loaded %d rules to Allowlist from %s, %d malformed", count, filename, malformed))
 	return scanner.Err()
 }
 
-// returns the count of blocked domains
+// returns the count of blocking rules, domains, patterns and rules with modifiers
 func (f *FilterList) Count() int {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
-	return len(f.domains)
+
+	var count int = len(f.domains) + f.patterns.len()
+	for _, rules := range f.rules {
+		count += len(rules)
+	}
+
+	return count + len(f.patternRules)
+}
+
+// returns the count of allowing rules, domains and patterns
+func (f *FilterList) AllowCount() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.allowed) + f.allowedPatterns.len()
 }
 
 func normalizeDomain(domain string) string {
@@ -114,68 +240,132 @@ func normalizeDomain(domain string) string {
 	return domain
 }
 
+// BLOCKED_FLAGS and NULL_FLAGS are the response flags used for blocked
+// domains, QR, RD and RA set with NXDOMAIN or NOERROR
+const (
+	BLOCKED_FLAGS uint16 = dns.FLAG_QR | dns.FLAG_RD | dns.FLAG_RA | dns.RCODE_NXDOMAIN
+	NULL_FLAGS    uint16 = dns.FLAG_QR | dns.FLAG_RD | dns.FLAG_RA | dns.RCODE_NOERROR
+	NULL_TTL      uint32 = 60
+)
+
+// CreateBlockedResponse answers NXDOMAIN for the question in query
 func CreateBlockedResponse(query []byte) []byte {
-	if len(query) < 12 {
+	if len(query) < dns.HEADER_SIZE {
 		return query
 	}
 
 	var (
-		response []byte = make([]byte, len(query))
-		flags    uint16 = 0x8183
-		ancount  uint16 = 0
+		message  *dns.Message
+		reply    *dns.Message
+		response []byte
+		err      error
 	)
-	copy(response, query)
+	if message, err = dns.Parse(query); err != nil {
+		return headerOnlyResponse(query, BLOCKED_FLAGS)
+	}
 
-	// QR = 1 (response) OPCODE = 0 (standard query)
-	// AA=1 (authoritative) and RCODE = 3 (domain not found)
-	// result, flags = 0x8183
-	binary.BigEndian.PutUint16(response[2:4], flags)
-	binary.BigEndian.PutUint16(response[6:8], ancount)
+	reply = message.Reply(dns.RCODE_NXDOMAIN)
+	reply.Flags = BLOCKED_FLAGS
+	if response, err = reply.Pack(); err != nil {
+		return headerOnlyResponse(query, BLOCKED_FLAGS)
+	}
 
 	return response
 }
 
+// CreateNullResponse answers with the unspecified address, 0.0.0.0 for A
+// and :: for AAAA, other types get an empty NOERROR answer
 func CreateNullResponse(query []byte) []byte {
-	if len(query) < 12 {
+	if len(query) < dns.HEADER_SIZE {
 		return query
 	}
 
 	var (
-		response []byte = make([]byte, len(query)+16)
-		flags    uint16 = 0x8180
-		ancount  uint16 = 1
-		position int    = len(query)
+		message  *dns.Message
+		reply    *dns.Message
+		response []byte
+		err      error
 	)
-	copy(response, query)
+	if message, err = dns.Parse(query); err != nil {
+		return headerOnlyResponse(query, NULL_FLAGS)
+	}
 
-	binary.BigEndian.PutUint16(response[2:4], flags)
-	binary.BigEndian.PutUint16(response[6:8], ancount)
+	reply = message.Reply(dns.RCODE_NOERROR)
+	reply.Flags = NULL_FLAGS
+	for _, question := range message.Questions {
+		switch question.Type {
+		case dns.TYPE_A:
+			reply.Answers = append(reply.Answers, dns.Resource{Name: question.Name, Type: dns.TYPE_A, Class: question.Class, TTL: NULL_TTL, Data: make([]byte, 4)})
+		case dns.TYPE_AAAA:
+			reply.Answers = append(reply.Answers, dns.Resource{Name: question.Name, Type: dns.TYPE_AAAA, Class: question.Class, TTL: NULL_TTL, Data: make([]byte, 16)})
+		}
+	}
 
-	response[position] = 0xC0
-	response[position+1] = 0x0C
-	position += 2
+	if response, err = reply.Pack(); err != nil {
+		return headerOnlyResponse(query, NULL_FLAGS)
+	}
 
-	// Type: A (0x0001)
-	binary.BigEndian.PutUint16(response[position:position+2], 1)
-	position += 2
+	return response
+}
 
-	// Type: IN (0x0001)
-	binary.BigEndian.PutUint16(response[position:position+2], 1)
-	position += 2
+// CreateRewriteResponse answers with the $dnsrewrite records of the asked
+// type and any CNAME, extra is appended after them (the records a CNAME
+// target resolved to). a rewritten response code answers without records
+func CreateRewriteResponse(query []byte, rewrites []Rewrite, extra ...dns.Resource) []byte {
+	if len(query) < dns.HEADER_SIZE {
+		return query
+	}
 
-	// TTL: 60 seconds
-	binary.BigEndian.PutUint16(response[position:position+4], 60)
-	position += 4
+	var (
+		message  *dns.Message
+		reply    *dns.Message
+		response []byte
+		rcode    uint16 = dns.RCODE_NOERROR
+		data     []byte
+		err      error
+	)
+	for _, rewrite := range rewrites {
+		if rewrite.Rcode != dns.RCODE_NOERROR {
+			rcode = rewrite.Rcode
+		}
+	}
 
-	// RDLENGTH: 4 bytes (IPv4 address)
-	binary.BigEndian.PutUint16(response[position:position+2], 4)
-	position += 2
+	if message, err = dns.Parse(query); err != nil {
+		return headerOnlyResponse(query, dns.FLAG_QR|dns.FLAG_RD|dns.FLAG_RA|rcode)
+	}
 
-	response[position] = 0
-	response[position+1] = 0
-	response[position+2] = 0
-	response[position+3] = 0
-	position += 4
+	reply = message.Reply(rcode)
+	for _, question := range message.Questions {
+		for _, rewrite := range rewrites {
+			if rcode != dns.RCODE_NOERROR || (rewrite.Type != question.Type && rewrite.Type != dns.TYPE_CNAME) {
+				continue
+			}
+			if data, err = rewrite.data(); err == nil {
+				reply.Answers = append(reply.Answers, dns.Resource{Name: question.Name, Type: rewrite.Type, Class: question.Class, TTL: NULL_TTL, Data: data})
+			}
+		}
+	}
+	if rcode == dns.RCODE_NOERROR {
+		reply.Answers = append(reply.Answers, extra...)
+	}
+
+	if response, err = reply.Pack(); err != nil {
+		return headerOnlyResponse(query, dns.FLAG_QR|dns.FLAG_RD|dns.FLAG_RA|dns.RCODE_SERVFAIL)
+	}
+
+	return response
+}
 
-	return response[:position]
+// headerOnlyResponse is the fallback for queries the codec can not read,
+// the ID is kept and every section left empty
+func headerOnlyResponse(query []byte, flags uint16) []byte {
+	var response []byte = make([]byte, dns.HEADER_SIZE)
+	copy(response, query[:dns.HEADER_SIZE])
+	binary.BigEndian.PutUint16(response[2:4], flags)
+	binary.BigEndian.PutUint16(response[4:6], 0)
+	binary.BigEndian.PutUint16(response[6:8], 0)
+	binary.BigEndian.PutUint16(response[8:10], 0)
+	binary.BigEndian.PutUint16(response[10:12], 0)
+
+	return response
 }
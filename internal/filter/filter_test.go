@@ -3,6 +3,7 @@ package filter
 import (
 	"encoding/binary"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -253,14 +254,17 @@ func TestCreateNullResponse(t *testing.T) {
 		position int
 	)
 
-	// Set up a minimal DNS query
+	// Set up a DNS query for ads.example.com A
 	binary.BigEndian.PutUint16(query[0:2], 0x5678) // Transaction ID
+	binary.BigEndian.PutUint16(query[4:6], 1)      // QDCOUNT = 1
+	query = append(query, 3, 'a', 'd', 's', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0)
+	query = append(query, 0, 1, 0, 1) // QTYPE A, QCLASS IN
 
 	response = CreateNullResponse(query)
 
 	// Response should be longer than query (query + answer record)
 	if len(response) <= len(query) {
-		t.Error("Null response should be longer than query")
+		t.Fatal("Null response should be longer than query")
 	}
 
 	// Check flags (should be 0x8180: QR=1, RCODE=0)
@@ -288,6 +292,13 @@ func TestCreateNullResponse(t *testing.T) {
 		t.Errorf("Expected record type A (1), got %d", recordType)
 	}
 
+	// Verify TTL is 60 seconds
+	position += 4
+	var ttl uint32 = binary.BigEndian.Uint32(response[position : position+4])
+	if ttl != 60 {
+		t.Errorf("Expected TTL 60, got %d", ttl)
+	}
+
 	// Verify IP address is 0.0.0.0 (last 4 bytes)
 	var ipStart int = len(response) - 4
 	if response[ipStart] != 0 || response[ipStart+1] != 0 ||
@@ -368,3 +379,141 @@ func TestNormalizeDomain(t *testing.T) {
 		}
 	}
 }
+
+// TEST 14: CreateNullResponse answers AAAA with ::
+// Tests that the answer type follows the question type
+func TestCreateNullResponse_AAAA(t *testing.T) {
+	var (
+		query    []byte = make([]byte, 12)
+		response []byte
+		position int
+	)
+	binary.BigEndian.PutUint16(query[4:6], 1) // QDCOUNT = 1
+	query = append(query, 3, 'a', 'd', 's', 3, 'c', 'o', 'm', 0)
+	query = append(query, 0, 28, 0, 1) // QTYPE AAAA, QCLASS IN
+
+	response = CreateNullResponse(query)
+
+	if binary.BigEndian.Uint16(response[6:8]) != 1 {
+		t.Fatalf("Expected answer count 1, got %d", binary.BigEndian.Uint16(response[6:8]))
+	}
+	position = len(query) + 2
+	if binary.BigEndian.Uint16(response[position:position+2]) != 28 {
+		t.Errorf("Expected record type AAAA (28), got %d", binary.BigEndian.Uint16(response[position:position+2]))
+	}
+	if binary.BigEndian.Uint16(response[position+8:position+10]) != 16 || len(response) != position+10+16 {
+		t.Error("Expected a 16 byte :: address")
+	}
+}
+
+// TEST 15: Allowlist wins over blocking
+// Tests that an exception unblocks the domain and its subdomains only
+func TestFilterList_AllowPrecedence(t *testing.T) {
+	var f *FilterList = NewFilterList()
+	f.Add("example.com")
+	f.Add("ads.cdn.example.com")
+	f.Allow("CDN.example.com.")
+
+	if !f.IsBlocked("example.com") || !f.IsBlocked("www.example.com") {
+		t.Error("Domains outside the exception should stay blocked")
+	}
+	if f.IsBlocked("cdn.example.com") || f.IsBlocked("ads.cdn.example.com") {
+		t.Error("The exception should win over blocking for itself and its subdomains")
+	}
+	if !f.IsAllowed("img.cdn.example.com") || f.IsAllowed("example.com") {
+		t.Error("IsAllowed should match the exception and its subdomains only")
+	}
+	if f.Count() != 2 || f.AllowCount() != 1 {
+		t.Errorf("Expected 2 blocked and 1 allowed, got %d and %d", f.Count(), f.AllowCount())
+	}
+}
+
+// TEST 16: Load @@ exceptions from a blocklist
+// Tests that @@||domain^ rules go to the allowlist
+func TestFilterList_LoadFromFile_Exceptions(t *testing.T) {
+	var (
+		f        *FilterList = NewFilterList()
+		filename string      = filepath.Join(t.TempDir(), "blocklist.txt")
+		err      error
+	)
+	err = os.WriteFile(filename, []byte("||tracker.com^\n@@||safe.tracker.com^\n@@||unrelated.org^\n"), 0o644)
+	if err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	if err = f.LoadFromFile(filename); err != nil {
+		t.Fatalf("Failed to load file: %v", err)
+	}
+
+	if !f.IsBlocked("ads.tracker.com") {
+		t.Error("ads.tracker.com should be blocked")
+	}
+	if f.IsBlocked("safe.tracker.com") || f.IsBlocked("img.safe.tracker.com") {
+		t.Error("safe.tracker.com is excepted and should not be blocked")
+	}
+	if f.Count() != 1 || f.AllowCount() != 2 {
+		t.Errorf("Expected 1 blocked and 2 allowed, got %d and %d", f.Count(), f.AllowCount())
+	}
+}
+
+// TEST 17: Load an allowlist file
+// Tests bare domains and Adblock rules with comments in between
+func TestFilterList_LoadAllowlistFromFile(t *testing.T) {
+	var (
+		f        *FilterList = NewFilterList()
+		filename string      = filepath.Join(t.TempDir(), "allowlist.txt")
+		err      error
+	)
+	err = os.WriteFile(filename, []byte("# local services\nbank.example\n\n! adblock style\n@@||shop.example^\n||news.example^\n"), 0o644)
+	if err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	f.Add("example")
+
+	if err = f.LoadAllowlistFromFile(filename); err != nil {
+		t.Fatalf("Failed to load file: %v", err)
+	}
+
+	for _, domain := range []string{"bank.example", "shop.example", "www.news.example"} {
+		if f.IsBlocked(domain) {
+			t.Errorf("%s should be allowed", domain)
+		}
+	}
+	if !f.IsBlocked("other.example") {
+		t.Error("other.example should stay blocked")
+	}
+	if f.AllowCount() != 3 {
+		t.Errorf("Expected 3 allowed domains, got %d", f.AllowCount())
+	}
+	if err = f.LoadAllowlistFromFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("Should return error for non-existent file")
+	}
+}
+
+// TEST 18: Allowlist files take patterns and modifiers
+// Tests that /regex/ and $modifiers are parsed like in a blocklist and
+// lines that are not rules are left out
+func TestFilterList_LoadAllowlistFromFile_Rules(t *testing.T) {
+	var (
+		f        *FilterList = NewFilterList()
+		filename string      = writeList(t, "@@||important.example^$important\n@@/^cdn[0-9]+\\.ads\\.example$/\nnot a domain\n@@||broken\n")
+		err      error
+	)
+	f.load([]byte("||important.example^$important\n||ads.example^\n"), FORMAT_ADBLOCK, "ads")
+	if err = f.LoadAllowlistFromFile(filename); err != nil {
+		t.Fatalf("Failed to load file: %v", err)
+	}
+
+	if f.Check(Query{Domain: "important.example"}).Blocked {
+		t.Error("The $important exception should win over the $important rule")
+	}
+	if f.Check(Query{Domain: "cdn1.ads.example"}).Blocked {
+		t.Error("cdn1.ads.example should be allowed by the regex")
+	}
+	if !f.Check(Query{Domain: "tracker.ads.example"}).Blocked {
+		t.Error("tracker.ads.example should stay blocked")
+	}
+	if f.AllowCount() != 1 {
+		t.Errorf("Expected only the regex as a plain exception, got %d", f.AllowCount())
+	}
+}
@@ -0,0 +1,373 @@
+package filter
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// Format is the syntax of a blocklist file
+type Format int
+
+const (
+	FORMAT_AUTO    Format = iota // detect the format from the first rules
+	FORMAT_ADBLOCK               // ||domain^ rules and @@||domain^ exceptions
+	FORMAT_HOSTS                 // 0.0.0.0 domain [domain...]
+	FORMAT_DOMAINS               // one domain per line
+	FORMAT_DNSMASQ               // address=/domain/, server=/domain/ or local=/domain/, other targets are skipped
+)
+
+const (
+	DETECT_SAMPLE int = 100 // rules looked at to detect the format
+)
+
+var formatNames = map[string]Format{
+	"auto":    FORMAT_AUTO,
+	"adblock": FORMAT_ADBLOCK,
+	"hosts":   FORMAT_HOSTS,
+	"domains": FORMAT_DOMAINS,
+	"dnsmasq": FORMAT_DNSMASQ,
+}
+
+var (
+	adblockRule *regexp.Regexp = regexp.MustCompile(`^\|\|(.*)\^$`) // take string from ||<some string>^
+	domainLabel *regexp.Regexp = regexp.MustCompile(`^[a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9_])?$`)
+)
+
+// hostnames that hosts files map to themselves, they are not blocklist entries
+var localHostnames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// ParseFormat accepts the names used on the command line
+func ParseFormat(name string) (Format, error) {
+	var (
+		format Format
+		found  bool
+	)
+	if format, found = formatNames[strings.ToLower(strings.TrimSpace(name))]; !found {
+		return FORMAT_AUTO, fmt.Errorf("unknown list format %q", name)
+	}
+
+	return format, nil
+}
+
+func (f Format) String() string {
+	for name, format := range formatNames {
+		if format == f {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// LoadStats counts what happened to the lines of a list
+type LoadStats struct {
+	Format     Format
+	Parsed     int // lines that gave at least one rule
+	Exceptions int // parsed lines that went to the allowlist
+	Skipped    int // blank lines, comments and local hostnames
+	Malformed  int // lines that do not follow the format
+}
+
+// lineResult is what a format parser made of a line
+type lineResult int
+
+const (
+	lineParsed lineResult = iota
+	lineSkipped
+	lineMalformed
+)
+
+// DetectFormat guesses the format from the first DETECT_SAMPLE rules, each
+// one votes for the format it looks like and the most votes win. a list
+// without a recognizable rule is read as adblock
+func DetectFormat(lines []string) Format {
+	var (
+		votes   map[Format]int = make(map[Format]int)
+		sampled int
+		line    string
+		best    Format = FORMAT_ADBLOCK
+	)
+	for _, line = range lines {
+		if line = strings.TrimSpace(line); isComment(line) {
+			if strings.HasPrefix(strings.ToLower(line), "[adblock") {
+				return FORMAT_ADBLOCK
+			}
+			continue
+		}
+
+		if format := guessFormat(line); format != FORMAT_AUTO {
+			votes[format]++
+		}
+		if sampled++; sampled == DETECT_SAMPLE {
+			break
+		}
+	}
+
+	for _, format := range []Format{FORMAT_ADBLOCK, FORMAT_HOSTS, FORMAT_DNSMASQ, FORMAT_DOMAINS} {
+		if votes[format] > votes[best] {
+			best = format
+		}
+	}
+
+	return best
+}
+
+// guessFormat tells which format a single rule looks like, FORMAT_AUTO
+// when none
+func guessFormat(line string) Format {
+	var fields []string = strings.Fields(stripInlineComment(line))
+	switch {
+	case strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@"):
+		return FORMAT_ADBLOCK
+	case strings.HasPrefix(line, "address=/") || strings.HasPrefix(line, "server=/") || strings.HasPrefix(line, "local=/"):
+		return FORMAT_DNSMASQ // forwarding lines vote too, parseDnsmasq skips them
+	case len(fields) >= 2 && isAddress(fields[0]):
+		return FORMAT_HOSTS
+	case len(fields) == 1 && isDomain(strings.ReplaceAll(fields[0], "*", "x")):
+		return FORMAT_DOMAINS
+	}
+
+	return FORMAT_AUTO
+}
+
+// parseLine reads one line of list, written in format, into the filter
+func (f *FilterList) parseLine(format Format, line string, list string) (lineResult, bool) {
+	if line = strings.TrimSpace(line); isComment(line) {
+		return lineSkipped, false
+	}
+
+	switch format {
+	case FORMAT_HOSTS:
+		return f.parseHosts(line, list), false
+	case FORMAT_DOMAINS:
+		return f.parseDomain(line, list), false
+	case FORMAT_DNSMASQ:
+		return f.parseDnsmasq(line, list), false
+	default:
+		return f.parseAdblock(line, list)
+	}
+}
+
+// parseAdblock handles ||domain^, ||glob^ and /regex/ rules and their @@
+// exceptions, the bool reports an exception. rules with $modifiers are
+// left to parseModified
+func (f *FilterList) parseAdblock(line string, list string) (lineResult, bool) {
+	var (
+		exception bool
+		domain    []string
+		index     *patternIndex = &f.patterns
+		modifiers string
+		modified  bool
+	)
+	if line, exception = strings.CutPrefix(line, "@@"); exception {
+		index = &f.allowedPatterns
+	}
+
+	if line, modifiers, modified = splitModifiers(line); modified {
+		return f.parseModified(exception, line, modifiers, list)
+	}
+	if f.isBadfiltered(ruleText(exception, line, nil)) {
+		return lineParsed, exception
+	}
+
+	if isRegexRule(line) {
+		if f.addPattern(index, line[1:len(line)-1], list) != nil {
+			return lineMalformed, false
+		}
+		return lineParsed, exception
+	}
+
+	domain = adblockRule.FindStringSubmatch(line)
+	if len(domain) == 0 { // if it is 0, no match was found :)
+		return lineMalformed, false
+	}
+
+	// the output is like [complete_line matched_group]
+	switch {
+	case strings.Contains(domain[1], "*"):
+		if f.addPattern(index, globToRegex(domain[1], true), list) != nil {
+			return lineMalformed, false
+		}
+	case exception:
+		f.Allow(domain[1])
+	default:
+		f.add(domain[1], list)
+	}
+
+	return lineParsed, exception
+}
+
+// parseHosts handles an address followed by one or more hostnames, the
+// address itself is ignored since every entry is blocked the same way
+func (f *FilterList) parseHosts(line string, list string) lineResult {
+	var (
+		fields []string = strings.Fields(stripInlineComment(line))
+		added  int
+	)
+	if len(fields) < 2 || !isAddress(fields[0]) {
+		return lineMalformed
+	}
+
+	for _, host := range fields[1:] {
+		if host = normalizeDomain(host); localHostnames[host] {
+			continue
+		}
+		if !isDomain(host) {
+			return lineMalformed
+		}
+		f.add(host, list)
+		added++
+	}
+
+	if added == 0 {
+		return lineSkipped
+	}
+	return lineParsed
+}
+
+// parseDomain handles a bare domain, a glob or a /regex/. a leading *. is
+// dropped since subdomains are always blocked with their parent
+func (f *FilterList) parseDomain(line string, list string) lineResult {
+	if isRegexRule(line) {
+		if f.addPattern(&f.patterns, line[1:len(line)-1], list) != nil {
+			return lineMalformed
+		}
+		return lineParsed
+	}
+
+	var fields []string = strings.Fields(stripInlineComment(line))
+	if len(fields) != 1 {
+		return lineMalformed
+	}
+
+	var domain string = strings.TrimPrefix(fields[0], "*.")
+	if strings.Contains(domain, "*") && isDomain(strings.ReplaceAll(domain, "*", "x")) {
+		if f.addPattern(&f.patterns, globToRegex(fields[0], false), list) != nil {
+			return lineMalformed
+		}
+		return lineParsed
+	}
+	if !isDomain(domain) {
+		return lineMalformed
+	}
+
+	f.add(domain, list)
+	return lineParsed
+}
+
+// parseDnsmasq handles address=/domain/[target], server=/domain/[target]
+// and local=/domain/, several domains may share a line. local always blocks,
+// address and server only without a target or with a null one (0.0.0.0, ::
+// and # for address), any other target forwards or redirects and is skipped
+func (f *FilterList) parseDnsmasq(line string, list string) lineResult {
+	var (
+		option  string
+		value   string
+		found   bool
+		fields  []string
+		parts   []string
+		domains []string
+		target  string
+	)
+	if option, value, found = strings.Cut(strings.TrimSpace(line), "="); !found {
+		return lineMalformed
+	}
+
+	switch option {
+	case "address", "server", "local":
+	default:
+		return lineMalformed
+	}
+
+	// # is a target here, comments need a blank before them
+	if fields = strings.Fields(value); len(fields) == 0 {
+		return lineMalformed
+	}
+
+	// /a.com/b.com/target splits into "", domains..., target
+	if parts = strings.Split(fields[0], "/"); len(parts) < 3 || parts[0] != "" {
+		return lineMalformed
+	}
+
+	domains, target = parts[1:len(parts)-1], parts[len(parts)-1]
+	for _, domain := range domains {
+		if !isDomain(domain) {
+			return lineMalformed
+		}
+	}
+	if !blocksTarget(option, target) {
+		return lineSkipped
+	}
+	for _, domain := range domains {
+		f.add(domain, list)
+	}
+
+	return lineParsed
+}
+
+// blocksTarget tells whether a dnsmasq option sends its domains nowhere
+func blocksTarget(option string, target string) bool {
+	switch {
+	case option == "local":
+		return true
+	case target == "", target == "0.0.0.0", target == "::":
+		return true
+	}
+
+	return option == "address" && target == "#"
+}
+
+// isComment covers the comment styles of every format, # and ! at the
+// start of a line and the [Adblock Plus] header
+func isComment(line string) bool {
+	return line == "" ||
+		strings.HasPrefix(line, "!") ||
+		strings.HasPrefix(line, "#") ||
+		strings.HasPrefix(line, "[")
+}
+
+// stripInlineComment drops a trailing # comment, adblock rules never get
+// here since # is part of their cosmetic syntax
+func stripInlineComment(line string) string {
+	if index := strings.IndexByte(line, '#'); index >= 0 {
+		return line[:index]
+	}
+
+	return line
+}
+
+func isAddress(value string) bool {
+	_, err := netip.ParseAddr(value)
+	return err == nil
+}
+
+// isDomain checks the shape of a hostname, underscores are accepted since
+// blocklists are full of them
+func isDomain(domain string) bool {
+	if domain = normalizeDomain(domain); domain == "" || len(domain) > 253 || isAddress(domain) {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if !domainLabel.MatchString(label) {
+			return false
+		}
+	}
+
+	return true
+}
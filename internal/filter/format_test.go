@@ -0,0 +1,185 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeList puts content in a temporary file and returns its path
+func writeList(t *testing.T, content string) string {
+	var filename string = filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	return filename
+}
+
+// TEST 1: Format names
+// Tests ParseFormat and String with the command line names
+func TestParseFormat(t *testing.T) {
+	for _, name := range []string{"auto", "adblock", "hosts", "domains", "dnsmasq"} {
+		format, err := ParseFormat(strings.ToUpper(name))
+		if err != nil {
+			t.Fatalf("ParseFormat(%s) failed: %v", name, err)
+		}
+		if format.String() != name {
+			t.Errorf("Expected %s, got %s", name, format)
+		}
+	}
+
+	if _, err := ParseFormat("pihole"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+// TEST 2: Detecting the format
+// Tests that the rules, not the comments, decide the format
+func TestDetectFormat(t *testing.T) {
+	var tests = []struct {
+		content  string
+		expected Format
+	}{
+		{"[Adblock Plus]\nads.com\n", FORMAT_ADBLOCK},
+		{"! title\n||ads.com^\n@@||ok.com^\n", FORMAT_ADBLOCK},
+		{"# hosts\n127.0.0.1 localhost\n0.0.0.0 ads.com\n0.0.0.0 tracker.com # inline\n", FORMAT_HOSTS},
+		{"# domains\nads.com\ntracker.com\n", FORMAT_DOMAINS},
+		{"address=/ads.com/\nserver=/tracker.com/\n", FORMAT_DNSMASQ},
+		{"# nothing but comments\n", FORMAT_ADBLOCK},
+	}
+
+	for i, test := range tests {
+		if format := DetectFormat(strings.Split(test.content, "\n")); format != test.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, test.expected, format)
+		}
+	}
+}
+
+// TEST 3: Hosts files
+// Tests several hostnames per line, local names and inline comments
+func TestFilterList_LoadFile_Hosts(t *testing.T) {
+	var (
+		f        *FilterList = NewFilterList()
+		filename string      = writeList(t, "# comment\n127.0.0.1 localhost\n::1 ip6-localhost ip6-loopback\n0.0.0.0 ads.com www.ads.com # banners\n0.0.0.0 tracker.com\n0.0.0.0\nnot an entry\n")
+		stats    LoadStats
+		err      error
+	)
+
+	if stats, err = f.LoadFile(filename, FORMAT_AUTO); err != nil {
+		t.Fatalf("Failed to load file: %v", err)
+	}
+
+	if stats.Format != FORMAT_HOSTS || stats.Parsed != 2 || stats.Skipped != 4 || stats.Malformed != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if !f.IsBlocked("www.ads.com") || !f.IsBlocked("tracker.com") || f.IsBlocked("localhost") {
+		t.Error("Expected the hosts entries blocked and localhost left alone")
+	}
+	if f.Count() != 3 {
+		t.Errorf("Expected 3 domains, got %d", f.Count())
+	}
+}
+
+// TEST 4: Plain domain lists
+// Tests wildcards, inline comments and lines that are not domains
+func TestFilterList_LoadFile_Domains(t *testing.T) {
+	var (
+		f        *FilterList = NewFilterList()
+		filename string      = writeList(t, "ads.com\n*.tracker.com # all of it\nTelemetry.Example.ORG.\n\nbad domain\nhttp://x.com/\n")
+		stats    LoadStats
+		err      error
+	)
+
+	if stats, err = f.LoadFile(filename, FORMAT_AUTO); err != nil {
+		t.Fatalf("Failed to load file: %v", err)
+	}
+
+	if stats.Format != FORMAT_DOMAINS || stats.Parsed != 3 || stats.Malformed != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if !f.IsBlocked("ads.com") || !f.IsBlocked("cdn.tracker.com") || !f.IsBlocked("telemetry.example.org") {
+		t.Error("Expected every listed domain blocked")
+	}
+}
+
+// TEST 5: dnsmasq lists
+// Tests address, server and several domains on one line
+func TestFilterList_LoadFile_Dnsmasq(t *testing.T) {
+	var (
+		f        *FilterList = NewFilterList()
+		filename string      = writeList(t, "address=/ads.com/0.0.0.0\naddress=/a.net/b.net/#\nserver=/tracker.com/\nconf-file=/etc/other.conf\naddress=ads.org\n")
+		stats    LoadStats
+		err      error
+	)
+
+	if stats, err = f.LoadFile(filename, FORMAT_AUTO); err != nil {
+		t.Fatalf("Failed to load file: %v", err)
+	}
+
+	if stats.Format != FORMAT_DNSMASQ || stats.Parsed != 3 || stats.Malformed != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	for _, domain := range []string{"ads.com", "a.net", "b.net", "tracker.com"} {
+		if !f.IsBlocked(domain) {
+			t.Errorf("%s should be blocked", domain)
+		}
+	}
+}
+
+// TEST 6: Forcing a format
+// Tests that an override skips detection
+func TestFilterList_LoadFile_Override(t *testing.T) {
+	var (
+		f        *FilterList = NewFilterList()
+		filename string      = writeList(t, "ads.com\ntracker.com\n")
+		stats    LoadStats
+		err      error
+	)
+
+	if stats, err = f.LoadFile(filename, FORMAT_HOSTS); err != nil {
+		t.Fatalf("Failed to load file: %v", err)
+	}
+
+	if stats.Format != FORMAT_HOSTS || stats.Parsed != 0 || stats.Malformed != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if _, err = f.LoadFile(filepath.Join(t.TempDir(), "missing.txt"), FORMAT_AUTO); err == nil {
+		t.Error("Should return error for non-existent file")
+	}
+}
+
+// TEST 7: dnsmasq targets
+// Tests that only lines sending their domains nowhere are blocked, forwards
+// and redirects are skipped
+func TestFilterList_ParseDnsmasq_Targets(t *testing.T) {
+	var tests = []struct {
+		line     string
+		expected lineResult
+		blocked  bool
+	}{
+		{"address=/ads.com/", lineParsed, true},
+		{"address=/ads.com/0.0.0.0", lineParsed, true},
+		{"address=/ads.com/::", lineParsed, true},
+		{"address=/ads.com/# null address", lineParsed, true},
+		{"server=/ads.com/", lineParsed, true},
+		{"local=/ads.com/", lineParsed, true},
+		{"address=/ads.com/1.2.3.4", lineSkipped, false},
+		{"address=/ads.com/fd00::1", lineSkipped, false},
+		{"server=/ads.com/10.0.0.1", lineSkipped, false},
+		{"server=/ads.com/10.0.0.1#5353", lineSkipped, false},
+		{"server=/ads.com/#", lineSkipped, false},
+		{"server=/bad domain/10.0.0.1", lineMalformed, false},
+	}
+
+	for i, test := range tests {
+		var f *FilterList = NewFilterList()
+		if result := f.parseDnsmasq(test.line, "dnsmasq"); result != test.expected {
+			t.Errorf("Test %d: expected result %d, got %d", i, test.expected, result)
+		}
+		if f.IsBlocked("ads.com") != test.blocked {
+			t.Errorf("Test %d: expected ads.com blocked %v", i, test.blocked)
+		}
+	}
+}
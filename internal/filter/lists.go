@@ -0,0 +1,184 @@
+package filter
+
+import (
+	"errors"
+	"flash-dns/internal/logger"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var remoteListName *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// List is one named blocklist, it is written on the command line as
+//
+//	ads=/etc/flash-dns/ads.txt format=adblock enabled=false
+//
+// the path may be a glob or a directory, every file it names is loaded
+// under the same name, or an http(s) url downloaded by Blocklists. without
+// a name the list is named after the file
+type List struct {
+	Name    string
+	Path    string
+	Format  Format
+	Enabled bool
+}
+
+// ParseList reads a list, format is used unless the list sets its own and
+// lists are enabled unless they say otherwise
+func ParseList(value string, format Format) (List, error) {
+	var (
+		list   List     = List{Format: format, Enabled: true}
+		fields []string = strings.Fields(value)
+		found  bool
+		key    string
+		option string
+		err    error
+	)
+	if len(fields) == 0 {
+		return list, fmt.Errorf("empty list")
+	}
+
+	// a url may hold = in its query, it only gets a name in front
+	if isURL(fields[0]) {
+		list.Name, list.Path = urlListName(fields[0]), fields[0]
+	} else if list.Name, list.Path, found = strings.Cut(fields[0], "="); !found {
+		list.Name, list.Path = listName(fields[0]), fields[0]
+	}
+	if list.Name == "" || list.Path == "" {
+		return list, fmt.Errorf("list %q is not name=path", fields[0])
+	}
+	// the name of a remote list names its copy on disk
+	if list.Remote() && !remoteListName.MatchString(list.Name) {
+		return list, fmt.Errorf("remote list %q needs a name of letters, digits, '.', '_' or '-'", fields[0])
+	}
+
+	for _, option = range fields[1:] {
+		if key, option, found = strings.Cut(option, "="); !found {
+			return list, fmt.Errorf("list option %q is not key=value", key)
+		}
+
+		switch key {
+		case "format":
+			if list.Format, err = ParseFormat(option); err != nil {
+				return list, err
+			}
+		case "enabled":
+			if list.Enabled, err = strconv.ParseBool(option); err != nil {
+				return list, fmt.Errorf("invalid list enabled %q", option)
+			}
+		default:
+			return list, fmt.Errorf("unknown list option %q", key)
+		}
+	}
+
+	return list, nil
+}
+
+// listName is the file name without its extension, a glob is named after
+// its directory
+func listName(path string) string {
+	if strings.ContainsAny(filepath.Base(path), "*?[") {
+		path = filepath.Dir(path)
+	}
+
+	path = filepath.Base(path)
+	return strings.TrimSuffix(path, filepath.Ext(path))
+}
+
+// urlListName names a list after the file in the url path
+func urlListName(value string) string {
+	var (
+		parsed *url.URL
+		err    error
+	)
+	if parsed, err = url.Parse(value); err != nil || parsed.Path == "" || parsed.Path == "/" {
+		return ""
+	}
+
+	return listName(parsed.Path)
+}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// Remote reports a list downloaded over http(s)
+func (l List) Remote() bool {
+	return isURL(l.Path)
+}
+
+// Files expands the path of the list, a directory gives every file in it
+func (l List) Files() ([]string, error) {
+	var (
+		pattern string = l.Path
+		info    os.FileInfo
+		matches []string
+		files   []string
+		err     error
+	)
+	if info, err = os.Stat(pattern); err == nil && info.IsDir() {
+		pattern = filepath.Join(pattern, "*")
+	}
+
+	if matches, err = filepath.Glob(pattern); err != nil {
+		return nil, fmt.Errorf("list %s: %w", l.Name, err)
+	}
+
+	for _, match := range matches {
+		if info, err = os.Stat(match); err == nil && info.Mode().IsRegular() {
+			files = append(files, match)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("list %s: no file matches %s", l.Name, l.Path)
+	}
+
+	return files, nil
+}
+
+// LoadList reads every file of the list, the rules remember the list name
+// so blocked queries can be attributed to it. disabled lists are skipped
+func (f *FilterList) LoadList(list List) (LoadStats, error) {
+	var (
+		files  []string
+		stats  LoadStats = LoadStats{Format: list.Format}
+		file   LoadStats
+		loaded int
+		errs   []error
+		err    error
+	)
+	if !list.Enabled {
+		logger.Info(fmt.Sprintf("List %s is disabled, not loading %s", list.Name, list.Path))
+		return stats, nil
+	}
+
+	if files, err = list.Files(); err != nil {
+		return stats, err
+	}
+
+	for _, filename := range files {
+		if file, err = f.loadFile(filename, list.Format, list.Name); err != nil {
+			errs = append(errs, fmt.Errorf("list %s: %w", list.Name, err))
+			continue
+		}
+
+		// a list mixing formats reports FORMAT_AUTO
+		if loaded++; loaded == 1 {
+			stats.Format = file.Format
+		} else if stats.Format != file.Format {
+			stats.Format = FORMAT_AUTO
+		}
+		stats.Parsed += file.Parsed
+		stats.Exceptions += file.Exceptions
+		stats.Skipped += file.Skipped
+		stats.Malformed += file.Malformed
+	}
+
+	logger.Info(fmt.Sprintf("List %s: %d files, %d rules (%d exceptions)", list.Name, loaded, stats.Parsed, stats.Exceptions))
+	return stats, errors.Join(errs...)
+}
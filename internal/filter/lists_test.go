@@ -0,0 +1,142 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TEST 1: Parsing lists
+// Tests names, defaults and options of the command line form
+func TestParseList(t *testing.T) {
+	var (
+		list List
+		err  error
+	)
+	if list, err = ParseList("ads=/etc/lists/ads.txt format=hosts enabled=false", FORMAT_AUTO); err != nil {
+		t.Fatalf("ParseList failed: %v", err)
+	}
+	if list != (List{Name: "ads", Path: "/etc/lists/ads.txt", Format: FORMAT_HOSTS, Enabled: false}) {
+		t.Errorf("Unexpected list %+v", list)
+	}
+
+	if list, err = ParseList("/etc/lists/malware.txt", FORMAT_DOMAINS); err != nil {
+		t.Fatalf("ParseList failed: %v", err)
+	}
+	if list.Name != "malware" || list.Format != FORMAT_DOMAINS || !list.Enabled {
+		t.Errorf("Expected an enabled malware list in the default format, got %+v", list)
+	}
+
+	if list, _ = ParseList("/etc/lists/extra/*.txt", FORMAT_AUTO); list.Name != "extra" {
+		t.Errorf("A glob should be named after its directory, got %q", list.Name)
+	}
+
+	for _, value := range []string{"", "=ads.txt", "ads=", "ads.txt format=pihole", "ads.txt enabled=maybe", "ads.txt color=red", "ads.txt enabled"} {
+		if _, err = ParseList(value, FORMAT_AUTO); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+// TEST 2: Loading a directory glob
+// Tests that every matching file is loaded under the list name and
+// disabled lists are left out
+func TestFilterList_LoadList(t *testing.T) {
+	var (
+		directory string      = t.TempDir()
+		f         *FilterList = NewFilterList()
+		stats     LoadStats
+		err       error
+	)
+	os.WriteFile(filepath.Join(directory, "a.txt"), []byte("||ads.com^\n"), 0o644)
+	os.WriteFile(filepath.Join(directory, "b.txt"), []byte("0.0.0.0 tracker.com\n0.0.0.0 metrics.com\n"), 0o644)
+	os.WriteFile(filepath.Join(directory, "c.csv"), []byte("||other.com^\n"), 0o644)
+
+	if stats, err = f.LoadList(List{Name: "ads", Path: filepath.Join(directory, "*.txt"), Enabled: true}); err != nil {
+		t.Fatalf("LoadList failed: %v", err)
+	}
+	if stats.Parsed != 3 || stats.Format != FORMAT_AUTO {
+		t.Errorf("Expected 3 rules from mixed formats, got %+v", stats)
+	}
+	if !f.IsBlocked("ads.com") || !f.IsBlocked("metrics.com") || f.IsBlocked("other.com") {
+		t.Error("Only the files matching the glob should be loaded")
+	}
+
+	if _, err = f.LoadList(List{Name: "off", Path: filepath.Join(directory, "c.csv")}); err != nil {
+		t.Fatalf("A disabled list should not fail: %v", err)
+	}
+	if f.IsBlocked("other.com") {
+		t.Error("A disabled list should not block anything")
+	}
+
+	if _, err = f.LoadList(List{Name: "dir", Path: directory, Enabled: true}); err != nil || !f.IsBlocked("other.com") {
+		t.Errorf("A directory should load every file in it, err %v", err)
+	}
+	if _, err = f.LoadList(List{Name: "missing", Path: filepath.Join(directory, "*.json"), Enabled: true}); err == nil {
+		t.Error("Expected an error when nothing matches")
+	}
+}
+
+// TEST 3: Attribution
+// Tests that a verdict names the list and rule that blocked, the first
+// list loaded keeps a domain found in several
+func TestFilterList_Check_Attribution(t *testing.T) {
+	var (
+		f       *FilterList = NewFilterList()
+		verdict Verdict
+	)
+	f.LoadList(List{Name: "ads", Path: writeList(t, "||ads.com^\n/^ad[0-9]+\\./\n||games.com^$dnstype=A\n"), Format: FORMAT_ADBLOCK, Enabled: true})
+	f.LoadList(List{Name: "malware", Path: writeList(t, "ads.com\nevil.com\n"), Format: FORMAT_DOMAINS, Enabled: true})
+
+	for domain, want := range map[string]Verdict{
+		"www.ads.com":     {Blocked: true, Rule: "ads.com", List: "ads"},
+		"evil.com":        {Blocked: true, Rule: "evil.com", List: "malware"},
+		"ad1.example.com": {Blocked: true, Rule: `/^ad[0-9]+\./`, List: "ads"},
+		"games.com":       {Blocked: true, Rule: "||games.com^$dnstype=A", List: "ads"},
+	} {
+		if verdict = f.Check(Query{Domain: domain, Type: 1}); verdict.Blocked != want.Blocked || verdict.Rule != want.Rule || verdict.List != want.List {
+			t.Errorf("%s: expected %+v, got %+v", domain, want, verdict)
+		}
+	}
+}
+
+// TEST 4: Exceptions across lists
+// Tests that an exception in one list lets through a rule of another
+func TestFilterList_LoadList_Exceptions(t *testing.T) {
+	var f *FilterList = NewFilterList()
+	f.LoadList(List{Name: "ads", Path: writeList(t, "||cdn.com^\n"), Format: FORMAT_ADBLOCK, Enabled: true})
+	f.LoadList(List{Name: "fixes", Path: writeList(t, "@@||cdn.com^\n"), Format: FORMAT_ADBLOCK, Enabled: true})
+
+	if f.IsBlocked("cdn.com") {
+		t.Error("The exception from the second list should apply to the first")
+	}
+}
+
+// TEST 5: Remote lists
+// Tests that urls are named after their file or given a name, and that
+// remote names are safe to use as file names
+func TestParseList_Remote(t *testing.T) {
+	var (
+		list List
+		err  error
+	)
+	if list, err = ParseList("https://example.com/lists/multi.txt?version=2", FORMAT_AUTO); err != nil {
+		t.Fatalf("ParseList failed: %v", err)
+	}
+	if list.Name != "multi" || list.Path != "https://example.com/lists/multi.txt?version=2" || !list.Remote() {
+		t.Errorf("Unexpected list %+v", list)
+	}
+
+	if list, err = ParseList("hagezi=https://example.com/pro.txt format=adblock", FORMAT_AUTO); err != nil || list.Name != "hagezi" || !list.Remote() {
+		t.Errorf("Expected the hagezi remote list, got %+v, err %v", list, err)
+	}
+	if list, _ = ParseList("/etc/lists/ads.txt", FORMAT_AUTO); list.Remote() {
+		t.Error("A local path is not remote")
+	}
+
+	for _, value := range []string{"https://example.com/", "../up=https://example.com/list.txt", "https://example.com/my%20list.txt"} {
+		if _, err = ParseList(value, FORMAT_AUTO); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package filter
+
+import (
+	"flash-dns/internal/dns"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Query is what a filter decision looks at, Type and Client are optional
+// and rules scoped with $dnstype or $client only apply when they are known
+type Query struct {
+	Domain string
+	Type   uint16
+	Client netip.Addr
+}
+
+// Verdict is the decision for a query, a non empty Rewrites is the answer
+// to send instead of asking upstream
+type Verdict struct {
+	Blocked  bool
+	Rewrites []Rewrite
+	Rule     string // the rule that decided, plain rules show the domain or pattern matched
+	List     string // the list the rule came from
+}
+
+// Rewrite is one $dnsrewrite, a response code alone or a record to answer with
+type Rewrite struct {
+	Rcode uint16
+	Type  uint16 // zero when only the response code is rewritten
+	Value string
+}
+
+var rcodeNames = map[string]uint16{
+	"NOERROR":  dns.RCODE_NOERROR,
+	"NXDOMAIN": dns.RCODE_NXDOMAIN,
+	"SERVFAIL": dns.RCODE_SERVFAIL,
+	"REFUSED":  dns.RCODE_REFUSED,
+}
+
+// rule is an adblock rule with modifiers, plain rules stay in the maps
+type rule struct {
+	text       string // the rule without $badfilter, what a $badfilter names
+	list       string
+	exception  bool
+	important  bool
+	badfilter  bool
+	noRewrite  bool           // @@...$dnsrewrite only cancels rewrites
+	domain     string         // ||domain^, matched with its subdomains
+	pattern    *regexp.Regexp // regex and glob rules
+	types      []uint16
+	notTypes   []uint16
+	clients    []netip.Prefix
+	notClients []netip.Prefix
+	rewrite    *Rewrite
+}
+
+// splitModifiers separates the $modifiers from the pattern, a regex keeps
+// any $ it holds between its slashes
+func splitModifiers(line string) (string, string, bool) {
+	if strings.HasPrefix(line, "/") {
+		var end int = strings.LastIndex(line, "/")
+		if end > 0 && strings.HasPrefix(line[end+1:], "$") {
+			return line[:end+1], line[end+2:], true
+		}
+		return line, "", false
+	}
+
+	return strings.Cut(line, "$")
+}
+
+// parseModifiers reads the modifiers of a rule, any modifier a DNS filter
+// can not honour makes the whole rule malformed
+func parseModifiers(r *rule, modifiers string) ([]string, error) {
+	var (
+		kept  []string
+		name  string
+		value string
+		err   error
+	)
+	for _, modifier := range strings.Split(modifiers, ",") {
+		modifier = strings.TrimSpace(modifier)
+		name, value, _ = strings.Cut(modifier, "=")
+
+		switch name {
+		case "important":
+			r.important = true
+		case "badfilter":
+			r.badfilter = true
+			continue
+		case "dnstype":
+			if r.types, r.notTypes, err = parseTypes(value); err != nil {
+				return nil, err
+			}
+		case "client":
+			if r.clients, r.notClients, err = parseClients(value); err != nil {
+				return nil, err
+			}
+		case "dnsrewrite":
+			if value == "" && r.exception {
+				r.noRewrite = true
+			} else if r.rewrite, err = parseRewrite(value); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported modifier %q", name)
+		}
+		kept = append(kept, modifier)
+	}
+
+	return kept, nil
+}
+
+// parseTypes reads A|AAAA or ~A|~AAAA
+func parseTypes(value string) ([]uint16, []uint16, error) {
+	var (
+		types    []uint16
+		notTypes []uint16
+		qtype    uint16
+		negated  bool
+		found    bool
+	)
+	for _, name := range strings.Split(value, "|") {
+		name, negated = strings.CutPrefix(strings.TrimSpace(name), "~")
+		if qtype, found = dns.ParseType(name); !found || name == "" {
+			return nil, nil, fmt.Errorf("unknown dns type %q", name)
+		}
+
+		if negated {
+			notTypes = append(notTypes, qtype)
+		} else {
+			types = append(types, qtype)
+		}
+	}
+
+	return types, notTypes, nil
+}
+
+// parseClients reads addresses and networks, optionally quoted or negated
+// with ~. clients known only by name are not supported
+func parseClients(value string) ([]netip.Prefix, []netip.Prefix, error) {
+	var (
+		clients    []netip.Prefix
+		notClients []netip.Prefix
+		prefix     netip.Prefix
+		addr       netip.Addr
+		negated    bool
+		err        error
+	)
+	for _, client := range strings.Split(value, "|") {
+		client, negated = strings.CutPrefix(strings.TrimSpace(client), "~")
+		client = strings.Trim(client, `'"`)
+
+		if addr, err = netip.ParseAddr(client); err == nil {
+			addr = addr.Unmap()
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		} else if prefix, err = netip.ParsePrefix(client); err != nil {
+			return nil, nil, fmt.Errorf("client %q is not an address or a network", client)
+		}
+
+		if negated {
+			notClients = append(notClients, prefix.Masked())
+		} else {
+			clients = append(clients, prefix.Masked())
+		}
+	}
+
+	return clients, notClients, nil
+}
+
+// parseRewrite reads the short forms (an address, a name for a CNAME or a
+// response code) and the full RCODE;TYPE;VALUE form
+func parseRewrite(value string) (*Rewrite, error) {
+	var (
+		parts   []string = strings.Split(value, ";")
+		rewrite *Rewrite = &Rewrite{}
+		found   bool
+		addr    netip.Addr
+		err     error
+	)
+	switch len(parts) {
+	case 3:
+		if rewrite.Rcode, found = rcodeNames[strings.ToUpper(parts[0])]; !found {
+			return nil, fmt.Errorf("unknown response code %q", parts[0])
+		}
+		if parts[1] == "" && parts[2] == "" {
+			return rewrite, nil
+		}
+		if rewrite.Type, found = dns.ParseType(parts[1]); !found {
+			return nil, fmt.Errorf("unknown dns type %q", parts[1])
+		}
+		rewrite.Value = parts[2]
+
+	case 1:
+		if rewrite.Rcode, found = rcodeNames[strings.ToUpper(value)]; found {
+			return rewrite, nil
+		}
+		if addr, err = netip.ParseAddr(value); err == nil {
+			rewrite.Type, rewrite.Value = dns.TYPE_AAAA, value
+			if addr.Is4() {
+				rewrite.Type = dns.TYPE_A
+			}
+		} else {
+			rewrite.Type, rewrite.Value = dns.TYPE_CNAME, value
+		}
+
+	default:
+		return nil, fmt.Errorf("invalid dnsrewrite %q", value)
+	}
+
+	if _, err = rewrite.data(); err != nil {
+		return nil, err
+	}
+	return rewrite, nil
+}
+
+// data is the rdata of the rewritten record
+func (r Rewrite) data() ([]byte, error) {
+	var (
+		addr   netip.Addr
+		err    error
+		result []byte
+	)
+	switch r.Type {
+	case dns.TYPE_A, dns.TYPE_AAAA:
+		if addr, err = netip.ParseAddr(r.Value); err != nil {
+			return nil, err
+		}
+		if addr.Is4() != (r.Type == dns.TYPE_A) {
+			return nil, fmt.Errorf("%s does not fit a record of type %d", r.Value, r.Type)
+		}
+		return addr.AsSlice(), nil
+
+	case dns.TYPE_CNAME, dns.TYPE_PTR:
+		if !isDomain(r.Value) {
+			return nil, fmt.Errorf("invalid name %q", r.Value)
+		}
+		return dns.EncodeName(r.Value)
+
+	case dns.TYPE_TXT:
+		for text := r.Value; ; text = text[min(len(text), 255):] {
+			result = append(result, byte(min(len(text), 255)))
+			result = append(result, text[:min(len(text), 255)]...)
+			if len(text) <= 255 {
+				return result, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("dnsrewrite of type %d is not supported", r.Type)
+}
+
+// parseModified reads a rule carrying modifiers into the rule index
+func (f *FilterList) parseModified(exception bool, pattern string, modifiers string, list string) (lineResult, bool) {
+	var (
+		r      *rule = &rule{exception: exception, list: list}
+		kept   []string
+		domain []string
+		err    error
+	)
+	if kept, err = parseModifiers(r, modifiers); err != nil {
+		return lineMalformed, false
+	}
+
+	switch {
+	case isRegexRule(pattern):
+		r.pattern, err = compilePattern(pattern[1 : len(pattern)-1])
+	default:
+		if domain = adblockRule.FindStringSubmatch(pattern); len(domain) == 0 {
+			return lineMalformed, false
+		}
+		if strings.Contains(domain[1], "*") {
+			r.pattern, err = compilePattern(globToRegex(domain[1], true))
+		} else {
+			r.domain = normalizeDomain(domain[1])
+		}
+	}
+	if err != nil {
+		return lineMalformed, false
+	}
+
+	r.text = ruleText(exception, pattern, kept)
+	if r.badfilter {
+		f.applyBadfilter(r, len(kept) == 0)
+		return lineParsed, false
+	}
+
+	f.addRule(r)
+	return lineParsed, exception
+}
+
+// ruleText is the rule as a $badfilter refers to it
+func ruleText(exception bool, pattern string, modifiers []string) string {
+	var text string = pattern
+	if exception {
+		text = "@@" + text
+	}
+	if len(modifiers) > 0 {
+		text += "$" + strings.Join(modifiers, ",")
+	}
+
+	return text
+}
+
+func (f *FilterList) addRule(r *rule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.badfilters[r.text] {
+		return
+	}
+	if r.pattern != nil {
+		f.patternRules = append(f.patternRules, r)
+		return
+	}
+	f.rules[r.domain] = append(f.rules[r.domain], r)
+}
+
+// applyBadfilter cancels the rule named by a $badfilter, now and when it
+// shows up later. plain says the named rule has no modifiers and lives in
+// the maps
+func (f *FilterList) applyBadfilter(r *rule, plain bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var named func(other *rule) bool = func(other *rule) bool { return other.text == r.text }
+	f.badfilters[r.text] = true
+	f.patternRules = slices.DeleteFunc(f.patternRules, named)
+	if r.domain != "" {
+		f.rules[r.domain] = slices.DeleteFunc(f.rules[r.domain], named)
+	}
+
+	if !plain {
+		return
+	}
+	switch {
+	case r.pattern != nil && r.exception:
+		f.allowedPatterns.remove(r.pattern.String())
+	case r.pattern != nil:
+		f.patterns.remove(r.pattern.String())
+	case r.exception:
+		delete(f.allowed, r.domain)
+	default:
+		delete(f.domains, r.domain)
+	}
+}
+
+// isBadfiltered reports a plain rule cancelled by a $badfilter
+func (f *FilterList) isBadfiltered(text string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.badfilters[text]
+}
+
+// applies checks the $dnstype and $client scopes of the rule
+func (r *rule) applies(query Query) bool {
+	if len(r.types) > 0 && !slices.Contains(r.types, query.Type) || slices.Contains(r.notTypes, query.Type) {
+		return false
+	}
+
+	return (len(r.clients) == 0 || containsClient(r.clients, query.Client)) && !containsClient(r.notClients, query.Client)
+}
+
+func containsClient(prefixes []netip.Prefix, client netip.Addr) bool {
+	if !client.IsValid() {
+		return false
+	}
+
+	client = client.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(client) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchRules collects the rules with modifiers that apply to the query,
+// must be called with f.mu held
+func (f *FilterList) matchRules(domain string, query Query) []*rule {
+	var (
+		matched  []*rule
+		suffix   string = domain
+		dotIndex int
+	)
+	for len(f.rules) > 0 {
+		for _, r := range f.rules[suffix] {
+			if r.applies(query) {
+				matched = append(matched, r)
+			}
+		}
+
+		if dotIndex = strings.IndexByte(suffix, '.'); dotIndex == -1 {
+			break
+		}
+		suffix = suffix[dotIndex+1:]
+	}
+
+	for _, r := range f.patternRules {
+		if r.pattern.MatchString(domain) && r.applies(query) {
+			matched = append(matched, r)
+		}
+	}
+
+	return matched
+}
+
+// Check decides a query the way AdGuard does: an $important exception
+// lets it through, then $important rules win, then exceptions, then
+// $dnsrewrite and last the blocking rules
+func (f *FilterList) Check(query Query) Verdict {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var (
+		domain            string = normalizeDomain(query.Domain)
+		importantAllow    *rule
+		importantBlock    *rule
+		allow             *rule
+		block             *rule
+		importantRewrites []*rule
+		rewrites          []*rule
+		noRewrite         bool
+	)
+	for _, r := range f.matchRules(domain, query) {
+		switch {
+		case r.exception && r.noRewrite:
+			noRewrite = true
+		case r.exception && r.important:
+			importantAllow = r
+		case r.exception:
+			allow = r
+		case r.rewrite != nil && r.important:
+			importantRewrites = append(importantRewrites, r)
+		case r.rewrite != nil:
+			rewrites = append(rewrites, r)
+		case r.important:
+			importantBlock = r
+		default:
+			block = r
+		}
+	}
+
+	switch {
+	case importantAllow != nil:
+		return Verdict{Rule: importantAllow.text, List: importantAllow.list}
+	case len(importantRewrites) > 0:
+		return rewriteVerdict(importantRewrites)
+	case importantBlock != nil:
+		return Verdict{Blocked: true, Rule: importantBlock.text, List: importantBlock.list}
+	case allow != nil:
+		return Verdict{Rule: allow.text, List: allow.list}
+	case f.isAllowed(domain):
+		return Verdict{}
+	case len(rewrites) > 0 && !noRewrite:
+		return rewriteVerdict(rewrites)
+	case block != nil:
+		return Verdict{Blocked: true, Rule: block.text, List: block.list}
+	}
+
+	var (
+		suffix  string
+		pattern patternRule
+		found   bool
+	)
+	if suffix, found = matchSuffix(f.domains, domain); found {
+		return Verdict{Blocked: true, Rule: suffix, List: f.domains[suffix]}
+	}
+	if pattern, found = f.patterns.match(domain); found {
+		return Verdict{Blocked: true, Rule: "/" + pattern.String() + "/", List: pattern.list}
+	}
+
+	return Verdict{}
+}
+
+func rewriteVerdict(rules []*rule) Verdict {
+	var verdict Verdict = Verdict{Rule: rules[0].text, List: rules[0].list}
+	for _, r := range rules {
+		verdict.Rewrites = append(verdict.Rewrites, *r.rewrite)
+	}
+
+	return verdict
+}
+
+// RewriteTarget is the name a CNAME rewrite points to when the rewrites
+// hold no record of the asked type, the caller resolves it to complete
+// the answer
+func RewriteTarget(rewrites []Rewrite, qtype uint16) (string, bool) {
+	var target string
+	for _, rewrite := range rewrites {
+		switch {
+		case rewrite.Rcode != dns.RCODE_NOERROR:
+			return "", false
+		case rewrite.Type == qtype:
+			return "", false
+		case rewrite.Type == dns.TYPE_CNAME && target == "":
+			target = rewrite.Value
+		}
+	}
+
+	return target, target != ""
+}
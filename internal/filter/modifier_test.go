@@ -0,0 +1,204 @@
+package filter
+
+import (
+	"bytes"
+	"flash-dns/internal/dns"
+	"net/netip"
+	"testing"
+)
+
+// loadRules parses adblock rules into a new list
+func loadRules(t *testing.T, rules string) (*FilterList, LoadStats) {
+	var (
+		f     *FilterList = NewFilterList()
+		stats LoadStats
+		err   error
+	)
+	if stats, err = f.LoadFile(writeList(t, rules), FORMAT_ADBLOCK); err != nil {
+		t.Fatalf("Failed to load rules: %v", err)
+	}
+
+	return f, stats
+}
+
+// TEST 1: $dnstype
+// Tests that a rule only applies to the listed query types, ~ excludes a type
+func TestFilterList_Check_DNSType(t *testing.T) {
+	var f *FilterList
+	f, _ = loadRules(t, "||v6.example^$dnstype=AAAA\n||mail.example^$dnstype=~MX\n")
+
+	if !f.Check(Query{Domain: "v6.example", Type: dns.TYPE_AAAA}).Blocked {
+		t.Error("AAAA queries should be blocked")
+	}
+	if f.Check(Query{Domain: "v6.example", Type: dns.TYPE_A}).Blocked {
+		t.Error("A queries should not be blocked")
+	}
+	if !f.Check(Query{Domain: "www.mail.example", Type: dns.TYPE_A}).Blocked {
+		t.Error("Types other than MX should be blocked")
+	}
+	if f.Check(Query{Domain: "mail.example", Type: dns.TYPE_MX}).Blocked {
+		t.Error("MX queries should not be blocked")
+	}
+	if f.Count() != 2 {
+		t.Errorf("Expected 2 rules, got %d", f.Count())
+	}
+}
+
+// TEST 2: $client
+// Tests addresses, networks and negated clients, unknown clients only
+// match rules that are not scoped to clients
+func TestFilterList_Check_Client(t *testing.T) {
+	var (
+		f    *FilterList
+		kids netip.Addr = netip.MustParseAddr("192.168.1.20")
+		host netip.Addr = netip.MustParseAddr("192.168.2.1")
+	)
+	f, _ = loadRules(t, "||games.com^$client=192.168.1.0/24|'fd00::1'\n||social.com^$client=~192.168.2.1\n")
+
+	if !f.Check(Query{Domain: "games.com", Client: kids}).Blocked {
+		t.Error("Clients in the network should be blocked")
+	}
+	if !f.Check(Query{Domain: "games.com", Client: netip.MustParseAddr("fd00::1")}).Blocked {
+		t.Error("The listed IPv6 client should be blocked")
+	}
+	if !f.Check(Query{Domain: "games.com", Client: netip.MustParseAddr("::ffff:192.168.1.7")}).Blocked {
+		t.Error("IPv4-mapped clients should match their IPv4 network")
+	}
+	if f.Check(Query{Domain: "games.com", Client: host}).Blocked || f.Check(Query{Domain: "games.com"}).Blocked {
+		t.Error("Other and unknown clients should not be blocked")
+	}
+
+	if f.Check(Query{Domain: "social.com", Client: host}).Blocked {
+		t.Error("The excluded client should not be blocked")
+	}
+	if !f.Check(Query{Domain: "social.com", Client: kids}).Blocked || !f.Check(Query{Domain: "social.com"}).Blocked {
+		t.Error("Every other client should be blocked")
+	}
+}
+
+// TEST 3: $important
+// Tests that an important rule beats an exception and the allowlist,
+// and an important exception beats it
+func TestFilterList_Check_Important(t *testing.T) {
+	var (
+		f       *FilterList
+		verdict Verdict
+	)
+	f, _ = loadRules(t, "||tracker.com^$important\n@@||tracker.com^\n||ads.com^\n@@||ads.com^\n||cdn.com^$important\n@@||cdn.com^$important\n")
+	f.Allow("tracker.com")
+
+	if verdict = f.Check(Query{Domain: "tracker.com"}); !verdict.Blocked || verdict.Rule != "||tracker.com^$important" {
+		t.Errorf("Important rule should win over exceptions, got %+v", verdict)
+	}
+	if f.Check(Query{Domain: "ads.com"}).Blocked {
+		t.Error("Exceptions should still win over plain rules")
+	}
+	if f.Check(Query{Domain: "cdn.com"}).Blocked {
+		t.Error("Important exceptions should win over important rules")
+	}
+}
+
+// TEST 4: $badfilter
+// Tests that a badfilter cancels the rule it names, loaded before or
+// after it, and leaves other rules alone
+func TestFilterList_Check_Badfilter(t *testing.T) {
+	var f *FilterList
+	f, _ = loadRules(t, "||ads.com^\n||ads.com^$badfilter\n||tracker.com^$badfilter\n||tracker.com^\n||v6.com^$dnstype=AAAA,badfilter\n||v6.com^$dnstype=AAAA\n||v6.com^$dnstype=A\n/^ad[0-9]+\\./$badfilter\n/^ad[0-9]+\\./\n@@||safe.com^$badfilter\n@@||safe.com^\n||safe.com^\n")
+
+	for _, domain := range []string{"ads.com", "tracker.com", "ad1.example.com"} {
+		if f.IsBlocked(domain) {
+			t.Errorf("%s should not be blocked once badfiltered", domain)
+		}
+	}
+	if f.Check(Query{Domain: "v6.com", Type: dns.TYPE_AAAA}).Blocked {
+		t.Error("The badfiltered AAAA rule should be gone")
+	}
+	if !f.Check(Query{Domain: "v6.com", Type: dns.TYPE_A}).Blocked {
+		t.Error("Rules with other modifiers should stay")
+	}
+	if !f.IsBlocked("safe.com") {
+		t.Error("A badfiltered exception should not allow the domain")
+	}
+	if f.Count() != 2 {
+		t.Errorf("Expected 2 rules left, got %d", f.Count())
+	}
+}
+
+// TEST 5: $dnsrewrite
+// Tests the short and full forms and that @@$dnsrewrite cancels rewrites
+func TestFilterList_Check_DNSRewrite(t *testing.T) {
+	var (
+		f       *FilterList
+		stats   LoadStats
+		verdict Verdict
+	)
+	f, stats = loadRules(t, "||nas.lan^$dnsrewrite=192.168.1.10\n||nas.lan^$dnsrewrite=NOERROR;AAAA;fd00::10\n||blocked.lan^$dnsrewrite=REFUSED\n||search.com^$dnsrewrite=safe.example.com\n||txt.lan^$dnsrewrite=NOERROR;TXT;hello world\n||old.lan^$dnsrewrite=1.2.3.4\n@@||old.lan^$dnsrewrite\n||bad.lan^$dnsrewrite=NOERROR;A;fd00::1\n||bad.lan^$popup\n")
+
+	if stats.Malformed != 2 {
+		t.Errorf("Expected 2 malformed rules, got %d", stats.Malformed)
+	}
+
+	verdict = f.Check(Query{Domain: "nas.lan", Type: dns.TYPE_A})
+	if verdict.Blocked || len(verdict.Rewrites) != 2 {
+		t.Fatalf("Expected both nas.lan rewrites, got %+v", verdict)
+	}
+	if verdict.Rewrites[0] != (Rewrite{Type: dns.TYPE_A, Value: "192.168.1.10"}) || verdict.Rewrites[1] != (Rewrite{Type: dns.TYPE_AAAA, Value: "fd00::10"}) {
+		t.Errorf("Unexpected rewrites %+v", verdict.Rewrites)
+	}
+
+	if verdict = f.Check(Query{Domain: "blocked.lan"}); len(verdict.Rewrites) != 1 || verdict.Rewrites[0].Rcode != dns.RCODE_REFUSED {
+		t.Errorf("Expected a REFUSED rewrite, got %+v", verdict)
+	}
+	if verdict = f.Check(Query{Domain: "txt.lan"}); len(verdict.Rewrites) != 1 || verdict.Rewrites[0].Type != dns.TYPE_TXT {
+		t.Errorf("Expected a TXT rewrite, got %+v", verdict)
+	}
+	if verdict = f.Check(Query{Domain: "old.lan"}); len(verdict.Rewrites) != 0 || verdict.Blocked {
+		t.Errorf("@@$dnsrewrite should cancel the rewrite, got %+v", verdict)
+	}
+
+	if target, found := RewriteTarget(f.Check(Query{Domain: "search.com"}).Rewrites, dns.TYPE_A); !found || target != "safe.example.com" {
+		t.Errorf("Expected safe.example.com as CNAME target, got %q", target)
+	}
+	if _, found := RewriteTarget(f.Check(Query{Domain: "nas.lan"}).Rewrites, dns.TYPE_A); found {
+		t.Error("Rewrites holding the asked type need no target")
+	}
+}
+
+// TEST 6: Rewritten responses
+// Tests the records of the asked type, CNAMEs with the extra records and
+// rewritten response codes
+func TestCreateRewriteResponse(t *testing.T) {
+	var (
+		rewrites []Rewrite = []Rewrite{{Type: dns.TYPE_A, Value: "192.168.1.10"}, {Type: dns.TYPE_AAAA, Value: "fd00::10"}}
+		query    []byte
+		message  *dns.Message
+		target   dns.Resource = dns.Resource{Name: "safe.example.com", Type: dns.TYPE_A, Class: 1, TTL: 60, Data: []byte{5, 6, 7, 8}}
+		err      error
+	)
+	query, _ = dns.BuildQuery(0x1234, "nas.lan", dns.TYPE_A)
+
+	if message, err = dns.Parse(CreateRewriteResponse(query, rewrites)); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if message.ID != 0x1234 || message.Rcode() != dns.RCODE_NOERROR || len(message.Answers) != 1 {
+		t.Fatalf("Expected one answer to 0x1234, got %+v", message)
+	}
+	if !bytes.Equal(message.Answers[0].Data, []byte{192, 168, 1, 10}) || message.Answers[0].Name != "nas.lan" {
+		t.Errorf("Unexpected answer %+v", message.Answers[0])
+	}
+
+	query, _ = dns.BuildQuery(1, "search.com", dns.TYPE_A)
+	if message, err = dns.Parse(CreateRewriteResponse(query, []Rewrite{{Type: dns.TYPE_CNAME, Value: "safe.example.com"}}, target)); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(message.Answers) != 2 || message.Answers[0].Type != dns.TYPE_CNAME || message.Answers[1].Name != "safe.example.com" {
+		t.Errorf("Expected the CNAME and its target, got %+v", message.Answers)
+	}
+
+	if message, err = dns.Parse(CreateRewriteResponse(query, []Rewrite{{Rcode: dns.RCODE_REFUSED}})); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if message.Rcode() != dns.RCODE_REFUSED || len(message.Answers) != 0 {
+		t.Errorf("Expected an empty REFUSED answer, got rcode %d with %d answers", message.Rcode(), len(message.Answers))
+	}
+}
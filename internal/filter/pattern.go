@@ -0,0 +1,132 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strings"
+)
+
+const (
+	MAX_PATTERN_LENGTH  int = 1024 // longest regex or glob source accepted
+	MAX_PATTERN_PROGRAM int = 4096 // most instructions a compiled pattern may take
+)
+
+// patternIndex holds the regex and glob rules, they are checked one by one
+// so they only run after the map lookup missed. Go regexps are RE2, they
+// match in linear time and refuse backreferences, the caps keep a single
+// rule from getting too big to check on every query
+type patternIndex struct {
+	rules []patternRule
+}
+
+// patternRule is a compiled pattern and the list it came from
+type patternRule struct {
+	*regexp.Regexp
+	list string
+}
+
+func (p *patternIndex) match(domain string) (patternRule, bool) {
+	for _, rule := range p.rules {
+		if rule.MatchString(domain) {
+			return rule, true
+		}
+	}
+
+	return patternRule{}, false
+}
+
+func (p *patternIndex) len() int {
+	return len(p.rules)
+}
+
+// remove drops the rules compiled from expression
+func (p *patternIndex) remove(expression string) {
+	p.rules = slices.DeleteFunc(p.rules, func(rule patternRule) bool { return rule.String() == expression })
+}
+
+// compilePattern checks expression against the caps before compiling it
+func compilePattern(expression string) (*regexp.Regexp, error) {
+	var (
+		parsed  *syntax.Regexp
+		program *syntax.Prog
+		err     error
+	)
+	if len(expression) > MAX_PATTERN_LENGTH {
+		return nil, fmt.Errorf("pattern longer than %d bytes", MAX_PATTERN_LENGTH)
+	}
+
+	if parsed, err = syntax.Parse(expression, syntax.Perl); err != nil {
+		return nil, err
+	}
+	if program, err = syntax.Compile(parsed.Simplify()); err != nil {
+		return nil, err
+	}
+	if len(program.Inst) > MAX_PATTERN_PROGRAM {
+		return nil, fmt.Errorf("pattern compiles to %d instructions, more than %d", len(program.Inst), MAX_PATTERN_PROGRAM)
+	}
+
+	return regexp.Compile(expression)
+}
+
+// globToRegex turns a glob where * stands for any run of characters into
+// an anchored regex, subdomains also matches any name below the glob like
+// ||domain^ does
+func globToRegex(glob string, subdomains bool) string {
+	var (
+		builder strings.Builder
+		parts   []string = strings.Split(normalizeDomain(glob), "*")
+	)
+	builder.WriteString("^")
+	if subdomains {
+		builder.WriteString(`(.*\.)?`)
+	}
+	for i, part := range parts {
+		if i > 0 {
+			builder.WriteString(".*")
+		}
+		builder.WriteString(regexp.QuoteMeta(part))
+	}
+	builder.WriteString("$")
+
+	return builder.String()
+}
+
+// isRegexRule reports a /regex/ rule
+func isRegexRule(rule string) bool {
+	return len(rule) > 2 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/")
+}
+
+// AddRegex blocks every domain matching expression, domains are matched
+// in lowercase without the trailing dot
+func (f *FilterList) AddRegex(expression string) error {
+	return f.addPattern(&f.patterns, expression, "")
+}
+
+// AddGlob blocks every domain matching glob, * stands for any run of
+// characters, dots included
+func (f *FilterList) AddGlob(glob string) error {
+	return f.addPattern(&f.patterns, globToRegex(glob, false), "")
+}
+
+// AllowRegex exempts every domain matching expression from blocking
+func (f *FilterList) AllowRegex(expression string) error {
+	return f.addPattern(&f.allowedPatterns, expression, "")
+}
+
+func (f *FilterList) addPattern(index *patternIndex, expression string, list string) error {
+	var (
+		rule *regexp.Regexp
+		err  error
+	)
+	if rule, err = compilePattern(expression); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	index.rules = append(index.rules, patternRule{Regexp: rule, list: list})
+
+	return nil
+}
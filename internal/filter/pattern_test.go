@@ -0,0 +1,104 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+// TEST 1: Regex rules
+// Tests that a regex blocks what it matches and nothing else
+func TestFilterList_AddRegex(t *testing.T) {
+	var f *FilterList = NewFilterList()
+	if err := f.AddRegex(`^ad[0-9]+\.`); err != nil {
+		t.Fatalf("AddRegex failed: %v", err)
+	}
+
+	if !f.IsBlocked("ad1.example.com") || !f.IsBlocked("AD42.Example.com.") {
+		t.Error("Domains matching the regex should be blocked")
+	}
+	if f.IsBlocked("ads.example.com") || f.IsBlocked("www.ad1.example.com") {
+		t.Error("Domains not matching the regex should not be blocked")
+	}
+	if f.Count() != 1 {
+		t.Errorf("Expected 1 rule, got %d", f.Count())
+	}
+}
+
+// TEST 2: Glob rules
+// Tests that * spans any characters, dots included
+func TestFilterList_AddGlob(t *testing.T) {
+	var f *FilterList = NewFilterList()
+	if err := f.AddGlob("*.tracker.*"); err != nil {
+		t.Fatalf("AddGlob failed: %v", err)
+	}
+
+	for _, domain := range []string{"a.tracker.com", "x.y.tracker.co.uk"} {
+		if !f.IsBlocked(domain) {
+			t.Errorf("%s should be blocked", domain)
+		}
+	}
+	for _, domain := range []string{"tracker.com", "notatracker.com", "a.tracker"} {
+		if f.IsBlocked(domain) {
+			t.Errorf("%s should not be blocked", domain)
+		}
+	}
+}
+
+// TEST 3: Patterns in lists
+// Tests /regex/ and ||glob^ rules and their exceptions in an adblock list,
+// and globs in a plain domain list
+func TestFilterList_LoadFile_Patterns(t *testing.T) {
+	var (
+		f     *FilterList = NewFilterList()
+		stats LoadStats
+		err   error
+	)
+	stats, err = f.LoadFile(writeList(t, "||ads.com^\n/^ad[0-9]+\\./\n||metrics*.example^\n@@/^ad0\\./\n/(a)\\1/\n"), FORMAT_ADBLOCK)
+	if err != nil {
+		t.Fatalf("Failed to load file: %v", err)
+	}
+
+	if stats.Parsed != 4 || stats.Malformed != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if !f.IsBlocked("ad7.site.org") || !f.IsBlocked("cdn.metrics-eu.example") {
+		t.Error("Expected the pattern rules to block")
+	}
+	if f.IsBlocked("ad0.site.org") {
+		t.Error("The regex exception should win")
+	}
+
+	if stats, err = f.LoadFile(writeList(t, "telemetry.*.net\n*.tracker.org\n"), FORMAT_AUTO); err != nil {
+		t.Fatalf("Failed to load file: %v", err)
+	}
+	if stats.Format != FORMAT_DOMAINS || stats.Parsed != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if !f.IsBlocked("telemetry.eu.net") || !f.IsBlocked("tracker.org") {
+		t.Error("Expected the glob and the wildcard domain to block")
+	}
+}
+
+// TEST 4: Dangerous patterns are refused
+// Tests the length and program caps and RE2 only syntax
+func TestFilterList_AddRegex_Caps(t *testing.T) {
+	var (
+		f     *FilterList = NewFilterList()
+		tests             = []string{
+			strings.Repeat("a", MAX_PATTERN_LENGTH+1),                 // too long
+			`[a-z]{1000}[0-9]{1000}[a-f]{1000}[g-h]{1000}[x-y]{1000}`, // too many instructions
+			`(a)\1`,   // backreference, not RE2
+			`(?=ads)`, // lookahead, not RE2
+			`[`,       // does not parse
+		}
+	)
+
+	for _, expression := range tests {
+		if err := f.AddRegex(expression); err == nil {
+			t.Errorf("Expected %.20q to be refused", expression)
+		}
+	}
+	if f.Count() != 0 {
+		t.Errorf("Refused patterns should not be added, got %d rules", f.Count())
+	}
+}
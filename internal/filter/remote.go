@@ -0,0 +1,154 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flash-dns/internal/logger"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DOWNLOAD_TIMEOUT time.Duration = 60 * time.Second // longest a list download may take
+	MAX_LIST_SIZE    int64         = 64 << 20         // biggest list accepted, HaGeZi ultimate is about 10MB
+)
+
+// remoteMeta is kept next to the copy of a remote list, its validators
+// make the next download conditional
+type remoteMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// download fetches a remote list with If-None-Match and If-Modified-Since
+// and reports whether its copy on disk changed. a download without a
+// single rule is refused so an error page can not replace a good copy
+func (b *Blocklists) download(ctx context.Context, list List) (bool, error) {
+	var (
+		copyPath string = b.copyPath(list)
+		meta     remoteMeta
+		previous []byte
+		request  *http.Request
+		response *http.Response
+		content  []byte
+		stats    LoadStats
+		err      error
+	)
+	if previous, err = os.ReadFile(copyPath); err == nil {
+		meta = readMeta(copyPath)
+	}
+
+	if request, err = http.NewRequestWithContext(ctx, http.MethodGet, list.Path, nil); err != nil {
+		return false, err
+	}
+	// validators are only good for the url and the copy they came with
+	if meta.URL == list.Path && previous != nil {
+		if meta.ETag != "" {
+			request.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			request.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	if response, err = b.client.Do(request); err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusNotModified:
+		logger.Info(fmt.Sprintf("List %s not modified since the last download", list.Name))
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("%s answered %s", list.Path, response.Status)
+	}
+
+	if content, err = io.ReadAll(io.LimitReader(response.Body, MAX_LIST_SIZE+1)); err != nil {
+		return false, err
+	}
+	if int64(len(content)) > MAX_LIST_SIZE {
+		return false, fmt.Errorf("%s is bigger than %d bytes", list.Path, MAX_LIST_SIZE)
+	}
+	if stats = NewFilterList().load(content, list.Format, list.Name); stats.Parsed == 0 {
+		return false, fmt.Errorf("%s holds no rule", list.Path)
+	}
+
+	meta = remoteMeta{URL: list.Path, ETag: response.Header.Get("ETag"), LastModified: response.Header.Get("Last-Modified")}
+	if bytes.Equal(content, previous) {
+		writeMeta(copyPath, meta)
+		logger.Info(fmt.Sprintf("List %s downloaded, unchanged", list.Name))
+		return false, nil
+	}
+
+	if err = writeAtomic(copyPath, content); err != nil {
+		return false, err
+	}
+	writeMeta(copyPath, meta)
+	logger.Info(fmt.Sprintf("List %s downloaded from %s: %d bytes", list.Name, list.Path, len(content)))
+
+	return true, nil
+}
+
+// writeAtomic replaces filename through a rename, a crash mid-write leaves
+// the previous copy in place
+func writeAtomic(filename string, content []byte) error {
+	var (
+		file *os.File
+		err  error
+	)
+	if file, err = os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp"); err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(content)
+	if err = errors.Join(err, file.Close()); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filename)
+}
+
+func metaPath(copyPath string) string {
+	return copyPath + ".json"
+}
+
+// readMeta is empty when the file is missing or broken, the download is
+// then unconditional
+func readMeta(copyPath string) remoteMeta {
+	var (
+		meta    remoteMeta
+		content []byte
+		err     error
+	)
+	if content, err = os.ReadFile(metaPath(copyPath)); err != nil {
+		return remoteMeta{}
+	}
+	if err = json.Unmarshal(content, &meta); err != nil {
+		return remoteMeta{}
+	}
+
+	return meta
+}
+
+func writeMeta(copyPath string, meta remoteMeta) {
+	var (
+		content []byte
+		err     error
+	)
+	if content, err = json.Marshal(meta); err == nil {
+		err = writeAtomic(metaPath(copyPath), content)
+	}
+	if err != nil {
+		logger.Warn(fmt.Sprintf("Failed to save the validators of %s: %v", copyPath, err))
+	}
+}
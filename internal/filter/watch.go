@@ -0,0 +1,107 @@
+package filter
+
+import (
+	"context"
+	"flash-dns/internal/logger"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const WATCH_DELAY time.Duration = time.Second // quiet time after a change before reloading, editors write in bursts
+
+// fileEvent is a change to name inside dir, an empty name means events
+// were lost and anything in dir may have changed
+type fileEvent struct {
+	dir  string
+	name string
+}
+
+// Watch reloads the filter when a local list or the allowlist changes,
+// directories are watched rather than files so lists replaced through a
+// rename are seen too. it returns once ctx is done, or right away when
+// the watch can not be set up
+func (b *Blocklists) Watch(ctx context.Context) error {
+	var (
+		targets map[string][]string = b.watchTargets()
+		events  <-chan fileEvent
+		event   fileEvent
+		open    bool
+		changed string
+		timer   *time.Timer
+		err     error
+	)
+	if len(targets) == 0 {
+		return nil
+	}
+
+	if events, err = watchDirs(ctx, slices.Sorted(maps.Keys(targets))); err != nil {
+		return err
+	}
+	logger.Info(fmt.Sprintf("Watching %d directories for blocklist changes", len(targets)))
+
+	timer = time.NewTimer(b.watchDelay)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case event, open = <-events:
+			if !open {
+				return nil
+			}
+			if event.name == "" || matchesAny(targets[event.dir], event.name) {
+				changed = filepath.Join(event.dir, event.name)
+				timer.Reset(b.watchDelay)
+			}
+
+		case <-timer.C:
+			logger.Info(fmt.Sprintf("Reloading blocklists, %s changed", changed))
+			if err = b.Reload(); err != nil {
+				logger.Error(fmt.Sprintf("Failed to reload blocklists: %v", err))
+			}
+		}
+	}
+}
+
+// watchTargets maps every directory holding a local list or the allowlist
+// to the names in it that belong to them
+func (b *Blocklists) watchTargets() map[string][]string {
+	var (
+		targets map[string][]string = make(map[string][]string)
+		paths   []string
+		info    os.FileInfo
+		err     error
+	)
+	for _, list := range b.config.Lists {
+		if list.Enabled && !list.Remote() {
+			paths = append(paths, list.Path)
+		}
+	}
+	if b.config.AllowFile != "" {
+		paths = append(paths, b.config.AllowFile)
+	}
+
+	for _, path := range paths {
+		if info, err = os.Stat(path); err == nil && info.IsDir() {
+			targets[path] = append(targets[path], "*")
+			continue
+		}
+		targets[filepath.Dir(path)] = append(targets[filepath.Dir(path)], filepath.Base(path))
+	}
+
+	return targets
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,104 @@
+//go:build linux
+
+package filter
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const (
+	WATCH_EVENTS      uint32 = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+	WATCH_BUFFER_SIZE int    = 64 * 1024 // room for a burst of events, each is 16 bytes plus its name
+)
+
+// watchDirs reports the changes inside dirs through inotify, the channel
+// is closed once ctx is done
+func watchDirs(ctx context.Context, dirs []string) (<-chan fileEvent, error) {
+	var (
+		fd      int
+		wd      int
+		file    *os.File
+		watches map[int32]string = make(map[int32]string, len(dirs))
+		events  chan fileEvent   = make(chan fileEvent, 16)
+		err     error
+	)
+	if fd, err = syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK); err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	// non blocking, reads go through the runtime poller and Close stops them
+	file = os.NewFile(uintptr(fd), "inotify")
+
+	for _, dir := range dirs {
+		if wd, err = syscall.InotifyAddWatch(fd, dir, WATCH_EVENTS); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("watching %s: %w", dir, err)
+		}
+		watches[int32(wd)] = dir
+	}
+
+	context.AfterFunc(ctx, func() { file.Close() })
+	go func() {
+		defer close(events)
+
+		var (
+			buffer    []byte = make([]byte, WATCH_BUFFER_SIZE)
+			bytesRead int
+			offset    int
+			event     fileEvent
+			found     bool
+			err       error
+		)
+		for {
+			if bytesRead, err = file.Read(buffer); err != nil {
+				return
+			}
+
+			for offset = 0; offset+syscall.SizeofInotifyEvent <= bytesRead; {
+				var (
+					watch  int32  = int32(binary.NativeEndian.Uint32(buffer[offset:]))
+					mask   uint32 = binary.NativeEndian.Uint32(buffer[offset+4:])
+					length int    = int(binary.NativeEndian.Uint32(buffer[offset+12:]))
+					name   []byte = buffer[offset+syscall.SizeofInotifyEvent : min(offset+syscall.SizeofInotifyEvent+length, bytesRead)]
+				)
+				offset += syscall.SizeofInotifyEvent + length
+
+				switch {
+				case mask&syscall.IN_Q_OVERFLOW != 0:
+					// events were dropped, every directory may have changed
+					for _, dir := range watches {
+						if !sendEvent(ctx, events, fileEvent{dir: dir}) {
+							return
+						}
+					}
+					continue
+				case mask&syscall.IN_IGNORED != 0:
+					continue
+				}
+
+				if event.dir, found = watches[watch]; !found {
+					continue
+				}
+				event.name = strings.TrimRight(string(name), "\x00")
+				if !sendEvent(ctx, events, event) {
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+func sendEvent(ctx context.Context, events chan<- fileEvent, event fileEvent) bool {
+	select {
+	case events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
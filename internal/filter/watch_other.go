@@ -0,0 +1,13 @@
+//go:build !linux
+
+package filter
+
+import (
+	"context"
+	"errors"
+)
+
+// watchDirs needs inotify, elsewhere lists are reloaded with SIGHUP only
+func watchDirs(ctx context.Context, dirs []string) (<-chan fileEvent, error) {
+	return nil, errors.New("watching list files needs inotify, only available on linux")
+}
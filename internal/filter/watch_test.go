@@ -0,0 +1,111 @@
+package filter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TEST 1: What is watched
+// Tests that the directories of local lists and the allowlist are watched
+// for their own names, remote and disabled lists are left out
+func TestBlocklists_WatchTargets(t *testing.T) {
+	var (
+		directory  string = t.TempDir()
+		blocklists *Blocklists
+		targets    map[string][]string
+	)
+	blocklists = NewBlocklists(BlocklistsConfig{
+		Lists: []List{
+			{Name: "ads", Path: filepath.Join(directory, "ads.txt"), Enabled: true},
+			{Name: "extra", Path: filepath.Join(directory, "extra", "*.txt"), Enabled: true},
+			{Name: "all", Path: directory, Enabled: true},
+			{Name: "off", Path: "/etc/off.txt"},
+			{Name: "remote", Path: "https://example.com/list.txt", Enabled: true},
+		},
+		AllowFile: filepath.Join(directory, "allow.txt"),
+	})
+
+	targets = blocklists.watchTargets()
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 directories, got %v", targets)
+	}
+	if !slices.Equal(targets[directory], []string{"ads.txt", "*", "allow.txt"}) || !slices.Equal(targets[filepath.Join(directory, "extra")], []string{"*.txt"}) {
+		t.Errorf("Unexpected targets %v", targets)
+	}
+	if !matchesAny(targets[filepath.Join(directory, "extra")], "more.txt") || matchesAny([]string{"ads.txt"}, "ads.txt.swp") {
+		t.Error("Names should be matched against the list patterns")
+	}
+}
+
+// TEST 2: Reloading on change
+// Tests that a list replaced through a rename is reloaded, and that an
+// empty write keeps the current filter
+func TestBlocklists_Watch(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("watching needs inotify")
+	}
+
+	var (
+		directory  string = t.TempDir()
+		filename   string = filepath.Join(directory, "ads.txt")
+		ctx        context.Context
+		cancel     context.CancelFunc
+		blocklists *Blocklists
+		done       chan error = make(chan error, 1)
+		current    *FilterList
+	)
+	os.WriteFile(filename, []byte("||ads.com^\n"), 0o644)
+	blocklists = NewBlocklists(BlocklistsConfig{Lists: []List{{Name: "ads", Path: filename, Format: FORMAT_ADBLOCK, Enabled: true}}, CacheDir: t.TempDir()})
+	blocklists.watchDelay = 20 * time.Millisecond
+	if err := blocklists.Load(context.Background()); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { done <- blocklists.Watch(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+
+	os.WriteFile(filepath.Join(directory, "unrelated.txt"), []byte("||unrelated.com^\n"), 0o644)
+	if err := writeAtomic(filename, []byte("||ads.com^\n||tracker.com^\n")); err != nil {
+		t.Fatalf("Failed to replace the list: %v", err)
+	}
+	if !waitFor(func() bool { return blocklists.Check(Query{Domain: "tracker.com"}).Blocked }) {
+		t.Fatal("The replaced list should be reloaded")
+	}
+	if blocklists.Check(Query{Domain: "unrelated.com"}).Blocked {
+		t.Error("Files outside the lists should not be loaded")
+	}
+
+	current = blocklists.Filter()
+	os.WriteFile(filename, nil, 0o644)
+	time.Sleep(10 * blocklists.watchDelay)
+	if blocklists.Filter() != current {
+		t.Error("An empty list should keep the current filter")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Watch failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Watch should return once the context is done")
+	}
+}
+
+// waitFor polls condition for up to two seconds
+func waitFor(condition func() bool) bool {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+
+	return false
+}
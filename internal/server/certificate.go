@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto/tls"
+	"flash-dns/internal/logger"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const CERT_CHECK_INTERVAL time.Duration = 30 * time.Second // how often the files are checked for changes
+
+// certReloader serves the certificate from disk and loads it again when
+// the cert or key file changes, a broken pair keeps the previous one in use
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	var (
+		reloader *certReloader = &certReloader{certFile: certFile, keyFile: keyFile, interval: CERT_CHECK_INTERVAL}
+		modTime  time.Time
+		err      error
+	)
+	if modTime, err = reloader.lastModified(); err != nil {
+		return nil, err
+	}
+	if err = reloader.load(modTime); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var (
+		now     time.Time = time.Now()
+		modTime time.Time
+		err     error
+	)
+	if now.Sub(c.checkedAt) >= c.interval {
+		c.checkedAt = now
+		if modTime, err = c.lastModified(); err != nil {
+			logger.Warn(fmt.Sprintf("Failed to check certificate files: %v", err))
+		} else if modTime.After(c.modTime) {
+			if err = c.load(modTime); err != nil {
+				logger.Error(fmt.Sprintf("Failed to reload certificate, keeping the previous one: %v", err))
+			} else {
+				logger.Info(fmt.Sprintf("Certificate reloaded from %s", c.certFile))
+			}
+		}
+	}
+
+	return c.cert, nil
+}
+
+// TLSConfig returns a server config that always asks the reloader
+func (c *certReloader) TLSConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     nextProtos,
+	}
+}
+
+func (c *certReloader) load(modTime time.Time) error {
+	var (
+		cert tls.Certificate
+		err  error
+	)
+	cert, err = tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// lastModified is the newest modification time of the two files
+func (c *certReloader) lastModified() (time.Time, error) {
+	var (
+		certInfo os.FileInfo
+		keyInfo  os.FileInfo
+		err      error
+	)
+	if certInfo, err = os.Stat(c.certFile); err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo, err = os.Stat(c.keyFile); err != nil {
+		return time.Time{}, err
+	}
+
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
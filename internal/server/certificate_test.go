@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate stores the first certificate of config as PEM files
+func writeTestCertificate(t *testing.T, config *tls.Config, certFile, keyFile string) {
+	t.Helper()
+
+	var (
+		certificate tls.Certificate = config.Certificates[0]
+		keyDER      []byte
+		err         error
+	)
+	keyDER, err = x509.MarshalECPrivateKey(certificate.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]}), 0o644)
+	if err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	if err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+}
+
+// TEST 1: Certificate is loaded at start
+// Tests that a missing file is reported right away
+func TestNewCertReloader_MissingFile(t *testing.T) {
+	var (
+		dir string = t.TempDir()
+		err error
+	)
+
+	_, err = newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+
+	if err == nil {
+		t.Error("Expected error for missing certificate files")
+	}
+}
+
+// TEST 2: Changed files are picked up
+// Tests that a rewritten pair replaces the served certificate
+func TestCertReloader_ReloadsOnChange(t *testing.T) {
+	var (
+		dir      string = t.TempDir()
+		certFile string = filepath.Join(dir, "cert.pem")
+		keyFile  string = filepath.Join(dir, "key.pem")
+		first    *tls.Config
+		second   *tls.Config
+		reloader *certReloader
+		served   *tls.Certificate
+		err      error
+	)
+	first, _ = newTestTLSConfig(t)
+	second, _ = newTestTLSConfig(t)
+	writeTestCertificate(t, first, certFile, keyFile)
+
+	reloader, err = newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader failed: %v", err)
+	}
+	reloader.interval = 0
+
+	writeTestCertificate(t, second, certFile, keyFile)
+	os.Chtimes(certFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+
+	served, _ = reloader.GetCertificate(nil)
+	if !bytes.Equal(served.Certificate[0], second.Certificates[0].Certificate[0]) {
+		t.Error("Expected the rewritten certificate to be served")
+	}
+}
+
+// TEST 3: Broken files keep the previous certificate
+// Tests that a failed reload does not take the listener down
+func TestCertReloader_KeepsPreviousOnError(t *testing.T) {
+	var (
+		dir      string = t.TempDir()
+		certFile string = filepath.Join(dir, "cert.pem")
+		keyFile  string = filepath.Join(dir, "key.pem")
+		config   *tls.Config
+		reloader *certReloader
+		served   *tls.Certificate
+		err      error
+	)
+	config, _ = newTestTLSConfig(t)
+	writeTestCertificate(t, config, certFile, keyFile)
+
+	reloader, err = newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader failed: %v", err)
+	}
+	reloader.interval = 0
+
+	os.WriteFile(certFile, []byte("not a certificate"), 0o644)
+	os.Chtimes(certFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+
+	served, err = reloader.GetCertificate(nil)
+	if err != nil || served == nil {
+		t.Fatalf("Expected previous certificate, got error %v", err)
+	}
+	if !bytes.Equal(served.Certificate[0], config.Certificates[0].Certificate[0]) {
+		t.Error("Expected the previous certificate to stay in use")
+	}
+}
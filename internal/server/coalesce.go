@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"sync"
+)
+
+// call is one upstream lookup shared by every query waiting on its key
+type call struct {
+	done     chan struct{}
+	response []byte
+	err      error
+}
+
+// inflight deduplicates concurrent lookups of the same cache key, the first
+// query does the work and the others wait for its result. the zero value
+// is ready to use
+type inflight struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// do runs fn once for every caller asking for key at the same time and
+// reports whether the result came from another caller. the response is
+// shared so it must be cloned before being modified, a caller whose ctx
+// ends stops waiting but the lookup keeps going for the others
+func (f *inflight) do(ctx context.Context, key string, fn func() ([]byte, error)) ([]byte, bool, error) {
+	var (
+		current *call
+		found   bool
+	)
+	f.mu.Lock()
+	if f.calls == nil {
+		f.calls = make(map[string]*call)
+	}
+	if current, found = f.calls[key]; found {
+		f.mu.Unlock()
+
+		select {
+		case <-current.done:
+			return current.response, true, current.err
+		case <-ctx.Done():
+			return nil, true, ctx.Err()
+		}
+	}
+
+	current = &call{done: make(chan struct{})}
+	f.calls[key] = current
+	f.mu.Unlock()
+
+	current.response, current.err = fn()
+
+	f.mu.Lock()
+	delete(f.calls, key)
+	f.mu.Unlock()
+	close(current.done)
+
+	return current.response, false, current.err
+}
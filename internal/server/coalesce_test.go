@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TEST 1: Concurrent callers share one call
+// Tests that fn runs once and everyone gets its result
+func TestInflight_Shared(t *testing.T) {
+	var (
+		group   inflight
+		calls   atomic.Int32
+		shared  atomic.Int32
+		release chan struct{} = make(chan struct{})
+		wg      sync.WaitGroup
+		i       int
+	)
+
+	for i = 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, wasShared, err := group.do(context.Background(), "example.com:1", func() ([]byte, error) {
+				calls.Add(1)
+				<-release
+				return []byte("answer"), nil
+			})
+			if err != nil || string(response) != "answer" {
+				t.Errorf("Unexpected result %q, %v", response, err)
+			}
+			if wasShared {
+				shared.Add(1)
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 || shared.Load() != 9 {
+		t.Errorf("Expected 1 call and 9 shared results, got %d and %d", calls.Load(), shared.Load())
+	}
+}
+
+// TEST 2: Finished calls are not reused
+// Tests that a later caller starts a new lookup and errors are passed on
+func TestInflight_Sequential(t *testing.T) {
+	var (
+		group    inflight
+		expected error = errors.New("upstream failed")
+		err      error
+		shared   bool
+	)
+
+	if _, shared, err = group.do(context.Background(), "example.com:1", func() ([]byte, error) { return nil, expected }); !errors.Is(err, expected) || shared {
+		t.Errorf("Expected the error of the call, got %v (shared %v)", err, shared)
+	}
+	if _, shared, err = group.do(context.Background(), "example.com:1", func() ([]byte, error) { return []byte("answer"), nil }); err != nil || shared {
+		t.Errorf("Expected a fresh call, got %v (shared %v)", err, shared)
+	}
+}
+
+// TEST 3: A waiter can give up
+// Tests that a cancelled waiter returns while the lookup goes on
+func TestInflight_WaiterCancelled(t *testing.T) {
+	var (
+		group   inflight
+		release chan struct{} = make(chan struct{})
+		done    chan []byte   = make(chan []byte)
+		ctx     context.Context
+		cancel  context.CancelFunc
+		err     error
+	)
+
+	go func() {
+		response, _, _ := group.do(context.Background(), "example.com:1", func() ([]byte, error) {
+			<-release
+			return []byte("answer"), nil
+		})
+		done <- response
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err = group.do(ctx, "example.com:1", func() ([]byte, error) { return nil, nil }); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the waiter to time out, got %v", err)
+	}
+
+	close(release)
+	if response := <-done; string(response) != "answer" {
+		t.Errorf("Expected the lookup to finish, got %q", response)
+	}
+}
@@ -1,21 +1,37 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"flash-dns/internal/cache"
+	"flash-dns/internal/dns"
 	"flash-dns/internal/filter"
 	"flash-dns/internal/logger"
 	"flash-dns/internal/utils"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"net"
+	"net/http"
+	"net/netip"
+	"os"
 	"strings"
 	"time"
+
+	"github.com/quic-go/quic-go"
 )
 
 const (
-	CLEANUP_TIME        time.Duration = 90 * time.Second // set the interval to clean expired cache
-	REPORT_STATUS_TIME  time.Duration = 5 * time.Minute  // interval to report status to the log
-	CLIENT_REQUEST_TIME time.Duration = 3 * time.Second  // how long we will read a client request
+	CLEANUP_TIME             time.Duration = 90 * time.Second        // set the interval to clean expired cache
+	REPORT_STATUS_TIME       time.Duration = 5 * time.Minute         // interval to report status to the log
+	CLIENT_REQUEST_TIME      time.Duration = 3 * time.Second         // how long we will read a client request
+	DEFAULT_MAX_UDP          uint16        = 1232                    // EDNS0 payload size recommended by DNS flag day 2020
+	DEFAULT_MAX_NEGATIVE_TTL uint32        = 3600                    // longest a NXDOMAIN or NODATA answer is cached
+	DEFAULT_MAX_STALE        time.Duration = 5 * time.Minute         // age up to which expired answers are served, the old grace period
+	DEFAULT_STALE_TIMEOUT    time.Duration = 1800 * time.Millisecond // client response timer of RFC 8767
+	DEFAULT_FAILURE_RECHECK  time.Duration = 30 * time.Second        // no upstream retries for a stale name after a failure
 )
 
 // Interfaces to be used in the server
@@ -25,29 +41,48 @@ type Resolver interface {
 }
 
 type Filter interface {
-	IsBlocked(domain string) bool
+	Check(query filter.Query) filter.Verdict
 	Count() int
 }
 
 type Cache interface {
-	Get(key string) ([]byte, bool, bool)
+	Get(key string) ([]byte, bool, bool)      // the response is a copy the caller may modify
+	GetStale(key string) ([]byte, bool, bool) // response, found and whether upstream should be tried again
+	MarkFailed(key string)
 	Set(key string, response []byte, ttl uint32)
 	Clean()
 }
 
 type ServerStatistics interface {
 	incrementBlocked()
+	incrementBlockedBy(list string)
 	incrementAllowed()
 	incrementCacheHits()
 	incrementCacheMisses()
+	incrementNegativeHits()
+	incrementUpstreamFailures()
 	GetStats() (blocked, allowed, cacheHits, cacheMisses uint64)
+	GetBlockedByList() map[string]uint64
+	GetNegativeHits() uint64
+	GetUpstreamFailures() uint64
+	GetUpstreamHealth() []UpstreamHealth
 	Log()
 }
 
 type Config struct {
 	LocalAddr   string
 	UpstreamDns string
-	FilterMode  string // nxdomain or null, default to nxdomain
+	FilterMode  string        // nxdomain or null, default to nxdomain
+	MaxUDPSize  uint16        // largest EDNS0 udp payload we answer with, default to DEFAULT_MAX_UDP
+	MaxNegative uint32        // cap in seconds for cached negative answers, default to DEFAULT_MAX_NEGATIVE_TTL
+	MaxStale    time.Duration // how long expired answers may be served stale (RFC 8767), default to DEFAULT_MAX_STALE, negative disables it
+	StaleAfter  time.Duration // how long upstream gets before a stale answer is sent, default to DEFAULT_STALE_TIMEOUT
+	Recheck     time.Duration // pause after a failed refresh of a stale name, default to DEFAULT_FAILURE_RECHECK
+	DoTAddr     string        // address for DNS-over-TLS clients, empty disables it
+	DoHAddr     string        // address for DNS-over-HTTPS clients, empty disables it
+	DoQAddr     string        // udp address for DNS-over-QUIC clients, empty disables it
+	CertFile    string        // certificate used by the encrypted listeners
+	KeyFile     string
 }
 
 // server implementation
@@ -58,23 +93,64 @@ type DNSServer struct {
 	filter     Filter
 	resolver   Resolver
 	statistics ServerStatistics
+	inflight   inflight // upstream lookups shared by identical queries
 }
 
-func NewDNSServer(config Config, resolver Resolver, filterList *filter.FilterList) *DNSServer {
-	var statistics *Statistics = &Statistics{}
+// NewDNSServer answers with resolver, blocklist may be nil to filter nothing
+func NewDNSServer(config Config, resolver Resolver, blocklist Filter) *DNSServer {
+	var (
+		statistics *Statistics     = &Statistics{}
+		dnsCache   *cache.DNSCache = cache.NewDNSCache()
+	)
+	if monitor, ok := resolver.(UpstreamMonitor); ok {
+		statistics.upstreams = monitor
+	}
+	if config.MaxUDPSize < dns.DEFAULT_UDP_SIZE {
+		config.MaxUDPSize = DEFAULT_MAX_UDP
+	}
+	if config.MaxNegative == 0 {
+		config.MaxNegative = DEFAULT_MAX_NEGATIVE_TTL
+	}
+	if config.StaleAfter == 0 {
+		config.StaleAfter = DEFAULT_STALE_TIMEOUT
+	}
+	if config.Recheck == 0 {
+		config.Recheck = DEFAULT_FAILURE_RECHECK
+	}
+	if config.MaxStale == 0 {
+		config.MaxStale = DEFAULT_MAX_STALE
+	}
+	if config.MaxStale > 0 {
+		dnsCache.SetServeStale(config.MaxStale, config.Recheck)
+	}
+
 	return &DNSServer{
-		cache:      cache.NewDNSCache(),
+		cache:      dnsCache,
 		config:     config,
-		filter:     filterList,
+		filter:     blocklist,
 		resolver:   resolver,
 		statistics: statistics,
 	}
 }
 
 func (s *DNSServer) handleQuery(ctx context.Context, query []byte, clientAddr *net.UDPAddr, conn *net.UDPConn) {
+	var response []byte = s.processQuery(ctx, query, clientAddr.AddrPort().Addr(), true)
+	if response == nil {
+		return
+	}
+
+	conn.WriteToUDP(response, clientAddr)
+}
+
+// processQuery runs the filter/cache/upstream pipeline for a single query
+// and returns the wire response, nil means nothing should be sent back.
+// it is shared by every transport the server listens on, udp answers are
+// truncated to what the client can receive. client scopes $client rules,
+// it is the zero Addr when unknown
+func (s *DNSServer) processQuery(ctx context.Context, query []byte, client netip.Addr, udp bool) []byte {
 	select {
 	case <-ctx.Done():
-		return
+		return nil
 	default:
 	}
 
@@ -82,51 +158,204 @@ func (s *DNSServer) handleQuery(ctx context.Context, query []byte, clientAddr *n
 	var (
 		queryInfo *utils.QueryInfo
 		err       error
-		response  []byte = make([]byte, 512)
-		blocked   bool
+		response  []byte
+		verdict   filter.Verdict
 	)
 	queryInfo, err = utils.ParseQuery(query)
 	if err != nil {
 		logger.Error(fmt.Sprintf("failed to parse query: %v", err))
-		return
+		return nil
 	}
 
-	if blocked = s.filterDomain(queryInfo.Domain); blocked {
-		copy(response, s.createBlockedResponse(query))
-		conn.WriteToUDP(response, clientAddr)
-		return
+	if verdict = s.checkFilter(queryInfo, client); verdict.Blocked {
+		return s.finalizeResponse(queryInfo, s.createBlockedResponse(query), udp)
+	}
+	if len(verdict.Rewrites) > 0 {
+		return s.finalizeResponse(queryInfo, s.rewriteResponse(ctx, query, queryInfo, verdict.Rewrites), udp)
 	}
 	s.statistics.incrementAllowed()
 
 	// response from cache immediately
 	var (
-		cachedResponse []byte = make([]byte, 512)
+		cachedResponse []byte
 		found          bool
 		needsRefresh   bool
 	)
 	if cachedResponse, found, needsRefresh = s.getCache(queryInfo.CacheKey, queryInfo.Domain); found {
-		copy(response, cachedResponse)
-		copy(response[0:2], query[0:2])
+		response = cachedResponse
+		if len(response) >= 2 {
+			copy(response[0:2], query[0:2])
+		}
 		if needsRefresh {
 			logger.Info(fmt.Sprintf("REFRESH CACHE: %s", queryInfo.Domain))
 			go s.refreshCache(ctx, query, queryInfo)
 		}
 
-		conn.WriteToUDP(response, clientAddr)
-		return
+		return s.finalizeResponse(queryInfo, response, udp)
 	}
 
 	s.statistics.incrementCacheMisses()
+
+	// expired but still inside the stale window
+	var (
+		staleResponse []byte
+		recheck       bool
+	)
+	if staleResponse, found, recheck = s.cache.GetStale(queryInfo.CacheKey); found {
+		return s.finalizeResponse(queryInfo, s.serveStale(ctx, query, queryInfo, staleResponse, recheck), udp)
+	}
+
 	logger.Info(fmt.Sprintf("CACHE MISS: %s - querying Upstream", queryInfo.Domain))
 
 	// if miss, query upstream
-	response, err = s.queryUpstream(ctx, query, queryInfo)
+	response, err = s.resolveShared(ctx, query, queryInfo)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Failed to Resolve: %s - %v", queryInfo.Domain, err))
-		return
+		if ctx.Err() != nil {
+			return nil
+		}
+		return s.finalizeResponse(queryInfo, s.upstreamFailure(query, err), udp)
 	}
 
-	conn.WriteToUDP(response, clientAddr)
+	// the cache holds the same bytes, answer with a copy carrying the client ID
+	response = bytes.Clone(response)
+	if len(response) >= 2 {
+		copy(response[0:2], query[0:2])
+	}
+
+	return s.finalizeResponse(queryInfo, response, udp)
+}
+
+// serveStale follows RFC 8767 for an expired entry, upstream gets
+// StaleAfter to answer and the stale copy is sent when it is slower or
+// fails. a slow upstream keeps going and refreshes the cache once it
+// answers. after a failure the name is served stale without asking
+// upstream until the recheck time has passed
+func (s *DNSServer) serveStale(ctx context.Context, query []byte, queryInfo *utils.QueryInfo, stale []byte, recheck bool) []byte {
+	if !recheck {
+		logger.Info(fmt.Sprintf("STALE: %s (upstream failed recently)", queryInfo.Domain))
+		return staleAnswer(query, stale)
+	}
+
+	var (
+		result   chan []byte = make(chan []byte, 1)
+		timer    *time.Timer = time.NewTimer(s.config.StaleAfter)
+		response []byte
+	)
+	defer timer.Stop()
+
+	logger.Info(fmt.Sprintf("STALE CACHE: %s - querying Upstream", queryInfo.Domain))
+	go func() {
+		var (
+			response []byte
+			err      error
+		)
+		if response, err = s.resolveShared(ctx, query, queryInfo); err != nil {
+			logger.Error(fmt.Sprintf("Failed to Resolve: %s - %v", queryInfo.Domain, err))
+			if ctx.Err() == nil {
+				s.statistics.incrementUpstreamFailures()
+				s.cache.MarkFailed(queryInfo.CacheKey)
+			}
+		}
+		result <- response
+	}()
+
+	select {
+	case response = <-result:
+		if response == nil {
+			logger.Warn(fmt.Sprintf("STALE: %s (upstream failed)", queryInfo.Domain))
+			return staleAnswer(query, stale)
+		}
+
+		response = bytes.Clone(response)
+		copy(response[0:2], query[0:2])
+		return response
+
+	case <-timer.C:
+		logger.Warn(fmt.Sprintf("STALE: %s (upstream slower than %v)", queryInfo.Domain, s.config.StaleAfter))
+		return staleAnswer(query, stale)
+	}
+}
+
+// staleAnswer marks a stale copy with the client ID and, for EDNS0 clients,
+// an extended error saying it is stale
+func staleAnswer(query []byte, stale []byte) []byte {
+	copy(stale[0:2], query[0:2])
+	if dns.IsNegative(stale) {
+		return dns.AddExtendedError(stale, dns.EDE_STALE_NXDOMAIN, "")
+	}
+
+	return dns.AddExtendedError(stale, dns.EDE_STALE_ANSWER, "")
+}
+
+// upstreamFailure answers a query no upstream could resolve with SERVFAIL
+// so the client does not wait for its own timeout
+func (s *DNSServer) upstreamFailure(query []byte, err error) []byte {
+	var (
+		code   uint16 = dns.EDE_NETWORK_ERROR
+		text   string = "upstream unreachable"
+		failed *rcodeError
+	)
+	s.statistics.incrementUpstreamFailures()
+
+	switch {
+	case errors.As(err, &failed) && failed.rcode == dns.RCODE_REFUSED:
+		code, text = dns.EDE_OTHER, "upstream refused"
+	case errors.As(err, &failed):
+		code, text = dns.EDE_NO_REACHABLE_AUTHORITY, "upstream answered SERVFAIL"
+	case errors.Is(err, errUpstreamTimeout) || errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded):
+		code, text = dns.EDE_NO_REACHABLE_AUTHORITY, "upstream timed out"
+	}
+
+	return dns.ServerFailure(query, code, text)
+}
+
+// finalizeResponse adapts a full response to the client that asked for it,
+// OPT is only sent back to EDNS0 clients and udp answers that do not fit
+// are truncated with TC set
+func (s *DNSServer) finalizeResponse(queryInfo *utils.QueryInfo, response []byte, udp bool) []byte {
+	if response == nil {
+		return nil
+	}
+
+	if !queryInfo.EDNS {
+		response = dns.StripEDNS0(response)
+	}
+
+	if udp {
+		response = dns.TruncateResponse(response, int(s.udpPayloadSize(queryInfo)))
+	}
+
+	return response
+}
+
+// udpPayloadSize is the size the client advertised, capped by our own maximum
+func (s *DNSServer) udpPayloadSize(queryInfo *utils.QueryInfo) uint16 {
+	if !queryInfo.EDNS {
+		return dns.DEFAULT_UDP_SIZE
+	}
+
+	return min(queryInfo.UDPSize, s.config.MaxUDPSize)
+}
+
+// resolveShared asks upstream through queryUpstream, joining the lookup of
+// the same cache key when one is already in flight. the lookup serves
+// every client waiting on it so it does not stop when one of them goes
+// away, the resolver timeouts bound it
+func (s *DNSServer) resolveShared(ctx context.Context, query []byte, queryInfo *utils.QueryInfo) ([]byte, error) {
+	var (
+		response []byte
+		shared   bool
+		err      error
+	)
+	response, shared, err = s.inflight.do(ctx, queryInfo.CacheKey, func() ([]byte, error) {
+		return s.queryUpstream(context.WithoutCancel(ctx), query, queryInfo)
+	})
+	if shared && err == nil {
+		logger.Info(fmt.Sprintf("COALESCED: %s", queryInfo.Domain))
+	}
+
+	return response, err
 }
 
 func (s *DNSServer) queryUpstream(ctx context.Context, query []byte, queryInfo *utils.QueryInfo) ([]byte, error) {
@@ -138,23 +367,52 @@ func (s *DNSServer) queryUpstream(ctx context.Context, query []byte, queryInfo *
 	}
 
 	var (
-		response []byte = make([]byte, 512)
+		response []byte
 		err      error
 		ttl      uint32
+		negative bool
 	)
-	response, err = s.resolver.Resolve(ctx, query)
+	response, err = s.resolver.Resolve(ctx, dns.SetEDNS0(query, s.config.MaxUDPSize))
 	if err != nil {
 		return nil, err
 	}
 
-	ttl = utils.ExtractTTL(response)
+	// a partial answer is still good for this client but must not be cached
+	if dns.IsTruncated(response) {
+		logger.Warn(fmt.Sprintf("NOT CACHED: %s (truncated response)", queryInfo.Domain))
+		return response, nil
+	}
+
+	// a failure of the authority should not stick to the name
+	if dns.IsFailure(response) {
+		logger.Warn(fmt.Sprintf("NOT CACHED: %s (rcode %d)", queryInfo.Domain, binary.BigEndian.Uint16(response[2:4])&dns.RCODE_MASK))
+		return response, nil
+	}
+
+	if ttl, negative = s.cacheTTL(response); ttl == 0 {
+		logger.Warn(fmt.Sprintf("NOT CACHED: %s (negative answer without SOA)", queryInfo.Domain))
+		return response, nil
+	}
+
+	// the SOA ttl is what resolvers below us cache the negative answer for,
+	// it must not outlive our own cap
+	if negative {
+		dns.CapTTLs(response, ttl)
+	}
 
 	s.cache.Set(queryInfo.CacheKey, response, ttl)
-	logger.Info(fmt.Sprintf("CACHED: %s (TTl: %ds)", queryInfo.Domain, ttl))
+	if negative {
+		logger.Info(fmt.Sprintf("CACHED NEGATIVE: %s (TTL: %ds)", queryInfo.Domain, ttl))
+	} else {
+		logger.Info(fmt.Sprintf("CACHED: %s (TTl: %ds)", queryInfo.Domain, ttl))
+	}
 
 	return response, nil
 }
 
+// refreshCache renews an entry about to expire, it shares the lookup with
+// other refreshes and misses of the same name so a popular entry is only
+// fetched once
 func (s *DNSServer) refreshCache(ctx context.Context, query []byte, queryInfo *utils.QueryInfo) {
 	select {
 	case <-ctx.Done():
@@ -162,35 +420,123 @@ func (s *DNSServer) refreshCache(ctx context.Context, query []byte, queryInfo *u
 	default:
 	}
 
+	if _, err := s.resolveShared(ctx, query, queryInfo); err != nil {
+		logger.Error(fmt.Sprintf("Failed to Refresh: %s - %v", queryInfo.Domain, err))
+		s.cache.MarkFailed(queryInfo.CacheKey)
+	}
+}
+
+// cacheTTL is how long response may be cached, negative answers follow the
+// SOA of the authority section (RFC 2308) capped by MaxNegative and
+// failures like SERVFAIL or REFUSED are not cached at all
+func (s *DNSServer) cacheTTL(response []byte) (uint32, bool) {
 	var (
-		response []byte = make([]byte, 512)
-		err      error
 		ttl      uint32
+		negative bool
 	)
-	response, err = s.resolver.Resolve(ctx, query)
-	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to Resolve: %s - %v", queryInfo.Domain, err))
-		return
+	if dns.IsFailure(response) {
+		return 0, false
+	}
+	if ttl, negative = dns.NegativeTTL(response); negative {
+		return min(ttl, s.config.MaxNegative), true
 	}
 
-	ttl = utils.ExtractTTL(response)
-	s.cache.Set(queryInfo.CacheKey, response, ttl)
-	logger.Info(fmt.Sprintf("REFRESHED: %s (TTL %ds)", queryInfo.Domain, ttl))
+	return utils.ExtractTTL(response), false
+}
+
+// checkFilter asks the filter about the query, blocked and rewritten
+// queries count as blocked, against the list of the rule too
+func (s *DNSServer) checkFilter(queryInfo *utils.QueryInfo, client netip.Addr) filter.Verdict {
+	if s.filter == nil {
+		return filter.Verdict{}
+	}
+
+	var verdict filter.Verdict = s.filter.Check(filter.Query{Domain: queryInfo.Domain, Type: queryInfo.QType, Client: client})
+	switch {
+	case verdict.Blocked:
+		logger.Info(fmt.Sprintf("BLOCKED: %s%s", queryInfo.Domain, attribution(verdict)))
+	case len(verdict.Rewrites) > 0:
+		logger.Info(fmt.Sprintf("REWRITE: %s%s", queryInfo.Domain, attribution(verdict)))
+	default:
+		return verdict
+	}
+
+	s.statistics.incrementBlocked()
+	if verdict.List != "" {
+		s.statistics.incrementBlockedBy(verdict.List)
+	}
+	return verdict
+}
+
+// attribution is the rule and list behind a verdict as shown in the log
+func attribution(verdict filter.Verdict) string {
+	switch {
+	case verdict.Rule != "" && verdict.List != "":
+		return fmt.Sprintf(" (%s in %s)", verdict.Rule, verdict.List)
+	case verdict.Rule != "":
+		return fmt.Sprintf(" (%s)", verdict.Rule)
+	}
+
+	return ""
 }
 
-func (s *DNSServer) filterDomain(domain string) bool {
-	if s.filter != nil && s.filter.IsBlocked(domain) {
-		s.statistics.incrementBlocked()
-		logger.Info(fmt.Sprintf("BLOCKED: %s", domain))
-		return true
+// rewriteResponse answers with the $dnsrewrite records, a CNAME to a name
+// outside the rules is followed through the cache and upstream so the
+// client gets the records it asked for
+func (s *DNSServer) rewriteResponse(ctx context.Context, query []byte, queryInfo *utils.QueryInfo, rewrites []filter.Rewrite) []byte {
+	var (
+		target     string
+		found      bool
+		targetInfo *utils.QueryInfo
+		lookup     []byte
+		response   []byte
+		message    *dns.Message
+		err        error
+	)
+	if target, found = filter.RewriteTarget(rewrites, queryInfo.QType); !found {
+		return filter.CreateRewriteResponse(query, rewrites)
+	}
+
+	if lookup, err = dns.BuildQuery(uint16(rand.UintN(65536)), target, queryInfo.QType); err != nil {
+		return filter.CreateRewriteResponse(query, rewrites)
+	}
+	if targetInfo, err = utils.ParseQuery(lookup); err != nil {
+		return filter.CreateRewriteResponse(query, rewrites)
+	}
+
+	if response, found, _ = s.cache.Get(targetInfo.CacheKey); !found {
+		if response, err = s.resolveShared(ctx, lookup, targetInfo); err != nil {
+			logger.Error(fmt.Sprintf("Failed to Resolve rewrite target: %s - %v", target, err))
+			return filter.CreateRewriteResponse(query, rewrites)
+		}
+	}
+
+	if message, err = dns.Parse(response); err != nil {
+		return filter.CreateRewriteResponse(query, rewrites)
 	}
 
-	return false
+	return filter.CreateRewriteResponse(query, rewrites, message.Answers...)
+}
+
+// addrOf is the IP of a connection peer, the zero Addr when it has none
+func addrOf(addr net.Addr) netip.Addr {
+	var (
+		addrPort netip.AddrPort
+		err      error
+	)
+	if addr == nil {
+		return netip.Addr{}
+	}
+	if addrPort, err = netip.ParseAddrPort(addr.String()); err != nil {
+		return netip.Addr{}
+	}
+
+	return addrPort.Addr()
 }
 
 func (s *DNSServer) getCache(cacheKey, domain string) ([]byte, bool, bool) {
 	var (
-		cachedResponse []byte = make([]byte, 512)
+		cachedResponse []byte
 		found          bool
 		needsRefresh   bool
 	)
@@ -200,6 +546,9 @@ func (s *DNSServer) getCache(cacheKey, domain string) ([]byte, bool, bool) {
 	}
 
 	s.statistics.incrementCacheHits()
+	if dns.IsNegative(cachedResponse) {
+		s.statistics.incrementNegativeHits()
+	}
 	logger.Info(fmt.Sprintf("CACHE HIT: %s", domain))
 
 	return cachedResponse, found, needsRefresh
@@ -215,10 +564,15 @@ func (s *DNSServer) createBlockedResponse(query []byte) []byte {
 
 func (s *DNSServer) Start(ctx context.Context) error {
 	var (
-		err    error
-		addr   *net.UDPAddr
-		conn   *net.UDPConn
-		buffer []byte = make([]byte, 512)
+		err          error
+		addr         *net.UDPAddr
+		conn         *net.UDPConn
+		listener     net.Listener
+		certificates *certReloader
+		httpServer   *http.Server
+		quicListener *quic.EarlyListener
+		closers      []io.Closer
+		buffer       []byte = make([]byte, dns.MAX_MESSAGE_SIZE)
 	)
 	addr, err = net.ResolveUDPAddr("udp", s.config.LocalAddr)
 	if err != nil {
@@ -231,16 +585,65 @@ func (s *DNSServer) Start(ctx context.Context) error {
 	}
 	defer conn.Close()
 
-	logger.Info(fmt.Sprintf("DNS server is Listening on: %s", s.config.LocalAddr))
+	// TCP shares the address with UDP, clients fall back to it after a truncated answer
+	listener, err = net.Listen("tcp", s.config.LocalAddr)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on tcp: %s", err.Error())
+	}
+	defer listener.Close()
+	closers = append(closers, conn, listener)
+	go s.serveTCP(ctx, listener)
+
+	if s.config.DoTAddr != "" || s.config.DoHAddr != "" || s.config.DoQAddr != "" {
+		if certificates, err = newCertReloader(s.config.CertFile, s.config.KeyFile); err != nil {
+			return fmt.Errorf("Failed to load certificate: %w", err)
+		}
+	}
+
+	if s.config.DoTAddr != "" {
+		if listener, err = s.listenDoT(certificates); err != nil {
+			return fmt.Errorf("Failed to listen on tls: %w", err)
+		}
+		defer listener.Close()
+		closers = append(closers, listener)
+		go s.serveTCP(ctx, listener)
+		logger.Info(fmt.Sprintf("DNS-over-TLS is Listening on: %s", s.config.DoTAddr))
+	}
+
+	if s.config.DoHAddr != "" {
+		if httpServer, err = s.listenDoH(ctx, certificates); err != nil {
+			return fmt.Errorf("Failed to listen on https: %w", err)
+		}
+		defer httpServer.Close()
+		closers = append(closers, httpServer)
+		logger.Info(fmt.Sprintf("DNS-over-HTTPS is Listening on: https://%s%s", s.config.DoHAddr, DOH_PATH))
+	}
+
+	if s.config.DoQAddr != "" {
+		if quicListener, err = s.listenDoQ(certificates); err != nil {
+			return fmt.Errorf("Failed to listen on quic: %w", err)
+		}
+		defer quicListener.Close()
+		closers = append(closers, quicListener)
+		go s.serveDoQ(ctx, quicListener)
+		logger.Info(fmt.Sprintf("DNS-over-QUIC is Listening on: %s", s.config.DoQAddr))
+	}
+
+	logger.Info(fmt.Sprintf("DNS server is Listening on: %s (udp/tcp)", s.config.LocalAddr))
 	logger.Info(fmt.Sprintf("DNS server upstream dns: %s", s.config.UpstreamDns))
+	logger.Info(fmt.Sprintf("DNS server max udp payload: %d bytes", s.config.MaxUDPSize))
 
 	if s.filter != nil {
 		logger.Info(fmt.Sprintf("Filter Loaded: %d domains", s.filter.Count()))
 	}
 
+	if monitor, ok := s.resolver.(UpstreamMonitor); ok {
+		go monitor.Monitor(ctx)
+	}
+
 	go s.cacheCleanUp(ctx)
 	go s.statsReporter(ctx)
-	go s.shutdownHandler(ctx, conn)
+	go s.shutdownHandler(ctx, closers...)
 
 	for {
 		select {
@@ -253,7 +656,6 @@ func (s *DNSServer) Start(ctx context.Context) error {
 		var (
 			bytesRead  int
 			clientAddr *net.UDPAddr
-			query      []byte = make([]byte, 512)
 		)
 		conn.SetReadDeadline(time.Now().Add(CLIENT_REQUEST_TIME))
 
@@ -275,8 +677,7 @@ func (s *DNSServer) Start(ctx context.Context) error {
 				continue
 			}
 		}
-		copy(query, buffer[:bytesRead])
-		go s.handleQuery(ctx, query, clientAddr, conn)
+		go s.handleQuery(ctx, bytes.Clone(buffer[:bytesRead]), clientAddr, conn)
 	}
 }
 
@@ -312,8 +713,10 @@ func (s *DNSServer) statsReporter(ctx context.Context) {
 	}
 }
 
-func (s *DNSServer) shutdownHandler(ctx context.Context, conn *net.UDPConn) {
+func (s *DNSServer) shutdownHandler(ctx context.Context, closers ...io.Closer) {
 	<-ctx.Done()
 	logger.Info("Shutdown signal received, closing the server.")
-	conn.Close()
+	for _, closer := range closers {
+		closer.Close()
+	}
 }
@@ -1,11 +1,18 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"flash-dns/internal/dns"
 	"flash-dns/internal/filter"
 	"flash-dns/internal/utils"
+	"fmt"
 	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
@@ -18,11 +25,13 @@ import (
 type MockResolver struct {
 	response  []byte
 	err       error
+	delay     time.Duration // how long to wait before answering
 	callCount int
 }
 
 func (m *MockResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
 	m.callCount++
+	time.Sleep(m.delay)
 	if m.err != nil {
 		return nil, m.err
 	}
@@ -31,14 +40,20 @@ func (m *MockResolver) Resolve(ctx context.Context, query []byte) ([]byte, error
 
 // MockCache simulates cache operations
 type MockCache struct {
+	mu           sync.Mutex // Set may run from a background refresh
 	data         map[string][]byte
+	stale        map[string][]byte // what GetStale answers with
+	failed       map[string]bool   // keys passed to MarkFailed
 	getCallCount int
 	setCallCount int
+	lastTTL      uint32
 }
 
 func NewMockCache() *MockCache {
 	return &MockCache{
-		data: make(map[string][]byte),
+		data:   make(map[string][]byte),
+		stale:  make(map[string][]byte),
+		failed: make(map[string]bool),
 	}
 }
 
@@ -52,8 +67,24 @@ func (m *MockCache) Get(key string) ([]byte, bool, bool) {
 	return value, found, false // needsRefresh always false for simplicity
 }
 
+func (m *MockCache) GetStale(key string) ([]byte, bool, bool) {
+	var (
+		value []byte
+		found bool
+	)
+	value, found = m.stale[key]
+	return bytes.Clone(value), found, !m.failed[key]
+}
+
+func (m *MockCache) MarkFailed(key string) {
+	m.failed[key] = true
+}
+
 func (m *MockCache) Set(key string, response []byte, ttl uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.setCallCount++
+	m.lastTTL = ttl
 	m.data[key] = response
 }
 
@@ -73,10 +104,10 @@ func NewMockFilter() *MockFilter {
 	}
 }
 
-func (m *MockFilter) IsBlocked(domain string) bool {
+func (m *MockFilter) Check(query filter.Query) filter.Verdict {
 	var blocked bool
-	_, blocked = m.blockedDomains[domain]
-	return blocked
+	_, blocked = m.blockedDomains[query.Domain]
+	return filter.Verdict{Blocked: blocked}
 }
 
 func (m *MockFilter) Count() int {
@@ -146,7 +177,7 @@ func TestDNSServer_FilterDomain_Blocked(t *testing.T) {
 	server = NewDNSServer(config, resolver, filterList)
 	server.filter = mockFilter
 
-	blocked = server.filterDomain(domain)
+	blocked = server.checkFilter(&utils.QueryInfo{Domain: domain}, netip.Addr{}).Blocked
 
 	if !blocked {
 		t.Error("Domain should be blocked")
@@ -182,7 +213,7 @@ func TestDNSServer_FilterDomain_Allowed(t *testing.T) {
 	server = NewDNSServer(config, resolver, filterList)
 	server.filter = mockFilter
 
-	blocked = server.filterDomain(domain)
+	blocked = server.checkFilter(&utils.QueryInfo{Domain: domain}, netip.Addr{}).Blocked
 
 	if blocked {
 		t.Error("Domain should not be blocked")
@@ -578,10 +609,711 @@ func TestDNSServer_QueryUpstream_ContextCancelled(t *testing.T) {
 	}
 }
 
+// TEST 13: Large answers are truncated for udp clients
+// Tests that TC is set instead of chopping the answer, and that tcp gets it whole
+func TestDNSServer_ProcessQuery_Truncation(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		query      []byte             = buildDNSQuery("example.com", 16, 1)
+		large      []byte             = buildDNSResponse("example.com", 16, 1, 300, make([]byte, 1000))
+		mockCache  *MockCache         = NewMockCache()
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		response   []byte
+	)
+
+	server = NewDNSServer(config, &MockResolver{}, filterList)
+	server.cache = mockCache
+	mockCache.Set("example.com:16", large, 300)
+
+	response = server.processQuery(ctx, query, netip.Addr{}, true)
+	if len(response) > 512 {
+		t.Errorf("UDP answer without EDNS0 should fit in 512 bytes, got %d", len(response))
+	}
+	if binary.BigEndian.Uint16(response[2:4])&dns.FLAG_TC == 0 {
+		t.Error("TC bit should be set on truncated answer")
+	}
+
+	response = server.processQuery(ctx, dns.SetEDNS0(query, 4096), netip.Addr{}, true)
+	if len(response) != len(large) {
+		t.Errorf("EDNS0 client should get the full answer, got %d bytes", len(response))
+	}
+
+	response = server.processQuery(ctx, query, netip.Addr{}, false)
+	if len(response) != len(large) {
+		t.Errorf("TCP answer should not be truncated, got %d bytes", len(response))
+	}
+}
+
+// TEST 14: Upstream queries advertise our payload size
+// Tests that queryUpstream forwards an OPT record with MaxUDPSize
+func TestDNSServer_QueryUpstream_ForwardsEDNS0(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+			MaxUDPSize:  1400,
+		}
+		query      []byte             = buildDNSQuery("example.com", 1, 1)
+		resolver   *recordingResolver = &recordingResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		queryInfo  *utils.QueryInfo = &utils.QueryInfo{Domain: "example.com", CacheKey: "example.com:1"}
+		size       uint16
+		present    bool
+		err        error
+	)
+
+	server = NewDNSServer(config, resolver, filterList)
+
+	if _, err = server.queryUpstream(ctx, query, queryInfo); err != nil {
+		t.Fatalf("QueryUpstream failed: %v", err)
+	}
+
+	size, present = dns.ParseEDNS0(resolver.lastQuery)
+	if !present || size != 1400 {
+		t.Errorf("Expected OPT with size 1400 upstream, got present=%v size=%d", present, size)
+	}
+}
+
+// TEST 15: Truncated upstream answers are not cached
+// Tests that a response still carrying TC is returned but never stored
+func TestDNSServer_QueryUpstream_TruncatedNotCached(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		query        []byte             = buildDNSQuery("example.com", 1, 1)
+		mockResponse []byte             = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		resolver     *MockResolver      = &MockResolver{response: mockResponse}
+		mockCache    *MockCache         = NewMockCache()
+		filterList   *filter.FilterList = filter.NewFilterList()
+		server       *DNSServer
+		queryInfo    *utils.QueryInfo = &utils.QueryInfo{Domain: "example.com", CacheKey: "example.com:1"}
+		response     []byte
+		err          error
+	)
+
+	binary.BigEndian.PutUint16(mockResponse[2:4], 0x8380) // TC set
+	server = NewDNSServer(config, resolver, filterList)
+	server.cache = mockCache
+
+	response, err = server.queryUpstream(ctx, query, queryInfo)
+
+	if err != nil {
+		t.Fatalf("QueryUpstream failed: %v", err)
+	}
+	if response == nil {
+		t.Error("Truncated response should still be returned")
+	}
+	if mockCache.setCallCount != 0 {
+		t.Errorf("Truncated response should not be cached, got %d set calls", mockCache.setCallCount)
+	}
+}
+
+// TEST 16: Negative answers are cached for the SOA minimum
+// Tests that NXDOMAIN uses the SOA and is capped by MaxNegative, in the
+// cache and in the SOA ttl the client sees
+func TestDNSServer_QueryUpstream_NegativeCaching(t *testing.T) {
+	var (
+		ctx        context.Context    = context.Background()
+		config     Config             = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", MaxNegative: 600}
+		query      []byte             = buildDNSQuery("missing.example.com", 1, 1)
+		resolver   *MockResolver      = &MockResolver{}
+		mockCache  *MockCache         = NewMockCache()
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		queryInfo  *utils.QueryInfo = &utils.QueryInfo{Domain: "missing.example.com", CacheKey: "missing.example.com:1"}
+		response   []byte
+		err        error
+	)
+	server = NewDNSServer(config, resolver, filterList)
+	server.cache = mockCache
+
+	resolver.response = buildNegativeResponse(t, query, dns.RCODE_NXDOMAIN, 3600, 300)
+	if response, err = server.queryUpstream(ctx, query, queryInfo); err != nil {
+		t.Fatalf("QueryUpstream failed: %v", err)
+	}
+	if mockCache.setCallCount != 1 || mockCache.lastTTL != 300 {
+		t.Errorf("Expected NXDOMAIN cached for 300s, got %d calls with ttl %d", mockCache.setCallCount, mockCache.lastTTL)
+	}
+	if ttl := soaTTL(t, response); ttl != 300 {
+		t.Errorf("Expected the SOA ttl lowered to 300s, got %d", ttl)
+	}
+
+	resolver.response = buildNegativeResponse(t, query, dns.RCODE_NOERROR, 86400, 86400)
+	if response, err = server.queryUpstream(ctx, query, queryInfo); err != nil {
+		t.Fatalf("QueryUpstream failed: %v", err)
+	}
+	if mockCache.lastTTL != 600 {
+		t.Errorf("Expected NODATA capped at 600s, got %d", mockCache.lastTTL)
+	}
+	if ttl := soaTTL(t, response); ttl != 600 {
+		t.Errorf("Expected the SOA ttl capped at 600s, got %d", ttl)
+	}
+	if ttl := soaTTL(t, mockCache.data[queryInfo.CacheKey]); ttl != 600 {
+		t.Errorf("Expected the cached SOA ttl capped at 600s, got %d", ttl)
+	}
+}
+
+// soaTTL is the ttl of the SOA in the authority section of response
+func soaTTL(t *testing.T, response []byte) uint32 {
+	var (
+		message *dns.Message
+		err     error
+	)
+	if message, err = dns.Parse(response); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(message.Authorities) != 1 {
+		t.Fatalf("Expected one authority record, got %d", len(message.Authorities))
+	}
+
+	return message.Authorities[0].TTL
+}
+
+// TEST 17: Negative answers without SOA are not cached
+// Tests RFC 2308 section 5, there is nothing to bound their lifetime
+func TestDNSServer_QueryUpstream_NegativeWithoutSOA(t *testing.T) {
+	var (
+		ctx        context.Context    = context.Background()
+		config     Config             = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}
+		query      []byte             = buildDNSQuery("missing.example.com", 1, 1)
+		resolver   *MockResolver      = &MockResolver{response: buildNegativeResponse(t, query, dns.RCODE_NXDOMAIN, 0, 0)}
+		mockCache  *MockCache         = NewMockCache()
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		queryInfo  *utils.QueryInfo = &utils.QueryInfo{Domain: "missing.example.com", CacheKey: "missing.example.com:1"}
+		response   []byte
+		err        error
+	)
+	server = NewDNSServer(config, resolver, filterList)
+	server.cache = mockCache
+
+	response, err = server.queryUpstream(ctx, query, queryInfo)
+
+	if err != nil || response == nil {
+		t.Fatalf("Expected the answer to be returned, got %v", err)
+	}
+	if mockCache.setCallCount != 0 {
+		t.Errorf("Negative answer without SOA should not be cached, got %d set calls", mockCache.setCallCount)
+	}
+}
+
+// TEST 18: Upstream failures are not cached
+// Tests that SERVFAIL, REFUSED, FORMERR and NOTIMP reach the client without
+// holding the name in the cache
+func TestDNSServer_QueryUpstream_FailureNotCached(t *testing.T) {
+	var (
+		ctx        context.Context    = context.Background()
+		config     Config             = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}
+		query      []byte             = buildDNSQuery("example.com", 1, 1)
+		resolver   *MockResolver      = &MockResolver{}
+		mockCache  *MockCache         = NewMockCache()
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		queryInfo  *utils.QueryInfo = &utils.QueryInfo{Domain: "example.com", CacheKey: "example.com:1"}
+		response   []byte
+		err        error
+	)
+	server = NewDNSServer(config, resolver, filterList)
+	server.cache = mockCache
+
+	for _, rcode := range []uint16{dns.RCODE_SERVFAIL, dns.RCODE_REFUSED, dns.RCODE_FORMERR, dns.RCODE_NOTIMP} {
+		resolver.response = buildNegativeResponse(t, query, rcode, 3600, 3600)
+
+		if response, err = server.queryUpstream(ctx, query, queryInfo); err != nil || response == nil {
+			t.Fatalf("Expected rcode %d to be returned, got %v", rcode, err)
+		}
+		if mockCache.setCallCount != 0 {
+			t.Errorf("Rcode %d should not be cached, got %d set calls with ttl %d", rcode, mockCache.setCallCount, mockCache.lastTTL)
+		}
+		if ttl, _ := server.cacheTTL(response); ttl != 0 {
+			t.Errorf("Expected no cache ttl for rcode %d, got %d", rcode, ttl)
+		}
+	}
+}
+
+// TEST 19: Negative cache hits are counted separately
+// Tests that only NXDOMAIN or NODATA hits increase the negative counter
+func TestDNSServer_GetCache_NegativeHit(t *testing.T) {
+	var (
+		config     Config             = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}
+		query      []byte             = buildDNSQuery("missing.example.com", 1, 1)
+		mockCache  *MockCache         = NewMockCache()
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		cacheHits  uint64
+	)
+	mockCache.Set("missing.example.com:1", buildNegativeResponse(t, query, dns.RCODE_NXDOMAIN, 60, 60), 60)
+	mockCache.Set("example.com:1", buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), 300)
+	server = NewDNSServer(config, &MockResolver{}, filterList)
+	server.cache = mockCache
+
+	server.getCache("missing.example.com:1", "missing.example.com")
+	server.getCache("example.com:1", "example.com")
+
+	_, _, cacheHits, _ = server.statistics.GetStats()
+	if cacheHits != 2 {
+		t.Errorf("Expected 2 cache hits, got %d", cacheHits)
+	}
+	if server.statistics.GetNegativeHits() != 1 {
+		t.Errorf("Expected 1 negative hit, got %d", server.statistics.GetNegativeHits())
+	}
+}
+
+// TEST 20: Failed upstreams answer SERVFAIL
+// Tests that the client gets SERVFAIL with an extended error and the failure is counted
+func TestDNSServer_ProcessQuery_UpstreamFailure(t *testing.T) {
+	var (
+		ctx        context.Context    = context.Background()
+		config     Config             = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}
+		query      []byte             = dns.SetEDNS0(buildDNSQuery("example.com", 1, 1), 1232)
+		resolver   *MockResolver      = &MockResolver{err: errUpstreamTimeout}
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		message    *dns.Message
+		err        error
+	)
+	server = NewDNSServer(config, resolver, filterList)
+	server.cache = NewMockCache()
+
+	if message, err = dns.Parse(server.processQuery(ctx, query, netip.Addr{}, true)); err != nil {
+		t.Fatalf("Expected a well formed response: %v", err)
+	}
+	if message.Rcode() != dns.RCODE_SERVFAIL {
+		t.Errorf("Expected SERVFAIL, got rcode %d", message.Rcode())
+	}
+	if message.ID != binary.BigEndian.Uint16(query[0:2]) {
+		t.Error("Response ID should match the query")
+	}
+	if message.EDNS == nil || len(message.EDNS.Options) != 1 || binary.BigEndian.Uint16(message.EDNS.Options[0].Data) != dns.EDE_NO_REACHABLE_AUTHORITY {
+		t.Errorf("Expected EDE No Reachable Authority, got %+v", message.EDNS)
+	}
+	if server.statistics.GetUpstreamFailures() != 1 {
+		t.Errorf("Expected 1 upstream failure, got %d", server.statistics.GetUpstreamFailures())
+	}
+}
+
+// TEST 21: Stale answers when every upstream fails
+// Tests that an expired entry is used with a Stale Answer extended error
+func TestDNSServer_ProcessQuery_ServeStaleOnFailure(t *testing.T) {
+	var (
+		ctx        context.Context    = context.Background()
+		config     Config             = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", MaxStale: time.Hour}
+		query      []byte             = dns.SetEDNS0(buildDNSQuery("example.com", 1, 1), 1232)
+		resolver   *MockResolver      = &MockResolver{err: fmt.Errorf("all upstream dns failed: connection refused")}
+		mockCache  *MockCache         = NewMockCache()
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		message    *dns.Message
+		err        error
+	)
+	mockCache.stale["example.com:1"] = dns.SetEDNS0(buildDNSResponse("example.com", 1, 1, 30, []byte{1, 2, 3, 4}), 1232)
+	server = NewDNSServer(config, resolver, filterList)
+	server.cache = mockCache
+
+	if message, err = dns.Parse(server.processQuery(ctx, query, netip.Addr{}, true)); err != nil {
+		t.Fatalf("Expected a well formed response: %v", err)
+	}
+	if message.Rcode() != dns.RCODE_NOERROR || len(message.Answers) != 1 {
+		t.Errorf("Expected the stale answer, got rcode %d with %d answers", message.Rcode(), len(message.Answers))
+	}
+	if message.EDNS == nil || len(message.EDNS.Options) != 1 || binary.BigEndian.Uint16(message.EDNS.Options[0].Data) != dns.EDE_STALE_ANSWER {
+		t.Errorf("Expected EDE Stale Answer, got %+v", message.EDNS)
+	}
+	if server.statistics.GetUpstreamFailures() != 1 {
+		t.Errorf("Expected 1 upstream failure, got %d", server.statistics.GetUpstreamFailures())
+	}
+	if !mockCache.failed["example.com:1"] {
+		t.Error("The failure should start the recheck timer")
+	}
+}
+
+// TEST 22: Slow upstreams get a stale answer after StaleAfter
+// Tests the client response timer, the late answer still refreshes the cache
+func TestDNSServer_ProcessQuery_StaleAfterTimer(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		config   Config          = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", MaxStale: time.Hour, StaleAfter: 50 * time.Millisecond}
+		query    []byte          = buildDNSQuery("example.com", 1, 1)
+		resolver *MockResolver   = &MockResolver{
+			response: buildDNSResponse("example.com", 1, 1, 300, []byte{5, 6, 7, 8}),
+			delay:    300 * time.Millisecond,
+		}
+		mockCache  *MockCache         = NewMockCache()
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		started    time.Time
+		message    *dns.Message
+		err        error
+	)
+	mockCache.stale["example.com:1"] = buildDNSResponse("example.com", 1, 1, 30, []byte{1, 2, 3, 4})
+	server = NewDNSServer(config, resolver, filterList)
+	server.cache = mockCache
+
+	started = time.Now()
+	if message, err = dns.Parse(server.processQuery(ctx, query, netip.Addr{}, true)); err != nil {
+		t.Fatalf("Expected a well formed response: %v", err)
+	}
+	if time.Since(started) >= resolver.delay {
+		t.Errorf("Stale answer should not wait for upstream, took %v", time.Since(started))
+	}
+	if len(message.Answers) != 1 || message.Answers[0].Data[0] != 1 {
+		t.Errorf("Expected the stale 1.2.3.4 answer, got %+v", message.Answers)
+	}
+
+	time.Sleep(2 * resolver.delay)
+	mockCache.mu.Lock()
+	defer mockCache.mu.Unlock()
+	if mockCache.setCallCount != 1 {
+		t.Errorf("The late upstream answer should be cached, got %d set calls", mockCache.setCallCount)
+	}
+}
+
+// TEST 23: Recently failed names skip upstream
+// Tests the failure recheck timer, stale data is sent without a new query
+func TestDNSServer_ProcessQuery_FailureRecheck(t *testing.T) {
+	var (
+		ctx        context.Context    = context.Background()
+		config     Config             = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", MaxStale: time.Hour}
+		query      []byte             = buildDNSQuery("example.com", 1, 1)
+		resolver   *MockResolver      = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{5, 6, 7, 8})}
+		mockCache  *MockCache         = NewMockCache()
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		response   []byte
+	)
+	mockCache.stale["example.com:1"] = buildDNSResponse("example.com", 1, 1, 30, []byte{1, 2, 3, 4})
+	mockCache.failed["example.com:1"] = true
+	server = NewDNSServer(config, resolver, filterList)
+	server.cache = mockCache
+
+	response = server.processQuery(ctx, query, netip.Addr{}, true)
+
+	if response == nil || binary.BigEndian.Uint16(response[0:2]) != binary.BigEndian.Uint16(query[0:2]) {
+		t.Fatal("Expected a stale answer with the client ID")
+	}
+	if resolver.callCount != 0 {
+		t.Errorf("Upstream should not be asked during the recheck time, got %d calls", resolver.callCount)
+	}
+}
+
+// TEST 24: Identical queries in flight share one upstream lookup
+// Tests that concurrent misses for a name reach upstream once and every
+// client gets its own transaction ID back
+func TestDNSServer_ProcessQuery_Coalesced(t *testing.T) {
+	var (
+		ctx        context.Context    = context.Background()
+		config     Config             = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}
+		resolver   *MockResolver      = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), delay: 100 * time.Millisecond}
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		wg         sync.WaitGroup
+		i          int
+	)
+	server = NewDNSServer(config, resolver, filterList)
+
+	for i = 0; i < 50; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			var (
+				query    []byte = buildDNSQuery("example.com", 1, 1)
+				response []byte
+			)
+			binary.BigEndian.PutUint16(query[0:2], id)
+
+			if response = server.processQuery(ctx, query, netip.Addr{}, true); response == nil {
+				t.Errorf("Client %d got no answer", id)
+				return
+			}
+			if binary.BigEndian.Uint16(response[0:2]) != id {
+				t.Errorf("Client %d got the answer for ID %d", id, binary.BigEndian.Uint16(response[0:2]))
+			}
+		}(uint16(1000 + i))
+	}
+	wg.Wait()
+
+	if resolver.callCount != 1 {
+		t.Errorf("Expected 1 upstream lookup, got %d", resolver.callCount)
+	}
+}
+
+// TEST 25: Concurrent refreshes share one upstream lookup
+// Tests that entries about to expire do not stampede upstream
+func TestDNSServer_RefreshCache_Coalesced(t *testing.T) {
+	var (
+		ctx        context.Context    = context.Background()
+		config     Config             = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}
+		query      []byte             = buildDNSQuery("example.com", 1, 1)
+		resolver   *MockResolver      = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), delay: 100 * time.Millisecond}
+		mockCache  *MockCache         = NewMockCache()
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		queryInfo  *utils.QueryInfo = &utils.QueryInfo{Domain: "example.com", CacheKey: "example.com:1", QType: 1, QClass: 1}
+		wg         sync.WaitGroup
+		i          int
+	)
+	server = NewDNSServer(config, resolver, filterList)
+	server.cache = mockCache
+
+	for i = 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.refreshCache(ctx, query, queryInfo)
+		}()
+	}
+	wg.Wait()
+
+	if resolver.callCount != 1 {
+		t.Errorf("Expected 1 upstream lookup, got %d", resolver.callCount)
+	}
+	if mockCache.setCallCount != 1 {
+		t.Errorf("Expected 1 cache set, got %d", mockCache.setCallCount)
+	}
+}
+
+// TEST 26: $dnsrewrite answers without upstream
+// Tests that a rewritten name gets the rule records and counts as blocked
+func TestDNSServer_ProcessQuery_Rewrite(t *testing.T) {
+	var (
+		ctx        context.Context    = context.Background()
+		config     Config             = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}
+		resolver   *MockResolver      = &MockResolver{response: buildDNSResponse("nas.lan", 1, 1, 300, []byte{9, 9, 9, 9})}
+		filterList *filter.FilterList = loadFilterRules(t, "||nas.lan^$dnsrewrite=192.168.1.10\n")
+		server     *DNSServer
+		message    *dns.Message
+		blocked    uint64
+		err        error
+	)
+	server = NewDNSServer(config, resolver, filterList)
+	server.cache = NewMockCache()
+
+	if message, err = dns.Parse(server.processQuery(ctx, buildDNSQuery("nas.lan", 1, 1), netip.Addr{}, true)); err != nil {
+		t.Fatalf("Expected a well formed response: %v", err)
+	}
+	if len(message.Answers) != 1 || !bytes.Equal(message.Answers[0].Data, []byte{192, 168, 1, 10}) {
+		t.Errorf("Expected the rewritten 192.168.1.10 answer, got %+v", message.Answers)
+	}
+	if resolver.callCount != 0 {
+		t.Errorf("Upstream should not be asked for a rewrite, got %d calls", resolver.callCount)
+	}
+	if blocked, _, _, _ = server.statistics.GetStats(); blocked != 1 {
+		t.Errorf("Expected 1 blocked request, got %d", blocked)
+	}
+	if server.statistics.GetBlockedByList()["rules"] != 1 {
+		t.Errorf("Expected the rewrite counted against its list, got %v", server.statistics.GetBlockedByList())
+	}
+}
+
+// TEST 27: $client rules see the client address
+// Tests that the address given to processQuery scopes the rule
+func TestDNSServer_ProcessQuery_ClientRule(t *testing.T) {
+	var (
+		ctx        context.Context    = context.Background()
+		config     Config             = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}
+		resolver   *MockResolver      = &MockResolver{response: buildDNSResponse("games.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		filterList *filter.FilterList = loadFilterRules(t, "||games.com^$client=192.168.1.0/24\n")
+		server     *DNSServer
+		message    *dns.Message
+		err        error
+	)
+	server = NewDNSServer(config, resolver, filterList)
+	server.cache = NewMockCache()
+
+	if message, err = dns.Parse(server.processQuery(ctx, buildDNSQuery("games.com", 1, 1), netip.MustParseAddr("192.168.1.20"), true)); err != nil {
+		t.Fatalf("Expected a well formed response: %v", err)
+	}
+	if message.Rcode() != dns.RCODE_NXDOMAIN {
+		t.Errorf("Expected NXDOMAIN for a client in the rule, got rcode %d", message.Rcode())
+	}
+
+	if message, err = dns.Parse(server.processQuery(ctx, buildDNSQuery("games.com", 1, 1), netip.MustParseAddr("10.0.0.5"), true)); err != nil {
+		t.Fatalf("Expected a well formed response: %v", err)
+	}
+	if message.Rcode() != dns.RCODE_NOERROR || len(message.Answers) != 1 {
+		t.Errorf("Expected the upstream answer for another client, got rcode %d", message.Rcode())
+	}
+}
+
+// TEST 28: CNAME rewrites are followed
+// Tests that the rewrite target is resolved and its records appended
+func TestDNSServer_ProcessQuery_RewriteCNAME(t *testing.T) {
+	var (
+		ctx        context.Context    = context.Background()
+		config     Config             = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}
+		resolver   *MockResolver      = &MockResolver{response: buildDNSResponse("safe.example.com", 1, 1, 300, []byte{5, 6, 7, 8})}
+		filterList *filter.FilterList = loadFilterRules(t, "||search.com^$dnsrewrite=safe.example.com\n")
+		server     *DNSServer
+		message    *dns.Message
+		err        error
+	)
+	server = NewDNSServer(config, resolver, filterList)
+	server.cache = NewMockCache()
+
+	if message, err = dns.Parse(server.processQuery(ctx, buildDNSQuery("search.com", 1, 1), netip.Addr{}, true)); err != nil {
+		t.Fatalf("Expected a well formed response: %v", err)
+	}
+	if len(message.Answers) != 2 || message.Answers[0].Type != dns.TYPE_CNAME || message.Answers[1].Type != dns.TYPE_A {
+		t.Fatalf("Expected a CNAME followed by the target A record, got %+v", message.Answers)
+	}
+	if message.Answers[1].Name != "safe.example.com" || !bytes.Equal(message.Answers[1].Data, []byte{5, 6, 7, 8}) {
+		t.Errorf("Expected safe.example.com 5.6.7.8, got %+v", message.Answers[1])
+	}
+	if resolver.callCount != 1 {
+		t.Errorf("Expected 1 upstream lookup for the target, got %d", resolver.callCount)
+	}
+}
+
+// TEST 29: Upstreams answering SERVFAIL count as failed
+// Tests that a SERVFAIL from every upstream is served stale when possible,
+// and otherwise answered with our own SERVFAIL and extended error
+func TestDNSServer_ProcessQuery_UpstreamsServfail(t *testing.T) {
+	var (
+		ctx        context.Context = context.Background()
+		config     Config          = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", MaxStale: time.Hour}
+		query      []byte          = dns.SetEDNS0(buildDNSQuery("example.com", 1, 1), 1232)
+		upstreams  []string
+		mockCache  *MockCache         = NewMockCache()
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		message    *dns.Message
+		err        error
+	)
+	for i := 0; i < 2; i++ {
+		var upstream *mockDNSServer
+		if upstream, err = startMockDNSServer(buildNegativeResponse(t, query, dns.RCODE_SERVFAIL, 0, 0), 0); err != nil {
+			t.Fatalf("Failed to start mock server: %v", err)
+		}
+		defer upstream.close()
+		upstreams = append(upstreams, upstream.addr)
+	}
+	mockCache.stale["example.com:1"] = dns.SetEDNS0(buildDNSResponse("example.com", 1, 1, 30, []byte{1, 2, 3, 4}), 1232)
+	server = NewDNSServer(config, &UpstreamResolver{upstreamAddrs: upstreams, timeout: 2 * time.Second}, filterList)
+	server.cache = mockCache
+
+	if message, err = dns.Parse(server.processQuery(ctx, query, netip.Addr{}, true)); err != nil {
+		t.Fatalf("Expected a well formed response: %v", err)
+	}
+	if message.Rcode() != dns.RCODE_NOERROR || len(message.Answers) != 1 {
+		t.Errorf("Expected the stale answer, got rcode %d with %d answers", message.Rcode(), len(message.Answers))
+	}
+	if server.statistics.GetUpstreamFailures() != 1 {
+		t.Errorf("Expected 1 upstream failure, got %d", server.statistics.GetUpstreamFailures())
+	}
+
+	delete(mockCache.stale, "example.com:1")
+	if message, err = dns.Parse(server.processQuery(ctx, query, netip.Addr{}, true)); err != nil {
+		t.Fatalf("Expected a well formed response: %v", err)
+	}
+	if message.Rcode() != dns.RCODE_SERVFAIL {
+		t.Errorf("Expected SERVFAIL, got rcode %d", message.Rcode())
+	}
+	if message.EDNS == nil || len(message.EDNS.Options) != 1 || binary.BigEndian.Uint16(message.EDNS.Options[0].Data) != dns.EDE_NO_REACHABLE_AUTHORITY {
+		t.Errorf("Expected EDE No Reachable Authority, got %+v", message.EDNS)
+	}
+	if server.statistics.GetUpstreamFailures() != 2 {
+		t.Errorf("Expected 2 upstream failures, got %d", server.statistics.GetUpstreamFailures())
+	}
+}
+
+// TEST 30: Serve-stale is on by default
+// Tests that a zero MaxStale serves expired answers for DEFAULT_MAX_STALE
+// and a negative one turns it off
+func TestNewDNSServer_MaxStaleDefault(t *testing.T) {
+	var (
+		response []byte = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		server   *DNSServer
+		found    bool
+	)
+	server = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353"}, &MockResolver{}, nil)
+	if server.config.MaxStale != DEFAULT_MAX_STALE {
+		t.Errorf("Expected MaxStale to default to %v, got %v", DEFAULT_MAX_STALE, server.config.MaxStale)
+	}
+	server.cache.Set("example.com:1", response, 0)
+	time.Sleep(10 * time.Millisecond)
+	if _, found, _ = server.cache.GetStale("example.com:1"); !found {
+		t.Error("Expected the expired answer to be served stale by default")
+	}
+
+	server = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353", MaxStale: -1}, &MockResolver{}, nil)
+	server.cache.Set("example.com:1", response, 0)
+	time.Sleep(10 * time.Millisecond)
+	if _, found, _ = server.cache.GetStale("example.com:1"); found {
+		t.Error("A negative MaxStale should turn serving stale off")
+	}
+}
+
+// loadFilterRules builds a filter list from adblock rules
+func loadFilterRules(t *testing.T, rules string) *filter.FilterList {
+	var (
+		filterList *filter.FilterList = filter.NewFilterList()
+		filename   string             = filepath.Join(t.TempDir(), "rules.txt")
+		err        error
+	)
+	if err = os.WriteFile(filename, []byte(rules), 0o644); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+	if _, err = filterList.LoadFile(filename, filter.FORMAT_ADBLOCK); err != nil {
+		t.Fatalf("Failed to load rules: %v", err)
+	}
+
+	return filterList
+}
+
+// recordingResolver keeps the last query it was asked to resolve
+type recordingResolver struct {
+	response  []byte
+	lastQuery []byte
+}
+
+func (r *recordingResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	r.lastQuery = query
+	return r.response, nil
+}
+
 // ============================================================================
 // HELPER FUNCTIONS FOR BUILDING DNS PACKETS
 // ============================================================================
 
+// buildNegativeResponse answers query with rcode and no records, a SOA is
+// added to the authority section when soaTTL is not zero
+func buildNegativeResponse(t *testing.T, query []byte, rcode uint16, soaTTL uint32, minimum uint32) []byte {
+	var (
+		message  *dns.Message
+		soa      []byte = []byte{2, 'n', 's', 0, 4, 'h', 'o', 's', 't', 0}
+		response []byte
+		err      error
+	)
+	if message, err = dns.Parse(query); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	message = message.Reply(rcode)
+	if soaTTL != 0 {
+		soa = binary.BigEndian.AppendUint32(soa, 1)    // serial
+		soa = binary.BigEndian.AppendUint32(soa, 7200) // refresh
+		soa = binary.BigEndian.AppendUint32(soa, 3600) // retry
+		soa = binary.BigEndian.AppendUint32(soa, 7200) // expire
+		soa = binary.BigEndian.AppendUint32(soa, minimum)
+		message.Authorities = []dns.Resource{{Name: "example.com", Type: dns.TYPE_SOA, Class: dns.CLASS_IN, TTL: soaTTL, Data: soa}}
+	}
+
+	if response, err = message.Pack(); err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+
+	return response
+}
+
 func buildDNSQuery(domain string, qtype uint16, qclass uint16) []byte {
 	var (
 		query    []byte = make([]byte, 12)
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"flash-dns/internal/dns"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DOH_SCHEME       string = "https://"
+	DOH_CONTENT_TYPE string = "application/dns-message"
+	DOH_CACHE_SIZE   int    = 256 // answers kept while their http freshness lasts
+)
+
+// DoHResolver forwards queries over DNS-over-HTTPS (RFC 8484), the
+// underlying http client keeps http/2 connections open between queries
+type DoHResolver struct {
+	endpoint string
+	method   string
+	client   *http.Client
+	timeout  time.Duration
+
+	mu    sync.Mutex
+	cache map[string]dohCacheEntry
+}
+
+type dohCacheEntry struct {
+	response  []byte
+	expiresAt time.Time
+}
+
+// NewDoHResolver takes the endpoint url, an optional #get fragment selects
+// GET requests (cache friendly) instead of the default POST. rootCAs nil
+// means the system pool
+func NewDoHResolver(spec string, timeout time.Duration, rootCAs *x509.CertPool) (*DoHResolver, error) {
+	var (
+		endpoint *url.URL
+		method   string = http.MethodPost
+		err      error
+	)
+	endpoint, err = url.Parse(strings.TrimSpace(spec))
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("not a dns-over-https upstream: %s", spec)
+	}
+
+	switch strings.ToLower(endpoint.Fragment) {
+	case "", "post":
+	case "get":
+		method = http.MethodGet
+	default:
+		return nil, fmt.Errorf("unknown method %q in %s", endpoint.Fragment, spec)
+	}
+	endpoint.Fragment = ""
+
+	return &DoHResolver{
+		endpoint: endpoint.String(),
+		method:   method,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				TLSClientConfig:     &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12},
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: timeout,
+			},
+		},
+		timeout: timeout,
+		cache:   make(map[string]dohCacheEntry),
+	}, nil
+}
+
+func (d *DoHResolver) String() string {
+	return d.endpoint
+}
+
+func (d *DoHResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < dns.HEADER_SIZE {
+		return nil, fmt.Errorf("query too short: %d bytes", len(query))
+	}
+
+	// the ID is always 0 on the wire so equal questions share http caches
+	var (
+		message  []byte = bytes.Clone(query)
+		cacheKey string
+		response []byte
+		found    bool
+		request  *http.Request
+		reply    *http.Response
+		maxAge   time.Duration
+		err      error
+	)
+	binary.BigEndian.PutUint16(message[0:2], 0)
+	cacheKey = string(message)
+
+	if response, found = d.cached(cacheKey); found {
+		copy(response[0:2], query[0:2])
+		return response, nil
+	}
+
+	request, err = d.newRequest(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err = d.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("doh request to %s failed: %w", d.endpoint, err)
+	}
+	defer reply.Body.Close()
+
+	if reply.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(reply.Body, 4096))
+		return nil, fmt.Errorf("doh upstream %s returned %s", d.endpoint, reply.Status)
+	}
+	if !strings.HasPrefix(reply.Header.Get("Content-Type"), DOH_CONTENT_TYPE) {
+		return nil, fmt.Errorf("doh upstream %s returned content type %q", d.endpoint, reply.Header.Get("Content-Type"))
+	}
+
+	response, err = io.ReadAll(io.LimitReader(reply.Body, int64(dns.MAX_MESSAGE_SIZE)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read doh response from %s: %w", d.endpoint, err)
+	}
+	if len(response) < dns.HEADER_SIZE || len(response) > dns.MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("invalid doh response size from %s: %d bytes", d.endpoint, len(response))
+	}
+
+	if maxAge = httpFreshness(reply.Header); maxAge > 0 {
+		d.store(cacheKey, response, maxAge)
+	}
+
+	response = bytes.Clone(response)
+	copy(response[0:2], query[0:2])
+	return response, nil
+}
+
+func (d *DoHResolver) newRequest(ctx context.Context, message []byte) (*http.Request, error) {
+	var (
+		request *http.Request
+		err     error
+	)
+	if d.method == http.MethodGet {
+		request, err = http.NewRequestWithContext(ctx, http.MethodGet,
+			d.endpoint+"?dns="+base64.RawURLEncoding.EncodeToString(message), nil)
+	} else {
+		request, err = http.NewRequestWithContext(ctx, http.MethodPost, d.endpoint, bytes.NewReader(message))
+		if err == nil {
+			request.Header.Set("Content-Type", DOH_CONTENT_TYPE)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Accept", DOH_CONTENT_TYPE)
+	return request, nil
+}
+
+func (d *DoHResolver) cached(key string) ([]byte, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var (
+		entry dohCacheEntry
+		found bool
+	)
+	entry, found = d.cache[key]
+	if !found {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(d.cache, key)
+		return nil, false
+	}
+
+	return bytes.Clone(entry.response), true
+}
+
+func (d *DoHResolver) store(key string, response []byte, maxAge time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var now time.Time = time.Now()
+	if len(d.cache) >= DOH_CACHE_SIZE {
+		for k, entry := range d.cache {
+			if now.After(entry.expiresAt) {
+				delete(d.cache, k)
+			}
+		}
+	}
+	if len(d.cache) >= DOH_CACHE_SIZE {
+		return
+	}
+
+	d.cache[key] = dohCacheEntry{response: bytes.Clone(response), expiresAt: now.Add(maxAge)}
+}
+
+// httpFreshness reads how long a response may be reused from Cache-Control
+// max-age minus Age, no-store and no-cache disable reuse
+func httpFreshness(header http.Header) time.Duration {
+	var (
+		maxAge    int = -1
+		age       int
+		directive string
+		value     string
+		found     bool
+		err       error
+	)
+	for _, directive = range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-store" || directive == "no-cache" {
+			return 0
+		}
+
+		if value, found = strings.CutPrefix(directive, "max-age="); found {
+			if maxAge, err = strconv.Atoi(value); err != nil {
+				return 0
+			}
+		}
+	}
+	if maxAge <= 0 {
+		return 0
+	}
+
+	if age, err = strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		maxAge -= age
+	}
+	if maxAge <= 0 {
+		return 0
+	}
+
+	return time.Duration(maxAge) * time.Second
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockDoHHandler answers RFC 8484 requests with a fixed response
+type mockDoHHandler struct {
+	response     []byte
+	cacheControl string
+	status       int
+	requests     atomic.Int32
+	http2        atomic.Bool
+	lastMethod   atomic.Value
+}
+
+func (m *mockDoHHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.requests.Add(1)
+	m.http2.Store(r.ProtoMajor == 2)
+	m.lastMethod.Store(r.Method)
+
+	var (
+		query []byte
+		err   error
+	)
+	if r.Method == http.MethodGet {
+		query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	} else {
+		query, err = io.ReadAll(r.Body)
+	}
+	if err != nil || len(query) < 12 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	if m.status != 0 {
+		http.Error(w, "upstream failure", m.status)
+		return
+	}
+
+	var response []byte = make([]byte, len(m.response))
+	copy(response, m.response)
+	copy(response[0:2], query[0:2])
+
+	w.Header().Set("Content-Type", DOH_CONTENT_TYPE)
+	if m.cacheControl != "" {
+		w.Header().Set("Cache-Control", m.cacheControl)
+	}
+	w.Write(response)
+}
+
+func startMockDoHServer(t *testing.T, handler *mockDoHHandler) (*httptest.Server, *x509.CertPool) {
+	t.Helper()
+
+	var (
+		server *httptest.Server = httptest.NewUnstartedServer(handler)
+		pool   *x509.CertPool   = x509.NewCertPool()
+	)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	pool.AddCert(server.Certificate())
+	return server, pool
+}
+
+// TEST 1: POST request over http/2
+// Tests that the default method is POST and the connection is http/2
+func TestDoHResolver_Resolve_Post(t *testing.T) {
+	var (
+		handler  *mockDoHHandler = &mockDoHHandler{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		server   *httptest.Server
+		pool     *x509.CertPool
+		resolver *DoHResolver
+		query    []byte = buildDNSQuery("example.com", 1, 1)
+		response []byte
+		err      error
+	)
+	server, pool = startMockDoHServer(t, handler)
+
+	resolver, err = NewDoHResolver(server.URL+"/dns-query", 2*time.Second, pool)
+	if err != nil {
+		t.Fatalf("NewDoHResolver failed: %v", err)
+	}
+
+	binary.BigEndian.PutUint16(query[0:2], 0xCAFE)
+	response, err = resolver.Resolve(context.Background(), query)
+
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if binary.BigEndian.Uint16(response[0:2]) != 0xCAFE {
+		t.Errorf("Expected client transaction ID 0xCAFE, got 0x%04X", binary.BigEndian.Uint16(response[0:2]))
+	}
+	if handler.lastMethod.Load() != http.MethodPost {
+		t.Errorf("Expected POST, got %v", handler.lastMethod.Load())
+	}
+	if !handler.http2.Load() {
+		t.Error("Expected request over http/2")
+	}
+}
+
+// TEST 2: GET request with base64url
+// Tests that #get selects the GET form of RFC 8484
+func TestDoHResolver_Resolve_Get(t *testing.T) {
+	var (
+		handler  *mockDoHHandler = &mockDoHHandler{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		server   *httptest.Server
+		pool     *x509.CertPool
+		resolver *DoHResolver
+		err      error
+	)
+	server, pool = startMockDoHServer(t, handler)
+
+	resolver, err = NewDoHResolver(server.URL+"/dns-query#get", 2*time.Second, pool)
+	if err != nil {
+		t.Fatalf("NewDoHResolver failed: %v", err)
+	}
+
+	if _, err = resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1)); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if handler.lastMethod.Load() != http.MethodGet {
+		t.Errorf("Expected GET, got %v", handler.lastMethod.Load())
+	}
+}
+
+// TEST 3: HTTP errors are resolver failures
+// Tests that a non 200 status returns an error
+func TestDoHResolver_Resolve_HTTPError(t *testing.T) {
+	var (
+		handler  *mockDoHHandler = &mockDoHHandler{status: http.StatusBadGateway}
+		server   *httptest.Server
+		pool     *x509.CertPool
+		resolver *DoHResolver
+		response []byte
+		err      error
+	)
+	server, pool = startMockDoHServer(t, handler)
+	resolver, _ = NewDoHResolver(server.URL+"/dns-query", 2*time.Second, pool)
+
+	response, err = resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1))
+
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("Expected 502 error, got %v", err)
+	}
+	if response != nil {
+		t.Error("Response should be nil on http error")
+	}
+}
+
+// TEST 4: Cache-Control max-age is honored
+// Tests that a fresh answer is reused without a second request
+func TestDoHResolver_Resolve_HonorsMaxAge(t *testing.T) {
+	var (
+		handler *mockDoHHandler = &mockDoHHandler{
+			response:     buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}),
+			cacheControl: "max-age=60",
+		}
+		server   *httptest.Server
+		pool     *x509.CertPool
+		resolver *DoHResolver
+		query    []byte = buildDNSQuery("example.com", 1, 1)
+		response []byte
+		err      error
+	)
+	server, pool = startMockDoHServer(t, handler)
+	resolver, _ = NewDoHResolver(server.URL+"/dns-query", 2*time.Second, pool)
+
+	if _, err = resolver.Resolve(context.Background(), query); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	binary.BigEndian.PutUint16(query[0:2], 0x4242)
+	response, err = resolver.Resolve(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	if handler.requests.Load() != 1 {
+		t.Errorf("Expected 1 http request, got %d", handler.requests.Load())
+	}
+	if binary.BigEndian.Uint16(response[0:2]) != 0x4242 {
+		t.Error("Cached answer should carry the new transaction ID")
+	}
+}
+
+// TEST 5: no-store disables reuse
+// Tests that every query goes to the server when caching is forbidden
+func TestDoHResolver_Resolve_NoStore(t *testing.T) {
+	var (
+		handler *mockDoHHandler = &mockDoHHandler{
+			response:     buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}),
+			cacheControl: "no-store, max-age=60",
+		}
+		server   *httptest.Server
+		pool     *x509.CertPool
+		resolver *DoHResolver
+		i        int
+	)
+	server, pool = startMockDoHServer(t, handler)
+	resolver, _ = NewDoHResolver(server.URL+"/dns-query", 2*time.Second, pool)
+
+	for i = 0; i < 2; i++ {
+		resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1))
+	}
+
+	if handler.requests.Load() != 2 {
+		t.Errorf("Expected 2 http requests, got %d", handler.requests.Load())
+	}
+}
+
+// TEST 6: Freshness accounts for Age
+// Tests the max-age and Age arithmetic
+func TestHTTPFreshness(t *testing.T) {
+	var tests = []struct {
+		cacheControl string
+		age          string
+		expected     time.Duration
+	}{
+		{"max-age=300", "", 300 * time.Second},
+		{"public, max-age=300", "100", 200 * time.Second},
+		{"max-age=300", "400", 0},
+		{"no-cache", "", 0},
+		{"", "", 0},
+	}
+
+	var header http.Header
+	for _, test := range tests {
+		header = http.Header{}
+		header.Set("Cache-Control", test.cacheControl)
+		if test.age != "" {
+			header.Set("Age", test.age)
+		}
+
+		if freshness := httpFreshness(header); freshness != test.expected {
+			t.Errorf("%q age %q: expected %v, got %v", test.cacheControl, test.age, test.expected, freshness)
+		}
+	}
+}
+
+// TEST 7: DoH upstream works in the parallel race
+// Tests that UpstreamResolver picks https:// upstreams from the transport map
+func TestUpstreamResolver_Resolve_DoH(t *testing.T) {
+	var (
+		handler  *mockDoHHandler = &mockDoHHandler{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		server   *httptest.Server
+		pool     *x509.CertPool
+		doh      *DoHResolver
+		spec     string
+		resolver *UpstreamResolver
+		err      error
+	)
+	server, pool = startMockDoHServer(t, handler)
+	spec = server.URL + "/dns-query"
+	doh, _ = NewDoHResolver(spec, 2*time.Second, pool)
+
+	resolver = &UpstreamResolver{
+		upstreamAddrs: []string{"192.0.2.1:53", spec}, // TEST-NET-1 never answers
+		timeout:       2 * time.Second,
+		transports:    map[string]Resolver{spec: doh},
+	}
+
+	if _, err = resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1)); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+}
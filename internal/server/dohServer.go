@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flash-dns/internal/dns"
+	"flash-dns/internal/logger"
+	"flash-dns/internal/utils"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	DOH_PATH         string        = "/dns-query" // RFC 8484 endpoint
+	DOH_JSON_PATH    string        = "/resolve"   // json flavor for scripting
+	DOH_READ_TIMEOUT time.Duration = 10 * time.Second
+	DOH_IDLE_TIMEOUT time.Duration = 2 * time.Minute
+)
+
+// dohJSONResponse follows the format used by the public json resolvers
+type dohJSONResponse struct {
+	Status   int               `json:"Status"`
+	TC       bool              `json:"TC"`
+	RD       bool              `json:"RD"`
+	RA       bool              `json:"RA"`
+	AD       bool              `json:"AD"`
+	CD       bool              `json:"CD"`
+	Question []dohJSONQuestion `json:"Question"`
+	Answer   []dohJSONAnswer   `json:"Answer,omitempty"`
+}
+
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type dohJSONAnswer struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// listenDoH starts the https server for DNS-over-HTTPS, the returned
+// server is closed on shutdown
+func (s *DNSServer) listenDoH(ctx context.Context, certificates *certReloader) (*http.Server, error) {
+	var (
+		listener net.Listener
+		err      error
+	)
+	listener, err = net.Listen("tcp", s.config.DoHAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.serveDoH(ctx, listener, certificates), nil
+}
+
+func (s *DNSServer) serveDoH(ctx context.Context, listener net.Listener, certificates *certReloader) *http.Server {
+	var server *http.Server = &http.Server{
+		Handler:           s.dohHandler(ctx),
+		TLSConfig:         certificates.TLSConfig("h2", "http/1.1"),
+		ReadHeaderTimeout: DOH_READ_TIMEOUT,
+		ReadTimeout:       DOH_READ_TIMEOUT,
+		IdleTimeout:       DOH_IDLE_TIMEOUT,
+	}
+
+	go func() {
+		var err error = server.ServeTLS(listener, "", "")
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error(fmt.Sprintf("DNS-over-HTTPS server stopped: %v", err))
+		}
+	}()
+
+	return server
+}
+
+// dohHandler routes the wire format and json endpoints, queries are resolved
+// with the server context so background refreshes outlive the request
+func (s *DNSServer) dohHandler(ctx context.Context) http.Handler {
+	var mux *http.ServeMux = http.NewServeMux()
+
+	mux.HandleFunc(DOH_PATH, func(w http.ResponseWriter, r *http.Request) {
+		s.serveDoHMessage(ctx, w, r)
+	})
+	mux.HandleFunc(DOH_JSON_PATH, func(w http.ResponseWriter, r *http.Request) {
+		s.serveDoHJSON(ctx, w, r)
+	})
+
+	return mux
+}
+
+func (s *DNSServer) serveDoHMessage(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var (
+		query    []byte
+		response []byte
+		err      error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		query, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get("dns"), "="))
+		if err != nil || len(query) == 0 {
+			http.Error(w, "missing or invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+
+	case http.MethodPost:
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), DOH_CONTENT_TYPE) {
+			http.Error(w, "content type must be "+DOH_CONTENT_TYPE, http.StatusUnsupportedMediaType)
+			return
+		}
+		query, err = io.ReadAll(io.LimitReader(r.Body, int64(dns.MAX_MESSAGE_SIZE)+1))
+		if err != nil || len(query) == 0 || len(query) > dns.MAX_MESSAGE_SIZE {
+			http.Error(w, "invalid dns message", http.StatusBadRequest)
+			return
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err = utils.ParseQuery(query); err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	if response = s.processQuery(ctx, query, requestAddr(r), false); response == nil {
+		http.Error(w, "failed to resolve", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", DOH_CONTENT_TYPE)
+	w.Header().Set("Cache-Control", s.cacheControl(response))
+	w.Write(response)
+}
+
+func (s *DNSServer) serveDoHJSON(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		name     string = r.URL.Query().Get("name")
+		typeName string = r.URL.Query().Get("type")
+		qtype    uint16 = 1
+		found    bool
+		query    []byte
+		response []byte
+		message  *dns.Message
+		result   dohJSONResponse
+		err      error
+	)
+	if typeName != "" {
+		if qtype, found = dns.ParseType(typeName); !found {
+			http.Error(w, "unknown record type", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if query, err = dns.BuildQuery(0, name, qtype); err != nil || name == "" {
+		http.Error(w, "missing or invalid name", http.StatusBadRequest)
+		return
+	}
+
+	if response = s.processQuery(ctx, query, requestAddr(r), false); response == nil {
+		http.Error(w, "failed to resolve", http.StatusBadGateway)
+		return
+	}
+
+	if message, err = dns.Parse(response); err != nil {
+		http.Error(w, "invalid upstream response", http.StatusBadGateway)
+		return
+	}
+
+	result = dohJSONResponse{
+		Status:   int(message.Rcode()),
+		TC:       message.Flags&dns.FLAG_TC != 0,
+		RD:       message.Flags&dns.FLAG_RD != 0,
+		RA:       message.Flags&dns.FLAG_RA != 0,
+		AD:       message.Flags&dns.FLAG_AD != 0,
+		CD:       message.Flags&dns.FLAG_CD != 0,
+		Question: []dohJSONQuestion{{Name: strings.TrimSuffix(name, ".") + ".", Type: qtype}},
+	}
+	for _, record := range message.Answers {
+		result.Answer = append(result.Answer, dohJSONAnswer{
+			Name: record.Name + ".",
+			Type: record.Type,
+			TTL:  record.TTL,
+			Data: record.DataString(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/dns-json")
+	w.Header().Set("Cache-Control", s.cacheControl(response))
+	json.NewEncoder(w).Encode(result)
+}
+
+// cacheControl keeps http caches in line with ours (RFC 8484 section 5.1),
+// answers are fresh for their smallest ttl and negative ones for their SOA,
+// failures such as SERVFAIL must not be kept at all
+func (s *DNSServer) cacheControl(response []byte) string {
+	if dns.IsFailure(response) {
+		return "no-store"
+	}
+
+	var ttl uint32
+	ttl, _ = s.cacheTTL(response)
+
+	return fmt.Sprintf("max-age=%d", ttl)
+}
+
+// requestAddr is the IP the https request came from, the zero Addr when
+// the remote address can not be read
+func requestAddr(r *http.Request) netip.Addr {
+	var (
+		addrPort netip.AddrPort
+		err      error
+	)
+	if addrPort, err = netip.ParseAddrPort(r.RemoteAddr); err != nil {
+		return netip.Addr{}
+	}
+
+	return addrPort.Addr()
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"flash-dns/internal/dns"
+	"flash-dns/internal/filter"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newDoHTestServer returns a server answering example.com from a mock
+// upstream and blocking ads.example.com
+func newDoHTestServer() *DNSServer {
+	var (
+		config     Config             = Config{LocalAddr: "127.0.0.1:0", FilterMode: "nxdomain"}
+		response   []byte             = buildDNSResponse("example.com", 1, 1, 300, []byte{93, 184, 216, 34})
+		mockFilter *MockFilter        = NewMockFilter()
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+	)
+	mockFilter.AddBlocked("ads.example.com")
+	server = NewDNSServer(config, &MockResolver{response: response}, filterList)
+	server.filter = mockFilter
+	server.cache = NewMockCache()
+
+	return server
+}
+
+// TEST 1: GET with base64url dns parameter
+// Tests the RFC 8484 GET form and the max-age header
+func TestDNSServer_DoH_Get(t *testing.T) {
+	var (
+		server   *DNSServer = newDoHTestServer()
+		query    []byte     = buildDNSQuery("example.com", 1, 1)
+		request  *http.Request
+		recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+	)
+	binary.BigEndian.PutUint16(query[0:2], 0)
+	request = httptest.NewRequest(http.MethodGet, DOH_PATH+"?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+
+	server.dohHandler(context.Background()).ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder.Header().Get("Content-Type") != DOH_CONTENT_TYPE {
+		t.Errorf("Expected %s, got %s", DOH_CONTENT_TYPE, recorder.Header().Get("Content-Type"))
+	}
+	if recorder.Header().Get("Cache-Control") != "max-age=300" {
+		t.Errorf("Expected max-age=300, got %s", recorder.Header().Get("Cache-Control"))
+	}
+	if binary.BigEndian.Uint16(recorder.Body.Bytes()[0:2]) != 0 {
+		t.Error("Response should carry the query ID 0")
+	}
+}
+
+// TEST 2: POST blocked domain behaves like udp
+// Tests that filtering and statistics are shared with the other transports
+func TestDNSServer_DoH_PostBlocked(t *testing.T) {
+	var (
+		server   *DNSServer = newDoHTestServer()
+		request  *http.Request
+		recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+		blocked  uint64
+	)
+	request = httptest.NewRequest(http.MethodPost, DOH_PATH, bytes.NewReader(buildDNSQuery("ads.example.com", 1, 1)))
+	request.Header.Set("Content-Type", DOH_CONTENT_TYPE)
+
+	server.dohHandler(context.Background()).ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", recorder.Code)
+	}
+	if binary.BigEndian.Uint16(recorder.Body.Bytes()[2:4]) != 0x8183 {
+		t.Errorf("Expected NXDOMAIN flags 0x8183, got 0x%04X", binary.BigEndian.Uint16(recorder.Body.Bytes()[2:4]))
+	}
+
+	blocked, _, _, _ = server.statistics.GetStats()
+	if blocked != 1 {
+		t.Errorf("Expected 1 blocked request, got %d", blocked)
+	}
+}
+
+// TEST 3: Invalid requests are rejected
+// Tests content type, method and payload checks
+func TestDNSServer_DoH_InvalidRequests(t *testing.T) {
+	var (
+		server  *DNSServer   = newDoHTestServer()
+		handler http.Handler = server.dohHandler(context.Background())
+		tests                = []struct {
+			method      string
+			target      string
+			contentType string
+			body        []byte
+			expected    int
+		}{
+			{http.MethodPost, DOH_PATH, "text/plain", buildDNSQuery("example.com", 1, 1), http.StatusUnsupportedMediaType},
+			{http.MethodPut, DOH_PATH, DOH_CONTENT_TYPE, nil, http.StatusMethodNotAllowed},
+			{http.MethodGet, DOH_PATH + "?dns=***", "", nil, http.StatusBadRequest},
+			{http.MethodGet, DOH_PATH + "?dns=AAAA", "", nil, http.StatusBadRequest},
+			{http.MethodGet, DOH_JSON_PATH + "?name=example.com&type=NOPE", "", nil, http.StatusBadRequest},
+			{http.MethodGet, DOH_JSON_PATH, "", nil, http.StatusBadRequest},
+		}
+		recorder *httptest.ResponseRecorder
+		request  *http.Request
+	)
+
+	for _, test := range tests {
+		recorder = httptest.NewRecorder()
+		request = httptest.NewRequest(test.method, test.target, bytes.NewReader(test.body))
+		if test.contentType != "" {
+			request.Header.Set("Content-Type", test.contentType)
+		}
+
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.expected {
+			t.Errorf("%s %s: expected %d, got %d", test.method, test.target, test.expected, recorder.Code)
+		}
+	}
+}
+
+// TEST 4: JSON api answers
+// Tests the /resolve flavor renders the A record
+func TestDNSServer_DoH_JSON(t *testing.T) {
+	var (
+		server   *DNSServer                 = newDoHTestServer()
+		request  *http.Request              = httptest.NewRequest(http.MethodGet, DOH_JSON_PATH+"?name=example.com&type=A", nil)
+		recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+		result   dohJSONResponse
+		err      error
+	)
+
+	server.dohHandler(context.Background()).ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", recorder.Code)
+	}
+	if err = json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Invalid json: %v", err)
+	}
+	if result.Status != 0 || len(result.Answer) != 1 {
+		t.Fatalf("Expected NOERROR with 1 answer, got %+v", result)
+	}
+	if result.Answer[0].Data != "93.184.216.34" || result.Answer[0].Name != "example.com." {
+		t.Errorf("Unexpected answer %+v", result.Answer[0])
+	}
+}
+
+// TEST 5: End to end over https
+// Tests the listener with our own DoH upstream client
+func TestDNSServer_ListenDoH(t *testing.T) {
+	var (
+		ctx          context.Context
+		cancel       context.CancelFunc
+		dir          string = t.TempDir()
+		serverConfig *tls.Config
+		pool         *x509.CertPool
+		server       *DNSServer = newDoHTestServer()
+		certificates *certReloader
+		listener     net.Listener
+		httpServer   *http.Server
+		client       *DoHResolver
+		cacheMisses  uint64
+		err          error
+	)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	serverConfig, pool = newTestTLSConfig(t)
+	server.config.DoHAddr = "127.0.0.1:0"
+	server.config.CertFile = filepath.Join(dir, "cert.pem")
+	server.config.KeyFile = filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, serverConfig, server.config.CertFile, server.config.KeyFile)
+
+	certificates, _ = newCertReloader(server.config.CertFile, server.config.KeyFile)
+
+	listener, err = net.Listen("tcp", server.config.DoHAddr)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	httpServer = server.serveDoH(ctx, listener, certificates)
+	defer httpServer.Close()
+
+	client, err = NewDoHResolver("https://"+listener.Addr().String()+DOH_PATH, 2*time.Second, pool)
+	if err != nil {
+		t.Fatalf("NewDoHResolver failed: %v", err)
+	}
+	if _, err = client.Resolve(ctx, buildDNSQuery("example.com", 1, 1)); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	_, _, _, cacheMisses = server.statistics.GetStats()
+	if cacheMisses != 1 {
+		t.Errorf("Expected 1 cache miss, got %d", cacheMisses)
+	}
+}
+
+// TEST 6: Cache-Control follows the answer
+// Tests that failures are not stored and negative answers use their SOA
+func TestDNSServer_DoH_CacheControl(t *testing.T) {
+	var (
+		server  *DNSServer   = newDoHTestServer()
+		handler http.Handler = server.dohHandler(context.Background())
+		query   []byte       = buildDNSQuery("missing.example.com", 1, 1)
+		tests                = []struct {
+			name     string
+			domain   string
+			resolver Resolver
+			expected string
+		}{
+			{"upstream failure", "example.com", &MockResolver{err: errUpstreamTimeout}, "no-store"},
+			{"upstream SERVFAIL", "example.com", &MockResolver{response: buildNegativeResponse(t, query, dns.RCODE_SERVFAIL, 0, 0)}, "no-store"},
+			{"NXDOMAIN with SOA", "missing.example.com", &MockResolver{response: buildNegativeResponse(t, query, dns.RCODE_NXDOMAIN, 3600, 60)}, "max-age=60"},
+			{"blocked", "ads.example.com", &MockResolver{}, "max-age=0"},
+		}
+		recorder *httptest.ResponseRecorder
+		request  *http.Request
+	)
+
+	for _, test := range tests {
+		server.resolver = test.resolver
+		server.cache = NewMockCache()
+		recorder = httptest.NewRecorder()
+		request = httptest.NewRequest(http.MethodPost, DOH_PATH, bytes.NewReader(buildDNSQuery(test.domain, 1, 1)))
+		request.Header.Set("Content-Type", DOH_CONTENT_TYPE)
+
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", test.name, recorder.Code)
+		}
+		if recorder.Header().Get("Cache-Control") != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, recorder.Header().Get("Cache-Control"))
+		}
+	}
+}
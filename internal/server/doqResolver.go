@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flash-dns/internal/dns"
+	"flash-dns/internal/logger"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	DOQ_SCHEME       string        = "quic://"
+	DOQ_DEFAULT_PORT string        = "853"
+	DOQ_ALPN         string        = "doq"
+	DOQ_IDLE_TIMEOUT time.Duration = 30 * time.Second // idle connections are closed after this
+)
+
+// error codes from RFC 9250 4.3
+const (
+	DOQ_NO_ERROR          quic.ApplicationErrorCode = 0x0
+	DOQ_INTERNAL_ERROR    quic.ApplicationErrorCode = 0x1
+	DOQ_PROTOCOL_ERROR    quic.ApplicationErrorCode = 0x2
+	DOQ_REQUEST_CANCELLED quic.StreamErrorCode      = 0x3
+)
+
+// DoQResolver forwards queries over DNS-over-QUIC (RFC 9250), one
+// connection is shared and every query gets its own stream, so a lost
+// packet only stalls the query it belongs to. Session tickets are kept
+// so reconnects can send the query in 0-RTT
+type DoQResolver struct {
+	address    string
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+	timeout    time.Duration
+
+	mu   sync.Mutex
+	conn *quic.Conn
+}
+
+// NewDoQResolver parses specs like quic://94.140.14.14:853#dns.adguard-dns.com,
+// the part after # works like it does for tls:// upstreams
+func NewDoQResolver(spec string, timeout time.Duration, rootCAs *x509.CertPool) (*DoQResolver, error) {
+	var (
+		address    string
+		serverName string
+		err        error
+	)
+	address, serverName, err = parseTLSUpstream(spec, DOQ_SCHEME, DOQ_DEFAULT_PORT)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DoQResolver{
+		address: address,
+		tlsConfig: &tls.Config{
+			ServerName:         serverName,
+			RootCAs:            rootCAs,
+			MinVersion:         tls.VersionTLS13,
+			NextProtos:         []string{DOQ_ALPN},
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		},
+		quicConfig: &quic.Config{
+			HandshakeIdleTimeout: timeout,
+			MaxIdleTimeout:       DOQ_IDLE_TIMEOUT,
+		},
+		timeout: timeout,
+	}, nil
+}
+
+func (d *DoQResolver) String() string {
+	return DOQ_SCHEME + d.address + "#" + d.tlsConfig.ServerName
+}
+
+func (d *DoQResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < dns.HEADER_SIZE {
+		return nil, fmt.Errorf("query too short: %d bytes", len(query))
+	}
+
+	var (
+		conn     *quic.Conn
+		response []byte
+		err      error
+		attempt  int
+	)
+
+	// like dot, a connection that went away while idle is only noticed on
+	// use, so the query is tried once more on a fresh connection
+	for attempt = 0; attempt < 2; attempt++ {
+		conn, err = d.connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err = d.exchange(ctx, conn, query)
+		if err == nil || conn.Context().Err() == nil || ctx.Err() != nil {
+			return response, err
+		}
+		logger.Warn(fmt.Sprintf("doq connection to %s dropped, reconnecting", d.address))
+	}
+
+	return nil, err
+}
+
+// exchange sends one query on a new stream, the ID is zero on the wire as
+// RFC 9250 4.2.1 requires and the client ID is put back on the answer
+func (d *DoQResolver) exchange(ctx context.Context, conn *quic.Conn, query []byte) ([]byte, error) {
+	var (
+		queryCtx context.Context
+		cancel   context.CancelFunc
+		stream   *quic.Stream
+		message  []byte = make([]byte, len(query))
+		response []byte
+		stop     func() bool
+		err      error
+	)
+	queryCtx, cancel = context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	stream, err = conn.OpenStreamSync(queryCtx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open doq stream to %s: %w", d.address, err)
+	}
+	stream.SetDeadline(time.Now().Add(d.timeout))
+
+	// a cancelled query tells the server it can stop working on it
+	stop = context.AfterFunc(queryCtx, func() {
+		stream.CancelRead(DOQ_REQUEST_CANCELLED)
+		stream.CancelWrite(DOQ_REQUEST_CANCELLED)
+	})
+	defer stop()
+
+	copy(message, query)
+	message[0], message[1] = 0, 0
+
+	// the fin after the query tells the server nothing else comes on this stream
+	if err = writeTCPMessage(stream, message); err != nil {
+		return nil, fmt.Errorf("doq query to %s failed: %w", d.address, err)
+	}
+	stream.Close()
+
+	response, err = readTCPMessage(stream)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("doq query to %s failed: %w", d.address, err)
+	}
+	if len(response) < dns.HEADER_SIZE {
+		return nil, fmt.Errorf("doq answer from %s too short: %d bytes", d.address, len(response))
+	}
+
+	copy(response[0:2], query[0:2])
+	return response, nil
+}
+
+// connection returns the shared connection, dialing a new one when needed.
+// The dial does not wait for the handshake, with a cached session ticket
+// the first query already leaves in 0-RTT, which is safe because plain
+// queries can be replayed without side effects
+func (d *DoQResolver) connection(ctx context.Context) (*quic.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn != nil && d.conn.Context().Err() == nil {
+		return d.conn, nil
+	}
+
+	var (
+		dialCtx context.Context
+		cancel  context.CancelFunc
+		conn    *quic.Conn
+		err     error
+	)
+	dialCtx, cancel = context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	conn, err = quic.DialAddrEarly(dialCtx, d.address, d.tlsConfig, d.quicConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", d.address, err)
+	}
+
+	d.conn = conn
+	return conn, nil
+}
+
+// Close drops the shared connection, the next query opens a new one
+func (d *DoQResolver) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn != nil {
+		d.conn.CloseWithError(DOQ_NO_ERROR, "")
+		d.conn = nil
+	}
+	return nil
+}
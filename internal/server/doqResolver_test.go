@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ============================================================================
+// LOCAL QUIC STAND-IN FOR TESTING
+// ============================================================================
+
+// mockDoQServer answers every stream with a fixed response and records
+// what the client sent
+type mockDoQServer struct {
+	listener    *quic.EarlyListener
+	response    []byte
+	connections atomic.Int32
+	resumed     atomic.Int32 // connections that used 0-RTT
+	nonZeroIDs  atomic.Int32 // queries sent with an ID other than zero
+	streams     atomic.Int32
+}
+
+func startMockDoQServer(t *testing.T, config *tls.Config, response []byte) *mockDoQServer {
+	t.Helper()
+
+	var (
+		listener *quic.EarlyListener
+		err      error
+		server   *mockDoQServer
+	)
+	config = config.Clone()
+	config.NextProtos = []string{DOQ_ALPN}
+
+	listener, err = quic.ListenAddrEarly("127.0.0.1:0", config, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatalf("Failed to start quic listener: %v", err)
+	}
+
+	server = &mockDoQServer{listener: listener, response: response}
+	go server.serve()
+	t.Cleanup(func() { listener.Close() })
+
+	return server
+}
+
+func (m *mockDoQServer) serve() {
+	var (
+		conn *quic.Conn
+		err  error
+	)
+	for {
+		conn, err = m.listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		m.connections.Add(1)
+		go m.handle(conn)
+	}
+}
+
+func (m *mockDoQServer) handle(conn *quic.Conn) {
+	var (
+		stream *quic.Stream
+		err    error
+	)
+	for {
+		stream, err = conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		m.streams.Add(1)
+
+		go func(stream *quic.Stream) {
+			var (
+				query []byte
+				err   error
+			)
+			if query, err = readTCPMessage(stream); err != nil {
+				return
+			}
+			if binary.BigEndian.Uint16(query[0:2]) != 0 {
+				m.nonZeroIDs.Add(1)
+			}
+
+			<-conn.HandshakeComplete()
+			if conn.ConnectionState().Used0RTT {
+				m.resumed.Add(1)
+			}
+
+			writeTCPMessage(stream, m.response)
+			stream.Close()
+		}(stream)
+	}
+}
+
+// ============================================================================
+// TESTS
+// ============================================================================
+
+// TEST 1: Resolve over quic
+// Tests that the ID is zero on the wire and restored on the answer
+func TestDoQResolver_Resolve_Success(t *testing.T) {
+	var (
+		serverConfig *tls.Config
+		pool         *x509.CertPool
+		mockResponse []byte = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		query        []byte = buildDNSQuery("example.com", 1, 1)
+		server       *mockDoQServer
+		resolver     *DoQResolver
+		response     []byte
+		err          error
+	)
+	serverConfig, pool = newTestTLSConfig(t)
+	binary.BigEndian.PutUint16(mockResponse[0:2], 0)
+	server = startMockDoQServer(t, serverConfig, mockResponse)
+
+	resolver, err = NewDoQResolver("quic://"+server.listener.Addr().String()+"#dns.test", 2*time.Second, pool)
+	if err != nil {
+		t.Fatalf("NewDoQResolver failed: %v", err)
+	}
+	defer resolver.Close()
+
+	binary.BigEndian.PutUint16(query[0:2], 0xBEEF)
+	response, err = resolver.Resolve(context.Background(), query)
+
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if binary.BigEndian.Uint16(response[0:2]) != 0xBEEF {
+		t.Errorf("Expected client transaction ID 0xBEEF, got 0x%04X", binary.BigEndian.Uint16(response[0:2]))
+	}
+	if binary.BigEndian.Uint16(query[0:2]) != 0xBEEF {
+		t.Error("Resolve should not modify the caller's query")
+	}
+	if server.nonZeroIDs.Load() != 0 {
+		t.Errorf("Expected ID 0 on the wire, got %d queries with another ID", server.nonZeroIDs.Load())
+	}
+}
+
+// TEST 2: Concurrent queries share one connection
+// Tests that every query gets its own stream on the same connection
+func TestDoQResolver_Resolve_StreamPerQuery(t *testing.T) {
+	var (
+		serverConfig *tls.Config
+		pool         *x509.CertPool
+		server       *mockDoQServer
+		resolver     *DoQResolver
+		wg           sync.WaitGroup
+		failures     atomic.Int32
+		i            int
+	)
+	serverConfig, pool = newTestTLSConfig(t)
+	server = startMockDoQServer(t, serverConfig, buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}))
+
+	resolver, _ = NewDoQResolver("quic://"+server.listener.Addr().String()+"#dns.test", 2*time.Second, pool)
+	defer resolver.Close()
+
+	// open the connection first so the concurrent queries find it
+	if _, err := resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1)); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	for i = 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1)); err != nil {
+				failures.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failures.Load() != 0 {
+		t.Errorf("Expected all queries to succeed, %d failed", failures.Load())
+	}
+	if server.connections.Load() != 1 {
+		t.Errorf("Expected 1 connection, got %d", server.connections.Load())
+	}
+	if server.streams.Load() != 11 {
+		t.Errorf("Expected 11 streams, got %d", server.streams.Load())
+	}
+}
+
+// TEST 3: Reconnects resume the session with 0-RTT
+// Tests that the session ticket from the first connection is used
+func TestDoQResolver_Resolve_ZeroRTT(t *testing.T) {
+	var (
+		serverConfig *tls.Config
+		pool         *x509.CertPool
+		server       *mockDoQServer
+		resolver     *DoQResolver
+		err          error
+	)
+	serverConfig, pool = newTestTLSConfig(t)
+	server = startMockDoQServer(t, serverConfig, buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}))
+
+	resolver, _ = NewDoQResolver("quic://"+server.listener.Addr().String()+"#dns.test", 2*time.Second, pool)
+	defer resolver.Close()
+
+	if _, err = resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1)); err != nil {
+		t.Fatalf("First Resolve failed: %v", err)
+	}
+	// give the session ticket time to arrive before dropping the connection
+	time.Sleep(50 * time.Millisecond)
+	resolver.Close()
+
+	if _, err = resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1)); err != nil {
+		t.Fatalf("Second Resolve failed: %v", err)
+	}
+
+	if server.connections.Load() != 2 {
+		t.Errorf("Expected 2 connections, got %d", server.connections.Load())
+	}
+	if server.resumed.Load() != 1 {
+		t.Errorf("Expected the second connection to use 0-RTT, got %d resumed", server.resumed.Load())
+	}
+}
+
+// TEST 4: Wrong server name fails verification
+// Tests that the certificate is checked against the name after #
+func TestDoQResolver_Resolve_BadServerName(t *testing.T) {
+	var (
+		serverConfig *tls.Config
+		pool         *x509.CertPool
+		server       *mockDoQServer
+		resolver     *DoQResolver
+		err          error
+	)
+	serverConfig, pool = newTestTLSConfig(t)
+	server = startMockDoQServer(t, serverConfig, buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}))
+
+	resolver, _ = NewDoQResolver("quic://"+server.listener.Addr().String()+"#wrong.example", 2*time.Second, pool)
+	defer resolver.Close()
+
+	_, err = resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1))
+
+	if err == nil {
+		t.Error("Expected a certificate error")
+	}
+}
+
+// TEST 5: NewUpstreamResolver builds quic transports
+// Tests that quic:// specs get a DoQ transport
+func TestNewUpstreamResolver_DoQ(t *testing.T) {
+	var (
+		resolver  *UpstreamResolver = NewUpstreamResolver("quic://94.140.14.14#dns.adguard-dns.com", STRATEGY_PARALLEL)
+		transport Resolver
+		found     bool
+	)
+
+	if transport, found = resolver.transports["quic://94.140.14.14#dns.adguard-dns.com"]; !found {
+		t.Fatal("quic upstream should have a transport")
+	}
+	if _, found = transport.(*DoQResolver); !found {
+		t.Errorf("Expected a *DoQResolver, got %T", transport)
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flash-dns/internal/dns"
+	"flash-dns/internal/logger"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	DOQ_STREAM_TIMEOUT time.Duration = 10 * time.Second // how long a single stream may take
+	DOQ_MAX_STREAMS    int64         = 100              // concurrent queries per connection
+)
+
+// listenDoQ opens the DNS-over-QUIC listener (RFC 9250) on udp. 0-RTT is
+// accepted, queries that arrive before the handshake are only answered
+// when they are plain QUERY opcodes since those may be replayed
+func (s *DNSServer) listenDoQ(certificates *certReloader) (*quic.EarlyListener, error) {
+	var tlsConfig *tls.Config = certificates.TLSConfig(DOQ_ALPN)
+	tlsConfig.MinVersion = tls.VersionTLS13
+
+	return quic.ListenAddrEarly(s.config.DoQAddr, tlsConfig, &quic.Config{
+		Allow0RTT:          true,
+		MaxIdleTimeout:     DOQ_IDLE_TIMEOUT,
+		MaxIncomingStreams: DOQ_MAX_STREAMS,
+	})
+}
+
+// serveDoQ accepts connections until the listener is closed
+func (s *DNSServer) serveDoQ(ctx context.Context, listener *quic.EarlyListener) {
+	var (
+		conn *quic.Conn
+		err  error
+	)
+
+	for {
+		conn, err = listener.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, quic.ErrServerClosed) {
+				return
+			}
+
+			logger.Error(fmt.Sprintf("Error accepting quic connection: %v", err))
+			continue
+		}
+
+		go s.handleDoQConn(ctx, conn)
+	}
+}
+
+// handleDoQConn answers every stream the client opens, each stream carries
+// exactly one query and its answer
+func (s *DNSServer) handleDoQConn(ctx context.Context, conn *quic.Conn) {
+	var (
+		stream *quic.Stream
+		err    error
+	)
+	defer conn.CloseWithError(DOQ_NO_ERROR, "")
+
+	for {
+		stream, err = conn.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+
+		go s.handleDoQStream(ctx, conn, stream)
+	}
+}
+
+func (s *DNSServer) handleDoQStream(ctx context.Context, conn *quic.Conn, stream *quic.Stream) {
+	var (
+		query    []byte
+		response []byte
+		err      error
+	)
+	stream.SetDeadline(time.Now().Add(DOQ_STREAM_TIMEOUT))
+
+	query, err = readTCPMessage(stream)
+	if err != nil || len(query) < dns.HEADER_SIZE {
+		if err != nil && !errors.Is(err, io.EOF) {
+			logger.Warn(fmt.Sprintf("Error reading doq query from %s: %v", conn.RemoteAddr(), err))
+		}
+		conn.CloseWithError(DOQ_PROTOCOL_ERROR, "malformed query")
+		return
+	}
+
+	// RFC 9250 4.2.1, the ID is always zero since the stream identifies the query
+	if query[0] != 0 || query[1] != 0 {
+		conn.CloseWithError(DOQ_PROTOCOL_ERROR, "message id must be zero")
+		return
+	}
+
+	// anything other than QUERY waits for the handshake so it can not be replayed
+	if query[2]&0x78 != 0 {
+		select {
+		case <-conn.HandshakeComplete():
+		case <-conn.Context().Done():
+			return
+		}
+	}
+
+	if response = s.processQuery(ctx, query, addrOf(conn.RemoteAddr()), false); response == nil {
+		stream.CancelRead(quic.StreamErrorCode(DOQ_INTERNAL_ERROR))
+		stream.CancelWrite(quic.StreamErrorCode(DOQ_INTERNAL_ERROR))
+		return
+	}
+
+	if err = writeTCPMessage(stream, response); err != nil {
+		logger.Warn(fmt.Sprintf("Error writing doq response to %s: %v", conn.RemoteAddr(), err))
+		stream.CancelWrite(quic.StreamErrorCode(DOQ_INTERNAL_ERROR))
+		return
+	}
+	stream.Close()
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"flash-dns/internal/filter"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// startDoQTestServer runs the DoQ listener of a server backed by mocks
+func startDoQTestServer(t *testing.T, ctx context.Context, response []byte) (*DNSServer, *quic.EarlyListener, *x509.CertPool) {
+	t.Helper()
+
+	var (
+		dir          string = t.TempDir()
+		serverConfig *tls.Config
+		pool         *x509.CertPool
+		config       Config
+		mockFilter   *MockFilter = NewMockFilter()
+		server       *DNSServer
+		certificates *certReloader
+		listener     *quic.EarlyListener
+		err          error
+	)
+	serverConfig, pool = newTestTLSConfig(t)
+	config = Config{
+		LocalAddr: "127.0.0.1:0",
+		DoQAddr:   "127.0.0.1:0",
+		CertFile:  filepath.Join(dir, "cert.pem"),
+		KeyFile:   filepath.Join(dir, "key.pem"),
+	}
+	writeTestCertificate(t, serverConfig, config.CertFile, config.KeyFile)
+
+	mockFilter.AddBlocked("ads.example.com")
+	server = NewDNSServer(config, &MockResolver{response: response}, filter.NewFilterList())
+	server.filter = mockFilter
+	server.cache = NewMockCache()
+
+	certificates, err = newCertReloader(config.CertFile, config.KeyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader failed: %v", err)
+	}
+	listener, err = server.listenDoQ(certificates)
+	if err != nil {
+		t.Fatalf("listenDoQ failed: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.serveDoQ(ctx, listener)
+
+	return server, listener, pool
+}
+
+// TEST 1: DoQ clients go through the same pipeline
+// Tests a blocked and an upstream answered query over the quic listener
+func TestDNSServer_ListenDoQ(t *testing.T) {
+	var (
+		ctx          context.Context
+		cancel       context.CancelFunc
+		mockResponse []byte = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		server       *DNSServer
+		listener     *quic.EarlyListener
+		pool         *x509.CertPool
+		client       *DoQResolver
+		response     []byte
+		err          error
+	)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	server, listener, pool = startDoQTestServer(t, ctx, mockResponse)
+
+	client, _ = NewDoQResolver("quic://"+listener.Addr().String()+"#dns.test", 2*time.Second, pool)
+	defer client.Close()
+
+	response, err = client.Resolve(ctx, buildDNSQuery("ads.example.com", 1, 1))
+	if err != nil {
+		t.Fatalf("Resolve blocked domain failed: %v", err)
+	}
+	if binary.BigEndian.Uint16(response[2:4]) != 0x8183 {
+		t.Errorf("Expected NXDOMAIN flags 0x8183, got 0x%04X", binary.BigEndian.Uint16(response[2:4]))
+	}
+
+	response, err = client.Resolve(ctx, buildDNSQuery("example.com", 1, 1))
+	if err != nil {
+		t.Fatalf("Resolve allowed domain failed: %v", err)
+	}
+	if len(response) != len(mockResponse) {
+		t.Errorf("Expected %d bytes, got %d", len(mockResponse), len(response))
+	}
+
+	var blocked, allowed uint64
+	blocked, allowed, _, _ = server.statistics.GetStats()
+	if blocked != 1 || allowed != 1 {
+		t.Errorf("Expected 1 blocked and 1 allowed, got %d and %d", blocked, allowed)
+	}
+}
+
+// TEST 2: A query with a non-zero ID is a protocol error
+// Tests that the connection is closed with DOQ_PROTOCOL_ERROR
+func TestDNSServer_DoQ_RejectsNonZeroID(t *testing.T) {
+	var (
+		ctx      context.Context
+		cancel   context.CancelFunc
+		listener *quic.EarlyListener
+		pool     *x509.CertPool
+		conn     *quic.Conn
+		stream   *quic.Stream
+		appErr   *quic.ApplicationError
+		err      error
+	)
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, listener, pool = startDoQTestServer(t, ctx, buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}))
+
+	conn, err = quic.DialAddr(ctx, listener.Addr().String(), &tls.Config{
+		ServerName: "dns.test",
+		RootCAs:    pool,
+		NextProtos: []string{DOQ_ALPN},
+	}, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	stream, err = conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("OpenStreamSync failed: %v", err)
+	}
+	writeTCPMessage(stream, buildDNSQuery("example.com", 1, 1)) // ID 0x1234
+	stream.Close()
+
+	_, err = readTCPMessage(stream)
+	if err == nil {
+		t.Fatal("Expected the query to be rejected")
+	}
+	<-conn.Context().Done()
+	if !errors.As(context.Cause(conn.Context()), &appErr) || appErr.ErrorCode != DOQ_PROTOCOL_ERROR {
+		t.Errorf("Expected DOQ_PROTOCOL_ERROR, got %v", context.Cause(conn.Context()))
+	}
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"flash-dns/internal/dns"
+	"flash-dns/internal/logger"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DOT_SCHEME       string        = "tls://"
+	DOT_DEFAULT_PORT string        = "853"
+	DOT_IDLE_TIMEOUT time.Duration = 30 * time.Second // idle connections are closed after this
+)
+
+var errDoTConnClosed error = errors.New("dot connection closed")
+
+// DoTResolver forwards queries over DNS-over-TLS (RFC 7858), a single
+// connection is kept open and shared by every query, answers are matched
+// back by transaction ID so they may arrive in any order
+type DoTResolver struct {
+	address   string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	mu   sync.Mutex
+	conn *dotConn
+}
+
+// NewDoTResolver parses specs like tls://1.1.1.1:853#cloudflare-dns.com,
+// the part after # is the name used for SNI and certificate checks, when
+// missing the host itself is verified. rootCAs nil means the system pool
+func NewDoTResolver(spec string, timeout time.Duration, rootCAs *x509.CertPool) (*DoTResolver, error) {
+	var (
+		address    string
+		serverName string
+		err        error
+	)
+	address, serverName, err = parseTLSUpstream(spec, DOT_SCHEME, DOT_DEFAULT_PORT)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DoTResolver{
+		address: address,
+		tlsConfig: &tls.Config{
+			ServerName:         serverName,
+			RootCAs:            rootCAs,
+			MinVersion:         tls.VersionTLS12,
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		},
+		timeout: timeout,
+	}, nil
+}
+
+// parseTLSUpstream splits scheme://host[:port][#name] into the address to
+// dial and the name to verify, shared by the tls based transports
+func parseTLSUpstream(spec, scheme, defaultPort string) (string, string, error) {
+	var (
+		rest       string
+		serverName string
+		host       string
+		port       string
+		err        error
+		found      bool
+	)
+	rest, found = strings.CutPrefix(strings.TrimSpace(spec), scheme)
+	if !found {
+		return "", "", fmt.Errorf("upstream %s does not start with %s", spec, scheme)
+	}
+
+	rest, serverName, _ = strings.Cut(rest, "#")
+	if rest == "" {
+		return "", "", fmt.Errorf("missing host in %s", spec)
+	}
+
+	host, port, err = net.SplitHostPort(rest)
+	if err != nil {
+		host = strings.Trim(rest, "[]")
+		port = defaultPort
+	}
+
+	if serverName == "" {
+		serverName = host
+	}
+
+	return net.JoinHostPort(host, port), serverName, nil
+}
+
+func (d *DoTResolver) String() string {
+	return DOT_SCHEME + d.address + "#" + d.tlsConfig.ServerName
+}
+
+func (d *DoTResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var (
+		conn     *dotConn
+		response []byte
+		err      error
+		attempt  int
+	)
+
+	// a connection the server closed while idle is only noticed on use,
+	// so a query that hits a dead connection is tried once more on a new one
+	for attempt = 0; attempt < 2; attempt++ {
+		conn, err = d.connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err = conn.exchange(ctx, query, d.timeout)
+		if !errors.Is(err, errDoTConnClosed) {
+			return response, err
+		}
+		logger.Warn(fmt.Sprintf("dot connection to %s dropped, reconnecting", d.address))
+	}
+
+	return nil, err
+}
+
+// connection returns the shared connection, dialing a new one when needed
+func (d *DoTResolver) connection(ctx context.Context) (*dotConn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn != nil && !d.conn.isClosed() {
+		return d.conn, nil
+	}
+
+	var (
+		dialer    tls.Dialer = tls.Dialer{NetDialer: &net.Dialer{Timeout: d.timeout}, Config: d.tlsConfig}
+		dialCtx   context.Context
+		cancel    context.CancelFunc
+		conn      net.Conn
+		err       error
+		connected *dotConn
+	)
+	dialCtx, cancel = context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	conn, err = dialer.DialContext(dialCtx, "tcp", d.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", d.address, err)
+	}
+
+	connected = &dotConn{
+		conn:    conn,
+		pending: make(map[uint16]chan []byte),
+		nextID:  uint16(rand.N(0x10000)),
+	}
+	go connected.readLoop()
+
+	d.conn = connected
+	return connected, nil
+}
+
+// Close drops the shared connection, the next query opens a new one
+func (d *DoTResolver) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn != nil {
+		d.conn.close(errDoTConnClosed)
+		d.conn = nil
+	}
+	return nil
+}
+
+// dotConn is one tls connection with the queries waiting on it
+type dotConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan []byte
+	nextID  uint16
+	closed  bool
+}
+
+func (c *dotConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// exchange sends the query under an ID unique on this connection and
+// restores the client ID on the answer
+func (c *dotConn) exchange(ctx context.Context, query []byte, timeout time.Duration) ([]byte, error) {
+	if len(query) < dns.HEADER_SIZE {
+		return nil, fmt.Errorf("query too short: %d bytes", len(query))
+	}
+
+	var (
+		id       uint16
+		waiter   chan []byte = make(chan []byte, 1)
+		message  []byte      = make([]byte, len(query))
+		response []byte
+		ok       bool
+		timer    *time.Timer = time.NewTimer(timeout)
+		err      error
+	)
+	defer timer.Stop()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errDoTConnClosed
+	}
+	for {
+		id = c.nextID
+		c.nextID++
+		if _, ok = c.pending[id]; !ok {
+			break
+		}
+	}
+	c.pending[id] = waiter
+	c.mu.Unlock()
+
+	copy(message, query)
+	binary.BigEndian.PutUint16(message[0:2], id)
+
+	c.writeMu.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	c.conn.SetReadDeadline(time.Now().Add(DOT_IDLE_TIMEOUT))
+	err = writeTCPMessage(c.conn, message)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, errDoTConnClosed
+	}
+
+	select {
+	case response, ok = <-waiter:
+		if !ok {
+			return nil, errDoTConnClosed
+		}
+		copy(response[0:2], query[0:2])
+		return response, nil
+
+	case <-ctx.Done():
+		c.forget(id)
+		return nil, ctx.Err()
+
+	case <-timer.C:
+		c.forget(id)
+		return nil, fmt.Errorf("dot query to %s timed out", c.conn.RemoteAddr())
+	}
+}
+
+func (c *dotConn) forget(id uint16) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// readLoop hands every answer to the query waiting on its ID until the
+// connection fails or goes idle
+func (c *dotConn) readLoop() {
+	var (
+		response []byte
+		err      error
+		id       uint16
+		waiter   chan []byte
+		found    bool
+	)
+
+	for {
+		response, err = readTCPMessage(c.conn)
+		if err != nil {
+			c.close(err)
+			return
+		}
+		if len(response) < dns.HEADER_SIZE {
+			continue
+		}
+
+		id = binary.BigEndian.Uint16(response[0:2])
+		c.mu.Lock()
+		waiter, found = c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+
+		if found {
+			waiter <- response
+		}
+	}
+}
+
+// close marks the connection dead and wakes every pending query
+func (c *dotConn) close(reason error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.conn.Close()
+
+	for id, waiter := range c.pending {
+		close(waiter)
+		delete(c.pending, id)
+	}
+
+	var netErr net.Error
+	if reason != nil && !errors.Is(reason, errDoTConnClosed) && !(errors.As(reason, &netErr) && netErr.Timeout()) {
+		logger.Info(fmt.Sprintf("dot connection to %s closed: %v", c.conn.RemoteAddr(), reason))
+	}
+}
@@ -0,0 +1,390 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ============================================================================
+// LOCAL TLS STAND-IN FOR TESTING
+// ============================================================================
+
+// newTestTLSConfig creates a throwaway CA and a server certificate signed by
+// it for dns.test and 127.0.0.1, returning the server config and the CA pool
+func newTestTLSConfig(t *testing.T) (*tls.Config, *x509.CertPool) {
+	t.Helper()
+
+	var (
+		caKey      *ecdsa.PrivateKey
+		serverKey  *ecdsa.PrivateKey
+		caTemplate *x509.Certificate
+		caDER      []byte
+		caCert     *x509.Certificate
+		serverDER  []byte
+		pool       *x509.CertPool = x509.NewCertPool()
+		err        error
+	)
+
+	caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	caTemplate = &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "flash-dns test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err = x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	caCert, _ = x509.ParseCertificate(caDER)
+	pool.AddCert(caCert)
+
+	serverKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate server key: %v", err)
+	}
+	serverDER, err = x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, &serverKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create server certificate: %v", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}},
+		NextProtos:   []string{"h2", "http/1.1", "doq"},
+	}, pool
+}
+
+// mockDoTServer answers framed queries over tls with a fixed response
+type mockDoTServer struct {
+	listener    net.Listener
+	response    []byte
+	connections atomic.Int32
+	closeAfter  int // close each connection after this many answers, 0 keeps it open
+}
+
+func startMockDoTServer(t *testing.T, config *tls.Config, response []byte, closeAfter int) *mockDoTServer {
+	t.Helper()
+
+	var (
+		listener net.Listener
+		err      error
+		server   *mockDoTServer
+	)
+	listener, err = tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("Failed to start tls listener: %v", err)
+	}
+
+	server = &mockDoTServer{listener: listener, response: response, closeAfter: closeAfter}
+	go server.serve()
+	t.Cleanup(func() { listener.Close() })
+
+	return server
+}
+
+func (m *mockDoTServer) serve() {
+	var (
+		conn net.Conn
+		err  error
+	)
+	for {
+		conn, err = m.listener.Accept()
+		if err != nil {
+			return
+		}
+		m.connections.Add(1)
+		go m.handle(conn)
+	}
+}
+
+func (m *mockDoTServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var (
+		writeMu  sync.Mutex
+		wg       sync.WaitGroup
+		query    []byte
+		err      error
+		answered int
+	)
+	for {
+		query, err = readTCPMessage(conn)
+		if err != nil {
+			break
+		}
+
+		// answer concurrently so responses can come back out of order
+		wg.Add(1)
+		go func(query []byte) {
+			defer wg.Done()
+			var response []byte = make([]byte, len(m.response))
+			copy(response, m.response)
+			copy(response[0:2], query[0:2])
+
+			writeMu.Lock()
+			writeTCPMessage(conn, response)
+			writeMu.Unlock()
+		}(query)
+
+		answered++
+		if m.closeAfter > 0 && answered >= m.closeAfter {
+			break
+		}
+	}
+	wg.Wait()
+}
+
+// ============================================================================
+// TESTS
+// ============================================================================
+
+// TEST 1: Parse DoT upstream specs
+// Tests that port and server name defaults are applied
+func TestParseTLSUpstream(t *testing.T) {
+	var tests = []struct {
+		spec       string
+		address    string
+		serverName string
+	}{
+		{"tls://1.1.1.1:853#cloudflare-dns.com", "1.1.1.1:853", "cloudflare-dns.com"},
+		{"tls://9.9.9.9#dns.quad9.net", "9.9.9.9:853", "dns.quad9.net"},
+		{"tls://dns.google", "dns.google:853", "dns.google"},
+		{"tls://[2606:4700:4700::1111]:853", "[2606:4700:4700::1111]:853", "2606:4700:4700::1111"},
+	}
+
+	var (
+		address    string
+		serverName string
+		err        error
+	)
+	for _, test := range tests {
+		address, serverName, err = parseTLSUpstream(test.spec, DOT_SCHEME, DOT_DEFAULT_PORT)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.spec, err)
+			continue
+		}
+		if address != test.address || serverName != test.serverName {
+			t.Errorf("%s: expected %s#%s, got %s#%s", test.spec, test.address, test.serverName, address, serverName)
+		}
+	}
+
+	if _, _, err = parseTLSUpstream("1.1.1.1", DOT_SCHEME, DOT_DEFAULT_PORT); err == nil {
+		t.Error("Spec without tls:// should be rejected")
+	}
+}
+
+// TEST 2: Resolve over tls with certificate verification
+// Tests a query against the local stand-in signed by the test CA
+func TestDoTResolver_Resolve_Success(t *testing.T) {
+	var (
+		serverConfig *tls.Config
+		pool         *x509.CertPool
+		mockResponse []byte = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		query        []byte = buildDNSQuery("example.com", 1, 1)
+		server       *mockDoTServer
+		resolver     *DoTResolver
+		response     []byte
+		err          error
+	)
+	serverConfig, pool = newTestTLSConfig(t)
+	server = startMockDoTServer(t, serverConfig, mockResponse, 0)
+
+	resolver, err = NewDoTResolver("tls://"+server.listener.Addr().String()+"#dns.test", 2*time.Second, pool)
+	if err != nil {
+		t.Fatalf("NewDoTResolver failed: %v", err)
+	}
+	defer resolver.Close()
+
+	binary.BigEndian.PutUint16(query[0:2], 0xBEEF)
+	response, err = resolver.Resolve(context.Background(), query)
+
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if binary.BigEndian.Uint16(response[0:2]) != 0xBEEF {
+		t.Errorf("Expected client transaction ID 0xBEEF, got 0x%04X", binary.BigEndian.Uint16(response[0:2]))
+	}
+	if len(response) != len(mockResponse) {
+		t.Errorf("Expected %d bytes, got %d", len(mockResponse), len(response))
+	}
+}
+
+// TEST 3: Wrong server name fails verification
+// Tests that the certificate is checked against the name after #
+func TestDoTResolver_Resolve_BadServerName(t *testing.T) {
+	var (
+		serverConfig *tls.Config
+		pool         *x509.CertPool
+		server       *mockDoTServer
+		resolver     *DoTResolver
+		err          error
+	)
+	serverConfig, pool = newTestTLSConfig(t)
+	server = startMockDoTServer(t, serverConfig, buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), 0)
+
+	resolver, _ = NewDoTResolver("tls://"+server.listener.Addr().String()+"#wrong.example", 2*time.Second, pool)
+	defer resolver.Close()
+
+	_, err = resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1))
+
+	if err == nil {
+		t.Error("Expected certificate verification error")
+	}
+}
+
+// TEST 4: Concurrent queries share one connection
+// Tests pipelining, identical client IDs must still get their own answers
+func TestDoTResolver_Resolve_Pipelined(t *testing.T) {
+	var (
+		serverConfig *tls.Config
+		pool         *x509.CertPool
+		server       *mockDoTServer
+		resolver     *DoTResolver
+		wg           sync.WaitGroup
+		failures     atomic.Int32
+		i            int
+	)
+	serverConfig, pool = newTestTLSConfig(t)
+	server = startMockDoTServer(t, serverConfig, buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), 0)
+
+	resolver, _ = NewDoTResolver("tls://"+server.listener.Addr().String()+"#dns.test", 2*time.Second, pool)
+	defer resolver.Close()
+
+	// warm up so every query below finds the connection open
+	if _, err := resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1)); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	for i = 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var (
+				query    []byte = buildDNSQuery("example.com", 1, 1) // every query uses 0x1234
+				response []byte
+				err      error
+			)
+			response, err = resolver.Resolve(context.Background(), query)
+			if err != nil || binary.BigEndian.Uint16(response[0:2]) != 0x1234 {
+				failures.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failures.Load() != 0 {
+		t.Errorf("Expected all queries to succeed, %d failed", failures.Load())
+	}
+	if server.connections.Load() != 1 {
+		t.Errorf("Expected 1 connection, got %d", server.connections.Load())
+	}
+}
+
+// TEST 5: Reconnect after the server drops the connection
+// Tests that a closed connection is replaced transparently
+func TestDoTResolver_Resolve_Reconnects(t *testing.T) {
+	var (
+		serverConfig *tls.Config
+		pool         *x509.CertPool
+		server       *mockDoTServer
+		resolver     *DoTResolver
+		err          error
+		i            int
+	)
+	serverConfig, pool = newTestTLSConfig(t)
+	server = startMockDoTServer(t, serverConfig, buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), 1)
+
+	resolver, _ = NewDoTResolver("tls://"+server.listener.Addr().String()+"#dns.test", 2*time.Second, pool)
+	defer resolver.Close()
+
+	for i = 0; i < 3; i++ {
+		if _, err = resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1)); err != nil {
+			t.Fatalf("Resolve %d failed: %v", i, err)
+		}
+		// let the client notice the close before the next query
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if server.connections.Load() != 3 {
+		t.Errorf("Expected 3 connections, got %d", server.connections.Load())
+	}
+}
+
+// TEST 6: UpstreamResolver races a DoT upstream
+// Tests that tls:// upstreams go through the transport map
+func TestUpstreamResolver_Resolve_DoT(t *testing.T) {
+	var (
+		serverConfig *tls.Config
+		pool         *x509.CertPool
+		server       *mockDoTServer
+		dot          *DoTResolver
+		spec         string
+		resolver     *UpstreamResolver
+		response     []byte
+		err          error
+	)
+	serverConfig, pool = newTestTLSConfig(t)
+	server = startMockDoTServer(t, serverConfig, buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), 0)
+
+	spec = "tls://" + server.listener.Addr().String() + "#dns.test"
+	dot, _ = NewDoTResolver(spec, 2*time.Second, pool)
+	defer dot.Close()
+
+	resolver = &UpstreamResolver{
+		upstreamAddrs: []string{spec},
+		timeout:       2 * time.Second,
+		transports:    map[string]Resolver{spec: dot},
+	}
+
+	response, err = resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1))
+
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if response == nil {
+		t.Error("Response should not be nil")
+	}
+}
+
+// TEST 7: NewUpstreamResolver keeps tls specs intact
+// Tests that plain IPs get :53 and tls:// specs get a transport
+func TestNewUpstreamResolver_MixedSchemes(t *testing.T) {
+	var resolver *UpstreamResolver = NewUpstreamResolver("8.8.8.8, tls://1.1.1.1#cloudflare-dns.com", STRATEGY_PARALLEL)
+
+	if len(resolver.upstreamAddrs) != 2 {
+		t.Fatalf("Expected 2 upstreams, got %d", len(resolver.upstreamAddrs))
+	}
+	if resolver.upstreamAddrs[0] != "8.8.8.8:53" {
+		t.Errorf("Expected '8.8.8.8:53', got '%s'", resolver.upstreamAddrs[0])
+	}
+	if _, found := resolver.transports["tls://1.1.1.1#cloudflare-dns.com"]; !found {
+		t.Error("tls upstream should have a transport")
+	}
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// listenDoT opens the DNS-over-TLS listener (RFC 7858), once decrypted the
+// stream uses the same framing as plain tcp so connections are served by
+// handleTCPConn and go through the same pipeline
+func (s *DNSServer) listenDoT(certificates *certReloader) (net.Listener, error) {
+	var (
+		listener net.Listener
+		err      error
+	)
+	listener, err = net.Listen("tcp", s.config.DoTAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.NewListener(listener, certificates.TLSConfig("dot")), nil
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"flash-dns/internal/filter"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TEST 1: DoT clients go through the same pipeline
+// Tests a blocked and an upstream answered query over the tls listener
+func TestDNSServer_ListenDoT(t *testing.T) {
+	var (
+		ctx          context.Context
+		cancel       context.CancelFunc
+		dir          string = t.TempDir()
+		serverConfig *tls.Config
+		pool         *x509.CertPool
+		config       Config
+		mockResponse []byte             = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		mockFilter   *MockFilter        = NewMockFilter()
+		filterList   *filter.FilterList = filter.NewFilterList()
+		server       *DNSServer
+		certificates *certReloader
+		listener     net.Listener
+		client       *DoTResolver
+		response     []byte
+		err          error
+	)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	serverConfig, pool = newTestTLSConfig(t)
+	config = Config{
+		LocalAddr: "127.0.0.1:0",
+		DoTAddr:   "127.0.0.1:0",
+		CertFile:  filepath.Join(dir, "cert.pem"),
+		KeyFile:   filepath.Join(dir, "key.pem"),
+	}
+	writeTestCertificate(t, serverConfig, config.CertFile, config.KeyFile)
+
+	mockFilter.AddBlocked("ads.example.com")
+	server = NewDNSServer(config, &MockResolver{response: mockResponse}, filterList)
+	server.filter = mockFilter
+	server.cache = NewMockCache()
+
+	certificates, err = newCertReloader(config.CertFile, config.KeyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader failed: %v", err)
+	}
+	listener, err = server.listenDoT(certificates)
+	if err != nil {
+		t.Fatalf("listenDoT failed: %v", err)
+	}
+	defer listener.Close()
+	go server.serveTCP(ctx, listener)
+
+	client, _ = NewDoTResolver("tls://"+listener.Addr().String()+"#dns.test", 2*time.Second, pool)
+	defer client.Close()
+
+	response, err = client.Resolve(ctx, buildDNSQuery("ads.example.com", 1, 1))
+	if err != nil {
+		t.Fatalf("Resolve blocked domain failed: %v", err)
+	}
+	if binary.BigEndian.Uint16(response[2:4]) != 0x8183 {
+		t.Errorf("Expected NXDOMAIN flags 0x8183, got 0x%04X", binary.BigEndian.Uint16(response[2:4]))
+	}
+
+	response, err = client.Resolve(ctx, buildDNSQuery("example.com", 1, 1))
+	if err != nil {
+		t.Fatalf("Resolve allowed domain failed: %v", err)
+	}
+	if len(response) != len(mockResponse) {
+		t.Errorf("Expected %d bytes, got %d", len(mockResponse), len(response))
+	}
+
+	var blocked, allowed uint64
+	blocked, allowed, _, _ = server.statistics.GetStats()
+	if blocked != 1 || allowed != 1 {
+		t.Errorf("Expected 1 blocked and 1 allowed, got %d and %d", blocked, allowed)
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"flash-dns/internal/dns"
+	"flash-dns/internal/logger"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	DOWN_THRESHOLD int           = 3                // consecutive failures before an upstream is taken out of rotation
+	PROBE_INTERVAL time.Duration = 30 * time.Second // how often upstreams that are down get a canary query
+	PROBE_NAME     string        = "."              // the canary asks for the root NS, every resolver can answer it
+)
+
+// UpstreamHealth is the state of one upstream as reported in the statistics
+type UpstreamHealth struct {
+	Address   string
+	Up        bool
+	Successes uint64
+	Failures  uint64
+	Spoofed   uint64        // answers dropped because they did not match the query
+	Latency   time.Duration // moving average of the round trip
+}
+
+// UpstreamMonitor is implemented by resolvers that track their upstreams
+type UpstreamMonitor interface {
+	Monitor(ctx context.Context)
+	Health() []UpstreamHealth
+}
+
+// upstreamHealth is guarded by the mutex of its UpstreamResolver
+type upstreamHealth struct {
+	successes   uint64
+	failures    uint64
+	spoofed     uint64
+	consecutive int // failures since the last success
+	rtt         time.Duration
+	measured    bool
+	down        bool
+}
+
+// healthOf must be called with u.mu held
+func (u *UpstreamResolver) healthOf(address string) *upstreamHealth {
+	var (
+		health *upstreamHealth
+		found  bool
+	)
+	if u.health == nil {
+		u.health = make(map[string]*upstreamHealth)
+	}
+	if health, found = u.health[address]; !found {
+		health = &upstreamHealth{}
+		u.health[address] = health
+	}
+
+	return health
+}
+
+// foldRTT adds a round trip to the moving average
+func (h *upstreamHealth) foldRTT(rtt time.Duration) {
+	if !h.measured {
+		h.rtt, h.measured = rtt, true
+		return
+	}
+
+	h.rtt = time.Duration(RTT_WEIGHT*float64(rtt) + (1-RTT_WEIGHT)*float64(h.rtt))
+}
+
+// recordSuccess brings an upstream back into rotation
+func (u *UpstreamResolver) recordSuccess(address string, rtt time.Duration) {
+	var health *upstreamHealth
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	health = u.healthOf(address)
+	health.successes++
+	health.consecutive = 0
+	health.foldRTT(rtt)
+
+	if health.down {
+		health.down = false
+		logger.Info(fmt.Sprintf("UPSTREAM UP: %s (latency %v)", address, health.rtt.Round(time.Millisecond)))
+	}
+}
+
+// recordFailure counts as RTT_PENALTY in the average, after DOWN_THRESHOLD
+// failures in a row the upstream is marked down
+func (u *UpstreamResolver) recordFailure(address string) {
+	var health *upstreamHealth
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	health = u.healthOf(address)
+	health.failures++
+	health.consecutive++
+	health.foldRTT(RTT_PENALTY)
+
+	if !health.down && health.consecutive >= DOWN_THRESHOLD {
+		health.down = true
+		logger.Warn(fmt.Sprintf("UPSTREAM DOWN: %s (%d failures in a row)", address, health.consecutive))
+	}
+}
+
+// recordSpoofed counts an answer that did not match its query, it says
+// nothing about the upstream itself so its health is left alone
+func (u *UpstreamResolver) recordSpoofed(address string, reason error) {
+	u.mu.Lock()
+	u.healthOf(address).spoofed++
+	u.mu.Unlock()
+
+	logger.Warn(fmt.Sprintf("SPOOFED: dropped answer for %s: %v", address, reason))
+}
+
+// available is the list of upstreams not marked down, when every upstream
+// is down all of them are returned since refusing to try is never better
+func (u *UpstreamResolver) available() []string {
+	var (
+		addresses []string = make([]string, 0, len(u.upstreamAddrs))
+		address   string
+		health    *upstreamHealth
+		found     bool
+	)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, address = range u.upstreamAddrs {
+		if health, found = u.health[address]; !found || !health.down {
+			addresses = append(addresses, address)
+		}
+	}
+	if len(addresses) == 0 {
+		return append(addresses, u.upstreamAddrs...)
+	}
+
+	return addresses
+}
+
+// Health reports every upstream in the configured order
+func (u *UpstreamResolver) Health() []UpstreamHealth {
+	var (
+		result  []UpstreamHealth = make([]UpstreamHealth, 0, len(u.upstreamAddrs))
+		address string
+		health  *upstreamHealth
+	)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, address = range u.upstreamAddrs {
+		health = u.healthOf(address)
+		result = append(result, UpstreamHealth{
+			Address:   address,
+			Up:        !health.down,
+			Successes: health.successes,
+			Failures:  health.failures,
+			Spoofed:   health.spoofed,
+			Latency:   health.rtt,
+		})
+	}
+
+	return result
+}
+
+// Monitor sends a canary query to every upstream that is down each
+// PROBE_INTERVAL, a good answer puts it back into rotation
+func (u *UpstreamResolver) Monitor(ctx context.Context) {
+	var ticker *time.Ticker = time.NewTicker(PROBE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			u.probe(ctx)
+		}
+	}
+}
+
+// probe checks the upstreams that are down, exchange records the result
+func (u *UpstreamResolver) probe(ctx context.Context) {
+	var (
+		query   []byte
+		err     error
+		address string
+		cancel  context.CancelFunc
+		down    []string
+	)
+	for _, health := range u.Health() {
+		if !health.Up {
+			down = append(down, health.Address)
+		}
+	}
+
+	for _, address = range down {
+		if query, err = dns.BuildQuery(uint16(rand.UintN(65536)), PROBE_NAME, dns.TYPE_NS); err != nil {
+			return
+		}
+
+		var probeCtx context.Context
+		probeCtx, cancel = context.WithTimeout(ctx, u.timeout)
+		_, _ = u.exchange(probeCtx, address, query)
+		cancel()
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TEST 1: Upstreams are marked down after DOWN_THRESHOLD failures
+// Tests that a down upstream leaves the rotation until it answers again
+func TestUpstreamResolver_MarkedDown(t *testing.T) {
+	var (
+		resolver *UpstreamResolver = &UpstreamResolver{
+			upstreamAddrs: []string{"a", "b"},
+			strategy:      STRATEGY_STRICT,
+		}
+		i int
+	)
+
+	for i = 0; i < DOWN_THRESHOLD-1; i++ {
+		resolver.recordFailure("a")
+	}
+	if order := resolver.order(); !slices.Equal(order, []string{"a", "b"}) {
+		t.Errorf("Upstream should stay in rotation below the threshold, got %v", order)
+	}
+
+	resolver.recordFailure("a")
+	if order := resolver.order(); !slices.Equal(order, []string{"b"}) {
+		t.Errorf("Expected only b in rotation, got %v", order)
+	}
+
+	resolver.recordSuccess("a", 10*time.Millisecond)
+	if order := resolver.order(); !slices.Equal(order, []string{"a", "b"}) {
+		t.Errorf("Expected a back in rotation, got %v", order)
+	}
+}
+
+// TEST 2: Every upstream down still tries them all
+// Tests that a resolver never refuses to query
+func TestUpstreamResolver_AllDown(t *testing.T) {
+	var (
+		resolver *UpstreamResolver = &UpstreamResolver{upstreamAddrs: []string{"a", "b"}}
+		i        int
+	)
+	for i = 0; i < DOWN_THRESHOLD; i++ {
+		resolver.recordFailure("a")
+		resolver.recordFailure("b")
+	}
+
+	if available := resolver.available(); !slices.Equal(available, []string{"a", "b"}) {
+		t.Errorf("Expected every upstream when all are down, got %v", available)
+	}
+}
+
+// TEST 3: Health reports counts and latency
+// Tests the snapshot used by the statistics
+func TestUpstreamResolver_Health(t *testing.T) {
+	var (
+		resolver *UpstreamResolver = &UpstreamResolver{upstreamAddrs: []string{"a", "b"}}
+		health   []UpstreamHealth
+	)
+	resolver.recordSuccess("a", 20*time.Millisecond)
+	resolver.recordFailure("a")
+
+	health = resolver.Health()
+
+	if len(health) != 2 || health[0].Address != "a" || health[1].Address != "b" {
+		t.Fatalf("Expected both upstreams in order, got %+v", health)
+	}
+	if health[0].Successes != 1 || health[0].Failures != 1 || !health[0].Up {
+		t.Errorf("Unexpected health for a: %+v", health[0])
+	}
+	if health[0].Latency <= 20*time.Millisecond {
+		t.Errorf("A failure should raise the latency, got %v", health[0].Latency)
+	}
+	if health[1].Successes != 0 || !health[1].Up {
+		t.Errorf("Unused upstream should be up with no counts, got %+v", health[1])
+	}
+}
+
+// TEST 4: The canary probe brings an upstream back
+// Tests that probe queries down upstreams and marks them up on an answer
+func TestUpstreamResolver_Probe(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		server   *mockDNSServer
+		resolver *UpstreamResolver
+		err      error
+		i        int
+	)
+	server = &mockDNSServer{echo: true} // the canary must get an answer to its own question
+	if err = server.start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.close()
+
+	resolver = &UpstreamResolver{upstreamAddrs: []string{server.addr}, timeout: time.Second}
+	for i = 0; i < DOWN_THRESHOLD; i++ {
+		resolver.recordFailure(server.addr)
+	}
+	if resolver.Health()[0].Up {
+		t.Fatal("Upstream should be down")
+	}
+
+	resolver.probe(ctx)
+
+	if !resolver.Health()[0].Up {
+		t.Error("A successful probe should bring the upstream back")
+	}
+}
+
+// TEST 5: Statistics expose the upstream health
+// Tests that the server hands the resolver to its statistics
+func TestStatistics_UpstreamHealth(t *testing.T) {
+	var (
+		resolver *UpstreamResolver = &UpstreamResolver{upstreamAddrs: []string{"a"}}
+		server   *DNSServer        = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353"}, resolver, nil)
+		health   []UpstreamHealth
+	)
+	resolver.recordSuccess("a", time.Millisecond)
+
+	health = server.statistics.GetUpstreamHealth()
+
+	if len(health) != 1 || health[0].Successes != 1 {
+		t.Errorf("Expected the resolver health, got %+v", health)
+	}
+	if (&Statistics{}).GetUpstreamHealth() != nil {
+		t.Error("Statistics without a resolver should report nothing")
+	}
+}
@@ -3,27 +3,115 @@ package server
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"flash-dns/internal/dns"
 	"flash-dns/internal/logger"
 	"fmt"
+	"math/rand/v2"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	DEFAULT_UPSTREAM_TIMEOUT time.Duration = 5 * time.Second        // how long a group waits for its upstreams
+	MIN_SOURCE_PORT          int           = 1024                   // random source ports stay above the privileged range
+	SOURCE_PORT_ATTEMPTS     int           = 5                      // random ports tried before the kernel picks one
+	MIN_ATTEMPT_TIMEOUT      time.Duration = 500 * time.Millisecond // least an upstream gets when the timeout is shared
+)
+
+var (
+	errUpstreamTimeout error = errors.New("all upstream dns failed to answer in time")
+)
+
+// rcodeError is an upstream answering SERVFAIL or REFUSED, another upstream
+// may still resolve the name so it counts as a failure of that upstream
+type rcodeError struct {
+	address string
+	rcode   uint16
+}
+
+func (e *rcodeError) Error() string {
+	return fmt.Sprintf("upstream %s answered with rcode %d", e.address, e.rcode)
+}
+
+// UpstreamResolver is a group of upstreams asked according to its strategy
 type UpstreamResolver struct {
 	upstreamAddrs []string
 	timeout       time.Duration
+	transports    map[string]Resolver // encrypted upstreams keyed by their spec, plain udp otherwise
+	strategy      Strategy
+	next          atomic.Uint64 // round-robin position
+	randomCase    bool          // DNS 0x20, set before the first query
+
+	mu     sync.Mutex
+	health map[string]*upstreamHealth
+}
+
+// NewUpstreamResolver takes a comma separated list of upstreams, plain IPs
+// are queried over udp on port 53, tls:// specs over DNS-over-TLS and
+// https:// urls over DNS-over-HTTPS
+func NewUpstreamResolver(upstream string, strategy Strategy) *UpstreamResolver {
+	return newUpstreamResolver(upstream, strategy, DEFAULT_UPSTREAM_TIMEOUT)
 }
 
-func NewUpstreamResolver(upstream string) *UpstreamResolver {
-	var addresses []string = strings.Split(upstream, ",")
-	for i, v := range addresses {
-		addresses[i] = strings.TrimSpace(v) + ":53"
+func newUpstreamResolver(upstream string, strategy Strategy, timeout time.Duration) *UpstreamResolver {
+	var (
+		specs     []string = strings.Split(upstream, ",")
+		addresses []string = make([]string, 0, len(specs))
+		resolver  *UpstreamResolver
+		transport Resolver
+		err       error
+		spec      string
+	)
+	resolver = &UpstreamResolver{
+		timeout:    timeout,
+		transports: make(map[string]Resolver),
+		strategy:   strategy,
+		health:     make(map[string]*upstreamHealth),
 	}
 
-	return &UpstreamResolver{
-		upstreamAddrs: addresses,
-		timeout:       5 * time.Second,
+	for _, spec = range specs {
+		spec = strings.TrimSpace(spec)
+		if !strings.Contains(spec, "://") {
+			addresses = append(addresses, spec+":53")
+			continue
+		}
+
+		transport, err = newTransport(spec, resolver.timeout)
+		if err != nil {
+			logger.Error(fmt.Sprintf("ignoring upstream %s: %v", spec, err))
+			continue
+		}
+		resolver.transports[spec] = transport
+		addresses = append(addresses, spec)
+	}
+
+	resolver.upstreamAddrs = addresses
+	return resolver
+}
+
+// SetRandomCase turns DNS 0x20 on for the plain upstreams, the letters of
+// every question go out in random case and answers must echo it exactly.
+// it must be called before the first query
+func (u *UpstreamResolver) SetRandomCase(enabled bool) {
+	u.randomCase = enabled
+}
+
+// newTransport builds the resolver for an upstream given with a scheme
+func newTransport(spec string, timeout time.Duration) (Resolver, error) {
+	switch {
+	case strings.HasPrefix(spec, DOT_SCHEME):
+		return NewDoTResolver(spec, timeout, nil)
+	case strings.HasPrefix(spec, DOH_SCHEME):
+		return NewDoHResolver(spec, timeout, nil)
+	case strings.HasPrefix(spec, DOQ_SCHEME):
+		return NewDoQResolver(spec, timeout, nil)
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme")
 	}
 }
 
@@ -33,64 +121,359 @@ func (u *UpstreamResolver) Resolve(ctx context.Context, query []byte) ([]byte, e
 		return nil, ctx.Err()
 	default:
 	}
+
+	if u.strategy == STRATEGY_PARALLEL {
+		return u.resolveParallel(ctx, query)
+	}
+
+	return u.resolveInOrder(ctx, query, u.order())
+}
+
+// resolveParallel races every upstream, the first answer wins. it fails as
+// soon as every upstream reported an error, or with errUpstreamTimeout when
+// they are still silent after the timeout. a SERVFAIL or REFUSED is only
+// reported when no other upstream answered
+func (u *UpstreamResolver) resolveParallel(ctx context.Context, query []byte) ([]byte, error) {
 	var (
+		addresses    []string = u.available()
 		queryCtx     context.Context
 		cancel       context.CancelFunc
-		response     []byte      = make([]byte, 512)
-		responseChan chan []byte = make(chan []byte, len(u.upstreamAddrs))
+		response     []byte
+		err          error
+		failed       *rcodeError
+		failures     int
+		responseChan chan []byte      = make(chan []byte, len(addresses))
+		errorChan    chan error       = make(chan error, len(addresses))
+		timeout      <-chan time.Time = time.After(u.timeout)
 	)
 	queryCtx, cancel = context.WithCancel(ctx)
 	defer cancel()
-	for _, address := range u.upstreamAddrs {
-		go u.resolveUpstream(queryCtx, address, query, responseChan)
+	for _, address := range addresses {
+		go func(address string) {
+			if err := u.resolveUpstream(queryCtx, address, query, responseChan); err != nil {
+				errorChan <- err
+			}
+		}(address)
 	}
 
-	select {
-	case response = <-responseChan:
-		return response, nil
+	for {
+		select {
+		case response = <-responseChan:
+			return response, nil
 
-	case <-ctx.Done():
-		return nil, ctx.Err()
+		case err = <-errorChan:
+			errors.As(err, &failed)
+			if failures++; failures < len(addresses) {
+				continue
+			}
+			if failed != nil {
+				return nil, fmt.Errorf("all upstream dns failed: %w", failed)
+			}
+			return nil, fmt.Errorf("all upstream dns failed: %w", err)
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
 
-	case <-time.After(u.timeout):
-		return nil, fmt.Errorf("all upstream dns failed")
+		case <-timeout:
+			if failed != nil {
+				return nil, fmt.Errorf("all upstream dns failed: %w", failed)
+			}
+			return nil, errUpstreamTimeout
+		}
+	}
+}
+
+// resolveInOrder tries one upstream at a time within the timeout of the
+// group, each one gets an equal share of what is left so dead upstreams
+// can not hold the client past it. a SERVFAIL or REFUSED moves on to the
+// next upstream and is only reported when the last one failed as well
+func (u *UpstreamResolver) resolveInOrder(ctx context.Context, query []byte, addresses []string) ([]byte, error) {
+	var (
+		queryCtx   context.Context
+		stop       context.CancelFunc
+		attemptCtx context.Context
+		cancel     context.CancelFunc
+		deadline   time.Time
+		share      time.Duration
+		response   []byte
+		err        error
+		failed     *rcodeError
+	)
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("all upstream dns failed: no upstream configured")
+	}
+
+	queryCtx, stop = context.WithTimeout(ctx, u.timeout)
+	defer stop()
+	deadline, _ = queryCtx.Deadline()
+
+	for i, address := range addresses {
+		share = max(time.Until(deadline)/time.Duration(len(addresses)-i), MIN_ATTEMPT_TIMEOUT)
+		attemptCtx, cancel = context.WithTimeout(queryCtx, share)
+		response, err = u.exchange(attemptCtx, address, query)
+		cancel()
+		if err == nil {
+			return response, nil
+		}
+		errors.As(err, &failed)
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
 	}
 
+	switch {
+	case failed != nil:
+		return nil, fmt.Errorf("all upstream dns failed: %w", failed)
+	case !time.Now().Before(deadline):
+		return nil, errUpstreamTimeout
+	}
+	return nil, fmt.Errorf("all upstream dns failed: %w", err)
 }
 
-func (u *UpstreamResolver) resolveUpstream(ctx context.Context, address string, query []byte, responseChan chan []byte) {
+// exchange asks a single upstream and records the outcome in its health
+func (u *UpstreamResolver) exchange(ctx context.Context, address string, query []byte) ([]byte, error) {
+	var (
+		transport Resolver
+		found     bool
+		response  []byte
+		err       error
+		started   time.Time = time.Now()
+	)
+	if transport, found = u.transports[address]; found {
+		response, err = transport.Resolve(ctx, query)
+		if err != nil {
+			err = fmt.Errorf("failed to resolve with upstream %s: %w", address, err)
+		}
+	} else {
+		response, err = u.resolveUDP(ctx, address, query)
+	}
+	if err == nil {
+		err = checkRcode(address, response)
+	}
+
+	if err != nil {
+		logger.Error(err.Error())
+		// being cancelled after losing a parallel race is not a failure
+		if !errors.Is(err, context.Canceled) {
+			u.recordFailure(address)
+		}
+		return nil, err
+	}
+
+	u.recordSuccess(address, time.Since(started))
+	return response, nil
+}
+
+// checkRcode turns a SERVFAIL or REFUSED into a rcodeError, the upstream
+// could not or would not resolve the name but another one may
+func checkRcode(address string, response []byte) error {
+	var (
+		header dns.Header
+		err    error
+	)
+	if header, err = dns.ParseHeader(response); err != nil {
+		return nil
+	}
+
+	switch header.Rcode() {
+	case dns.RCODE_SERVFAIL, dns.RCODE_REFUSED:
+		return &rcodeError{address: address, rcode: header.Rcode()}
+	}
+
+	return nil
+}
+
+func (u *UpstreamResolver) resolveUpstream(ctx context.Context, address string, query []byte, responseChan chan []byte) error {
+	var (
+		response []byte
+		err      error
+	)
+	if response, err = u.exchange(ctx, address, query); err != nil {
+		return err
+	}
+
+	select {
+	case responseChan <- response:
+		// do nothing :)
+	case <-ctx.Done():
+	}
+
+	return nil
+}
+
+// resolveUDP sends the query over plain udp, falling back to tcp on
+// truncation. it goes out with a random ID from a random source port and
+// datagrams that do not answer it are dropped as spoofing attempts, the
+// caller gets the answer back with its own ID and question. the socket is
+// closed as soon as ctx is done
+func (u *UpstreamResolver) resolveUDP(ctx context.Context, address string, query []byte) ([]byte, error) {
 	var (
 		conn      net.Conn
 		err       error
-		deadline  time.Time
-		response  []byte = make([]byte, 512)
+		stop      func() bool
+		sent      []byte = u.disguise(query)
+		response  []byte = make([]byte, dns.MAX_MESSAGE_SIZE)
 		bytesRead int
 	)
-	conn, err = net.Dial("udp", address)
+	conn, err = dialRandomPort(address)
 	if err != nil {
-		logger.Error(fmt.Sprintf("failed to connect to upstream %s: %v", address, err))
-		return
+		return nil, fmt.Errorf("failed to connect to upstream %s: %v", address, err)
 	}
 	defer conn.Close()
 
-	deadline = time.Now().Add(u.timeout)
-	conn.SetDeadline(deadline)
+	conn.SetDeadline(u.deadline(ctx))
+	stop = context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if _, err = conn.Write(sent); err != nil {
+		return nil, fmt.Errorf("failed to write query to %s: %w", address, contextErr(ctx, err))
+	}
+
+	for {
+		bytesRead, err = conn.Read(response)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response from %s: %w", address, contextErr(ctx, err))
+		}
 
-	if _, err = conn.Write(query); err != nil {
-		logger.Error(fmt.Sprintf("failed to write query to %s: %v", address, err))
-		return
+		if err = dns.MatchResponse(sent, response[:bytesRead], u.randomCase); err == nil {
+			break
+		}
+		u.recordSpoofed(address, err)
 	}
+	response = bytes.Clone(response[:bytesRead])
+
+	// the answer did not fit in udp, ask the same upstream again over tcp
+	if dns.IsTruncated(response) {
+		logger.Info(fmt.Sprintf("truncated response from %s, retrying over tcp", address))
+		response, err = u.resolveTCP(ctx, address, sent)
+		if err != nil {
+			return nil, fmt.Errorf("failed tcp fallback to %s: %w", address, contextErr(ctx, err))
+		}
+	}
+
+	return restoreQuery(query, response), nil
+}
 
-	bytesRead, err = conn.Read(response)
+// deadline is when a plain exchange gives up, after the timeout or when ctx
+// expires if that comes first
+func (u *UpstreamResolver) deadline(ctx context.Context) time.Time {
+	var (
+		deadline time.Time = time.Now().Add(u.timeout)
+		expires  time.Time
+		found    bool
+	)
+	if expires, found = ctx.Deadline(); found && expires.Before(deadline) {
+		return expires
+	}
+
+	return deadline
+}
+
+// contextErr reports the reason ctx ended in place of the error of a
+// socket it closed, being cancelled after losing a race is not a failure
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// disguise copies the query with a fresh random ID and, with 0x20 on, its
+// question in random case
+func (u *UpstreamResolver) disguise(query []byte) []byte {
+	var sent []byte
+	if u.randomCase {
+		sent = dns.RandomizeCase(query)
+	} else {
+		sent = bytes.Clone(query)
+	}
+
+	if len(sent) >= 2 {
+		binary.BigEndian.PutUint16(sent[0:2], uint16(rand.UintN(65536)))
+	}
+
+	return sent
+}
+
+// restoreQuery puts the ID and question of the original query back into a
+// response that matched its disguised copy
+func restoreQuery(query []byte, response []byte) []byte {
+	var (
+		end int
+		err error
+	)
+	copy(response[0:2], query[0:2])
+	if end, err = dns.QuestionEnd(query); err == nil && end <= len(response) {
+		copy(response[dns.HEADER_SIZE:end], query[dns.HEADER_SIZE:end])
+	}
+
+	return response
+}
+
+// dialRandomPort connects to address from a random source port, when the
+// random ports tried are all taken the kernel picks one
+func dialRandomPort(address string) (net.Conn, error) {
+	var (
+		remote *net.UDPAddr
+		conn   *net.UDPConn
+		err    error
+		i      int
+	)
+	if remote, err = net.ResolveUDPAddr("udp", address); err != nil {
+		return nil, err
+	}
+
+	for i = 0; i < SOURCE_PORT_ATTEMPTS; i++ {
+		if conn, err = net.DialUDP("udp", &net.UDPAddr{Port: MIN_SOURCE_PORT + rand.IntN(65536-MIN_SOURCE_PORT)}, remote); err == nil {
+			return conn, nil
+		}
+	}
+
+	return net.DialUDP("udp", nil, remote)
+}
+
+// resolveTCP sends the query to the upstream over tcp, used when the udp
+// answer came back truncated
+func (u *UpstreamResolver) resolveTCP(ctx context.Context, address string, query []byte) ([]byte, error) {
+	var (
+		dialer   net.Dialer = net.Dialer{Timeout: u.timeout}
+		conn     net.Conn
+		err      error
+		stop     func() bool
+		response []byte
+	)
+	conn, err = dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
-		logger.Error(fmt.Sprintf("failed to read response from %s: %v", address, err))
-		return
+		return nil, err
 	}
+	defer conn.Close()
 
-	select {
-	case responseChan <- bytes.Clone(response[:bytesRead]):
-		// do nothing :)
-	case <-ctx.Done():
-		return
+	conn.SetDeadline(u.deadline(ctx))
+	stop = context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err = writeTCPMessage(conn, query); err != nil {
+		return nil, err
 	}
+
+	response, err = readTCPMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = dns.MatchResponse(query, response, u.randomCase); err != nil {
+		u.recordSpoofed(address, err)
+		return nil, err
+	}
+
+	if dns.IsTruncated(response) {
+		return nil, fmt.Errorf("response truncated over tcp")
+	}
+
+	return response, nil
 }
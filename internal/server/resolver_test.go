@@ -1,8 +1,11 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
+	"flash-dns/internal/dns"
 	"net"
 	"strings"
 	"testing"
@@ -19,36 +22,40 @@ type mockDNSServer struct {
 	conn     *net.UDPConn
 	response []byte
 	delay    time.Duration
+	echo     bool     // answer with the query itself, QR set and no records
+	spoofs   [][]byte // forged datagrams sent before every answer
 }
 
 func startMockDNSServer(response []byte, delay time.Duration) (*mockDNSServer, error) {
+	var server *mockDNSServer = &mockDNSServer{response: response, delay: delay}
+	if err := server.start(); err != nil {
+		return nil, err
+	}
+
+	return server, nil
+}
+
+// start listens on a free local port and serves in the background, the
+// fields must be set before
+func (m *mockDNSServer) start() error {
 	var (
-		addr   *net.UDPAddr
-		conn   *net.UDPConn
-		err    error
-		server *mockDNSServer
+		addr *net.UDPAddr
+		err  error
 	)
-
 	addr, err = net.ResolveUDPAddr("udp", "127.0.0.1:0")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	conn, err = net.ListenUDP("udp", addr)
+	m.conn, err = net.ListenUDP("udp", addr)
 	if err != nil {
-		return nil, err
-	}
-
-	server = &mockDNSServer{
-		addr:     conn.LocalAddr().String(),
-		conn:     conn,
-		response: response,
-		delay:    delay,
+		return err
 	}
+	m.addr = m.conn.LocalAddr().String()
 
-	go server.serve()
+	go m.serve()
 
-	return server, nil
+	return nil
 }
 
 func (m *mockDNSServer) serve() {
@@ -70,6 +77,17 @@ func (m *mockDNSServer) serve() {
 			time.Sleep(m.delay)
 		}
 
+		for _, spoof := range m.spoofs {
+			m.conn.WriteToUDP(spoof, addr)
+		}
+
+		if m.echo && bytesRead >= 4 {
+			var echoed []byte = bytes.Clone(buffer[:bytesRead])
+			binary.BigEndian.PutUint16(echoed[2:4], 0x8180)
+			m.conn.WriteToUDP(echoed, addr)
+			continue
+		}
+
 		// Copy transaction ID from query to response
 		if len(m.response) >= 2 && bytesRead >= 2 {
 			var responseCopy []byte = make([]byte, len(m.response))
@@ -98,7 +116,7 @@ func TestNewUpstreamResolver_SingleAddress(t *testing.T) {
 		resolver *UpstreamResolver
 	)
 
-	resolver = NewUpstreamResolver(upstream)
+	resolver = NewUpstreamResolver(upstream, STRATEGY_PARALLEL)
 
 	if resolver == nil {
 		t.Fatal("Resolver should not be nil")
@@ -122,7 +140,7 @@ func TestNewUpstreamResolver_MultipleAddresses(t *testing.T) {
 		resolver *UpstreamResolver
 	)
 
-	resolver = NewUpstreamResolver(upstream)
+	resolver = NewUpstreamResolver(upstream, STRATEGY_PARALLEL)
 
 	if len(resolver.upstreamAddrs) != 3 {
 		t.Errorf("Expected 3 upstream addresses, got %d", len(resolver.upstreamAddrs))
@@ -147,7 +165,7 @@ func TestNewUpstreamResolver_TrimsWhitespace(t *testing.T) {
 		resolver *UpstreamResolver
 	)
 
-	resolver = NewUpstreamResolver(upstream)
+	resolver = NewUpstreamResolver(upstream, STRATEGY_PARALLEL)
 
 	if resolver.upstreamAddrs[0] != "8.8.8.8:53" {
 		t.Errorf("Expected trimmed '8.8.8.8:53', got '%s'", resolver.upstreamAddrs[0])
@@ -497,5 +515,364 @@ func TestUpstreamResolver_Resolve_ContextTimeout(t *testing.T) {
 	}
 }
 
+// TEST 13: Truncated udp answer falls back to tcp
+// Tests that the resolver retries over tcp and returns the complete answer
+func TestUpstreamResolver_Resolve_TruncatedFallsBackToTCP(t *testing.T) {
+	var (
+		ctx          context.Context = context.Background()
+		query        []byte          = buildDNSQuery("example.com", 16, 1)
+		fullResponse []byte          = buildDNSResponse("example.com", 16, 1, 300, make([]byte, 1000))
+		truncated    []byte          = buildDNSResponse("example.com", 16, 1, 300, nil)[:29]
+		udpServer    *mockDNSServer
+		listener     net.Listener
+		err          error
+		resolver     *UpstreamResolver
+		response     []byte
+	)
+
+	// header and question only, with TC set
+	binary.BigEndian.PutUint16(truncated[2:4], 0x8380)
+	binary.BigEndian.PutUint16(truncated[6:8], 0)
+
+	udpServer, err = startMockDNSServer(truncated, 0)
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer udpServer.close()
+
+	listener, err = startMockTCPServer(udpServer.addr, fullResponse)
+	if err != nil {
+		t.Skipf("tcp port matching the udp mock is not available: %v", err)
+	}
+	defer listener.Close()
+
+	resolver = &UpstreamResolver{
+		upstreamAddrs: []string{udpServer.addr},
+		timeout:       2 * time.Second,
+	}
+
+	response, err = resolver.Resolve(ctx, query)
+
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if len(response) != len(fullResponse) {
+		t.Errorf("Expected full response of %d bytes, got %d", len(fullResponse), len(response))
+	}
+	if binary.BigEndian.Uint16(response[2:4])&0x0200 != 0 {
+		t.Error("Response from tcp should not be truncated")
+	}
+}
+
+// startMockTCPServer answers every framed query on address with response
+func startMockTCPServer(address string, response []byte) (net.Listener, error) {
+	var (
+		listener net.Listener
+		err      error
+	)
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		var (
+			conn  net.Conn
+			query []byte
+			err   error
+		)
+		for {
+			conn, err = listener.Accept()
+			if err != nil {
+				return
+			}
+
+			query, err = readTCPMessage(conn)
+			if err == nil {
+				var responseCopy []byte = make([]byte, len(response))
+				copy(responseCopy, response)
+				copy(responseCopy[0:2], query[0:2])
+				writeTCPMessage(conn, responseCopy)
+			}
+			conn.Close()
+		}
+	}()
+
+	return listener, nil
+}
+
 // Note: Helper functions buildDNSQuery, buildDNSResponse, and splitDomain
 // are defined in dnsServer_test.go and shared across test files in this package
+
+// TEST 14: Resolve fails fast when every upstream errors
+// Tests that the resolver does not wait for its timeout once all upstreams failed
+func TestUpstreamResolver_Resolve_FailsFast(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		query    []byte          = buildDNSQuery("example.com", 1, 1)
+		resolver *UpstreamResolver
+		started  time.Time
+		err      error
+	)
+	resolver = &UpstreamResolver{
+		upstreamAddrs: []string{"127.0.0.1:1", "127.0.0.1:2"}, // closed ports refuse at once,
+		timeout:       5 * time.Second,
+	}
+
+	started = time.Now()
+	_, err = resolver.Resolve(ctx, query)
+
+	if err == nil {
+		t.Fatal("Expected error when all upstreams fail")
+	}
+	if errors.Is(err, errUpstreamTimeout) {
+		t.Error("Expected the upstream error, not a timeout")
+	}
+	if time.Since(started) > 2*time.Second {
+		t.Errorf("Resolve should fail without waiting for the timeout, took %v", time.Since(started))
+	}
+}
+
+// TEST 15: Forged datagrams are dropped and counted
+// Tests that an answer carrying the client ID instead of the random one
+// sent upstream is ignored while the real answer is returned
+func TestUpstreamResolver_Resolve_DropsSpoofed(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		query    []byte          = buildDNSQuery("example.com", 1, 1)
+		forged   []byte          = buildDNSResponse("example.com", 1, 1, 86400, []byte{6, 6, 6, 6})
+		server   *mockDNSServer
+		resolver *UpstreamResolver
+		response []byte
+		err      error
+	)
+	server = &mockDNSServer{
+		response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}),
+		spoofs:   [][]byte{forged, buildDNSResponse("other.com", 1, 1, 300, []byte{6, 6, 6, 6})[:2]},
+	}
+	if err = server.start(); err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer server.close()
+
+	resolver = &UpstreamResolver{upstreamAddrs: []string{server.addr}, timeout: 2 * time.Second}
+	if response, err = resolver.Resolve(ctx, query); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	if !bytes.HasSuffix(response, []byte{1, 2, 3, 4}) {
+		t.Error("Expected the real answer, got the forged one")
+	}
+	if binary.BigEndian.Uint16(response[0:2]) != binary.BigEndian.Uint16(query[0:2]) {
+		t.Error("Expected the answer to carry the client ID")
+	}
+	if spoofed := resolver.Health()[0].Spoofed; spoofed != 2 {
+		t.Errorf("Expected 2 spoofing attempts, got %d", spoofed)
+	}
+}
+
+// TEST 16: 0x20 case randomization
+// Tests that an upstream echoing the case is accepted with the client
+// question restored, and one that does not is rejected
+func TestUpstreamResolver_Resolve_RandomCase(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		domain   string          = "www.some-long-example-name.com"
+		query    []byte          = buildDNSQuery(domain, 1, 1)
+		echo     *mockDNSServer  = &mockDNSServer{echo: true}
+		lower    *mockDNSServer  = &mockDNSServer{response: buildDNSResponse(domain, 1, 1, 300, []byte{1, 2, 3, 4})}
+		resolver *UpstreamResolver
+		response []byte
+		err      error
+	)
+	if err = echo.start(); err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer echo.close()
+	if err = lower.start(); err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer lower.close()
+
+	resolver = &UpstreamResolver{upstreamAddrs: []string{echo.addr}, timeout: time.Second}
+	resolver.SetRandomCase(true)
+	if response, err = resolver.Resolve(ctx, query); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if !bytes.Equal(response[12:len(query)], query[12:]) {
+		t.Error("Expected the question of the client back")
+	}
+
+	resolver = &UpstreamResolver{upstreamAddrs: []string{lower.addr}, timeout: 300 * time.Millisecond}
+	resolver.SetRandomCase(true)
+	if _, err = resolver.Resolve(ctx, query); err == nil {
+		t.Error("An answer that lost the case should be rejected")
+	}
+	if resolver.Health()[0].Spoofed == 0 {
+		t.Error("Expected the answer to be counted as spoofed")
+	}
+}
+
+// TEST 17: SERVFAIL does not win a parallel race
+// Tests that a fast upstream answering SERVFAIL loses to a slower good one
+// and is counted as failed
+func TestUpstreamResolver_Resolve_ParallelSkipsServfail(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		query    []byte          = buildDNSQuery("example.com", 1, 1)
+		broken   *mockDNSServer
+		healthy  *mockDNSServer
+		resolver *UpstreamResolver
+		response []byte
+		err      error
+	)
+	if broken, err = startMockDNSServer(buildNegativeResponse(t, query, dns.RCODE_SERVFAIL, 0, 0), 0); err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer broken.close()
+	if healthy, err = startMockDNSServer(buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), 100*time.Millisecond); err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer healthy.close()
+
+	resolver = &UpstreamResolver{upstreamAddrs: []string{broken.addr, healthy.addr}, timeout: 2 * time.Second}
+	if response, err = resolver.Resolve(ctx, query); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	if !bytes.HasSuffix(response, []byte{1, 2, 3, 4}) {
+		t.Errorf("Expected the answer of the healthy upstream, got rcode %d", binary.BigEndian.Uint16(response[2:4])&dns.RCODE_MASK)
+	}
+	if failures := resolver.Health()[0].Failures; failures != 1 {
+		t.Errorf("Expected the SERVFAIL counted as a failure, got %d", failures)
+	}
+}
+
+// TEST 18: REFUSED fails over to the next upstream
+// Tests strict order moving on after REFUSED, and a failure carrying the
+// rcode once every upstream refused
+func TestUpstreamResolver_Resolve_InOrderSkipsRefused(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		query    []byte          = buildDNSQuery("example.com", 1, 1)
+		refusing *mockDNSServer
+		healthy  *mockDNSServer
+		resolver *UpstreamResolver
+		response []byte
+		err      error
+	)
+	if refusing, err = startMockDNSServer(buildNegativeResponse(t, query, dns.RCODE_REFUSED, 0, 0), 0); err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer refusing.close()
+	if healthy, err = startMockDNSServer(buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), 0); err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer healthy.close()
+
+	resolver = &UpstreamResolver{upstreamAddrs: []string{refusing.addr, healthy.addr}, timeout: 2 * time.Second, strategy: STRATEGY_STRICT}
+	if response, err = resolver.Resolve(ctx, query); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if !bytes.HasSuffix(response, []byte{1, 2, 3, 4}) {
+		t.Error("Expected the answer of the second upstream")
+	}
+
+	resolver = &UpstreamResolver{upstreamAddrs: []string{refusing.addr}, timeout: 2 * time.Second, strategy: STRATEGY_STRICT}
+	var failed *rcodeError
+	if _, err = resolver.Resolve(ctx, query); !errors.As(err, &failed) || failed.rcode != dns.RCODE_REFUSED {
+		t.Errorf("Expected an error carrying REFUSED once every upstream refused, got %v", err)
+	}
+}
+
+// TEST 19: Plain exchanges follow their context
+// Tests that a cancelled exchange gives up at once without counting as a
+// failure, and that an earlier context deadline beats the timeout
+func TestUpstreamResolver_Exchange_FollowsContext(t *testing.T) {
+	var (
+		query    []byte = buildDNSQuery("example.com", 1, 1)
+		slow     *mockDNSServer
+		resolver *UpstreamResolver
+		ctx      context.Context
+		cancel   context.CancelFunc
+		started  time.Time
+		err      error
+	)
+	if slow, err = startMockDNSServer(buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), 2*time.Second); err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer slow.close()
+	resolver = &UpstreamResolver{upstreamAddrs: []string{slow.addr}, timeout: 5 * time.Second}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	started = time.Now()
+	if _, err = resolver.exchange(ctx, slow.addr, query); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the exchange to be cancelled, got %v", err)
+	}
+	if time.Since(started) > time.Second {
+		t.Errorf("A cancelled exchange should return at once, took %v", time.Since(started))
+	}
+	if failures := resolver.Health()[0].Failures; failures != 0 {
+		t.Errorf("A cancelled exchange should not count as a failure, got %d", failures)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started = time.Now()
+	if _, err = resolver.exchange(ctx, slow.addr, query); err == nil {
+		t.Error("Expected the exchange to time out")
+	}
+	if time.Since(started) > time.Second {
+		t.Errorf("The context deadline should beat the timeout, took %v", time.Since(started))
+	}
+}
+
+// TEST 20: Dead upstreams share the timeout
+// Tests that a black-holed first upstream only costs its share of the
+// timeout, and that a group of dead upstreams gives up within the timeout
+func TestUpstreamResolver_Resolve_InOrderSharesTimeout(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		query    []byte          = buildDNSQuery("example.com", 1, 1)
+		silent   []*mockDNSServer
+		healthy  *mockDNSServer
+		resolver *UpstreamResolver
+		response []byte
+		started  time.Time
+		err      error
+	)
+	for i := 0; i < 3; i++ {
+		var server *mockDNSServer
+		if server, err = startMockDNSServer(buildDNSResponse("example.com", 1, 1, 300, []byte{6, 6, 6, 6}), time.Minute); err != nil {
+			t.Fatalf("Failed to start mock server: %v", err)
+		}
+		defer server.close()
+		silent = append(silent, server)
+	}
+	if healthy, err = startMockDNSServer(buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), 0); err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer healthy.close()
+
+	resolver = &UpstreamResolver{upstreamAddrs: []string{silent[0].addr, healthy.addr}, timeout: 2 * time.Second, strategy: STRATEGY_STRICT}
+	started = time.Now()
+	if response, err = resolver.Resolve(ctx, query); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if !bytes.HasSuffix(response, []byte{1, 2, 3, 4}) {
+		t.Error("Expected the answer of the second upstream")
+	}
+	if elapsed := time.Since(started); elapsed > 1500*time.Millisecond {
+		t.Errorf("The dead upstream should only get its share of the timeout, took %v", elapsed)
+	}
+
+	resolver = &UpstreamResolver{upstreamAddrs: []string{silent[0].addr, silent[1].addr, silent[2].addr}, timeout: 2 * time.Second, strategy: STRATEGY_STRICT}
+	started = time.Now()
+	if _, err = resolver.Resolve(ctx, query); !errors.Is(err, errUpstreamTimeout) {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 2500*time.Millisecond {
+		t.Errorf("Dead upstreams should not add up past the timeout, took %v", elapsed)
+	}
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"flash-dns/internal/dns"
+	"flash-dns/internal/logger"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// ForwardRule sends every name under one of its domains to its own group
+// of upstreams, it is written on the command line as
+//
+//	lan,192.168.0.0/16=192.168.1.1 strategy=strict timeout=2s
+//
+// networks are turned into their reverse zones
+type ForwardRule struct {
+	Domains   []string
+	Upstreams string
+	Strategy  Strategy
+	Timeout   time.Duration
+}
+
+// ParseForwardRule reads a rule, strategy defaults to parallel and timeout
+// to DEFAULT_UPSTREAM_TIMEOUT
+func ParseForwardRule(value string) (ForwardRule, error) {
+	var (
+		rule      ForwardRule = ForwardRule{Strategy: STRATEGY_PARALLEL, Timeout: DEFAULT_UPSTREAM_TIMEOUT}
+		fields    []string    = strings.Fields(value)
+		domains   string
+		found     bool
+		key       string
+		option    string
+		domain    string
+		err       error
+		prefix    netip.Prefix
+		separator bool
+	)
+	if len(fields) == 0 {
+		return rule, fmt.Errorf("empty forward rule")
+	}
+
+	if domains, rule.Upstreams, separator = strings.Cut(fields[0], "="); !separator || domains == "" || rule.Upstreams == "" {
+		return rule, fmt.Errorf("forward rule %q is not domains=upstreams", fields[0])
+	}
+
+	for _, domain = range strings.Split(domains, ",") {
+		if prefix, err = netip.ParsePrefix(domain); err == nil {
+			rule.Domains = append(rule.Domains, reverseZones(prefix)...)
+			continue
+		}
+
+		if domain = normalizeSuffix(domain); domain == "" {
+			return rule, fmt.Errorf("empty domain in forward rule %q", fields[0])
+		}
+		rule.Domains = append(rule.Domains, domain)
+	}
+
+	for _, option = range fields[1:] {
+		if key, option, found = strings.Cut(option, "="); !found {
+			return rule, fmt.Errorf("forward option %q is not key=value", key)
+		}
+
+		switch key {
+		case "strategy":
+			if rule.Strategy, err = ParseStrategy(option); err != nil {
+				return rule, err
+			}
+		case "timeout":
+			if rule.Timeout, err = time.ParseDuration(option); err != nil || rule.Timeout <= 0 {
+				return rule, fmt.Errorf("invalid forward timeout %q", option)
+			}
+		default:
+			return rule, fmt.Errorf("unknown forward option %q", key)
+		}
+	}
+
+	return rule, nil
+}
+
+// reverseZones lists the in-addr.arpa or ip6.arpa zones covering prefix,
+// prefixes that do not end on an octet (nibble for ipv6) are expanded to
+// every zone one step longer (at most 128 of them)
+func reverseZones(prefix netip.Prefix) []string {
+	var (
+		step   int = 8
+		bits   int
+		count  int
+		labels []string
+		bytes  []byte
+		zones  []string
+		i      int
+		suffix string = "in-addr.arpa"
+	)
+	prefix = prefix.Masked()
+	if prefix.Addr().Is6() {
+		step, suffix = 4, "ip6.arpa"
+	}
+
+	bits = (prefix.Bits() + step - 1) / step * step
+	count = 1 << (bits - prefix.Bits())
+	for i = 0; i < count; i++ {
+		bytes = prefix.Addr().AsSlice()
+		// the free bits sit right before the zone boundary
+		setBits(bytes, prefix.Bits(), bits, i)
+
+		labels = labels[:0]
+		if step == 8 {
+			for _, octet := range bytes[:bits/8] {
+				labels = append([]string{fmt.Sprint(octet)}, labels...)
+			}
+		} else {
+			for nibble := 0; nibble < bits/4; nibble++ {
+				labels = append([]string{fmt.Sprintf("%x", bytes[nibble/2]>>(4*(1-nibble%2))&0x0F)}, labels...)
+			}
+		}
+		zones = append(zones, strings.Join(append(labels, suffix), "."))
+	}
+
+	return zones
+}
+
+// setBits writes value into the bits [from, to) of address, most
+// significant bit first
+func setBits(address []byte, from int, to int, value int) {
+	var bit int
+	for bit = to - 1; bit >= from; bit-- {
+		if value&1 == 1 {
+			address[bit/8] |= 0x80 >> (bit % 8)
+		}
+		value >>= 1
+	}
+}
+
+// normalizeSuffix lowercases a domain and drops wildcards and dots around it
+func normalizeSuffix(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimPrefix(domain, "*")
+	return strings.Trim(domain, ".")
+}
+
+// Router forwards each query to the group of the longest domain suffix
+// that matches its name, anything else goes to the fallback resolver
+type Router struct {
+	routes   map[string]Resolver
+	groups   []Resolver // every group once, for health and monitoring
+	fallback Resolver
+}
+
+func NewRouter(fallback Resolver, rules []ForwardRule) *Router {
+	var (
+		router *Router = &Router{
+			routes:   make(map[string]Resolver),
+			groups:   []Resolver{fallback},
+			fallback: fallback,
+		}
+		rule   ForwardRule
+		group  Resolver
+		domain string
+	)
+	for _, rule = range rules {
+		group = newUpstreamResolver(rule.Upstreams, rule.Strategy, rule.Timeout)
+		router.groups = append(router.groups, group)
+
+		for _, domain = range rule.Domains {
+			router.routes[domain] = group
+		}
+		logger.Info(fmt.Sprintf("FORWARD: %s -> %s (%s, %v)", strings.Join(rule.Domains, ","), rule.Upstreams, rule.Strategy, rule.Timeout))
+	}
+
+	return router
+}
+
+func (r *Router) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	return r.route(query).Resolve(ctx, query)
+}
+
+// route picks the resolver for the question name, trying the full name
+// first and dropping one label at a time
+func (r *Router) route(query []byte) Resolver {
+	var (
+		buffer   [dns.MAX_NAME_LENGTH]byte
+		name     []byte
+		err      error
+		suffix   string
+		resolver Resolver
+		found    bool
+		dot      int
+	)
+	if len(r.routes) == 0 {
+		return r.fallback
+	}
+
+	if name, _, err = dns.AppendName(buffer[:0], query, dns.HEADER_SIZE); err != nil {
+		return r.fallback
+	}
+
+	suffix = strings.ToLower(string(name))
+	for suffix != "" {
+		if resolver, found = r.routes[suffix]; found {
+			return resolver
+		}
+
+		if dot = strings.IndexByte(suffix, '.'); dot < 0 {
+			break
+		}
+		suffix = suffix[dot+1:]
+	}
+
+	return r.fallback
+}
+
+// SetRandomCase turns DNS 0x20 on or off for every group, see
+// UpstreamResolver.SetRandomCase
+func (r *Router) SetRandomCase(enabled bool) {
+	for _, group := range r.groups {
+		if upstream, ok := group.(*UpstreamResolver); ok {
+			upstream.SetRandomCase(enabled)
+		}
+	}
+}
+
+// Monitor runs the health checks of every group that has them
+func (r *Router) Monitor(ctx context.Context) {
+	for _, group := range r.groups {
+		if monitor, ok := group.(UpstreamMonitor); ok {
+			go monitor.Monitor(ctx)
+		}
+	}
+	<-ctx.Done()
+}
+
+// Health joins the upstreams of every group
+func (r *Router) Health() []UpstreamHealth {
+	var result []UpstreamHealth
+	for _, group := range r.groups {
+		if monitor, ok := group.(UpstreamMonitor); ok {
+			result = append(result, monitor.Health()...)
+		}
+	}
+
+	return result
+}
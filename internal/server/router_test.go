@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TEST 1: Queries go to the longest matching suffix
+// Tests that a more specific rule wins over a broader one and that other
+// names use the fallback
+func TestRouter_LongestSuffix(t *testing.T) {
+	var (
+		fallback *MockResolver = &MockResolver{response: []byte("fallback")}
+		corp     *MockResolver = &MockResolver{response: []byte("corp")}
+		lab      *MockResolver = &MockResolver{response: []byte("lab")}
+		router   *Router       = &Router{
+			routes:   map[string]Resolver{"corp.example": corp, "lab.corp.example": lab},
+			fallback: fallback,
+		}
+		tests = []struct {
+			domain   string
+			expected string
+		}{
+			{"corp.example", "corp"},
+			{"WWW.Corp.Example", "corp"},
+			{"db.lab.corp.example", "lab"},
+			{"notcorp.example", "fallback"},
+			{"example.com", "fallback"},
+		}
+	)
+
+	for _, test := range tests {
+		response, err := router.Resolve(context.Background(), buildDNSQuery(test.domain, 1, 1))
+		if err != nil {
+			t.Fatalf("Resolve(%s) failed: %v", test.domain, err)
+		}
+		if string(response) != test.expected {
+			t.Errorf("%s went to %q, expected %q", test.domain, response, test.expected)
+		}
+	}
+}
+
+// TEST 2: A malformed query uses the fallback
+// Tests that routing never fails a query on its own
+func TestRouter_MalformedQuery(t *testing.T) {
+	var (
+		fallback *MockResolver = &MockResolver{response: []byte("fallback")}
+		router   *Router       = &Router{
+			routes:   map[string]Resolver{"lan": &MockResolver{}},
+			fallback: fallback,
+		}
+	)
+
+	if _, err := router.Resolve(context.Background(), []byte{0, 1, 2}); err != nil || fallback.callCount != 1 {
+		t.Errorf("Expected the fallback to answer, err %v, calls %d", err, fallback.callCount)
+	}
+}
+
+// TEST 3: Parsing forward rules
+// Tests domains, options and the errors of ParseForwardRule
+func TestParseForwardRule(t *testing.T) {
+	var (
+		rule ForwardRule
+		err  error
+	)
+	rule, err = ParseForwardRule("*.LAN,corp.example.=192.168.1.1,10.0.0.1 strategy=strict timeout=2s")
+	if err != nil {
+		t.Fatalf("ParseForwardRule failed: %v", err)
+	}
+	if !slices.Equal(rule.Domains, []string{"lan", "corp.example"}) {
+		t.Errorf("Unexpected domains %v", rule.Domains)
+	}
+	if rule.Upstreams != "192.168.1.1,10.0.0.1" || rule.Strategy != STRATEGY_STRICT || rule.Timeout != 2*time.Second {
+		t.Errorf("Unexpected rule %+v", rule)
+	}
+
+	if rule, _ = ParseForwardRule("lan=192.168.1.1"); rule.Strategy != STRATEGY_PARALLEL || rule.Timeout != DEFAULT_UPSTREAM_TIMEOUT {
+		t.Errorf("Expected default strategy and timeout, got %+v", rule)
+	}
+
+	for _, invalid := range []string{"", "lan", "=1.1.1.1", "lan=", "lan=1.1.1.1 strategy=best", "lan=1.1.1.1 timeout=soon", "lan=1.1.1.1 retries=3", "lan=1.1.1.1 strict"} {
+		if _, err = ParseForwardRule(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+// TEST 4: Networks become reverse zones
+// Tests octet and nibble alignment and the expansion of unaligned prefixes
+func TestReverseZones(t *testing.T) {
+	var tests = []struct {
+		network  string
+		expected []string
+	}{
+		{"192.168.0.0/16", []string{"168.192.in-addr.arpa"}},
+		{"10.1.2.3/8", []string{"10.in-addr.arpa"}},
+		{"172.16.0.0/14", []string{"16.172.in-addr.arpa", "17.172.in-addr.arpa", "18.172.in-addr.arpa", "19.172.in-addr.arpa"}},
+		{"fd00::/8", []string{"d.f.ip6.arpa"}},
+		{"2001:db8::/31", []string{"8.b.d.0.1.0.0.2.ip6.arpa", "9.b.d.0.1.0.0.2.ip6.arpa"}},
+	}
+
+	for _, test := range tests {
+		rule, err := ParseForwardRule(test.network + "=192.168.1.1")
+		if err != nil {
+			t.Fatalf("ParseForwardRule(%s) failed: %v", test.network, err)
+		}
+		if !slices.Equal(rule.Domains, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.network, test.expected, rule.Domains)
+		}
+	}
+
+	if rule, _ := ParseForwardRule("10.0.0.0/1=192.168.1.1"); len(rule.Domains) != 128 {
+		t.Errorf("Expected 128 zones for a /1, got %d", len(rule.Domains))
+	}
+}
+
+// TEST 5: Health covers every group
+// Tests that the router reports the upstreams of the fallback and the rules
+func TestRouter_Health(t *testing.T) {
+	var (
+		router *Router = NewRouter(
+			NewUpstreamResolver("1.1.1.1", STRATEGY_PARALLEL),
+			[]ForwardRule{{Domains: []string{"lan"}, Upstreams: "192.168.1.1", Timeout: time.Second}},
+		)
+		addresses []string
+	)
+
+	for _, health := range router.Health() {
+		addresses = append(addresses, health.Address)
+	}
+	if !slices.Equal(addresses, []string{"1.1.1.1:53", "192.168.1.1:53"}) {
+		t.Errorf("Unexpected upstreams %v", addresses)
+	}
+	if router.routes["lan"].(*UpstreamResolver).timeout != time.Second {
+		t.Error("Expected the rule timeout on its group")
+	}
+}
@@ -3,7 +3,12 @@ package server
 import (
 	"flash-dns/internal/logger"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Statistics struct {
@@ -11,12 +16,30 @@ type Statistics struct {
 	allowedCount atomic.Uint64
 	cacheHits    atomic.Uint64
 	cacheMisses  atomic.Uint64
+	negativeHits atomic.Uint64 // cache hits answered with NXDOMAIN or NODATA
+	upstreamFail atomic.Uint64 // queries no upstream could answer
+	upstreams    UpstreamMonitor
+
+	listsMu sync.Mutex
+	lists   map[string]uint64 // blocked queries by the list that blocked them
 }
 
 func (s *Statistics) incrementBlocked() {
 	_ = s.blockedCount.Add(1)
 }
 
+// incrementBlockedBy counts a blocked query against list, it comes on top
+// of incrementBlocked
+func (s *Statistics) incrementBlockedBy(list string) {
+	s.listsMu.Lock()
+	defer s.listsMu.Unlock()
+
+	if s.lists == nil {
+		s.lists = make(map[string]uint64)
+	}
+	s.lists[list]++
+}
+
 func (s *Statistics) incrementAllowed() {
 	_ = s.allowedCount.Add(1)
 }
@@ -29,10 +52,42 @@ func (s *Statistics) incrementCacheMisses() {
 	_ = s.cacheMisses.Add(1)
 }
 
+func (s *Statistics) incrementNegativeHits() {
+	_ = s.negativeHits.Add(1)
+}
+
+func (s *Statistics) incrementUpstreamFailures() {
+	_ = s.upstreamFail.Add(1)
+}
+
 func (s *Statistics) GetStats() (blocked, allowed, cacheHits, cacheMisses uint64) {
 	return s.blockedCount.Load(), s.allowedCount.Load(), s.cacheHits.Load(), s.cacheMisses.Load()
 }
 
+// GetBlockedByList is a copy of the blocked counts by list
+func (s *Statistics) GetBlockedByList() map[string]uint64 {
+	s.listsMu.Lock()
+	defer s.listsMu.Unlock()
+	return maps.Clone(s.lists)
+}
+
+func (s *Statistics) GetNegativeHits() uint64 {
+	return s.negativeHits.Load()
+}
+
+func (s *Statistics) GetUpstreamFailures() uint64 {
+	return s.upstreamFail.Load()
+}
+
+// GetUpstreamHealth is empty when the resolver does not track its upstreams
+func (s *Statistics) GetUpstreamHealth() []UpstreamHealth {
+	if s.upstreams == nil {
+		return nil
+	}
+
+	return s.upstreams.Health()
+}
+
 func (s *Statistics) Log() {
 	var (
 		blocked      uint64
@@ -50,5 +105,24 @@ func (s *Statistics) Log() {
 	blockRate = float64(blocked) / float64(total) * 100
 	CacheHitRate = float64(cacheHits) / float64(cacheHits+cacheMisses) * 100
 
-	logger.Info(fmt.Sprintf("Status - Total: %d | Blocked: %d (%.1f%%) | Cache Hit Rate: %.1f%%", total, blocked, blockRate, CacheHitRate))
+	logger.Info(fmt.Sprintf("Status - Total: %d | Blocked: %d (%.1f%%) | Cache Hit Rate: %.1f%% | Negative Hits: %d | Upstream Failures: %d", total, blocked, blockRate, CacheHitRate, s.GetNegativeHits(), s.GetUpstreamFailures()))
+
+	var (
+		lists  map[string]uint64 = s.GetBlockedByList()
+		counts []string
+	)
+	for _, list := range slices.Sorted(maps.Keys(lists)) {
+		counts = append(counts, fmt.Sprintf("%s: %d", list, lists[list]))
+	}
+	if len(counts) > 0 {
+		logger.Info("Blocked by list - " + strings.Join(counts, " | "))
+	}
+
+	for _, upstream := range s.GetUpstreamHealth() {
+		var state string = "up"
+		if !upstream.Up {
+			state = "DOWN"
+		}
+		logger.Info(fmt.Sprintf("Upstream %s - %s | Answered: %d | Failed: %d | Spoofed: %d | Latency: %v", upstream.Address, state, upstream.Successes, upstream.Failures, upstream.Spoofed, upstream.Latency.Round(time.Millisecond)))
+	}
 }
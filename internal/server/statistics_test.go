@@ -564,3 +564,68 @@ func TestStatistics_RealisticScenario(t *testing.T) {
 	// Log shouldn't panic
 	stats.Log()
 }
+
+// TEST 19: Increment negative hits counter
+// Tests that negative hits are kept apart from the other counters
+func TestStatistics_IncrementNegativeHits(t *testing.T) {
+	var (
+		stats     *Statistics = &Statistics{}
+		cacheHits uint64
+	)
+
+	stats.incrementNegativeHits()
+
+	_, _, cacheHits, _ = stats.GetStats()
+	if stats.GetNegativeHits() != 1 {
+		t.Errorf("Expected negativeHits=1, got %d", stats.GetNegativeHits())
+	}
+	if cacheHits != 0 {
+		t.Errorf("Expected cacheHits=0, got %d", cacheHits)
+	}
+}
+
+// TEST 20: Increment upstream failures counter
+// Tests that upstream failures are counted on their own
+func TestStatistics_IncrementUpstreamFailures(t *testing.T) {
+	var stats *Statistics = &Statistics{}
+
+	stats.incrementUpstreamFailures()
+	stats.incrementUpstreamFailures()
+
+	if stats.GetUpstreamFailures() != 2 {
+		t.Errorf("Expected upstreamFailures=2, got %d", stats.GetUpstreamFailures())
+	}
+}
+
+// TEST 21: Blocked queries by list
+// Tests that every list keeps its own count and the copy is safe to modify
+func TestStatistics_IncrementBlockedBy(t *testing.T) {
+	var (
+		stats *Statistics = &Statistics{}
+		lists map[string]uint64
+		wg    sync.WaitGroup
+	)
+	if len(stats.GetBlockedByList()) != 0 {
+		t.Error("Expected no list counts before anything was blocked")
+	}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(list string) {
+			defer wg.Done()
+			stats.incrementBlockedBy(list)
+		}([]string{"ads", "malware"}[i%2])
+	}
+	wg.Wait()
+
+	if lists = stats.GetBlockedByList(); lists["ads"] != 5 || lists["malware"] != 5 {
+		t.Errorf("Expected 5 blocked by each list, got %v", lists)
+	}
+	lists["ads"] = 100
+	if stats.GetBlockedByList()["ads"] != 5 {
+		t.Error("Changing the copy should not change the counts")
+	}
+
+	// Log shouldn't panic
+	stats.Log()
+}
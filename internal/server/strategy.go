@@ -0,0 +1,89 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Strategy decides which upstreams of a group are asked and in which order
+type Strategy int
+
+const (
+	STRATEGY_PARALLEL    Strategy = iota // ask every upstream at once, the first answer wins
+	STRATEGY_STRICT                      // ask in the configured order, the next one only on failure
+	STRATEGY_ROUND_ROBIN                 // start at the next upstream on every query, fail over in order
+	STRATEGY_RANDOM                      // shuffle the upstreams on every query, fail over in that order
+	STRATEGY_FASTEST                     // lowest average round trip first, fail over to the slower ones
+)
+
+const (
+	RTT_WEIGHT  float64       = 0.3             // weight of a new sample in the moving average
+	RTT_PENALTY time.Duration = 5 * time.Second // sample recorded when an upstream fails
+)
+
+var strategyNames = map[string]Strategy{
+	"parallel":    STRATEGY_PARALLEL,
+	"strict":      STRATEGY_STRICT,
+	"round-robin": STRATEGY_ROUND_ROBIN,
+	"random":      STRATEGY_RANDOM,
+	"fastest":     STRATEGY_FASTEST,
+}
+
+// ParseStrategy accepts the names used on the command line
+func ParseStrategy(name string) (Strategy, error) {
+	var (
+		strategy Strategy
+		found    bool
+	)
+	if strategy, found = strategyNames[strings.ToLower(strings.TrimSpace(name))]; !found {
+		return STRATEGY_PARALLEL, fmt.Errorf("unknown upstream strategy %q", name)
+	}
+
+	return strategy, nil
+}
+
+func (s Strategy) String() string {
+	for name, strategy := range strategyNames {
+		if strategy == s {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// order returns the upstreams in rotation in the order they should be tried
+func (u *UpstreamResolver) order() []string {
+	var (
+		addresses []string = u.available()
+		start     int
+	)
+	if len(addresses) < 2 {
+		return addresses
+	}
+
+	switch u.strategy {
+	case STRATEGY_ROUND_ROBIN:
+		start = int((u.next.Add(1) - 1) % uint64(len(addresses)))
+		return append(addresses[start:], addresses[:start]...)
+
+	case STRATEGY_RANDOM:
+		rand.Shuffle(len(addresses), func(i, j int) {
+			addresses[i], addresses[j] = addresses[j], addresses[i]
+		})
+
+	case STRATEGY_FASTEST:
+		u.mu.Lock()
+		// upstreams without a sample sort first so they get measured
+		slices.SortStableFunc(addresses, func(a, b string) int {
+			return cmp.Compare(u.healthOf(a).rtt, u.healthOf(b).rtt)
+		})
+		u.mu.Unlock()
+	}
+
+	return addresses
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TEST 1: ParseStrategy accepts every strategy name
+// Tests the names round trip through String and unknown names fail
+func TestParseStrategy(t *testing.T) {
+	var (
+		strategy Strategy
+		err      error
+	)
+	for _, name := range []string{"parallel", "strict", "round-robin", "random", "fastest"} {
+		if strategy, err = ParseStrategy(name); err != nil {
+			t.Errorf("ParseStrategy(%q) failed: %v", name, err)
+		}
+		if strategy.String() != name {
+			t.Errorf("Expected %q, got %q", name, strategy.String())
+		}
+	}
+
+	if _, err = ParseStrategy("fastest-first"); err == nil {
+		t.Error("Expected error for an unknown strategy")
+	}
+}
+
+// TEST 2: Strict order only asks the next upstream on failure
+// Tests failover from a dead upstream and that the first healthy one answers
+func TestUpstreamResolver_Strict(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		query    []byte          = buildDNSQuery("example.com", 1, 1)
+		first    *mockDNSServer
+		second   *mockDNSServer
+		resolver *UpstreamResolver
+		response []byte
+		err      error
+	)
+	if first, err = startMockDNSServer(buildDNSResponse("example.com", 1, 1, 300, []byte{1, 1, 1, 1}), 100*time.Millisecond); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer first.close()
+	if second, err = startMockDNSServer(buildDNSResponse("example.com", 1, 1, 300, []byte{2, 2, 2, 2}), 0); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer second.close()
+
+	resolver = &UpstreamResolver{
+		upstreamAddrs: []string{first.addr, second.addr},
+		timeout:       2 * time.Second,
+		strategy:      STRATEGY_STRICT,
+	}
+
+	// the first upstream is slower but strict order waits for it
+	if response, err = resolver.Resolve(ctx, query); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if response[len(response)-1] != 1 {
+		t.Errorf("Expected the answer of the first upstream, got %v", response[len(response)-4:])
+	}
+
+	resolver.upstreamAddrs = []string{"127.0.0.1:1", second.addr}
+	if response, err = resolver.Resolve(ctx, query); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if response[len(response)-1] != 2 {
+		t.Errorf("Expected failover to the second upstream, got %v", response[len(response)-4:])
+	}
+}
+
+// TEST 3: Round-robin rotates the starting upstream
+// Tests that consecutive queries start at consecutive upstreams
+func TestUpstreamResolver_RoundRobinOrder(t *testing.T) {
+	var resolver *UpstreamResolver = &UpstreamResolver{
+		upstreamAddrs: []string{"a", "b", "c"},
+		strategy:      STRATEGY_ROUND_ROBIN,
+	}
+
+	for _, expected := range [][]string{{"a", "b", "c"}, {"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}} {
+		if order := resolver.order(); !slices.Equal(order, expected) {
+			t.Errorf("Expected %v, got %v", expected, order)
+		}
+	}
+}
+
+// TEST 4: Random order is a permutation
+// Tests that every upstream is still tried exactly once
+func TestUpstreamResolver_RandomOrder(t *testing.T) {
+	var (
+		resolver *UpstreamResolver = &UpstreamResolver{
+			upstreamAddrs: []string{"a", "b", "c", "d"},
+			strategy:      STRATEGY_RANDOM,
+		}
+		order []string = resolver.order()
+	)
+
+	slices.Sort(order)
+	if !slices.Equal(order, resolver.upstreamAddrs) {
+		t.Errorf("Expected a permutation of %v, got %v", resolver.upstreamAddrs, order)
+	}
+}
+
+// TEST 5: Fastest orders by the moving average
+// Tests the EWMA update and that unmeasured upstreams are tried first
+func TestUpstreamResolver_FastestOrder(t *testing.T) {
+	var resolver *UpstreamResolver = &UpstreamResolver{
+		upstreamAddrs: []string{"slow", "fast", "new"},
+		strategy:      STRATEGY_FASTEST,
+	}
+
+	resolver.recordSuccess("slow", 100*time.Millisecond)
+	resolver.recordSuccess("fast", 10*time.Millisecond)
+	resolver.recordSuccess("fast", 20*time.Millisecond)
+
+	if resolver.health["fast"].rtt != 13*time.Millisecond {
+		t.Errorf("Expected an average of 13ms, got %v", resolver.health["fast"].rtt)
+	}
+	if order := resolver.order(); !slices.Equal(order, []string{"new", "fast", "slow"}) {
+		t.Errorf("Expected [new fast slow], got %v", order)
+	}
+}
+
+// TEST 6: Fastest learns from real queries
+// Tests that a failing upstream is penalized and moves behind a working one
+func TestUpstreamResolver_FastestLearns(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		query    []byte          = buildDNSQuery("example.com", 1, 1)
+		server   *mockDNSServer
+		resolver *UpstreamResolver
+		err      error
+	)
+	if server, err = startMockDNSServer(buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), 0); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.close()
+
+	resolver = &UpstreamResolver{
+		upstreamAddrs: []string{"127.0.0.1:1", server.addr},
+		timeout:       2 * time.Second,
+		strategy:      STRATEGY_FASTEST,
+	}
+
+	if _, err = resolver.Resolve(ctx, query); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if order := resolver.order(); order[0] != server.addr {
+		t.Errorf("Expected the working upstream first, got %v", order)
+	}
+}
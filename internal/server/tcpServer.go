@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flash-dns/internal/logger"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	TCP_IDLE_TIMEOUT  time.Duration = 10 * time.Second // how long a tcp connection may stay silent
+	TCP_WRITE_TIMEOUT time.Duration = 5 * time.Second  // how long we wait to flush an answer
+	TCP_MAX_PIPELINE  int           = 16               // queries answered concurrently per connection
+)
+
+// serveTCP accepts connections until the listener is closed
+func (s *DNSServer) serveTCP(ctx context.Context, listener net.Listener) {
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	for {
+		conn, err = listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			logger.Error(fmt.Sprintf("Error accepting tcp connection: %v", err))
+			continue
+		}
+
+		go s.handleTCPConn(ctx, conn)
+	}
+}
+
+// handleTCPConn reads length prefixed queries from a single connection,
+// queries are answered as soon as they are ready so one slow upstream
+// does not hold back the others pipelined behind it (RFC 7766)
+func (s *DNSServer) handleTCPConn(ctx context.Context, conn net.Conn) {
+	var (
+		writeMu sync.Mutex
+		wg      sync.WaitGroup
+		slots   chan struct{} = make(chan struct{}, TCP_MAX_PIPELINE)
+		stop    func() bool
+		query   []byte
+		err     error
+	)
+	defer conn.Close()
+
+	// unblock the pending read when the server is shutting down
+	stop = context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(TCP_IDLE_TIMEOUT))
+
+		query, err = readTCPMessage(conn)
+		if err != nil {
+			var netErr net.Error
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) &&
+				!(errors.As(err, &netErr) && netErr.Timeout()) {
+				logger.Warn(fmt.Sprintf("Error reading tcp query from %s: %v", conn.RemoteAddr(), err))
+			}
+			break
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(query []byte) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			var (
+				response []byte = s.processQuery(ctx, query, addrOf(conn.RemoteAddr()), false)
+				writeErr error
+			)
+			if response == nil {
+				return
+			}
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(TCP_WRITE_TIMEOUT))
+			if writeErr = writeTCPMessage(conn, response); writeErr != nil {
+				logger.Warn(fmt.Sprintf("Error writing tcp response to %s: %v", conn.RemoteAddr(), writeErr))
+			}
+		}(query)
+	}
+
+	// answer whatever is still in flight before closing
+	wg.Wait()
+}
+
+// readTCPMessage reads one message using the two byte length framing of RFC 1035 4.2.2
+func readTCPMessage(reader io.Reader) ([]byte, error) {
+	var (
+		prefix  []byte = make([]byte, 2)
+		length  uint16
+		message []byte
+		err     error
+	)
+	if _, err = io.ReadFull(reader, prefix); err != nil {
+		return nil, err
+	}
+
+	length = binary.BigEndian.Uint16(prefix)
+	if length == 0 {
+		return nil, fmt.Errorf("empty tcp message")
+	}
+
+	message = make([]byte, length)
+	if _, err = io.ReadFull(reader, message); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// writeTCPMessage writes prefix and message in a single call so they
+// leave in the same segment whenever possible
+func writeTCPMessage(writer io.Writer, message []byte) error {
+	if len(message) > 0xFFFF {
+		return fmt.Errorf("message too large for tcp: %d bytes", len(message))
+	}
+
+	var framed []byte = make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(framed[0:2], uint16(len(message)))
+	copy(framed[2:], message)
+
+	var err error
+	_, err = writer.Write(framed)
+	return err
+}
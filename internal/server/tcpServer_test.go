@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flash-dns/internal/filter"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TEST 1: Framing round trip
+// Tests that writeTCPMessage and readTCPMessage agree on the length prefix
+func TestTCPMessage_RoundTrip(t *testing.T) {
+	var (
+		buffer  bytes.Buffer
+		query   []byte = buildDNSQuery("example.com", 1, 1)
+		message []byte
+		err     error
+	)
+
+	if err = writeTCPMessage(&buffer, query); err != nil {
+		t.Fatalf("writeTCPMessage failed: %v", err)
+	}
+	if binary.BigEndian.Uint16(buffer.Bytes()[0:2]) != uint16(len(query)) {
+		t.Errorf("Expected prefix %d, got %d", len(query), binary.BigEndian.Uint16(buffer.Bytes()[0:2]))
+	}
+
+	message, err = readTCPMessage(&buffer)
+	if err != nil {
+		t.Fatalf("readTCPMessage failed: %v", err)
+	}
+	if !bytes.Equal(message, query) {
+		t.Error("Message should survive the round trip unchanged")
+	}
+}
+
+// TEST 2: Truncated frame returns error
+// Tests that a length prefix without enough bytes behind it is rejected
+func TestReadTCPMessage_Truncated(t *testing.T) {
+	var (
+		reader *bytes.Reader = bytes.NewReader([]byte{0x00, 0x20, 0x01, 0x02})
+		err    error
+	)
+
+	_, err = readTCPMessage(reader)
+	if err == nil {
+		t.Error("Expected error for truncated frame")
+	}
+}
+
+// TEST 3: Zero length frame returns error
+// Tests that an empty message is not handed to the pipeline
+func TestReadTCPMessage_ZeroLength(t *testing.T) {
+	var err error
+
+	_, err = readTCPMessage(bytes.NewReader([]byte{0x00, 0x00}))
+	if err == nil {
+		t.Error("Expected error for zero length frame")
+	}
+}
+
+// TEST 4: Pipelined queries on one connection
+// Tests that several queries sent back to back are all answered
+func TestDNSServer_ServeTCP_Pipelined(t *testing.T) {
+	var (
+		ctx        context.Context
+		cancel     context.CancelFunc
+		config     Config             = Config{LocalAddr: "127.0.0.1:0", FilterMode: "nxdomain"}
+		mockFilter *MockFilter        = NewMockFilter()
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		listener   net.Listener
+		conn       net.Conn
+		err        error
+		domains    []string        = []string{"ads.example.com", "tracker.example.com", "ads.example.com"}
+		ids        map[uint16]bool = make(map[uint16]bool)
+		query      []byte
+		response   []byte
+		i          int
+	)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	mockFilter.AddBlocked("ads.example.com")
+	mockFilter.AddBlocked("tracker.example.com")
+	server = NewDNSServer(config, &MockResolver{}, filterList)
+	server.filter = mockFilter
+
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go server.serveTCP(ctx, listener)
+
+	conn, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	for i = range domains {
+		query = buildDNSQuery(domains[i], 1, 1)
+		binary.BigEndian.PutUint16(query[0:2], uint16(i+1))
+		if err = writeTCPMessage(conn, query); err != nil {
+			t.Fatalf("Failed to write query %d: %v", i, err)
+		}
+	}
+
+	for i = range domains {
+		response, err = readTCPMessage(conn)
+		if err != nil {
+			t.Fatalf("Failed to read response %d: %v", i, err)
+		}
+		if binary.BigEndian.Uint16(response[2:4]) != 0x8183 {
+			t.Errorf("Expected NXDOMAIN flags 0x8183, got 0x%04X", binary.BigEndian.Uint16(response[2:4]))
+		}
+		ids[binary.BigEndian.Uint16(response[0:2])] = true
+	}
+
+	if len(ids) != len(domains) {
+		t.Errorf("Expected %d distinct transaction IDs, got %d", len(domains), len(ids))
+	}
+}
+
+// TEST 5: Connection closes when the server stops
+// Tests that cancelling the context releases idle connections
+func TestDNSServer_HandleTCPConn_ContextCancelled(t *testing.T) {
+	var (
+		ctx        context.Context
+		cancel     context.CancelFunc
+		config     Config             = Config{LocalAddr: "127.0.0.1:0"}
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		client     net.Conn
+		serverSide net.Conn
+		done       chan struct{} = make(chan struct{})
+		err        error
+	)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	server = NewDNSServer(config, &MockResolver{}, filterList)
+
+	client, serverSide = net.Pipe()
+	defer client.Close()
+
+	go func() {
+		server.handleTCPConn(ctx, serverSide)
+		close(done)
+	}()
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection handler should return after cancellation")
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	if err != io.EOF && err != io.ErrClosedPipe {
+		t.Errorf("Expected closed connection, got %v", err)
+	}
+}
@@ -2,149 +2,70 @@ package utils
 
 import (
 	"encoding/binary"
+	"flash-dns/internal/dns"
 	"fmt"
-	"strings"
-	"sync"
 )
 
-var builderPool = sync.Pool{
-	New: func() interface{} {
-		return &strings.Builder{}
-	},
-}
-
 type QueryInfo struct {
 	Domain   string
 	CacheKey string
 	QType    uint16
 	QClass   uint16
+	EDNS     bool   // client sent an OPT record
+	UDPSize  uint16 // payload size the client can receive over udp
 }
 
+// ParseQuery reads the first question and the EDNS0 size, only the domain
+// is copied out of the message
 func ParseQuery(query []byte) (*QueryInfo, error) {
-	var queryLength int = len(query)
-	if queryLength < 12 {
-		return nil, fmt.Errorf("query too short: %d bytes", len(query))
-	}
-
 	var (
-		builder  *strings.Builder = builderPool.Get().(*strings.Builder)
-		position int              = 12
-		length   int              = 0
-		domain   string
-		qtype    uint16
-		qclass   uint16
-		cacheKey string
+		header   dns.Header
+		buffer   [dns.MAX_NAME_LENGTH]byte
+		name     []byte
+		position int
+		err      error
+		info     *QueryInfo = &QueryInfo{}
 	)
-	builder.Reset()
-	defer builderPool.Put(builder)
-
-	for position < queryLength {
-		length = int(query[position])
-
-		if length == 0 {
-			position++
-			break
-		}
-
-		if length >= 192 {
-			position += 2
-			continue
-		}
-
-		if builder.Len() > 0 {
-			builder.WriteRune('.')
-		}
-		position++
-
-		if position+length > queryLength {
-			return nil, fmt.Errorf("invalid domain name length")
-		}
-
-		builder.Write(query[position : position+length])
-		position += length
+	if header, err = dns.ParseHeader(query); err != nil {
+		return nil, err
+	}
+	if header.QDCount == 0 {
+		return nil, fmt.Errorf("query has no question")
 	}
-	domain = builder.String()
 
-	if position+4 > queryLength {
+	if name, position, err = dns.AppendName(buffer[:0], query, dns.HEADER_SIZE); err != nil {
+		return nil, err
+	}
+	if position+4 > len(query) {
 		return nil, fmt.Errorf("query too short for QTYPE/QCLASS")
 	}
 
-	qtype = binary.BigEndian.Uint16(query[position : position+2])
-	qclass = binary.BigEndian.Uint16(query[position+2 : position+4])
+	info.Domain = string(name)
+	info.QType = binary.BigEndian.Uint16(query[position : position+2])
+	info.QClass = binary.BigEndian.Uint16(query[position+2 : position+4])
+	info.CacheKey = fmt.Sprintf("%s:%d", info.Domain, info.QType)
+	info.UDPSize, info.EDNS = dns.ParseEDNS0(query)
 
-	cacheKey = fmt.Sprintf("%s:%d", domain, qtype)
-
-	return &QueryInfo{Domain: domain, QType: qtype, QClass: qclass, CacheKey: cacheKey}, nil
+	return info, nil
 }
 
+// ExtractTTL is the smallest ttl in the answer section, capped at an hour
 func ExtractTTL(response []byte) uint32 {
-	if len(response) < 12 {
+	if len(response) < dns.HEADER_SIZE {
 		return 300 // 5 minutes -> 60 * 5 = 300
 	}
 
 	var (
-		position int    = 12
-		qdcount  uint16 = binary.BigEndian.Uint16(response[4:6])
-		ancount  uint16 = binary.BigEndian.Uint16(response[6:8])
-		minTTL   uint32 = uint32(3600) // default 1 hour
-		i        int
-		length   int
-		ttl      uint32
-		rdlength uint16
+		scanner dns.RecordScanner
+		record  dns.RecordHeader
+		minTTL  uint32 = uint32(3600) // default 1 hour
 	)
-
-	// Skip question section
-	for i = 0; i < int(qdcount); i++ {
-		// Skip domain name
-		for position < len(response) && response[position] != 0 {
-			if response[position] >= 192 { // compression pointer
-				position += 2
-				goto skipQuestionTypeClass // Jump past the zero-check
-			}
-			length = int(response[position])
-			position += length + 1
-		}
-
-		// Only check for zero if we didn't hit a compression pointer
-		if position < len(response) && response[position] == 0 {
-			position++
-		}
-
-	skipQuestionTypeClass:
-		position += 4 // skip QTYPE and QCLASS
-	}
-
-	// Read answer section to find TTL
-	for i = 0; i < int(ancount) && position+10 < len(response); i++ {
-		// Skip name
-		for position < len(response) && response[position] != 0 {
-			if response[position] >= 192 { // compression pointer
-				position += 2
-				goto readAnswerTTL // Jump past the zero-check
-			}
-
-			length = int(response[position])
-			position += length + 1
-		}
-
-		// Only check for zero if we didn't hit a compression pointer
-		if position < len(response) && response[position] == 0 {
-			position++
-		}
-
-	readAnswerTTL:
-		if position+10 > len(response) {
+	scanner.Reset(response)
+	for scanner.Next() {
+		if record = scanner.Record(); record.Section != dns.SECTION_ANSWER {
 			break
 		}
-
-		ttl = binary.BigEndian.Uint32(response[position+4 : position+8])
-		if ttl < minTTL {
-			minTTL = ttl
-		}
-
-		// skip type, class, ttl and rdlength
-		rdlength = binary.BigEndian.Uint16(response[position+8 : position+10])
-		position += 10 + int(rdlength)
+		minTTL = min(minTTL, record.TTL)
 	}
 
 	return minTTL
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"encoding/binary"
+	"flash-dns/internal/dns"
 	"testing"
 )
 
@@ -224,16 +225,16 @@ func TestExtractTTL_CompressionPointer(t *testing.T) {
 	}
 }
 
-// TEST 11: Parse query with compression pointer
-// Tests that compression pointers in queries are skipped
+// TEST 11: Parse query with a looping compression pointer
+// Tests that a pointer that does not go backwards is rejected
 func TestParseQuery_WithCompressionPointer(t *testing.T) {
 	var (
 		query []byte = make([]byte, 12)
-		info  *QueryInfo
 		err   error
 	)
+	binary.BigEndian.PutUint16(query[4:6], 1) // QDCOUNT = 1
 
-	// Add domain with compression pointer
+	// Add domain with a pointer back to its own start
 	query = append(query, 7) // Length of "example"
 	query = append(query, []byte("example")...)
 	query = append(query, 0xC0, 0x0C) // Compression pointer
@@ -243,13 +244,10 @@ func TestParseQuery_WithCompressionPointer(t *testing.T) {
 	query = append(query, 0, 1) // QTYPE = 1
 	query = append(query, 0, 1) // QCLASS = 1
 
-	info, err = ParseQuery(query)
+	_, err = ParseQuery(query)
 
-	if err != nil {
-		t.Fatalf("ParseQuery failed: %v", err)
-	}
-	if info.Domain != "example" {
-		t.Errorf("Expected domain 'example', got '%s'", info.Domain)
+	if err == nil {
+		t.Error("Expected error for a pointer loop")
 	}
 }
 
@@ -313,6 +311,66 @@ func TestParseQuery_CacheKeyFormat(t *testing.T) {
 	}
 }
 
+// TEST 14: ParseQuery fills EDNS0 fields
+// Tests that QueryInfo reports the advertised size
+func TestParseQuery_EDNS0(t *testing.T) {
+	var (
+		query []byte = dns.SetEDNS0(buildDNSQuery("example.com", 1, 1), 1400)
+		info  *QueryInfo
+		err   error
+	)
+
+	info, err = ParseQuery(query)
+
+	if err != nil {
+		t.Fatalf("ParseQuery failed: %v", err)
+	}
+	if info.Domain != "example.com" {
+		t.Errorf("Expected domain example.com, got %s", info.Domain)
+	}
+	if !info.EDNS || info.UDPSize != 1400 {
+		t.Errorf("Expected EDNS0 with size 1400, got edns=%v size=%d", info.EDNS, info.UDPSize)
+	}
+}
+
+// TEST 15: ParseQuery reads what dns.BuildQuery wrote
+// Tests the round trip used by the json api
+func TestParseQuery_BuildQuery(t *testing.T) {
+	var (
+		query []byte
+		info  *QueryInfo
+		err   error
+	)
+
+	query, err = dns.BuildQuery(0x1111, "www.example.com.", 28)
+	if err != nil {
+		t.Fatalf("BuildQuery failed: %v", err)
+	}
+
+	info, err = ParseQuery(query)
+	if err != nil {
+		t.Fatalf("ParseQuery failed: %v", err)
+	}
+	if info.Domain != "www.example.com" || info.QType != 28 {
+		t.Errorf("Expected www.example.com:28, got %s", info.CacheKey)
+	}
+}
+
+// TEST 16: ExtractTTL ignores records outside the answer section
+// Tests that an OPT record does not lower the ttl
+func TestExtractTTL_IgnoresAdditional(t *testing.T) {
+	var (
+		response []byte = dns.SetEDNS0(buildDNSResponse("example.com", 1, 1, 600, []byte{1, 2, 3, 4}), 1232)
+		ttl      uint32
+	)
+
+	ttl = ExtractTTL(response)
+
+	if ttl != 600 {
+		t.Errorf("Expected TTL 600, got %d", ttl)
+	}
+}
+
 // ============================================================================
 // HELPER FUNCTIONS FOR BUILDING DNS PACKETS
 // ============================================================================